@@ -2,8 +2,13 @@ package Tools
 
 import (
 	"fmt"
+	"io"
 	. "lua/src/api"
+	"lua/src/asm"
 	"lua/src/binchunk"
+	"lua/src/vm"
+	"os"
+	"strings"
 )
 
 func PrintStack(ls LuaState) {
@@ -24,18 +29,47 @@ func PrintStack(ls LuaState) {
 	fmt.Println()
 }
 
-// 把函数原型的信息打印到控制台
-func List(f *binchunk.Prototype) {
-	printHeader(f)
-	printCode(f)
-	printDeatils(f)
+// 把函数原型的信息打印到控制台，full为true时同时打印常量表、局部变量表和Upvalue表
+// lua-5.3.4/src/luac.c#PrintFunction()
+func List(f *binchunk.Prototype, full bool) {
+	Fprint(os.Stdout, f, full, true)
+}
+
+// 和List()一样，但是输出到w，编辑器等工具用它取得反汇编的文本
+// addrs为false时不打印函数原型的地址，子函数用起止行号表示，同样的代码每次得到同样的文本
+func Fprint(w io.Writer, f *binchunk.Prototype, full, addrs bool) {
+	printHeader(w, f, addrs)
+	printCode(w, f, addrs)
+	if full {
+		printDebug(w, f, addrs)
+	}
 	for _, p := range f.Protos {
-		List(p)
+		Fprint(w, p, full, addrs)
 	}
 }
 
+// 列表中引用函数原型的写法：地址，或者起止行号
+func protoRef(f *binchunk.Prototype, addrs bool) string {
+	if addrs {
+		return fmt.Sprintf("%p", f)
+	}
+	return fmt.Sprintf("<%d,%d>", f.LineDefined, f.LastLineDefined)
+}
+
 // 打印函数原型的头部信息
-func printHeader(f *binchunk.Prototype) {
+// lua-5.3.4/src/luac.c#PrintHeader()
+func printHeader(w io.Writer, f *binchunk.Prototype, addrs bool) {
+	s := f.Source
+	if s == "" {
+		s = "=?"
+	}
+	if s[0] == '@' || s[0] == '=' {
+		s = s[1:]
+	} else if s[0] == binchunk.LUA_SIGNATURE[0] {
+		s = "(bstring)"
+	} else {
+		s = "(string)"
+	}
 	funcType := "main"
 	if f.LineDefined > 0 {
 		funcType = "function"
@@ -44,43 +78,156 @@ func printHeader(f *binchunk.Prototype) {
 	if f.IsVararg > 0 {
 		varargFlag = "+"
 	}
-	fmt.Printf("\n%s <%s:%d,%d> (%d instructions)\n", funcType, f.Source, f.LineDefined, f.LastLineDefined, len(f.Code))
-	fmt.Printf("%d%s params, %d slots, %d upvalues, ", f.NumParams, varargFlag, f.MaxStackSize, len(f.Upvalues))
-	fmt.Printf("%d locals, %d constants, %d functions\n", len(f.LocVars), len(f.Constants), len(f.Protos))
+	at := ""
+	if addrs {
+		at = " at " + protoRef(f, true)
+	}
+	fmt.Fprintf(w, "\n%s <%s:%d,%d> (%d instruction%s%s)\n",
+		funcType, s, f.LineDefined, f.LastLineDefined,
+		len(f.Code), plural(len(f.Code)), at)
+	fmt.Fprintf(w, "%d%s param%s, %d slot%s, %d upvalue%s, ",
+		f.NumParams, varargFlag, plural(int(f.NumParams)),
+		f.MaxStackSize, plural(int(f.MaxStackSize)),
+		len(f.Upvalues), plural(len(f.Upvalues)))
+	fmt.Fprintf(w, "%d local%s, %d constant%s, %d function%s\n",
+		len(f.LocVars), plural(len(f.LocVars)),
+		len(f.Constants), plural(len(f.Constants)),
+		len(f.Protos), plural(len(f.Protos)))
+}
+
+// 单复数后缀
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
 }
 
-// 打印指令的序号、行号和十六进制表示
-func printCode(f *binchunk.Prototype) {
-	for pc, c := range f.Code {
+// 打印指令的序号、行号、操作码和操作数，并附上常量、Upvalue名和跳转目标等注释
+// lua-5.3.4/src/luac.c#PrintCode()
+func printCode(w io.Writer, f *binchunk.Prototype, addrs bool) {
+	for pc := 0; pc < len(f.Code); pc++ {
+		i := vm.Instruction(f.Code[pc])
+		op := i.Opcode()
+		a, b, c := i.ABC()
+		_, bx := i.ABx()
+		_, sbx := i.AsBx()
+		ax := i.Ax()
+
 		line := "-"
-		if len(f.LineInfo) > 0 {
+		if pc < len(f.LineInfo) && f.LineInfo[pc] > 0 {
 			line = fmt.Sprintf("%d", f.LineInfo[pc])
 		}
-		fmt.Printf("\t%d\t[%s]\t0x%08X\n", pc+1, line, c)
+		fmt.Fprintf(w, "\t%d\t[%s]\t%-9s\t", pc+1, line, strings.TrimSpace(i.OpName()))
+
+		switch i.OpMode() {
+		case vm.IABC:
+			fmt.Fprintf(w, "%d", a)
+			if i.BMode() != vm.OpArgN {
+				fmt.Fprintf(w, " %d", asm.RKArg(b))
+			}
+			if i.CMode() != vm.OpArgN {
+				fmt.Fprintf(w, " %d", asm.RKArg(c))
+			}
+		case vm.IABx:
+			fmt.Fprintf(w, "%d", a)
+			if i.BMode() == vm.OpArgK {
+				fmt.Fprintf(w, " %d", -1-bx)
+			}
+			if i.BMode() == vm.OpArgU {
+				fmt.Fprintf(w, " %d", bx)
+			}
+		case vm.IAsBx:
+			fmt.Fprintf(w, "%d %d", a, sbx)
+		case vm.IAx:
+			fmt.Fprintf(w, "%d", -1-ax)
+		}
+
+		switch op {
+		case vm.OP_LOADK:
+			fmt.Fprintf(w, "\t; %s", constantToString(f, bx))
+		case vm.OP_GETUPVAL, vm.OP_SETUPVAL:
+			fmt.Fprintf(w, "\t; %s", upvalName(f, b))
+		case vm.OP_GETTABUP:
+			fmt.Fprintf(w, "\t; %s", upvalName(f, b))
+			if c > 0xFF {
+				fmt.Fprintf(w, " %s", constantToString(f, c&0xFF))
+			}
+		case vm.OP_SETTABUP:
+			fmt.Fprintf(w, "\t; %s", upvalName(f, a))
+			if b > 0xFF {
+				fmt.Fprintf(w, " %s", constantToString(f, b&0xFF))
+			}
+			if c > 0xFF {
+				fmt.Fprintf(w, " %s", constantToString(f, c&0xFF))
+			}
+		case vm.OP_GETTABLE, vm.OP_SELF:
+			if c > 0xFF {
+				fmt.Fprintf(w, "\t; %s", constantToString(f, c&0xFF))
+			}
+		case vm.OP_SETTABLE, vm.OP_ADD, vm.OP_SUB, vm.OP_MUL, vm.OP_MOD,
+			vm.OP_POW, vm.OP_DIV, vm.OP_IDIV, vm.OP_BAND, vm.OP_BOR,
+			vm.OP_BXOR, vm.OP_SHL, vm.OP_SHR, vm.OP_EQ, vm.OP_LT, vm.OP_LE:
+			if b > 0xFF || c > 0xFF {
+				fmt.Fprintf(w, "\t; %s %s", rkToString(f, b), rkToString(f, c))
+			}
+		case vm.OP_JMP, vm.OP_FORLOOP, vm.OP_FORPREP, vm.OP_TFORLOOP:
+			fmt.Fprintf(w, "\t; to %d", sbx+pc+2)
+		case vm.OP_CLOSURE:
+			if bx < len(f.Protos) {
+				fmt.Fprintf(w, "\t; %s", protoRef(f.Protos[bx], addrs))
+			}
+		case vm.OP_SETLIST:
+			if c == 0 { // 批次号存放在下一条EXTRAARG指令中
+				pc++
+				if pc < len(f.Code) {
+					fmt.Fprintf(w, "\t; %d", f.Code[pc])
+				}
+			} else {
+				fmt.Fprintf(w, "\t; %d", c)
+			}
+		case vm.OP_EXTRAARG:
+			fmt.Fprintf(w, "\t; %s", constantToString(f, ax))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// RK操作数的注释：常量显示其值，寄存器显示为"-"
+func rkToString(f *binchunk.Prototype, rk int) string {
+	if rk > 0xFF {
+		return constantToString(f, rk&0xFF)
 	}
+	return "-"
 }
 
 // 打印常量表、局部变量表和Upvalue表
-func printDeatils(f *binchunk.Prototype) {
-	fmt.Printf("constants (%d):\n", len(f.Constants))
-	for i, c := range f.Constants {
-		fmt.Printf("\t%d\t%s\n", i+1, constantToString(c))
+// lua-5.3.4/src/luac.c#PrintDebug()
+func printDebug(w io.Writer, f *binchunk.Prototype, addrs bool) {
+	ref := protoRef(f, addrs)
+	fmt.Fprintf(w, "constants (%d) for %s:\n", len(f.Constants), ref)
+	for i := range f.Constants {
+		fmt.Fprintf(w, "\t%d\t%s\n", i+1, constantToString(f, i))
 	}
 
-	fmt.Printf("locals (%d):\n", len(f.LocVars))
+	fmt.Fprintf(w, "locals (%d) for %s:\n", len(f.LocVars), ref)
 	for i, v := range f.LocVars {
-		fmt.Printf("\t%d\t%s\t%d\t%d\n", i, v.VarName, v.StartPC+1, v.EndPC+1)
+		fmt.Fprintf(w, "\t%d\t%s\t%d\t%d\n", i, v.VarName, v.StartPC+1, v.EndPC+1)
 	}
 
-	fmt.Printf("upvalues (%d):\n", len(f.Upvalues))
+	fmt.Fprintf(w, "upvalues (%d) for %s:\n", len(f.Upvalues), ref)
 	for i, u := range f.Upvalues {
-		fmt.Printf("\t%d\t%s\t%d\t%d\n", i, u.Name, u.Instack, u.Idx)
+		fmt.Fprintf(w, "\t%d\t%s\t%d\t%d\n", i, upvalName(f, i), u.Instack, u.Idx)
 	}
 }
 
 // 把常量转换成字符串表示
-func constantToString(c interface{}) string {
-	switch c.(type) {
+// lua-5.3.4/src/luac.c#PrintConstant()
+func constantToString(f *binchunk.Prototype, idx int) string {
+	if idx < 0 || idx >= len(f.Constants) {
+		return "?"
+	}
+	switch c := f.Constants[idx].(type) {
 	case nil:
 		return "nil"
 	case bool:
@@ -88,9 +235,13 @@ func constantToString(c interface{}) string {
 	case int64:
 		return fmt.Sprint(c)
 	case float64:
-		return fmt.Sprint(c)
+		s := fmt.Sprintf("%.14g", c)
+		if strings.Trim(s, "-0123456789") == "" { // 看起来像整数，加上".0"
+			s += ".0"
+		}
+		return s
 	case string:
-		return fmt.Sprintf("%q", c)
+		return asm.QuoteString(c)
 	default:
 		return "?"
 	}
@@ -98,8 +249,8 @@ func constantToString(c interface{}) string {
 
 // 获取Upvalue的名字
 func upvalName(f *binchunk.Prototype, idx int) string {
-	if len(f.UpvalueNames) > 0 {
-		return f.UpvalueNames[idx]
+	if idx < len(f.Upvalues) && f.Upvalues[idx].Name != "" {
+		return f.Upvalues[idx].Name
 	}
 	return "-"
 }
@@ -0,0 +1,191 @@
+package aot
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	. "lua/src/binchunk"
+	"strconv"
+	"strings"
+)
+
+// 把编译好的函数原型翻译成Go源代码(ahead-of-time)
+// 每个函数原型对应一个Go函数，指令逐条展开成对api.LuaVM的调用，跳转变成goto，
+// 不再有取指令、解码和分派的开销。生成的函数由state.LoadNative()挂到加载出来的函数原型上，
+// 调用时仍然使用解释器的栈帧，所以Upvalue、可变参数、协程和错误信息都和解释执行一样
+
+// 生成代码的选项
+type Config struct {
+	Package string // 生成的包名，为"main"时同时生成和lua命令一样运行chunk的main函数
+	Strip   bool   // 嵌入的chunk去掉调试信息
+}
+
+// 生成Go源代码，proto是编译好的主函数原型
+// 生成的包提供Load(ls)把主函数压入栈顶，以及Main(ls)以GoFunction的形式执行chunk
+func Generate(proto *Prototype, cfg Config) ([]byte, error) {
+	if !token.IsIdentifier(cfg.Package) {
+		return nil, fmt.Errorf("invalid package name '%s'", cfg.Package)
+	}
+	g := &generator{}
+	g.collect(proto)
+	for i, p := range g.protos {
+		newFunction(g, p, i).generate()
+	}
+	chunk := Dump(*proto, cfg.Strip)
+
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "// Code generated by luaaot from %s. DO NOT EDIT.\n\n", ChunkID(proto.Source))
+	fmt.Fprintf(out, "package %s\n\n", cfg.Package)
+	imports := []string{"lua/src/api", "lua/src/state"}
+	if g.usesVM {
+		imports = append(imports, "lua/src/vm")
+	}
+	if cfg.Package == "main" {
+		imports = append(imports, "fmt", "os")
+		if proto.Dialect == LUA_DIALECT_54 {
+			imports = append(imports, "lua/src/binchunk")
+		}
+	}
+	out.WriteString(importDecl(imports))
+	fmt.Fprintf(out, loaderTemplate, strconv.Quote(proto.Source), strconv.Quote(string(chunk)), nativeList(len(g.protos)))
+	if cfg.Package == "main" {
+		dialect := ""
+		if proto.Dialect == LUA_DIALECT_54 {
+			dialect = "ls.SetDialect(binchunk.LUA_DIALECT_54)\n"
+		}
+		fmt.Fprintf(out, mainTemplate, dialect)
+	}
+	out.Write(g.buf.Bytes())
+	return format.Source(out.Bytes())
+}
+
+type generator struct {
+	buf    bytes.Buffer
+	protos []*Prototype // 按先序排列的函数原型，和Load()挂载Go函数的顺序一致
+	usesVM bool         // 是否用到了vm包里和解释器共用的函数
+}
+
+func (self *generator) collect(proto *Prototype) {
+	self.protos = append(self.protos, proto)
+	for _, p := range proto.Protos {
+		self.collect(p)
+	}
+}
+
+func importDecl(paths []string) string {
+	quoted := make([]string, len(paths))
+	for i, path := range paths {
+		quoted[i] = "\t" + strconv.Quote(path) + "\n"
+	}
+	return "import (\n" + strings.Join(quoted, "") + ")\n\n"
+}
+
+func nativeList(n int) string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = funcName(i)
+	}
+	return strings.Join(names, ", ")
+}
+
+func funcName(i int) string {
+	return fmt.Sprintf("f%d", i)
+}
+
+const loaderTemplate = `const chunkName = %s
+
+// 编译好的二进制chunk，Go函数只代替指令的执行，函数原型的其他部分(常量表、Upvalue表等)从这里加载
+const chunk = %s
+
+// 按先序排列的函数原型对应的Go函数
+var natives = []func(api.LuaVM){%s}
+
+// 加载chunk，把主函数压入栈顶，返回值和LuaState.Load()相同
+func Load(ls api.LuaState) int {
+	return state.LoadNative(ls, []byte(chunk), chunkName, natives)
+}
+
+// 以GoFunction的形式执行chunk：参数传给主函数，返回主函数的全部返回值
+func Main(ls api.LuaState) int {
+	nArgs := ls.GetTop()
+	if Load(ls) != api.LUA_OK {
+		ls.Error()
+	}
+	ls.Insert(1)
+	ls.Call(nArgs, api.LUA_MULTRET)
+	return ls.GetTop()
+}
+
+`
+
+// 和lua命令执行脚本时一样：全局表arg保存命令行参数，出错时打印错误信息和栈回溯
+const mainTemplate = `var progName = "lua"
+
+func main() {
+	ls := state.New()
+	ls.PushGoFunction(pmain)
+	status := ls.PCall(0, 1, 0)
+	result := ls.ToBoolean(-1)
+	report(ls, status)
+	if result && status == api.LUA_OK {
+		os.Exit(0)
+	}
+	os.Exit(1)
+}
+
+func pmain(ls api.LuaState) int {
+	if len(os.Args) > 0 && os.Args[0] != "" {
+		progName = os.Args[0]
+	}
+	%sls.OpenLibs()
+	ls.CreateTable(len(os.Args)-1, 1)
+	for i, arg := range os.Args {
+		ls.PushString(arg)
+		ls.RawSetI(-2, int64(i))
+	}
+	ls.SetGlobal("arg")
+	status := Load(ls)
+	if status == api.LUA_OK {
+		args := os.Args[1:]
+		for _, arg := range args {
+			ls.PushString(arg)
+		}
+		base := ls.GetTop() - len(args)
+		ls.PushGoFunction(msgHandler)
+		ls.Insert(base)
+		status = ls.PCall(len(args), api.LUA_MULTRET, base)
+		ls.Remove(base)
+	}
+	if report(ls, status) != api.LUA_OK {
+		return 0
+	}
+	ls.PushBoolean(true)
+	return 1
+}
+
+func msgHandler(ls api.LuaState) int {
+	msg, ok := ls.ToStringX(1)
+	if !ok {
+		if ls.CallMeta(1, "__tostring") && ls.Type(-1) == api.LUA_TSTRING {
+			return 1
+		}
+		msg = fmt.Sprintf("(error object is a %%s value)", ls.TypeName2(1))
+	}
+	ls.Traceback(ls, msg, 1)
+	return 1
+}
+
+func report(ls api.LuaState, status int) int {
+	if status != api.LUA_OK {
+		msg, ok := ls.ToStringX(-1)
+		if !ok {
+			msg = fmt.Sprintf("(error object is a %%s value)", ls.TypeName2(-1))
+		}
+		fmt.Fprintf(os.Stderr, "%%s: %%s\n", progName, msg)
+		ls.Pop(1)
+	}
+	return status
+}
+
+`
@@ -0,0 +1,398 @@
+package aot
+
+import (
+	"fmt"
+	. "lua/src/binchunk"
+	. "lua/src/vm"
+	"strconv"
+	"strings"
+)
+
+// 一个函数原型对应的Go函数
+// 寄存器R(x)在栈帧里的索引是x+1，和解释器执行指令时一样
+type function struct {
+	*generator
+	proto     *Prototype
+	name      string
+	dialect   byte
+	reachable []bool       // 从入口能够执行到的指令，执行不到的指令不生成代码
+	labels    map[int]bool // 跳转目标，生成goto用的标签
+}
+
+func newFunction(g *generator, proto *Prototype, idx int) *function {
+	dialect := proto.Dialect
+	if dialect == 0 {
+		dialect = LUA_DIALECT_53
+	}
+	return &function{
+		generator: g,
+		proto:     proto,
+		name:      funcName(idx),
+		dialect:   dialect,
+		reachable: make([]bool, len(proto.Code)),
+		labels:    map[int]bool{},
+	}
+}
+
+func (self *function) inst(pc int) Instruction {
+	return Instruction(self.proto.Code[pc])
+}
+
+// 指令的跳转目标和顺序执行时的下一条指令，没有下一条指令时next为-1
+func (self *function) successors(pc int) (jumps []int, next int) {
+	i := self.inst(pc)
+	_, _, c := i.ABC()
+	_, sBx := i.AsBx()
+	switch i.Opcode() {
+	case OP_JMP:
+		return []int{pc + 1 + sBx}, -1
+	case OP_RETURN:
+		return nil, -1
+	case OP_LOADBOOL:
+		if c != 0 {
+			return []int{pc + 2}, -1
+		}
+	case OP_EQ, OP_LT, OP_LE, OP_TEST, OP_TESTSET:
+		return []int{pc + 2}, pc + 1
+	case OP_FORPREP:
+		if self.dialect == LUA_DIALECT_54 { // 进入循环时顺序执行，否则跳过FORLOOP
+			return []int{pc + 2 + sBx}, pc + 1
+		}
+		return []int{pc + 1 + sBx}, -1
+	case OP_FORLOOP, OP_TFORLOOP:
+		return []int{pc + 1 + sBx}, pc + 1
+	case OP_LOADKX: // 跳过EXTRAARG
+		return nil, pc + 2
+	case OP_SETLIST:
+		if c == 0 {
+			return nil, pc + 2
+		}
+	}
+	return nil, pc + 1
+}
+
+// 找出能够执行到的指令和跳转目标
+func (self *function) analyze() {
+	work := []int{0}
+	self.reachable[0] = true
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		jumps, next := self.successors(pc)
+		for _, target := range jumps {
+			self.labels[target] = true
+		}
+		if next >= 0 {
+			jumps = append(jumps, next)
+		}
+		for _, succ := range jumps {
+			if succ >= 0 && succ < len(self.reachable) && !self.reachable[succ] {
+				self.reachable[succ] = true
+				work = append(work, succ)
+			}
+		}
+	}
+}
+
+func (self *function) generate() {
+	self.analyze()
+	p := self.proto
+	kind := "main"
+	if p.LineDefined > 0 {
+		kind = "function"
+	}
+	self.printf("// %s <%s:%d,%d>\n", kind, ChunkID(p.Source), p.LineDefined, p.LastLineDefined)
+	self.printf("func %s(ls api.LuaVM) {\n", self.name)
+	for pc := range p.Code {
+		if !self.reachable[pc] {
+			continue
+		}
+		if self.labels[pc] {
+			self.printf("L%d:\n", pc)
+		}
+		self.printf("// [%d] %s\n", pc+1, describe(self.inst(pc)))
+		if len(p.LineInfo) > 0 { // 保持pc和解释器一致，错误信息里的行号来自pc
+			self.printf("ls.AddPC(%d - ls.PC())\n", pc+1)
+		}
+		self.translate(pc)
+	}
+	self.printf("}\n\n")
+}
+
+func (self *function) printf(f string, a ...interface{}) {
+	fmt.Fprintf(&self.buf, f, a...)
+}
+
+// 指令的操作码和操作数，和luac -l的格式相近
+func describe(i Instruction) string {
+	name := strings.TrimSpace(i.OpName())
+	switch i.OpMode() {
+	case IABx:
+		a, bx := i.ABx()
+		return fmt.Sprintf("%s %d %d", name, a, bx)
+	case IAsBx:
+		a, sBx := i.AsBx()
+		return fmt.Sprintf("%s %d %d", name, a, sBx)
+	case IAx:
+		return fmt.Sprintf("%s %d", name, i.Ax())
+	}
+	a, b, c := i.ABC()
+	return fmt.Sprintf("%s %d %d %d", name, a, b, c)
+}
+
+// 把常量或寄存器压入栈顶
+// 浮点数常量仍然从常量表取，避免在源代码里表示NaN、无穷大和-0
+func (self *function) pushRK(rk int) {
+	if rk <= 0xFF {
+		self.printf("ls.PushValue(%d)\n", rk+1)
+		return
+	}
+	self.pushConst(rk & 0xFF)
+}
+
+func (self *function) pushConst(idx int) {
+	switch k := self.proto.Constants[idx].(type) {
+	case nil:
+		self.printf("ls.PushNil()\n")
+	case bool:
+		self.printf("ls.PushBoolean(%t)\n", k)
+	case int64:
+		self.printf("ls.PushInteger(%d)\n", k)
+	case string:
+		self.printf("ls.PushString(%s)\n", strconv.Quote(k))
+	default:
+		self.printf("ls.GetConst(%d)\n", idx)
+	}
+}
+
+func upvalueIndex(idx int) string {
+	return fmt.Sprintf("api.LuaUpvalueIndex(%d)", idx+1)
+}
+
+var arithOps = map[int]string{
+	OP_ADD:  "api.LUA_OPADD",
+	OP_SUB:  "api.LUA_OPSUB",
+	OP_MUL:  "api.LUA_OPMUL",
+	OP_MOD:  "api.LUA_OPMOD",
+	OP_POW:  "api.LUA_OPPOW",
+	OP_DIV:  "api.LUA_OPDIV",
+	OP_IDIV: "api.LUA_OPIDIV",
+	OP_BAND: "api.LUA_OPBAND",
+	OP_BOR:  "api.LUA_OPBOR",
+	OP_BXOR: "api.LUA_OPBXOR",
+	OP_SHL:  "api.LUA_OPSHL",
+	OP_SHR:  "api.LUA_OPSHR",
+	OP_UNM:  "api.LUA_OPUNM",
+	OP_BNOT: "api.LUA_OPBNOT",
+}
+
+var compareOps = map[int]string{
+	OP_EQ: "api.LUA_OPEQ",
+	OP_LT: "api.LUA_OPLT",
+	OP_LE: "api.LUA_OPLE",
+}
+
+// 翻译一条指令，语义和vm包里对应的函数相同
+func (self *function) translate(pc int) {
+	i := self.inst(pc)
+	op := i.Opcode()
+	a, b, c := i.ABC()
+	_, bx := i.ABx()
+	_, sBx := i.AsBx()
+	ra := a + 1 // R(A)在栈帧里的索引
+
+	switch op {
+	case OP_MOVE:
+		self.printf("ls.Copy(%d, %d)\n", b+1, ra)
+	case OP_LOADK:
+		self.pushConst(bx)
+		self.printf("ls.Replace(%d)\n", ra)
+	case OP_LOADKX:
+		self.pushConst(self.inst(pc + 1).Ax())
+		self.printf("ls.Replace(%d)\n", ra)
+	case OP_LOADBOOL:
+		self.printf("ls.PushBoolean(%t)\n", b != 0)
+		self.printf("ls.Replace(%d)\n", ra)
+		if c != 0 {
+			self.printf("goto L%d\n", pc+2)
+		}
+	case OP_LOADNIL:
+		self.printf("ls.PushNil()\n")
+		for j := ra; j <= ra+b; j++ {
+			self.printf("ls.Copy(-1, %d)\n", j)
+		}
+		self.printf("ls.Pop(1)\n")
+	case OP_GETUPVAL:
+		self.printf("ls.Copy(%s, %d)\n", upvalueIndex(b), ra)
+	case OP_SETUPVAL:
+		self.printf("ls.Copy(%d, %s)\n", ra, upvalueIndex(b))
+	case OP_GETTABUP:
+		self.pushRK(c)
+		self.printf("ls.GetTable(%s)\n", upvalueIndex(b))
+		self.printf("ls.Replace(%d)\n", ra)
+	case OP_SETTABUP:
+		self.pushRK(b)
+		self.pushRK(c)
+		self.printf("ls.SetTable(%s)\n", upvalueIndex(a))
+	case OP_GETTABLE:
+		self.pushRK(c)
+		self.printf("ls.GetTable(%d)\n", b+1)
+		self.printf("ls.Replace(%d)\n", ra)
+	case OP_SETTABLE:
+		self.pushRK(b)
+		self.pushRK(c)
+		self.printf("ls.SetTable(%d)\n", ra)
+	case OP_NEWTABLE:
+		self.printf("ls.CreateTable(%d, %d)\n", Fb2int(b), Fb2int(c))
+		self.printf("ls.Replace(%d)\n", ra)
+	case OP_SELF:
+		self.printf("ls.Copy(%d, %d)\n", b+1, ra+1)
+		self.pushRK(c)
+		self.printf("ls.GetTable(%d)\n", b+1)
+		self.printf("ls.Replace(%d)\n", ra)
+	case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV,
+		OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+		self.pushRK(b)
+		self.pushRK(c)
+		self.printf("ls.Arith(%s)\n", arithOps[op])
+		self.printf("ls.Replace(%d)\n", ra)
+	case OP_UNM, OP_BNOT:
+		self.printf("ls.PushValue(%d)\n", b+1)
+		self.printf("ls.Arith(%s)\n", arithOps[op])
+		self.printf("ls.Replace(%d)\n", ra)
+	case OP_NOT:
+		self.printf("ls.PushBoolean(!ls.ToBoolean(%d))\n", b+1)
+		self.printf("ls.Replace(%d)\n", ra)
+	case OP_LEN:
+		self.printf("ls.Len(%d)\n", b+1)
+		self.printf("ls.Replace(%d)\n", ra)
+	case OP_CONCAT:
+		self.printf("ls.CheckStack(%d)\n", c-b+1)
+		for j := b + 1; j <= c+1; j++ {
+			self.printf("ls.PushValue(%d)\n", j)
+		}
+		self.printf("ls.Concat(%d)\n", c-b+1)
+		self.printf("ls.Replace(%d)\n", ra)
+	case OP_JMP:
+		if a != 0 {
+			self.printf("ls.CloseUpvalues(%d)\n", a)
+		}
+		self.printf("goto L%d\n", pc+1+sBx)
+	case OP_EQ, OP_LT, OP_LE: // 比较结果和A不一致时跳过下一条指令
+		not := ""
+		if a != 0 {
+			not = "!"
+		}
+		if b <= 0xFF && c <= 0xFF { // 两个操作数都在寄存器里，不用压栈
+			self.printf("if %sls.Compare(%d, %d, %s) {\ngoto L%d\n}\n", not, b+1, c+1, compareOps[op], pc+2)
+			break
+		}
+		self.pushRK(b)
+		self.pushRK(c)
+		self.printf("if %sls.Compare(-2, -1, %s) {\nls.Pop(2)\ngoto L%d\n}\n", not, compareOps[op], pc+2)
+		self.printf("ls.Pop(2)\n")
+	case OP_TEST:
+		not := "!"
+		if c == 0 {
+			not = ""
+		}
+		self.printf("if %sls.ToBoolean(%d) {\ngoto L%d\n}\n", not, ra, pc+2)
+	case OP_TESTSET:
+		not := "!"
+		if c == 0 {
+			not = ""
+		}
+		self.printf("if %sls.ToBoolean(%d) {\ngoto L%d\n}\n", not, b+1, pc+2)
+		self.printf("ls.Copy(%d, %d)\n", b+1, ra)
+	case OP_CALL:
+		self.printf("ls.Call(%s, %d)\n", self.pushFuncAndArgs(ra, b), c-1)
+		self.popResults(ra, c)
+	case OP_TAILCALL: // 和CALL一样，返回值留在栈顶交给后面的RETURN
+		self.printf("ls.Call(%s, -1)\n", self.pushFuncAndArgs(ra, b))
+		self.popResults(ra, 0)
+	case OP_RETURN:
+		if b > 1 {
+			self.printf("ls.CheckStack(%d)\n", b-1)
+			for j := ra; j <= ra+b-2; j++ {
+				self.printf("ls.PushValue(%d)\n", j)
+			}
+		} else if b == 0 {
+			self.usesVM = true
+			self.printf("vm.FixStack(%d, ls)\n", ra)
+		}
+		self.printf("ls.CloseUpvalues(1)\n")
+		self.printf("return\n")
+	case OP_FORLOOP:
+		self.usesVM = true
+		loop := "vm.ForLoop"
+		if self.dialect == LUA_DIALECT_54 {
+			loop = "vm.ForLoop54"
+		}
+		self.printf("if %s(%d, ls) {\ngoto L%d\n}\n", loop, ra, pc+1+sBx)
+	case OP_FORPREP:
+		if self.dialect == LUA_DIALECT_54 {
+			self.usesVM = true
+			self.printf("if !vm.ForPrep54(%d, ls) {\ngoto L%d\n}\n", ra, pc+2+sBx)
+			break
+		}
+		self.printf("ls.PushValue(%d)\n", ra)
+		self.printf("ls.PushValue(%d)\n", ra+2)
+		self.printf("ls.Arith(api.LUA_OPSUB)\n")
+		self.printf("ls.Replace(%d)\n", ra)
+		self.printf("goto L%d\n", pc+1+sBx)
+	case OP_TFORCALL:
+		self.printf("ls.CheckStack(3)\n")
+		for j := ra; j < ra+3; j++ {
+			self.printf("ls.PushValue(%d)\n", j)
+		}
+		self.printf("ls.Call(2, %d)\n", c)
+		self.popResults(ra+3, c+1)
+	case OP_TFORLOOP:
+		self.printf("if !ls.IsNil(%d) {\nls.Copy(%d, %d)\ngoto L%d\n}\n", ra+1, ra+1, ra, pc+1+sBx)
+	case OP_SETLIST:
+		if c == 0 {
+			c = self.inst(pc + 1).Ax()
+		}
+		self.usesVM = true
+		self.printf("vm.SetList(%d, %d, %d, ls)\n", ra, b, c)
+	case OP_CLOSURE:
+		self.printf("ls.LoadProto(%d)\n", bx)
+		self.printf("ls.Replace(%d)\n", ra)
+	case OP_VARARG:
+		if b != 1 {
+			self.printf("ls.LoadVararg(%d)\n", b-1)
+			self.popResults(ra, b)
+		}
+	case OP_TBC:
+		self.printf("ls.ToClose(%d)\n", ra)
+	case OP_EXTRAARG: // 由前一条指令处理
+	default:
+		panic(fmt.Sprintf("unknown opcode %d", op))
+	}
+}
+
+// 把函数和参数压入栈顶，返回表示参数个数的表达式
+// 参数个数固定时直接展开，否则交给和解释器共用的vm.PushFuncAndArgs()
+func (self *function) pushFuncAndArgs(a, b int) string {
+	if b == 0 {
+		self.usesVM = true
+		return fmt.Sprintf("vm.PushFuncAndArgs(%d, 0, ls)", a)
+	}
+	self.printf("ls.CheckStack(%d)\n", b)
+	for j := a; j < a+b; j++ {
+		self.printf("ls.PushValue(%d)\n", j)
+	}
+	return strconv.Itoa(b - 1)
+}
+
+// 把返回值放到从a开始的寄存器里，c为0时返回值留在栈顶
+func (self *function) popResults(a, c int) {
+	if c == 0 {
+		self.usesVM = true
+		self.printf("vm.PopResults(%d, 0, ls)\n", a)
+		return
+	}
+	for j := a + c - 2; j >= a; j-- {
+		self.printf("ls.Replace(%d)\n", j)
+	}
+}
@@ -31,6 +31,7 @@ type AuxLib interface {
 	GetSubTable(idx int, fname string) bool
 	GetMetafield(obj int, e string) LuaType
 	CallMeta(obj int, e string) bool
+	Traceback(l1 LuaState, msg string, level int)
 	OpenLibs()
 	RequireF(modname string, openf GoFunction, glb bool)
 	NewLib(l FuncReg)
@@ -1,6 +1,10 @@
 package api
 
-import . "lua/src/binchunk"
+import (
+	. "lua/src/binchunk"
+	"lua/src/compiler/options"
+	. "lua/src/number"
+)
 
 type LuaType = int
 type ArithOp = int
@@ -61,6 +65,11 @@ type BasicAPI interface {
 	SetField(idx int, k string)                    // 设置指定索引处的表中指定键的值
 	SetI(idx int, n int64)                         // 设置指定索引处的表中指定键的值
 	Load(chunk []byte, chunkName, mode string) int // 加载一个块
+	SetVerifyBytecode(verify bool)                 // 设置加载二进制块时是否校验字节码
+	SetDialect(dialect byte)                       // 设置编译文本块时使用的语言方言
+	Dialect() byte                                 // 获取编译文本块时使用的语言方言
+	SetOptimization(passes int)                    // 设置编译文本块时执行的优化遍
+	Optimization() int                             // 获取编译文本块时执行的优化遍
 	Call(nArgs, nResults int)                      // 调用一个函数
 	PushGoFunction(f GoFunction)                   // 将Go函数压入栈顶
 	IsGoFunction(idx int) bool                     // 判断指定索引处的值是否是Go函数
@@ -88,6 +97,7 @@ type BasicAPI interface {
 	NewThread() LuaState                           // 创建一个协程并将其压入栈顶
 	Resume(from LuaState, nArgs int) int           // 恢复一个协程
 	Yield(nResults int) int                        // 挂起一个协程
+	CloseThread(from LuaState) int                 // 关闭一个协程
 	Status() int                                   // 获取协程的状态
 	IsYieldable() bool                             // 判断当前协程是否可以挂起
 	ToThread(idx int) LuaState                     // 将指定索引处的值转换成协程
@@ -96,9 +106,14 @@ type BasicAPI interface {
 	GetStack() bool                                // 获取栈帧
 	ToProto(idx int) *Prototype                    // 将指定索引处的值转换成原型
 	SetUpvalue(idx, n int)                         // 设置指定索引处的闭包的指定upvalue的值
+	ToClose(idx int)                               // 把指定索引处的值标记为待关闭变量
 	GetUpvalue(idx, n int)                         // 获取指定索引处的闭包的指定upvalue的值
 	NewUserdata(data interface{})                  // 创建一个新的userdata并将其压入栈顶
 	ToUserdata(idx int) *interface{}               // 将指定索引处的值转换成userdata
+	RandState() *Xoshiro256                        // 获取当前状态的伪随机数生成器
+
+	// 和Load一样加载一个块，文本块按照编译选项编译
+	LoadWithOptions(chunk []byte, mode string, opts *options.CompileOptions) int
 }
 
 type LuaState interface {
@@ -11,5 +11,6 @@ type LuaVM interface {
 	RegisterCount() int  // 获取寄存器数量
 	LoadVararg(n int)    // 将可变参数推入栈顶
 	LoadProto(idx int)   // 将指定子函数原型推入栈顶
-	CloseUpvalues(a int) // 关闭指定索引处的Upvalue
+	CloseUpvalues(a int) // 关闭指定索引处及以上的Upvalue和待关闭变量
+	FuncDialect() byte   // 获取当前函数编译时使用的语言方言
 }
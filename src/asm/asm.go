@@ -0,0 +1,479 @@
+package asm
+
+import (
+	"fmt"
+	"lua/src/binchunk"
+	"lua/src/vm"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 汇编器：把Disassemble生成(或手写)的汇编文本转换成函数原型
+type assembler struct {
+	chunkName string
+	line      int         // 当前行号
+	funcs     []*function // 正在汇编的函数(嵌套)
+	main      *binchunk.Prototype
+	dialect   byte // .dialect指定的语言方言，0表示默认的5.3
+}
+
+// 正在汇编的函数
+type function struct {
+	proto  *binchunk.Prototype
+	line   int            // .function所在行号
+	lines  []uint32       // 每条指令的行号
+	nLines int            // 写了行号的指令数量
+	labels map[string]int // 标签名 => 指令索引
+	fixups []fixup        // 引用了标签的跳转指令
+}
+
+// 等待回填的跳转指令
+type fixup struct {
+	pc    int
+	label string
+	line  int
+}
+
+type asmError struct {
+	msg string
+}
+
+// 汇编文本，chunkName用于错误信息
+func Assemble(chunk, chunkName string) (proto *binchunk.Prototype, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(*asmError); ok {
+				proto, err = nil, fmt.Errorf("%s", e.msg)
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	self := &assembler{chunkName: chunkName}
+	for i, text := range strings.Split(chunk, "\n") {
+		self.line = i + 1
+		self.assembleLine(self.tokenize(strings.TrimSuffix(text, "\r")))
+	}
+	if len(self.funcs) > 0 {
+		self.line = self.funcs[len(self.funcs)-1].line
+		self.error("'.function' without matching '.end'")
+	}
+	if self.main == nil {
+		self.error("no function")
+	}
+	return self.main, nil
+}
+
+func (self *assembler) error(f string, a ...interface{}) {
+	msg := fmt.Sprintf(f, a...)
+	panic(&asmError{fmt.Sprintf("%s:%d: %s", binchunk.ChunkID(self.chunkName), self.line, msg)})
+}
+
+// 把一行拆成单词，字符串保留引号，分号之后是注释
+func (self *assembler) tokenize(text string) []string {
+	var tokens []string
+	for i := 0; i < len(text); {
+		switch c := text[i]; {
+		case c == ';':
+			return tokens
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(text) && text[j] != '"'; j++ {
+				if text[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(text) {
+				self.error("unfinished string")
+			}
+			tokens = append(tokens, text[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(text) && !strings.ContainsRune(" \t;\"", rune(text[j])) {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+func (self *assembler) current() *function {
+	if len(self.funcs) == 0 {
+		self.error("'.function' expected")
+	}
+	return self.funcs[len(self.funcs)-1]
+}
+
+func (self *assembler) assembleLine(tokens []string) {
+	if len(tokens) == 0 {
+		return
+	}
+	if tok := tokens[0]; strings.HasSuffix(tok, ":") && !strings.HasPrefix(tok, ".") { // 标签
+		name := tok[:len(tok)-1]
+		if !isName(name) {
+			self.error("invalid label '%s'", name)
+		}
+		fi := self.current()
+		if _, found := fi.labels[name]; found {
+			self.error("label '%s' already defined", name)
+		}
+		fi.labels[name] = len(fi.proto.Code)
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return
+		}
+	}
+	if strings.HasPrefix(tokens[0], ".") {
+		self.directive(tokens[0], tokens[1:])
+	} else {
+		self.instruction(tokens)
+	}
+}
+
+// 处理伪指令
+func (self *assembler) directive(name string, args []string) {
+	switch name {
+	case ".dialect":
+		self.checkArgs(name, args, 1, 1)
+		if self.main != nil {
+			self.error("'.dialect' must precede '.function'")
+		}
+		switch args[0] {
+		case "5.3":
+			self.dialect = 0
+		case "5.4":
+			self.dialect = binchunk.LUA_DIALECT_54
+		default:
+			self.error("unknown dialect '%s'", args[0])
+		}
+	case ".function":
+		self.checkArgs(name, args, 3, 3)
+		if self.main != nil && len(self.funcs) == 0 {
+			self.error("only one main function allowed")
+		}
+		proto := &binchunk.Prototype{
+			Source:          self.parseString(args[0]),
+			LineDefined:     uint32(self.parseInt(args[1], 0, math.MaxUint32)),
+			LastLineDefined: uint32(self.parseInt(args[2], 0, math.MaxUint32)),
+			Code:            []uint32{},
+			Constants:       []interface{}{},
+			Upvalues:        []binchunk.Upvalue{},
+			Protos:          []*binchunk.Prototype{},
+			LineInfo:        []uint32{},
+			LocVars:         []binchunk.LocVar{},
+			UpvalueNames:    []string{},
+			Dialect:         self.dialect,
+		}
+		if len(self.funcs) == 0 {
+			self.main = proto
+		} else {
+			parent := self.current().proto
+			parent.Protos = append(parent.Protos, proto)
+		}
+		self.funcs = append(self.funcs, &function{
+			proto:  proto,
+			line:   self.line,
+			labels: map[string]int{},
+		})
+	case ".end":
+		self.checkArgs(name, args, 0, 0)
+		self.finish(self.current())
+		self.funcs = self.funcs[:len(self.funcs)-1]
+	case ".params":
+		self.checkArgs(name, args, 1, 1)
+		self.current().proto.NumParams = byte(self.parseInt(args[0], 0, 0xFF))
+	case ".vararg":
+		self.checkArgs(name, args, 0, 1)
+		flag := int64(1)
+		if len(args) > 0 {
+			flag = self.parseInt(args[0], 0, 0xFF)
+		}
+		self.current().proto.IsVararg = byte(flag)
+	case ".slots":
+		self.checkArgs(name, args, 1, 1)
+		self.current().proto.MaxStackSize = byte(self.parseInt(args[0], 0, 0xFF))
+	case ".const":
+		self.checkArgs(name, args, 1, 1)
+		proto := self.current().proto
+		proto.Constants = append(proto.Constants, self.parseConstant(args[0]))
+	case ".upvalue":
+		self.checkArgs(name, args, 3, 3)
+		proto := self.current().proto
+		upval := binchunk.Upvalue{
+			Name:    self.parseString(args[0]),
+			Instack: byte(self.parseInt(args[1], 0, 1)),
+			Idx:     byte(self.parseInt(args[2], 0, 0xFF)),
+		}
+		proto.Upvalues = append(proto.Upvalues, upval)
+		proto.UpvalueNames = append(proto.UpvalueNames, upval.Name)
+	case ".local":
+		self.checkArgs(name, args, 3, 3)
+		proto := self.current().proto
+		proto.LocVars = append(proto.LocVars, binchunk.LocVar{
+			VarName: self.parseString(args[0]),
+			StartPC: uint32(self.parseInt(args[1], 1, math.MaxUint32) - 1),
+			EndPC:   uint32(self.parseInt(args[2], 1, math.MaxUint32) - 1),
+		})
+	default:
+		self.error("unknown directive '%s'", name)
+	}
+}
+
+func (self *assembler) checkArgs(name string, args []string, min, max int) {
+	if len(args) < min || len(args) > max {
+		self.error("wrong number of arguments to '%s'", name)
+	}
+}
+
+// 函数结束：回填标签并检查行号表
+func (self *assembler) finish(fi *function) {
+	code := fi.proto.Code
+	for _, fix := range fi.fixups {
+		target, found := fi.labels[fix.label]
+		if !found {
+			self.line = fix.line
+			self.error("undefined label '%s'", fix.label)
+		}
+		sbx := target - fix.pc - 1
+		if sbx < -vm.MAXARG_sBx || sbx > vm.MAXARG_sBx+1 {
+			self.line = fix.line
+			self.error("jump to '%s' too far", fix.label)
+		}
+		i := code[fix.pc]
+		i = i << 18 >> 18 // 清除sBx字段
+		code[fix.pc] = i | uint32(sbx+vm.MAXARG_sBx)<<14
+	}
+	if fi.nLines > 0 {
+		if fi.nLines != len(code) {
+			self.error("line info must be given for all instructions or none")
+		}
+		fi.proto.LineInfo = fi.lines
+	}
+}
+
+// 汇编一条指令：[序号] [[行号]] 操作码 操作数...
+func (self *assembler) instruction(tokens []string) {
+	fi := self.current()
+	if _, err := strconv.Atoi(tokens[0]); err == nil { // 序号只是为了方便阅读
+		tokens = tokens[1:]
+	}
+	if len(tokens) > 0 && strings.HasPrefix(tokens[0], "[") && strings.HasSuffix(tokens[0], "]") {
+		if line := tokens[0][1 : len(tokens[0])-1]; line != "-" {
+			fi.lines = append(fi.lines, uint32(self.parseInt(line, 0, math.MaxUint32)))
+			fi.nLines++
+		} else {
+			fi.lines = append(fi.lines, 0)
+		}
+		tokens = tokens[1:]
+	} else {
+		fi.lines = append(fi.lines, 0)
+	}
+	if len(tokens) == 0 {
+		self.error("opcode expected")
+	}
+
+	op := opcodeByName(tokens[0])
+	if op < 0 {
+		self.error("unknown opcode '%s'", tokens[0])
+	}
+	i := vm.Instruction(op)
+	args := tokens[1:]
+	var inst int
+	switch i.OpMode() {
+	case vm.IABC:
+		b, c := 0, 0
+		used := 1
+		if i.BMode() != vm.OpArgN {
+			used++
+		}
+		if i.CMode() != vm.OpArgN {
+			used++
+		}
+		switch len(args) {
+		case 3:
+			b, c = self.rkArg(args[1]), self.rkArg(args[2])
+		case used:
+			next := 1
+			if i.BMode() != vm.OpArgN {
+				b = self.rkArg(args[next])
+				next++
+			}
+			if i.CMode() != vm.OpArgN {
+				c = self.rkArg(args[next])
+			}
+		default:
+			self.error("wrong number of operands to '%s'", tokens[0])
+		}
+		inst = b<<23 | c<<14 | self.regArg(args[0])<<6 | op
+	case vm.IABx:
+		bx := 0
+		switch {
+		case len(args) == 2:
+			bx = int(self.parseInt(args[1], -1-vm.MAXARG_Bx, vm.MAXARG_Bx))
+			if bx < 0 { // 常量索引
+				bx = -1 - bx
+			}
+		case len(args) == 1 && i.BMode() == vm.OpArgN:
+		default:
+			self.error("wrong number of operands to '%s'", tokens[0])
+		}
+		inst = bx<<14 | self.regArg(args[0])<<6 | op
+	case vm.IAsBx:
+		if len(args) != 2 {
+			self.error("wrong number of operands to '%s'", tokens[0])
+		}
+		sbx := 0
+		if isName(args[1]) {
+			fi.fixups = append(fi.fixups, fixup{len(fi.proto.Code), args[1], self.line})
+		} else {
+			sbx = int(self.parseInt(args[1], -vm.MAXARG_sBx, vm.MAXARG_sBx+1))
+		}
+		inst = (sbx+vm.MAXARG_sBx)<<14 | self.regArg(args[0])<<6 | op
+	default: // IAx
+		if len(args) != 1 {
+			self.error("wrong number of operands to '%s'", tokens[0])
+		}
+		ax := int(self.parseInt(args[0], -1<<26, 1<<26-1))
+		if ax < 0 { // 常量索引
+			ax = -1 - ax
+		}
+		inst = ax<<6 | op
+	}
+	fi.proto.Code = append(fi.proto.Code, uint32(inst))
+}
+
+// 根据名字查找操作码，找不到返回-1
+func opcodeByName(name string) int {
+	for op := vm.OP_MOVE; op <= vm.OP_TBC; op++ {
+		if strings.EqualFold(strings.TrimSpace(vm.Instruction(op).OpName()), name) {
+			return op
+		}
+	}
+	return -1
+}
+
+// 操作数A：寄存器索引
+func (self *assembler) regArg(s string) int {
+	return int(self.parseInt(s, 0, 0xFF))
+}
+
+// 操作数B或C：负数表示常量索引
+func (self *assembler) rkArg(s string) int {
+	n := int(self.parseInt(s, -0x100, 0x1FF))
+	if n < 0 {
+		return 0x100 | (-1 - n)
+	}
+	return n
+}
+
+func (self *assembler) parseInt(s string, min, max int64) int64 {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		self.error("integer expected near '%s'", s)
+	}
+	if n < min || n > max {
+		self.error("value %d out of range [%d, %d]", n, min, max)
+	}
+	return n
+}
+
+// 常量：nil、true、false、整数、浮点数(带小数点或指数，或者inf/-inf/nan)、字符串
+func (self *assembler) parseConstant(s string) interface{} {
+	switch s {
+	case "nil":
+		return nil
+	case "true":
+		return true
+	case "false":
+		return false
+	case "inf":
+		return math.Inf(1)
+	case "-inf":
+		return math.Inf(-1)
+	case "nan":
+		return math.NaN()
+	}
+	if strings.HasPrefix(s, "\"") {
+		return self.parseString(s)
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !strings.ContainsAny(s, "xXnN_") {
+		return f
+	}
+	self.error("invalid constant '%s'", s)
+	return nil
+}
+
+// 去掉字符串的引号并处理转义序列
+func (self *assembler) parseString(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		self.error("string expected near '%s'", s)
+	}
+	s = s[1 : len(s)-1]
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			buf = append(buf, s[i])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			self.error("invalid escape sequence")
+		}
+		switch c := s[i]; c {
+		case 'a':
+			buf = append(buf, '\a')
+		case 'b':
+			buf = append(buf, '\b')
+		case 'f':
+			buf = append(buf, '\f')
+		case 'n':
+			buf = append(buf, '\n')
+		case 'r':
+			buf = append(buf, '\r')
+		case 't':
+			buf = append(buf, '\t')
+		case 'v':
+			buf = append(buf, '\v')
+		case '"', '\'', '\\':
+			buf = append(buf, c)
+		default:
+			if c < '0' || c > '9' {
+				self.error("invalid escape sequence '\\%c'", c)
+			}
+			n := 0
+			for j := 0; j < 3 && i < len(s) && s[i] >= '0' && s[i] <= '9'; j++ {
+				n = n*10 + int(s[i]-'0')
+				i++
+			}
+			i--
+			if n > 0xFF {
+				self.error("decimal escape too large")
+			}
+			buf = append(buf, byte(n))
+		}
+	}
+	return string(buf)
+}
+
+// 判断是否是合法的标签名
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,218 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"lua/src/binchunk"
+	"lua/src/vm"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 汇编格式示例：
+//
+//	.function "@hello.lua" 0 0
+//	.params 0
+//	.vararg
+//	.slots 2
+//	.upvalue "_ENV" 1 0
+//	.const "print"	; -1
+//	.const "hello"	; -2
+//		1	[1]	GETTABUP 	0 0 -1
+//		2	[1]	LOADK    	1 -2
+//		3	[1]	CALL     	0 2 1
+//		4	[1]	RETURN   	0 1
+//	.end
+//
+// 指令行的写法和Tools.List的列表一致：序号和[行号]可以省略，RK操作数中的常量写成-1-idx，
+// 跳转指令的sBx既可以写数字也可以写标签名。子函数写在父函数的.function和.end之间，
+// 按出现顺序编号。分号之后的内容是注释。使用5.4方言编译的chunk在最前面写".dialect 5.4"。
+
+// 把函数原型转换成汇编文本，Assemble可以把它还原成同样的函数原型
+func Disassemble(f *binchunk.Prototype) string {
+	var buf bytes.Buffer
+	if f.Dialect == binchunk.LUA_DIALECT_54 {
+		buf.WriteString(".dialect 5.4\n")
+	}
+	disassemble(&buf, f)
+	return buf.String()
+}
+
+func disassemble(buf *bytes.Buffer, f *binchunk.Prototype) {
+	fmt.Fprintf(buf, ".function %s %d %d\n", QuoteString(f.Source), f.LineDefined, f.LastLineDefined)
+	fmt.Fprintf(buf, ".params %d\n", f.NumParams)
+	switch f.IsVararg {
+	case 0:
+	case 1:
+		buf.WriteString(".vararg\n")
+	default:
+		fmt.Fprintf(buf, ".vararg %d\n", f.IsVararg)
+	}
+	fmt.Fprintf(buf, ".slots %d\n", f.MaxStackSize)
+	for i, u := range f.Upvalues {
+		fmt.Fprintf(buf, ".upvalue %s %d %d\t; %d\n", QuoteString(u.Name), u.Instack, u.Idx, i)
+	}
+	for i, k := range f.Constants {
+		fmt.Fprintf(buf, ".const %s\t; %d\n", constantToString(k), -1-i)
+	}
+	for i, v := range f.LocVars {
+		fmt.Fprintf(buf, ".local %s %d %d\t; %d\n", QuoteString(v.VarName), v.StartPC+1, v.EndPC+1, i)
+	}
+
+	labels := jumpLabels(f)
+	for pc, c := range f.Code {
+		if label, ok := labels[pc]; ok {
+			fmt.Fprintf(buf, "%s:\n", label)
+		}
+		line := "-"
+		if len(f.LineInfo) > 0 {
+			line = strconv.Itoa(int(f.LineInfo[pc]))
+		}
+		i := vm.Instruction(c)
+		fmt.Fprintf(buf, "\t%d\t[%s]\t%-9s\t%s\n", pc+1, line,
+			strings.TrimSpace(i.OpName()), operands(i, pc, labels))
+	}
+
+	for _, p := range f.Protos {
+		disassemble(buf, p)
+	}
+	buf.WriteString(".end\n")
+}
+
+// 给跳转目标分配标签，标签名是目标指令的序号
+func jumpLabels(f *binchunk.Prototype) map[int]string {
+	labels := map[int]string{}
+	for pc, c := range f.Code {
+		i := vm.Instruction(c)
+		if isJump(i.Opcode()) {
+			_, sbx := i.AsBx()
+			if target := pc + 1 + sbx; target >= 0 && target < len(f.Code) {
+				labels[target] = fmt.Sprintf("L%d", target+1)
+			}
+		}
+	}
+	return labels
+}
+
+// 使用sBx表示跳转偏移的指令
+func isJump(op int) bool {
+	switch op {
+	case vm.OP_JMP, vm.OP_FORLOOP, vm.OP_FORPREP, vm.OP_TFORLOOP:
+		return true
+	}
+	return false
+}
+
+// 按照luac列表的方式打印操作数，未使用的操作数不为0时打印全部操作数，以免丢失信息
+func operands(i vm.Instruction, pc int, labels map[int]string) string {
+	switch i.OpMode() {
+	case vm.IABC:
+		a, b, c := i.ABC()
+		if (i.BMode() == vm.OpArgN && b != 0) || (i.CMode() == vm.OpArgN && c != 0) {
+			return fmt.Sprintf("%d %d %d", a, RKArg(b), RKArg(c))
+		}
+		s := strconv.Itoa(a)
+		if i.BMode() != vm.OpArgN {
+			s += " " + strconv.Itoa(RKArg(b))
+		}
+		if i.CMode() != vm.OpArgN {
+			s += " " + strconv.Itoa(RKArg(c))
+		}
+		return s
+	case vm.IABx:
+		a, bx := i.ABx()
+		switch i.BMode() {
+		case vm.OpArgK:
+			return fmt.Sprintf("%d %d", a, -1-bx)
+		case vm.OpArgN:
+			if bx == 0 {
+				return strconv.Itoa(a)
+			}
+		}
+		return fmt.Sprintf("%d %d", a, bx)
+	case vm.IAsBx:
+		a, sbx := i.AsBx()
+		if label, ok := labels[pc+1+sbx]; ok {
+			return fmt.Sprintf("%d %s", a, label)
+		}
+		return fmt.Sprintf("%d %d", a, sbx)
+	default: // IAx
+		return strconv.Itoa(-1 - i.Ax())
+	}
+}
+
+// RK操作数：常量索引显示为负数(-1-idx)，寄存器索引原样显示，Tools.List也使用这种写法
+func RKArg(rk int) int {
+	if rk > 0xFF {
+		return -1 - (rk & 0xFF)
+	}
+	return rk
+}
+
+// 把常量转换成可以被Assemble解析的字符串，浮点数总是带有小数点或指数
+func constantToString(k interface{}) string {
+	switch x := k.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		switch {
+		case math.IsInf(x, 1):
+			return "inf"
+		case math.IsInf(x, -1):
+			return "-inf"
+		case math.IsNaN(x):
+			return "nan"
+		}
+		s := strconv.FormatFloat(x, 'g', -1, 64)
+		if strings.Trim(s, "-0123456789") == "" { // 看起来像整数，加上".0"
+			s += ".0"
+		}
+		return s
+	case string:
+		return QuoteString(x)
+	default:
+		panic(fmt.Sprintf("unknown constant type %T", k))
+	}
+}
+
+// 给字符串加上引号并转义，不可打印字符写成\ddd，和luac列表中字符串常量的写法一致
+// lua-5.3.4/src/luac.c#PrintString()
+func QuoteString(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			buf.WriteString("\\\"")
+		case '\\':
+			buf.WriteString("\\\\")
+		case '\a':
+			buf.WriteString("\\a")
+		case '\b':
+			buf.WriteString("\\b")
+		case '\f':
+			buf.WriteString("\\f")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\t':
+			buf.WriteString("\\t")
+		case '\v':
+			buf.WriteString("\\v")
+		default:
+			if c >= 0x20 && c < 0x7F {
+				buf.WriteByte(c)
+			} else {
+				fmt.Fprintf(&buf, "\\%03d", c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
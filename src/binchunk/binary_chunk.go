@@ -1,5 +1,7 @@
 package binchunk
 
+import "strings"
+
 // 二进制 chunk 定义
 type binaryChunk struct {
 	header                  // 头部
@@ -37,6 +39,16 @@ const (
 	LUAC_NUM         = 370.5                // 一个浮点数，检测浮点数格式
 )
 
+// 语言方言，默认是5.3
+// 5.4方言只是源代码层面的扩展，编译出的chunk仍然是本虚拟机(5.3)的指令集和函数原型布局，
+// 并不是官方5.4的chunk格式。这样的chunk头部版本号仍然是0x53，用非官方的扩展格式号和普通chunk区分，
+// 官方luac 5.3/5.4都会拒绝它，官方luac 5.4生成的chunk也会因为版本不符被本虚拟机拒绝
+const (
+	LUA_DIALECT_53  = LUAC_VERSION // Lua 5.3
+	LUA_DIALECT_54  = 0x54         // Lua 5.4
+	LUAC_FORMAT_EXT = 1            // 扩展格式号：使用了5.4方言扩展(TBC指令、5.4的for循环语义)的chunk
+)
+
 // 原型
 type Prototype struct {
 	Source          string        // 源文件名
@@ -52,6 +64,7 @@ type Prototype struct {
 	LineInfo        []uint32      // 行号表，行号表和指令表一一对应，记录了每条指令对应的源代码行号
 	LocVars         []LocVar      // 局部变量表
 	UpvalueNames    []string      // upvalue名列表，和前面的Upvalue表一一对应，记录每个Upvalue在源代码中的名字
+	Dialect         byte          // 编译时使用的语言方言，0等同于LUA_DIALECT_53，不单独写入chunk，由头部的格式号决定
 }
 
 // go语言中的空接口可以等效c语言中的union的效果
@@ -64,6 +77,8 @@ const (
 	TAG_LONG_STR  = 0x14 // 长字符串
 )
 
+const LUAI_MAXSHORTLEN = 40 // 短字符串的最大长度
+
 type Upvalue struct {
 	Name    string // upvalue名
 	Instack byte   // 是否在寄存器(栈)中
@@ -76,22 +91,68 @@ type LocVar struct {
 	EndPC   uint32 // 结束指令索引
 }
 
-// 解析二进制chunk
-func Undump(data []byte) *Prototype {
-	reader := &reader{data}
-	reader.checkHeader()        // 检查头部
-	reader.readByte()           // 跳过upvalue数量
-	return reader.readProto("") // 读取主函数原型
+// 解析二进制chunk，chunk格式不对或者被截断时返回error
+// lua-5.3.4/src/lundump.c#luaU_undump()
+func Undump(data []byte) (proto *Prototype, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(*undumpError); ok {
+				proto, err = nil, e
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	reader := &reader{data: data}
+	reader.checkHeader()             // 检查头部
+	reader.readByte()                // 跳过upvalue数量
+	return reader.readProto(""), nil // 读取主函数原型
 }
 
-func Dump(prototype Prototype) []byte {
-	writer := &writer{prototype, make([]byte, 0)}
-	writer.writeHeader() // 写入头部
-	writer.writeByte(0)  // 写入upvalue数量
-	writer.writeProto(&prototype)
+// 生成二进制chunk，strip为true时去掉调试信息(源文件名、行号表、局部变量表和Upvalue名)
+func Dump(prototype Prototype, strip bool) []byte {
+	writer := &writer{prototype, make([]byte, 0), strip}
+	writer.writeHeader()                            // 写入头部
+	writer.writeByte(byte(len(prototype.Upvalues))) // 写入upvalue数量
+	writer.writeProto(&prototype, "")
 	return writer.data
 }
 
 func IsBinaryChunk(data []byte) bool {
 	return len(data) > 4 && string(data[:4]) == LUA_SIGNATURE
 }
+
+const LUA_IDSIZE = 60 // 源文件描述的最大长度(包括C字符串结尾的'\0')
+
+// 把chunk名字(Prototype.Source)转换成适合在错误信息中显示的形式
+// "=name"原样显示，"@file"显示文件名，其他情况显示为[string "..."]
+// lua-5.3.4/src/lobject.c#luaO_chunkid()
+func ChunkID(source string) string {
+	if strings.HasPrefix(source, "=") { /* 'literal' source */
+		if len(source) <= LUA_IDSIZE { /* small enough? */
+			return source[1:]
+		}
+		return source[1:LUA_IDSIZE] /* truncate it */
+	} else if strings.HasPrefix(source, "@") { /* file name */
+		if len(source) <= LUA_IDSIZE { /* small enough? */
+			return source[1:]
+		}
+		/* add '...' before rest of name */
+		return "..." + source[len(source)-(LUA_IDSIZE-len("...")-1):]
+	} else { /* string; format as [string "source"] */
+		const pre, rets, pos = `[string "`, "...", `"]`
+		bufflen := LUA_IDSIZE - len(pre+rets+pos) - 1 /* save space for prefix+suffix+'\0' */
+		nl := strings.IndexByte(source, '\n')         /* find first new line (if any) */
+		if len(source) < bufflen && nl < 0 {          /* small one-line source? */
+			return pre + source + pos
+		}
+		if nl >= 0 {
+			source = source[:nl] /* stop at first newline */
+		}
+		if len(source) > bufflen {
+			source = source[:bufflen]
+		}
+		return pre + source + rets + pos
+	}
+}
@@ -6,119 +6,214 @@ import (
 )
 
 // 完成二进制chunk解析工作
+// 除了本机的格式，也能读取其他平台上的luac生成的chunk(大端序、4字节的size_t和int、32位整数和浮点数)
+// lua-5.3.4/src/lundump.c
 type reader struct {
-	data []byte
+	data        []byte
+	order       binary.ByteOrder // 字节序
+	cintSize    byte             // int大小
+	sizetSize   byte             // size_t大小
+	integerSize byte             // lua 整数大小
+	numberSize  byte             // lua 浮点数大小
+	dialect     byte             // 语言方言(由头部的格式号决定)
+}
+
+// 解析失败时抛出，Undump把它转换成error返回
+type undumpError struct {
+	why string
+}
+
+func (self *undumpError) Error() string {
+	return self.why + " precompiled chunk"
+}
+
+func (self *reader) error(why string) {
+	panic(&undumpError{why})
 }
 
 // 检查头部
+// lua-5.3.4/src/lundump.c#checkHeader()
 func (self *reader) checkHeader() {
 	if string(self.readBytes(4)) != LUA_SIGNATURE {
-		panic("not a precompiled chunk!")
-	} else if self.readByte() != LUAC_VERSION {
-		panic("version mismatch!")
-	} else if self.readByte() != LUAC_FORMAT {
-		panic("format mismatch!")
-	} else if string(self.readBytes(6)) != LUAC_DATA {
-		panic("corrupted!")
-	} else if self.readByte() != CINT_SIZE {
-		panic("int size mismatch!")
-	} else if self.readByte() != CSIZET_SIZE {
-		panic("size_t size mismatch!")
-	} else if self.readByte() != INSTRUCTION_SIZE {
-		panic("instruction size mismatch!")
-	} else if self.readByte() != LUA_INTEGER_SIZE {
-		panic("lua_Integer size mismatch!")
-	} else if self.readByte() != LUA_NUMBER_SIZE {
-		panic("lua_Number size mismatch!")
-	} else if self.readLuaInteger() != LUAC_INT {
-		panic("endianness mismatch!")
-	} else if self.readLuaNumber() != LUAC_NUM {
-		panic("float format mismatch!")
+		self.error("not a")
+	}
+	if self.readByte() != LUAC_VERSION {
+		self.error("version mismatch in")
+	}
+	switch self.readByte() {
+	case LUAC_FORMAT:
+		self.dialect = LUA_DIALECT_53
+	case LUAC_FORMAT_EXT:
+		self.dialect = LUA_DIALECT_54
+	default:
+		self.error("format mismatch in")
+	}
+	if string(self.readBytes(6)) != LUAC_DATA {
+		self.error("corrupted")
+	}
+	self.cintSize = self.checkSize("int", 4, 8)
+	self.sizetSize = self.checkSize("size_t", 4, 8)
+	self.checkSize("Instruction", INSTRUCTION_SIZE, INSTRUCTION_SIZE)
+	self.integerSize = self.checkSize("lua_Integer", 4, 8)
+	self.numberSize = self.checkSize("lua_Number", 4, 8)
+
+	// 用LUAC_INT判断字节序
+	b := self.readBytes(uint64(self.integerSize))
+	switch int64(LUAC_INT) {
+	case self.decodeInteger(b, binary.LittleEndian):
+		self.order = binary.LittleEndian
+	case self.decodeInteger(b, binary.BigEndian):
+		self.order = binary.BigEndian
+	default:
+		self.error("endianness mismatch in")
+	}
+	if self.readLuaNumber() != LUAC_NUM {
+		self.error("float format mismatch in")
 	}
 }
 
+// 读取并检查类型大小，只接受[min, max]之间的2的幂
+func (self *reader) checkSize(tname string, min, max byte) byte {
+	size := self.readByte()
+	if size < min || size > max || size&(size-1) != 0 {
+		self.error(tname + " size mismatch in")
+	}
+	return size
+}
+
 // 读取函数原型
+// lua-5.3.4/src/lundump.c#LoadFunction()
 func (self *reader) readProto(parentSource string) *Prototype {
-	source := self.readString()
-	if source == "" {
+	source, ok := self.readStringX()
+	if !ok {
 		source = parentSource
 	}
-	return &Prototype{
+	proto := &Prototype{
 		Source:          source,
-		LineDefined:     self.readUint32(),
-		LastLineDefined: self.readUint32(),
+		LineDefined:     self.readCInt(),
+		LastLineDefined: self.readCInt(),
 		NumParams:       self.readByte(),
 		IsVararg:        self.readByte(),
 		MaxStackSize:    self.readByte(),
 		Code:            self.readCode(),
 		Constants:       self.readConstants(),
 		Upvalues:        self.readUpvalues(),
-		Protos:          self.readProtos(source),
-		LineInfo:        self.readLineInfo(),
-		LocVars:         self.readLocVars(),
+		Dialect:         self.dialect,
 	}
+	proto.Protos = self.readProtos(source)
+	proto.LineInfo = self.readLineInfo()
+	proto.LocVars = self.readLocVars()
+	proto.UpvalueNames = self.readUpvalueNames()
+	if n := len(proto.UpvalueNames); n > 0 { // 去掉调试信息的chunk没有Upvalue名
+		if n > len(proto.Upvalues) {
+			self.error("corrupted")
+		}
+		for i, name := range proto.UpvalueNames {
+			proto.Upvalues[i].Name = name
+		}
+	}
+	return proto
 }
 
 // 读取基本数据类型
-// 读取基本数据类型的方法一共有七种，其他方法通过调用这7种方法来从二进制chunk里提取数据
+// 所有读取操作都会先检查剩余的数据是否足够，不够时报告chunk被截断
 
 // 读取一个字节
 func (self *reader) readByte() byte {
-	b := self.data[0]
-	self.data = self.data[1:]
-	return b
+	return self.readBytes(1)[0]
 }
 
 // 读取n个字节
-func (self *reader) readBytes(n uint) []byte {
+func (self *reader) readBytes(n uint64) []byte {
+	if n > uint64(len(self.data)) {
+		self.error("truncated")
+	}
 	bytes := self.data[:n]
 	self.data = self.data[n:]
 	return bytes
 }
 
-// 用小端的方式从字节流读取一个cint存储类型(在go中对应uint32)
-func (self *reader) readUint32() uint32 {
-	i := binary.LittleEndian.Uint32(self.data)
-	self.data = self.data[4:]
-	return i
+// 读取一个无符号整数，大小由size决定
+func (self *reader) readUint(size byte) uint64 {
+	b := self.readBytes(uint64(size))
+	if size == 4 {
+		return uint64(self.order.Uint32(b))
+	}
+	return self.order.Uint64(b)
+}
+
+// 读取一个cint存储类型(在go中对应uint32)
+func (self *reader) readCInt() uint32 {
+	n := self.readUint(self.cintSize)
+	if n > math.MaxUint32 {
+		self.error("corrupted")
+	}
+	return uint32(n)
+}
+
+// 读取一个size_t存储类型
+func (self *reader) readSizeT() uint64 {
+	return self.readUint(self.sizetSize)
 }
 
-// 用小端的方式从字节流读取一个size_t存储类型(在go中对应uint64)
-func (self *reader) readUint64() uint64 {
-	i := binary.LittleEndian.Uint64(self.data)
-	self.data = self.data[8:]
-	return i
+// 读取表的长度，每个元素至少占用minSize个字节，长度不可能超过剩余的数据
+func (self *reader) readCount(minSize int) int {
+	n := uint64(self.readCInt())
+	if n*uint64(minSize) > uint64(len(self.data)) {
+		self.error("truncated")
+	}
+	return int(n)
+}
+
+// 按照指定的字节序解码Lua整数，4字节整数需要做符号扩展
+func (self *reader) decodeInteger(b []byte, order binary.ByteOrder) int64 {
+	if len(b) == 4 {
+		return int64(int32(order.Uint32(b)))
+	}
+	return int64(order.Uint64(b))
 }
 
 // 读取Lua整数
 func (self *reader) readLuaInteger() int64 {
-	return int64(self.readUint64())
+	return self.decodeInteger(self.readBytes(uint64(self.integerSize)), self.order)
 }
 
 // 读取Lua浮点数
 func (self *reader) readLuaNumber() float64 {
-	return math.Float64frombits(self.readUint64())
+	if self.numberSize == 4 {
+		return float64(math.Float32frombits(uint32(self.readUint(4))))
+	}
+	return math.Float64frombits(self.readUint(8))
 }
 
 // 读取Lua字符串
 func (self *reader) readString() string {
-	size := uint(self.readByte())
+	s, _ := self.readStringX()
+	return s
+}
+
+// 读取Lua字符串，第二个返回值为false表示NULL字符串
+// lua-5.3.4/src/lundump.c#LoadString()
+func (self *reader) readStringX() (string, bool) {
+	size := uint64(self.readByte())
 	if size == 0 {
-		return ""
+		return "", false
 	}
 	if size == 0xFF {
-		size = uint(self.readUint64())
+		size = self.readSizeT()
+		if size == 0 {
+			self.error("corrupted")
+		}
 	}
 	bytes := self.readBytes(size - 1)
-	return string(bytes)
+	return string(bytes), true
 }
 
 // 读取指令表
 func (self *reader) readCode() []uint32 {
-	size := self.readUint32()
-	code := make([]uint32, size)
+	code := make([]uint32, self.readCount(INSTRUCTION_SIZE))
 	for i := range code {
-		code[i] = self.readUint32()
+		code[i] = uint32(self.readUint(INSTRUCTION_SIZE))
 	}
 	return code
 }
@@ -139,27 +234,25 @@ func (self *reader) readConstant() interface{} {
 	case TAG_LONG_STR:
 		return self.readString()
 	default:
-		panic("corrupted!")
+		self.error("corrupted")
+		return nil
 	}
 }
 
 // 读取常量表
 func (self *reader) readConstants() []interface{} {
-	size := self.readUint32()
-	k := make([]interface{}, size)
+	k := make([]interface{}, self.readCount(1))
 	for i := range k {
 		k[i] = self.readConstant()
 	}
 	return k
 }
 
-// 读取Upvalue表
+// 读取Upvalue表，Upvalue名属于调试信息，在后面单独读取
 func (self *reader) readUpvalues() []Upvalue {
-	size := self.readUint32()
-	upvalues := make([]Upvalue, size)
+	upvalues := make([]Upvalue, self.readCount(2))
 	for i := range upvalues {
 		upvalues[i] = Upvalue{
-			Name:    self.readString(),
 			Instack: self.readByte(),
 			Idx:     self.readByte(),
 		}
@@ -169,8 +262,7 @@ func (self *reader) readUpvalues() []Upvalue {
 
 // 读取子函数原型表
 func (self *reader) readProtos(source string) []*Prototype {
-	size := self.readUint32()
-	p := make([]*Prototype, size)
+	p := make([]*Prototype, self.readCount(1))
 	for i := range p {
 		p[i] = self.readProto(source)
 	}
@@ -179,23 +271,21 @@ func (self *reader) readProtos(source string) []*Prototype {
 
 // 读取行号表
 func (self *reader) readLineInfo() []uint32 {
-	size := self.readUint32()
-	lineInfo := make([]uint32, size)
+	lineInfo := make([]uint32, self.readCount(int(self.cintSize)))
 	for i := range lineInfo {
-		lineInfo[i] = self.readUint32()
+		lineInfo[i] = self.readCInt()
 	}
 	return lineInfo
 }
 
 // 读取局部变量表
 func (self *reader) readLocVars() []LocVar {
-	size := self.readUint32()
-	locVars := make([]LocVar, size)
+	locVars := make([]LocVar, self.readCount(1))
 	for i := range locVars {
 		locVars[i] = LocVar{
 			VarName: self.readString(),
-			StartPC: self.readUint32(),
-			EndPC:   self.readUint32(),
+			StartPC: self.readCInt(),
+			EndPC:   self.readCInt(),
 		}
 	}
 	return locVars
@@ -203,8 +293,7 @@ func (self *reader) readLocVars() []LocVar {
 
 // 读取Upvalue名表
 func (self *reader) readUpvalueNames() []string {
-	size := self.readUint32()
-	upvalueNames := make([]string, size)
+	upvalueNames := make([]string, self.readCount(1))
 	for i := range upvalueNames {
 		upvalueNames[i] = self.readString()
 	}
@@ -8,12 +8,17 @@ import (
 type writer struct {
 	prototype Prototype
 	data      []byte
+	strip     bool // 是否去掉调试信息
 }
 
 func (self *writer) writeHeader() {
 	self.writeBytes([]byte(LUA_SIGNATURE))
 	self.writeByte(LUAC_VERSION)
-	self.writeByte(LUAC_FORMAT)
+	if self.prototype.Dialect == LUA_DIALECT_54 {
+		self.writeByte(LUAC_FORMAT_EXT)
+	} else {
+		self.writeByte(LUAC_FORMAT)
+	}
 	self.writeBytes([]byte(LUAC_DATA))
 	self.writeByte(CINT_SIZE)
 	self.writeByte(CSIZET_SIZE)
@@ -24,8 +29,14 @@ func (self *writer) writeHeader() {
 	self.writeLuaNumber(LUAC_NUM)
 }
 
-func (self *writer) writeProto(proto *Prototype) {
-	self.writeString(proto.Source)
+// 子函数的源文件名与父函数相同时不重复写入
+// lua-5.3.4/src/ldump.c#DumpFunction()
+func (self *writer) writeProto(proto *Prototype, parentSource string) {
+	if self.strip || proto.Source == parentSource {
+		self.writeByte(0) // NULL字符串
+	} else {
+		self.writeString(proto.Source)
+	}
 	self.writeUint32(proto.LineDefined)
 	self.writeUint32(proto.LastLineDefined)
 	self.writeByte(proto.NumParams)
@@ -34,9 +45,16 @@ func (self *writer) writeProto(proto *Prototype) {
 	self.writeCode(proto.Code)
 	self.writeConstants(proto.Constants)
 	self.writeUpvalues(proto.Upvalues)
-	self.writeProtos(proto.Protos)
-	self.writeLineInfo(proto.LineInfo)
-	self.writeLocVars(proto.LocVars)
+	self.writeProtos(proto.Protos, proto.Source)
+	if self.strip {
+		self.writeUint32(0) // 行号表
+		self.writeUint32(0) // 局部变量表
+		self.writeUint32(0) // Upvalue名表
+	} else {
+		self.writeLineInfo(proto.LineInfo)
+		self.writeLocVars(proto.LocVars)
+		self.writeUpvalueNames(proto.Upvalues)
+	}
 }
 
 func (self *writer) writeByte(b byte) {
@@ -67,8 +85,16 @@ func (self *writer) writeLuaNumber(n float64) {
 	self.writeUint64(math.Float64bits(n))
 }
 
+// 长度小于0xFF的字符串用一个字节记录长度+1，否则先写0xFF再写size_t长度
+// lua-5.3.4/src/ldump.c#DumpString()
 func (self *writer) writeString(s string) {
-	self.writeByte(byte(len(s) + 1))
+	size := len(s) + 1
+	if size < 0xFF {
+		self.writeByte(byte(size))
+	} else {
+		self.writeByte(0xFF)
+		self.writeUint64(uint64(size))
+	}
 	self.writeBytes([]byte(s))
 }
 
@@ -99,7 +125,11 @@ func (self *writer) writeConstants(constants []interface{}) {
 			self.writeByte(TAG_NUMBER)
 			self.writeLuaNumber(c.(float64))
 		case string:
-			self.writeByte(TAG_LONG_STR)
+			if len(c.(string)) <= LUAI_MAXSHORTLEN {
+				self.writeByte(TAG_SHORT_STR)
+			} else {
+				self.writeByte(TAG_LONG_STR)
+			}
 			self.writeString(c.(string))
 		}
 	}
@@ -108,16 +138,15 @@ func (self *writer) writeConstants(constants []interface{}) {
 func (self *writer) writeUpvalues(upvalues []Upvalue) {
 	self.writeUint32(uint32(len(upvalues)))
 	for _, u := range upvalues {
-		self.writeString(u.Name)
 		self.writeByte(u.Instack)
 		self.writeByte(u.Idx)
 	}
 }
 
-func (self *writer) writeProtos(protos []*Prototype) {
+func (self *writer) writeProtos(protos []*Prototype, source string) {
 	self.writeUint32(uint32(len(protos)))
 	for _, p := range protos {
-		self.writeProto(p)
+		self.writeProto(p, source)
 	}
 }
 
@@ -137,10 +166,16 @@ func (self *writer) writeLocVars(locVars []LocVar) {
 	}
 }
 
-// 暂时废弃
-func (self *writer) writeUpvalueNames(upvalueNames []string) {
-	self.writeUint32(uint32(len(upvalueNames)))
-	for _, name := range upvalueNames {
-		self.writeString(name)
+// Upvalue名写在调试信息里，全部没有名字(比如读取自去掉调试信息的chunk)时不写
+func (self *writer) writeUpvalueNames(upvalues []Upvalue) {
+	for _, u := range upvalues {
+		if u.Name != "" {
+			self.writeUint32(uint32(len(upvalues)))
+			for _, u := range upvalues {
+				self.writeString(u.Name)
+			}
+			return
+		}
 	}
+	self.writeUint32(0)
 }
@@ -1,6 +1,8 @@
 package ast
 
-type Exp interface{}
+type Exp interface {
+	Node
+}
 
 // 简单表达式
 type NilExp struct{ Line int }    // nil
@@ -65,7 +67,9 @@ type FuncDefExp struct { // 函数定义表达式
 // prefixexp ::= Name | '(' exp ')' | prefixexp '[' exp ']' | prefixexp '.' Name | prefixexp [':' Name] args
 
 type ParensExp struct { // 圆括号表达式 用途：改变运算符的优先级或者结合性
-	Exp Exp
+	Line     int // `(`所在行号
+	LastLine int // `)`所在行号
+	Exp      Exp
 }
 
 type TableAccessExp struct { // 表访问表达式
@@ -0,0 +1,395 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	. "lua/src/compiler/lexer"
+	"math"
+	"reflect"
+	"unicode/utf8"
+)
+
+// 语法树的JSON格式，供Go以外的工具使用
+//
+// 文档的格式是{"version": JSONVersion, "chunk": 源代码名字, "block": 代码块}。
+// 每个节点是一个对象，"type"是节点的类型名(如"BinopExp")，其余的键由nodeFields列出(如"lastLine")。
+// 运算符用名字表示(如"add"、"unm"、"bnot")，不是lexer里token常量的值；
+// 不是合法UTF-8的字符串用"strBase64"代替"str"；inf和nan浮点数用字符串"inf"、"-inf"、"nan"表示。
+// 格式发生不兼容的变化时JSONVersion加1
+const JSONVersion = 1
+
+// 所有节点类型，新增节点类型时必须加到这里
+var nodeTypes = map[string]reflect.Type{}
+
+// 节点在JSON中的一个字段：JSON的键和对应的Go结构体字段名
+type nodeField struct {
+	key   string
+	field string
+}
+
+// 每种节点在JSON中的字段，按输出的顺序排列。JSON格式是给外部工具用的，
+// 键名固定在这里，不会因为重命名Go结构体的字段而改变；新增节点类型或字段时必须加到这里，
+// init()检查这张表和Go结构体的字段一一对应
+var nodeFields = map[string][]nodeField{
+	"Block":               {{"lastLine", "LastLine"}, {"stats", "Stats"}, {"retExps", "RetExps"}},
+	"NilExp":              {{"line", "Line"}},
+	"TrueExp":             {{"line", "Line"}},
+	"FalseExp":            {{"line", "Line"}},
+	"VarargExp":           {{"line", "Line"}},
+	"IntegerExp":          {{"line", "Line"}, {"val", "Val"}},
+	"FloatExp":            {{"line", "Line"}, {"val", "Val"}},
+	"StringExp":           {{"line", "Line"}, {"str", "Str"}},
+	"NameExp":             {{"line", "Line"}, {"name", "Name"}},
+	"UnopExp":             {{"line", "Line"}, {"op", "Op"}, {"exp", "Exp"}},
+	"BinopExp":            {{"line", "Line"}, {"op", "Op"}, {"exp1", "Exp1"}, {"exp2", "Exp2"}},
+	"ConcatExp":           {{"line", "Line"}, {"exps", "Exps"}},
+	"TableConstructorExp": {{"line", "Line"}, {"lastLine", "LastLine"}, {"keyExps", "KeyExps"}, {"valExps", "ValExps"}},
+	"FuncDefExp":          {{"line", "Line"}, {"lastLine", "LastLine"}, {"parList", "ParList"}, {"isVararg", "IsVararg"}, {"block", "Block"}},
+	"ParensExp":           {{"line", "Line"}, {"lastLine", "LastLine"}, {"exp", "Exp"}},
+	"TableAccessExp":      {{"lastLine", "LastLine"}, {"prefixExp", "PrefixExp"}, {"keyExp", "KeyExp"}},
+	"FuncCallExp":         {{"line", "Line"}, {"lastLine", "LastLine"}, {"prefixExp", "PrefixExp"}, {"nameExp", "NameExp"}, {"args", "Args"}},
+	"EmptyStat":           {{"line", "Line"}},
+	"BreakStat":           {{"line", "Line"}},
+	"LabelStat":           {{"line", "Line"}, {"name", "Name"}},
+	"GotoStat":            {{"line", "Line"}, {"name", "Name"}},
+	"DoStat":              {{"line", "Line"}, {"lastLine", "LastLine"}, {"block", "Block"}},
+	"WhileStat":           {{"line", "Line"}, {"lastLine", "LastLine"}, {"exp", "Exp"}, {"block", "Block"}},
+	"RepeatStat":          {{"line", "Line"}, {"block", "Block"}, {"exp", "Exp"}},
+	"IfStat":              {{"line", "Line"}, {"lastLine", "LastLine"}, {"exps", "Exps"}, {"blocks", "Blocks"}},
+	"ForNumStat":          {{"lineOfFor", "LineOfFor"}, {"lineOfDo", "LineOfDo"}, {"varName", "VarName"}, {"initExp", "InitExp"}, {"limitExp", "LimitExp"}, {"stepExp", "StepExp"}, {"block", "Block"}, {"lastLine", "LastLine"}},
+	"ForInStat":           {{"lineOfFor", "LineOfFor"}, {"lineOfDo", "LineOfDo"}, {"nameList", "NameList"}, {"expList", "ExpList"}, {"block", "Block"}, {"lastLine", "LastLine"}},
+	"LocalVarDeclStat":    {{"line", "Line"}, {"lastLine", "LastLine"}, {"nameList", "NameList"}, {"expList", "ExpList"}, {"attribList", "AttribList"}},
+	"AssignStat":          {{"lastLine", "LastLine"}, {"varList", "VarList"}, {"expList", "ExpList"}},
+	"LocalFuncDefStat":    {{"line", "Line"}, {"name", "Name"}, {"exp", "Exp"}},
+}
+
+func init() {
+	for _, node := range []Node{
+		&Block{},
+		&NilExp{}, &TrueExp{}, &FalseExp{}, &VarargExp{},
+		&IntegerExp{}, &FloatExp{}, &StringExp{}, &NameExp{},
+		&UnopExp{}, &BinopExp{}, &ConcatExp{},
+		&TableConstructorExp{}, &FuncDefExp{},
+		&ParensExp{}, &TableAccessExp{}, &FuncCallExp{},
+		&EmptyStat{}, &BreakStat{}, &LabelStat{}, &GotoStat{},
+		&DoStat{}, &WhileStat{}, &RepeatStat{}, &IfStat{},
+		&ForNumStat{}, &ForInStat{},
+		&LocalVarDeclStat{}, &AssignStat{}, &LocalFuncDefStat{},
+	} {
+		t := reflect.TypeOf(node).Elem()
+		nodeTypes[t.Name()] = t
+		fields := nodeFields[t.Name()]
+		if len(fields) != t.NumField() {
+			panic(fmt.Sprintf("ast: JSON fields of %s do not match the struct", t.Name()))
+		}
+		for _, f := range fields {
+			if _, ok := t.FieldByName(f.field); !ok {
+				panic(fmt.Sprintf("ast: %s has no field %s", t.Name(), f.field))
+			}
+		}
+	}
+}
+
+// 可以出现在语句位置的节点类型，函数调用既是表达式也是语句
+var statTypes = map[string]bool{
+	"EmptyStat": true, "BreakStat": true, "LabelStat": true, "GotoStat": true,
+	"DoStat": true, "WhileStat": true, "RepeatStat": true, "IfStat": true,
+	"ForNumStat": true, "ForInStat": true,
+	"LocalVarDeclStat": true, "AssignStat": true, "LocalFuncDefStat": true,
+	"FuncCallExp": true,
+}
+
+var statType = reflect.TypeOf((*Stat)(nil)).Elem()
+var expType = reflect.TypeOf((*Exp)(nil)).Elem()
+
+// 运算符的名字
+var unopNames = map[int]string{
+	TOKEN_OP_UNM:  "unm",
+	TOKEN_OP_NOT:  "not",
+	TOKEN_OP_LEN:  "len",
+	TOKEN_OP_BNOT: "bnot",
+}
+
+var binopNames = map[int]string{
+	TOKEN_OP_ADD:    "add",
+	TOKEN_OP_SUB:    "sub",
+	TOKEN_OP_MUL:    "mul",
+	TOKEN_OP_DIV:    "div",
+	TOKEN_OP_IDIV:   "idiv",
+	TOKEN_OP_POW:    "pow",
+	TOKEN_OP_MOD:    "mod",
+	TOKEN_OP_BAND:   "band",
+	TOKEN_OP_BOR:    "bor",
+	TOKEN_OP_BXOR:   "bxor",
+	TOKEN_OP_SHL:    "shl",
+	TOKEN_OP_SHR:    "shr",
+	TOKEN_OP_CONCAT: "concat",
+	TOKEN_OP_LT:     "lt",
+	TOKEN_OP_LE:     "le",
+	TOKEN_OP_GT:     "gt",
+	TOKEN_OP_GE:     "ge",
+	TOKEN_OP_EQ:     "eq",
+	TOKEN_OP_NE:     "ne",
+	TOKEN_OP_AND:    "and",
+	TOKEN_OP_OR:     "or",
+}
+
+// 按照顺序输出键值对的JSON对象
+type jsonObject []jsonField
+
+type jsonField struct {
+	key   string
+	value interface{}
+}
+
+func (self jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range self {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// 把代码块编码成JSON文档
+func EncodeJSON(chunkName string, block *Block) ([]byte, error) {
+	return json.Marshal(jsonObject{
+		{"version", JSONVersion},
+		{"chunk", chunkName},
+		{"block", encodeNode(reflect.ValueOf(block))},
+	})
+}
+
+func encodeNode(v reflect.Value) interface{} {
+	if v.IsNil() {
+		return nil
+	}
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	v = v.Elem()
+	t := v.Type()
+	if _, ok := nodeTypes[t.Name()]; !ok {
+		panic(fmt.Sprintf("ast.EncodeJSON: unexpected node type %s", t))
+	}
+	obj := jsonObject{{"type", t.Name()}}
+	for _, f := range nodeFields[t.Name()] {
+		key, value := f.key, v.FieldByName(f.field)
+		switch {
+		case t.Name() == "UnopExp" && key == "op":
+			obj = append(obj, jsonField{key, unopNames[int(value.Int())]})
+		case t.Name() == "BinopExp" && key == "op":
+			obj = append(obj, jsonField{key, binopNames[int(value.Int())]})
+		case t.Name() == "FloatExp" && key == "val":
+			obj = append(obj, jsonField{key, encodeFloat(value.Float())})
+		case t.Name() == "StringExp" && key == "str" && !utf8.ValidString(value.String()):
+			obj = append(obj, jsonField{"strBase64", base64.StdEncoding.EncodeToString([]byte(value.String()))})
+		default:
+			obj = append(obj, jsonField{key, encodeValue(value)})
+		}
+	}
+	return obj
+}
+
+func encodeValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return encodeNode(v)
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.String {
+			return v.Interface()
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = encodeNode(v.Index(i))
+		}
+		return list
+	default:
+		return v.Interface()
+	}
+}
+
+func encodeFloat(f float64) interface{} {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return f
+}
+
+// 把EncodeJSON生成的JSON文档解码成代码块
+func DecodeJSON(data []byte) (chunkName string, block *Block, err error) {
+	var doc struct {
+		Version int
+		Chunk   string
+		Block   json.RawMessage
+	}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return
+	}
+	if doc.Version != JSONVersion {
+		return "", nil, fmt.Errorf("unsupported AST JSON version %d", doc.Version)
+	}
+	var raw interface{}
+	dec := json.NewDecoder(bytes.NewReader(doc.Block))
+	dec.UseNumber() // 保持整数的精度
+	if err = dec.Decode(&raw); err != nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(jsonError); ok {
+				err = e
+				return
+			}
+			panic(r)
+		}
+	}()
+	block, _ = decodeNode(raw, reflect.TypeOf(block)).Interface().(*Block)
+	if block == nil {
+		return "", nil, jsonError("missing block")
+	}
+	return doc.Chunk, block, nil
+}
+
+type jsonError string
+
+func (self jsonError) Error() string {
+	return "bad AST JSON: " + string(self)
+}
+
+// 解码一个节点，t是节点要放入的位置的类型(节点指针或者Exp、Stat接口)
+func decodeNode(raw interface{}, t reflect.Type) reflect.Value {
+	if raw == nil {
+		return reflect.Zero(t)
+	}
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		panic(jsonError("node is not an object"))
+	}
+	name, _ := obj["type"].(string)
+	nt, ok := nodeTypes[name]
+	if !ok {
+		panic(jsonError(fmt.Sprintf("unknown node type %q", name)))
+	}
+	ptr := reflect.New(nt)
+	// Exp和Stat是相同的接口，需要按类型名区分
+	misplaced := t == statType && !statTypes[name] ||
+		t == expType && (name == "Block" || statTypes[name] && name != "FuncCallExp")
+	if misplaced || !ptr.Type().AssignableTo(t) {
+		panic(jsonError(fmt.Sprintf("unexpected %s", name)))
+	}
+	v := ptr.Elem()
+	for _, f := range nodeFields[name] {
+		key, field := f.key, v.FieldByName(f.field)
+		value := obj[key]
+		switch {
+		case name == "UnopExp" && key == "op":
+			field.SetInt(int64(decodeOp(value, unopNames)))
+		case name == "BinopExp" && key == "op":
+			field.SetInt(int64(decodeOp(value, binopNames)))
+		case name == "StringExp" && key == "str" && obj["strBase64"] != nil:
+			s, _ := obj["strBase64"].(string)
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				panic(jsonError("bad strBase64"))
+			}
+			field.SetString(string(b))
+		default:
+			decodeValue(value, field)
+		}
+	}
+	return ptr
+}
+
+func decodeOp(raw interface{}, names map[int]string) int {
+	for op, name := range names {
+		if name == raw {
+			return op
+		}
+	}
+	panic(jsonError(fmt.Sprintf("unknown operator %v", raw)))
+}
+
+func decodeValue(raw interface{}, field reflect.Value) {
+	if raw == nil {
+		return
+	}
+	switch field.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		field.Set(decodeNode(raw, field.Type()))
+	case reflect.Slice:
+		list, ok := raw.([]interface{})
+		if !ok {
+			panic(jsonError("expected a list"))
+		}
+		s := reflect.MakeSlice(field.Type(), len(list), len(list))
+		for i, item := range list {
+			if field.Type().Elem().Kind() == reflect.String {
+				str, _ := item.(string)
+				s.Index(i).SetString(str)
+			} else {
+				s.Index(i).Set(decodeNode(item, field.Type().Elem()))
+			}
+		}
+		field.Set(s)
+	case reflect.String:
+		str, _ := raw.(string)
+		field.SetString(str)
+	case reflect.Bool:
+		b, _ := raw.(bool)
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, ok := raw.(json.Number)
+		if !ok {
+			panic(jsonError("expected an integer"))
+		}
+		i, err := n.Int64()
+		if err != nil {
+			panic(jsonError(fmt.Sprintf("bad integer %s", n)))
+		}
+		field.SetInt(i)
+	case reflect.Float64:
+		field.SetFloat(decodeFloat(raw))
+	}
+}
+
+func decodeFloat(raw interface{}) float64 {
+	switch raw {
+	case "inf":
+		return math.Inf(1)
+	case "-inf":
+		return math.Inf(-1)
+	case "nan":
+		return math.NaN()
+	}
+	n, ok := raw.(json.Number)
+	if !ok {
+		panic(jsonError("expected a number"))
+	}
+	f, err := n.Float64()
+	if err != nil {
+		panic(jsonError(fmt.Sprintf("bad number %s", n)))
+	}
+	return f
+}
@@ -0,0 +1,113 @@
+package ast
+
+// 语法树节点，所有表达式和语句都实现这个接口
+type Node interface {
+	Pos() (line, lastLine int) // 节点的起始行号和末尾行号
+}
+
+func startLine(node Node) int {
+	line, _ := node.Pos()
+	return line
+}
+
+func endLine(node Node) int {
+	_, lastLine := node.Pos()
+	return lastLine
+}
+
+// 代码块从第一条语句开始，空的代码块只有末尾行号
+func (self *Block) Pos() (int, int) {
+	if len(self.Stats) > 0 {
+		return startLine(self.Stats[0]), self.LastLine
+	}
+	if len(self.RetExps) > 0 {
+		return startLine(self.RetExps[0]), self.LastLine
+	}
+	return self.LastLine, self.LastLine
+}
+
+// 表达式
+
+func (self *NilExp) Pos() (int, int)     { return self.Line, self.Line }
+func (self *TrueExp) Pos() (int, int)    { return self.Line, self.Line }
+func (self *FalseExp) Pos() (int, int)   { return self.Line, self.Line }
+func (self *VarargExp) Pos() (int, int)  { return self.Line, self.Line }
+func (self *IntegerExp) Pos() (int, int) { return self.Line, self.Line }
+func (self *FloatExp) Pos() (int, int)   { return self.Line, self.Line }
+func (self *StringExp) Pos() (int, int)  { return self.Line, self.Line }
+func (self *NameExp) Pos() (int, int)    { return self.Line, self.Line }
+
+func (self *UnopExp) Pos() (int, int) {
+	return self.Line, endLine(self.Exp)
+}
+
+func (self *BinopExp) Pos() (int, int) {
+	return startLine(self.Exp1), endLine(self.Exp2)
+}
+
+func (self *ConcatExp) Pos() (int, int) {
+	return startLine(self.Exps[0]), endLine(self.Exps[len(self.Exps)-1])
+}
+
+func (self *TableConstructorExp) Pos() (int, int) {
+	return self.Line, self.LastLine
+}
+
+func (self *FuncDefExp) Pos() (int, int) {
+	return self.Line, self.LastLine
+}
+
+func (self *ParensExp) Pos() (int, int) {
+	return self.Line, self.LastLine
+}
+
+func (self *TableAccessExp) Pos() (int, int) {
+	return startLine(self.PrefixExp), self.LastLine
+}
+
+func (self *FuncCallExp) Pos() (int, int) {
+	return startLine(self.PrefixExp), self.LastLine
+}
+
+// 语句
+
+func (self *EmptyStat) Pos() (int, int) { return self.Line, self.Line }
+func (self *BreakStat) Pos() (int, int) { return self.Line, self.Line }
+func (self *LabelStat) Pos() (int, int) { return self.Line, self.Line }
+func (self *GotoStat) Pos() (int, int)  { return self.Line, self.Line }
+
+func (self *DoStat) Pos() (int, int) {
+	return self.Line, self.LastLine
+}
+
+func (self *WhileStat) Pos() (int, int) {
+	return self.Line, self.LastLine
+}
+
+func (self *RepeatStat) Pos() (int, int) {
+	return self.Line, endLine(self.Exp)
+}
+
+func (self *IfStat) Pos() (int, int) {
+	return self.Line, self.LastLine
+}
+
+func (self *ForNumStat) Pos() (int, int) {
+	return self.LineOfFor, self.LastLine
+}
+
+func (self *ForInStat) Pos() (int, int) {
+	return self.LineOfFor, self.LastLine
+}
+
+func (self *LocalVarDeclStat) Pos() (int, int) {
+	return self.Line, self.LastLine
+}
+
+func (self *AssignStat) Pos() (int, int) {
+	return startLine(self.VarList[0]), self.LastLine
+}
+
+func (self *LocalFuncDefStat) Pos() (int, int) {
+	return self.Line, self.Exp.LastLine
+}
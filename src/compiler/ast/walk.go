@@ -0,0 +1,195 @@
+package ast
+
+import "fmt"
+
+// 遍历语法树，用法和go/ast一样：
+// Walk先调用v.Visit(node)，返回的w不为nil时用w按源代码顺序遍历node的每个子节点，最后调用w.Visit(nil)
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	for _, child := range children(node) {
+		Walk(v, child)
+	}
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// 按深度优先的顺序对每个节点调用f，f返回false时不再访问这个节点的子节点
+// 每个节点的子节点都访问完之后还会调用f(nil)
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
+
+// 按源代码顺序返回节点的直接子节点，没有的可选子节点(比如数组元素的键)不包括在内
+func children(node Node) []Node {
+	var nodes []Node
+	addExps := func(exps []Exp) {
+		for _, exp := range exps {
+			if exp != nil {
+				nodes = append(nodes, exp)
+			}
+		}
+	}
+
+	switch n := node.(type) {
+	case *Block:
+		for _, stat := range n.Stats {
+			nodes = append(nodes, stat)
+		}
+		addExps(n.RetExps)
+	case *NilExp, *TrueExp, *FalseExp, *VarargExp,
+		*IntegerExp, *FloatExp, *StringExp, *NameExp:
+	case *UnopExp:
+		nodes = append(nodes, n.Exp)
+	case *BinopExp:
+		nodes = append(nodes, n.Exp1, n.Exp2)
+	case *ConcatExp:
+		addExps(n.Exps)
+	case *TableConstructorExp:
+		for i, valExp := range n.ValExps {
+			addExps([]Exp{n.KeyExps[i], valExp})
+		}
+	case *FuncDefExp:
+		nodes = append(nodes, n.Block)
+	case *ParensExp:
+		nodes = append(nodes, n.Exp)
+	case *TableAccessExp:
+		nodes = append(nodes, n.PrefixExp, n.KeyExp)
+	case *FuncCallExp:
+		nodes = append(nodes, n.PrefixExp)
+		if n.NameExp != nil {
+			nodes = append(nodes, n.NameExp)
+		}
+		addExps(n.Args)
+	case *EmptyStat, *BreakStat, *LabelStat, *GotoStat:
+	case *DoStat:
+		nodes = append(nodes, n.Block)
+	case *WhileStat:
+		nodes = append(nodes, n.Exp, n.Block)
+	case *RepeatStat:
+		nodes = append(nodes, n.Block, n.Exp)
+	case *IfStat:
+		for i, exp := range n.Exps {
+			nodes = append(nodes, exp, n.Blocks[i])
+		}
+	case *ForNumStat:
+		nodes = append(nodes, n.InitExp, n.LimitExp, n.StepExp, n.Block)
+	case *ForInStat:
+		addExps(n.ExpList)
+		nodes = append(nodes, n.Block)
+	case *LocalVarDeclStat:
+		addExps(n.ExpList)
+	case *AssignStat:
+		addExps(n.VarList)
+		addExps(n.ExpList)
+	case *LocalFuncDefStat:
+		nodes = append(nodes, n.Exp)
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+	return nodes
+}
+
+// 自底向上改写语法树：先改写node的子节点，再用f(node)的返回值替换node
+// f返回的节点必须能放回原来的位置，比如代码块只能换成代码块；
+// 代码块里的语句可以换成nil，表示删除这条语句
+func Rewrite(node Node, f func(Node) Node) Node {
+	exp := func(e Exp) Exp {
+		if e == nil {
+			return nil
+		}
+		return Rewrite(e, f)
+	}
+	exps := func(list []Exp) {
+		for i, e := range list {
+			list[i] = exp(e)
+		}
+	}
+	block := func(b *Block) *Block {
+		return Rewrite(b, f).(*Block)
+	}
+
+	switch n := node.(type) {
+	case *Block:
+		stats := n.Stats[:0]
+		for _, stat := range n.Stats {
+			if stat = Rewrite(stat, f); stat != nil {
+				stats = append(stats, stat)
+			}
+		}
+		n.Stats = stats
+		exps(n.RetExps)
+	case *NilExp, *TrueExp, *FalseExp, *VarargExp,
+		*IntegerExp, *FloatExp, *StringExp, *NameExp:
+	case *UnopExp:
+		n.Exp = exp(n.Exp)
+	case *BinopExp:
+		n.Exp1 = exp(n.Exp1)
+		n.Exp2 = exp(n.Exp2)
+	case *ConcatExp:
+		exps(n.Exps)
+	case *TableConstructorExp:
+		for i := range n.ValExps {
+			n.KeyExps[i] = exp(n.KeyExps[i])
+			n.ValExps[i] = exp(n.ValExps[i])
+		}
+	case *FuncDefExp:
+		n.Block = block(n.Block)
+	case *ParensExp:
+		n.Exp = exp(n.Exp)
+	case *TableAccessExp:
+		n.PrefixExp = exp(n.PrefixExp)
+		n.KeyExp = exp(n.KeyExp)
+	case *FuncCallExp:
+		n.PrefixExp = exp(n.PrefixExp)
+		if n.NameExp != nil {
+			n.NameExp = Rewrite(n.NameExp, f).(*StringExp)
+		}
+		exps(n.Args)
+	case *EmptyStat, *BreakStat, *LabelStat, *GotoStat:
+	case *DoStat:
+		n.Block = block(n.Block)
+	case *WhileStat:
+		n.Exp = exp(n.Exp)
+		n.Block = block(n.Block)
+	case *RepeatStat:
+		n.Block = block(n.Block)
+		n.Exp = exp(n.Exp)
+	case *IfStat:
+		for i := range n.Exps {
+			n.Exps[i] = exp(n.Exps[i])
+			n.Blocks[i] = block(n.Blocks[i])
+		}
+	case *ForNumStat:
+		n.InitExp = exp(n.InitExp)
+		n.LimitExp = exp(n.LimitExp)
+		n.StepExp = exp(n.StepExp)
+		n.Block = block(n.Block)
+	case *ForInStat:
+		exps(n.ExpList)
+		n.Block = block(n.Block)
+	case *LocalVarDeclStat:
+		exps(n.ExpList)
+	case *AssignStat:
+		exps(n.VarList)
+		exps(n.ExpList)
+	case *LocalFuncDefStat:
+		n.Exp = Rewrite(n.Exp, f).(*FuncDefExp)
+	default:
+		panic(fmt.Sprintf("ast.Rewrite: unexpected node type %T", n))
+	}
+	return f(node)
+}
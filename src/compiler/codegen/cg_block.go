@@ -5,8 +5,19 @@ import (
 )
 
 func cgBlock(fi *funcInfo, node *Block) {
-	for _, stat := range node.Stats { // 遍历语句序列
-		cgStat(fi, stat) // 生成语句
+	cgBlockUntil(fi, node, false)
+}
+
+// 生成块，until为true时是repeat语句的循环体，后面的条件表达式仍然可以访问块中的局部变量
+// lua-5.3.4/src/lparser.c#statlist()
+func cgBlockUntil(fi *funcInfo, node *Block, until bool) {
+	nActVars := fi.usedRegs           // 进入块时活跃的局部变量占用的寄存器数量
+	for i, stat := range node.Stats { // 遍历语句序列
+		if label, ok := stat.(*LabelStat); ok && !until && node.RetExps == nil && onlyLabelsAfter(node.Stats[i+1:]) {
+			fi.addLabel(label.Name, label.Line, nActVars) // 块末尾的标签，可以认为局部变量已经离开作用域
+		} else {
+			cgStat(fi, stat) // 生成语句
+		}
 	}
 
 	if node.RetExps != nil { // 如果有返回值
@@ -14,9 +25,25 @@ func cgBlock(fi *funcInfo, node *Block) {
 	}
 }
 
+// 判断语句序列是否只有标签和空语句
+// lua-5.3.4/src/lparser.c#skipnoopstat()
+func onlyLabelsAfter(stats []Stat) bool {
+	for _, stat := range stats {
+		switch stat.(type) {
+		case *LabelStat, *EmptyStat:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // 处理并生成返回指令
 func cgRetStat(fi *funcInfo, exps []Exp) {
 	nExps := len(exps)
+	if nExps > 0 {
+		fi.curLine, _ = exps[0].Pos()
+	}
 	if nExps == 0 { // 如果没有返回值
 		fi.emitReturn(0, 0) // 生成返回指令
 		return
@@ -29,7 +56,7 @@ func cgRetStat(fi *funcInfo, exps []Exp) {
 				return
 			}
 		}
-		if fcExp, ok := exps[0].(*FuncCallExp); ok { // 如果是函数调用
+		if fcExp, ok := exps[0].(*FuncCallExp); ok && fi.minSlotOfTBCVars(0) < 0 { // 如果是函数调用(有待关闭变量时不能尾调用)
 			r := fi.allocReg()
 			cgTailCallExp(fi, fcExp, r) // 生成尾调用指令
 			fi.freeReg()
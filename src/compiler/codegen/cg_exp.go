@@ -17,6 +17,7 @@ const (
 )
 
 func cgExp(fi *funcInfo, node Exp, a, n int) {
+	fi.curLine, _ = node.Pos()
 	switch exp := node.(type) {
 	case *NilExp:
 		fi.emitLoadNil(a, n)
@@ -56,7 +57,7 @@ func cgExp(fi *funcInfo, node Exp, a, n int) {
 // 生成vararg表达式
 func cgVarargExp(fi *funcInfo, exp *VarargExp, a, n int) {
 	if !fi.isVararg {
-		panic("cannot use '...' outside a vararg function")
+		fi.errorAt(exp.Line, "cannot use '...' outside a vararg function near '...'")
 	}
 	fi.emitVararg(a, n)
 }
@@ -73,7 +74,10 @@ func cgFuncDefExp(fi *funcInfo, node *FuncDefExp, a int) {
 	}
 	cgBlock(subFI, node.Block) // 函数体
 	subFI.exitScope()          // 退出作用域
-	subFI.emitReturn(0, 0)     // 返回
+	if node.LastLine > 0 {     // 最后的RETURN属于end所在的行，主函数没有end
+		subFI.curLine = node.LastLine
+	}
+	subFI.emitReturn(0, 0) // 返回
 
 	bx := len(fi.subFuncs) - 1
 	fi.emitClosure(a, bx)
@@ -116,7 +120,7 @@ func cgTableConstructorExp(fi *funcInfo, node *TableConstructorExp, a int) {
 					n = 50
 				}
 				fi.freeRegs(n)
-				c := (arrIdx-1)/50 + 1 // todo: c > 0xFF
+				c := (arrIdx-1)/50 + 1
 				if i == nExps-1 && multRet {
 					fi.emitSetList(a, 0, c)
 				} else {
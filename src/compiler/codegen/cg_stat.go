@@ -5,6 +5,7 @@ import (
 )
 
 func cgStat(fi *funcInfo, node Stat) {
+	fi.curLine, _ = node.Pos()
 	switch stat := node.(type) {
 	case *FuncCallStat:
 		cgFuncCallStat(fi, stat)
@@ -28,8 +29,10 @@ func cgStat(fi *funcInfo, node Stat) {
 		cgLocalVarDeclStat(fi, stat)
 	case *LocalFuncDefStat:
 		cgLocalFuncDefStat(fi, stat)
-	case *LabelStat, *GotoStat:
-		panic("label and goto statements are not supported!")
+	case *LabelStat:
+		fi.addLabel(stat.Name, stat.Line, fi.usedRegs)
+	case *GotoStat:
+		fi.addGoto(stat.Name, stat.Line)
 	}
 }
 
@@ -48,8 +51,8 @@ func cgFuncCallStat(fi *funcInfo, node *FuncCallStat) {
 
 // 生成break语句
 func cgBreakStat(fi *funcInfo, node *BreakStat) {
-	pc := fi.emitJmp(0, 0) // 生成跳转指令(等到确定跳转位置时再填充跳转偏移)
-	fi.addBreakJmp(pc)     // 将跳转指令的pc加入break列表
+	pc := fi.emitJmp(fi.getBreakJmpArgA(), 0) // 生成跳转指令(等到确定跳转位置时再填充跳转偏移)
+	fi.addBreakJmp(pc, node.Line)             // 将跳转指令的pc加入break列表
 }
 
 // 生成do语句
@@ -78,16 +81,16 @@ func cgWhileStat(fi *funcInfo, node *WhileStat) {
 
 // 生成repeat语句
 func cgRepeatStat(fi *funcInfo, node *RepeatStat) {
-	fi.enterScope(true)                    // 进入循环块
-	pcBeforeBlock := fi.pc()               // 记录下repeat语句的起始位置
-	cgBlock(fi, node.Block)                // 生成块
-	r := fi.allocReg()                     // 为repeat表达式分配一个寄存器
-	cgExp(fi, node.Exp, r, 1)              // 生成repeat表达式
-	fi.freeReg()                           // 释放寄存器
-	fi.emitTest(r, 1)                      // 生成测试指令
-	fi.emitJmp(0, pcBeforeBlock-fi.pc()-1) // 生成跳转指令(跳转到repeat语句的起始位置)
-	fi.closeOpenUpvals()                   // 关闭未关闭的upvalue
-	fi.exitScope()                         // 退出块
+	fi.enterScope(true)                                  // 进入循环块
+	pcBeforeBlock := fi.pc()                             // 记录下repeat语句的起始位置
+	cgBlockUntil(fi, node.Block, true)                   // 生成块
+	r := fi.allocReg()                                   // 为repeat表达式分配一个寄存器
+	cgExp(fi, node.Exp, r, 1)                            // 生成repeat表达式
+	fi.freeReg()                                         // 释放寄存器
+	fi.emitTest(r, 0)                                    // 生成测试指令(条件为假时跳回循环开始)
+	fi.emitJmp(fi.getJmpArgA(), pcBeforeBlock-fi.pc()-1) // 生成跳转指令(跳转到repeat语句的起始位置，同时关闭upvalue)
+	fi.closeOpenUpvals()                                 // 关闭未关闭的upvalue
+	fi.exitScope()                                       // 退出块
 }
 
 // 生成if语句
@@ -152,6 +155,7 @@ func cgForInStat(fi *funcInfo, node *ForInStat) {
 	}
 	pcJmpToTFC := fi.emitJmp(0, 0)            // 生成跳转指令(等到确定跳转位置时再填充跳转偏移)
 	cgBlock(fi, node.Block)                   // 生成块
+	fi.closeOpenUpvals()                      // 关闭未关闭的upvalue
 	fi.fixSbx(pcJmpToTFC, fi.pc()-pcJmpToTFC) // 填充跳转指令的跳转偏移
 	rGenerator := fi.slotOfLocVar("(for generator)")
 	fi.emitTForCall(rGenerator, len(node.NameList))
@@ -204,6 +208,11 @@ func cgLocalVarDeclStat(fi *funcInfo, node *LocalVarDeclStat) {
 	for _, name := range node.NameList {
 		fi.addLocVar(name)
 	}
+	for i, attrib := range node.AttribList { // 5.4的变量属性
+		if attrib != "" {
+			fi.setLocVarAttrib(node.NameList[i], attrib)
+		}
+	}
 }
 
 // 赋值语句
@@ -225,6 +234,9 @@ func cgAssignStat(fi *funcInfo, node *AssignStat) {
 			cgExp(fi, taExp.KeyExp, kRegs[i], 1)    // 生成键表达式
 		} else { // 如果是变量
 			name := exp.(*NameExp).Name
+			if fi.isReadOnlyVar(name) {
+				fi.errorAt(exp.(*NameExp).Line, "attempt to assign to const variable '%s'", name)
+			}
 			if fi.slotOfLocVar(name) < 0 && fi.indexOfUpval(name) < 0 { // 如果变量不是局部变量也不是upvalue，说明是全局变量
 				// global var
 				kRegs[i] = -1
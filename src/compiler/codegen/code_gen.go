@@ -5,9 +5,28 @@ import (
 	. "lua/src/compiler/ast"
 )
 
+// 每个函数可以使用的寄存器数量(不含)，MaxStackSize只有一个字节
+// lua-5.3.4/src/lcode.c#MAXREGS
+const MAXREGS = 255
+
+// 每个函数最多可以有的Upvalue数量
+// lua-5.3.4/src/lfunc.h#MAXUPVAL
+const MAXUPVAL = 255
+
 func GenProto(chunk *Block) *Prototype {
+	return GenProtoMaxRegs(chunk, "", MAXREGS)
+}
+
+// 生成函数原型，每个函数最多使用maxRegs-1个寄存器，超出时报错
+// 错误以*SyntaxError的形式抛出，chunkName用于错误信息
+func GenProtoMaxRegs(chunk *Block, chunkName string, maxRegs int) *Prototype {
+	if maxRegs <= 0 || maxRegs > MAXREGS {
+		maxRegs = MAXREGS
+	}
 	fd := &FuncDefExp{IsVararg: true, Block: chunk}
 	fi := newFuncInfo(nil, fd)
+	fi.regLimit = maxRegs
+	fi.chunkName = chunkName
 	fi.addLocVar("_ENV")
 	cgFuncDefExp(fi, fd, 0)
 	return toProto(fi.subFuncs[0])
@@ -6,15 +6,17 @@ import (
 
 func toProto(fi *funcInfo) *Prototype {
 	proto := &Prototype{
-		NumParams:    byte(fi.numParams),    // 参数个数
-		MaxStackSize: byte(fi.maxRegs),      // 最大栈空间
-		Code:         fi.insts,              // 指令表
-		Constants:    getConstants(fi),      // 常量表
-		Upvalues:     getUpvalues(fi),       // upvalue表
-		Protos:       toProtos(fi.subFuncs), // 子函数原型表
-		LineInfo:     []uint32{},            // debug info
-		LocVars:      []LocVar{},            // debug info
-		UpvalueNames: fi.upvalNames,         // debug info
+		LineDefined:     uint32(fi.line),       // 开始行号
+		LastLineDefined: uint32(fi.lastLine),   // 结束行号
+		NumParams:       byte(fi.numParams),    // 参数个数
+		MaxStackSize:    byte(fi.maxRegs),      // 最大栈空间
+		Code:            fi.insts,              // 指令表
+		Constants:       getConstants(fi),      // 常量表
+		Upvalues:        getUpvalues(fi),       // upvalue表
+		Protos:          toProtos(fi.subFuncs), // 子函数原型表
+		LineInfo:        fi.lineInfo,           // debug info
+		LocVars:         getLocVars(fi),        // debug info
+		UpvalueNames:    fi.upvalNames,         // debug info
 	}
 
 	if proto.MaxStackSize < 2 {
@@ -43,16 +45,22 @@ func getConstants(fi *funcInfo) []interface{} {
 	return consts
 }
 
+func getLocVars(fi *funcInfo) []LocVar {
+	locVars := make([]LocVar, len(fi.locVars))
+	for i, locVar := range fi.locVars {
+		locVars[i] = LocVar{locVar.name, uint32(locVar.startPC), uint32(locVar.endPC)}
+	}
+	return locVars
+}
+
 func getUpvalues(fi *funcInfo) []Upvalue {
 	upvals := make([]Upvalue, len(fi.upvalues))
-	i := 0
 	for _, uv := range fi.upvalues {
 		if uv.locVarSlot >= 0 { // instack
-			upvals[uv.index] = Upvalue{fi.upvalNames[i], 1, byte(uv.locVarSlot)}
+			upvals[uv.index] = Upvalue{fi.upvalNames[uv.index], 1, byte(uv.locVarSlot)}
 		} else {
-			upvals[uv.index] = Upvalue{fi.upvalNames[i], 0, byte(uv.upvalIndex)}
+			upvals[uv.index] = Upvalue{fi.upvalNames[uv.index], 0, byte(uv.upvalIndex)}
 		}
-		i++
 	}
 	return upvals
 }
@@ -1,6 +1,7 @@
 package codegen
 
 import (
+	"fmt"
 	. "lua/src/compiler/ast"
 	. "lua/src/compiler/lexer"
 	. "lua/src/vm"
@@ -25,6 +26,7 @@ type funcInfo struct {
 	constants  map[interface{}]int    // 常量表
 	usedRegs   int                    // 已分配的寄存器数量
 	maxRegs    int                    // 最大寄存器数量
+	regLimit   int                    // 可以使用的寄存器数量(不含)，子函数和父函数相同
 	scopeLv    int                    // 作用域层级
 	locVars    []*locVarInfo          // 局部变量表
 	locNames   map[string]*locVarInfo // 局部变量名表
@@ -32,15 +34,29 @@ type funcInfo struct {
 	parent     *funcInfo              // 父函数
 	upvalues   map[string]upvalInfo   // Upvalue表
 	insts      []uint32               // 指令表
+	lineInfo   []uint32               // 行号表，和指令表一一对应
 	subFuncs   []*funcInfo            // 子函数表
 	numParams  int                    // 参数数量
 	isVararg   bool                   // 是否是可变参数
 	upvalNames []string               // Upvalue名表
+	line       int                    // 函数定义开始行号
+	lastLine   int                    // 函数定义结束行号
+	labels     []labelInfo            // 当前可见的标签，按定义顺序排列
+	gotos      []gotoInfo             // 还没有找到标签的goto语句
+	chunkName  string                 // chunk名字，用于错误信息，子函数和父函数相同
+	curLine    int                    // 正在生成代码的语句或表达式的行号，超出限制时报告这一行，也是生成的指令的行号
 }
 
 func newFuncInfo(parent *funcInfo, fd *FuncDefExp) *funcInfo {
+	regLimit := MAXREGS
+	chunkName := ""
+	if parent != nil {
+		regLimit = parent.regLimit
+		chunkName = parent.chunkName
+	}
 	return &funcInfo{
 		parent:     parent,
+		regLimit:   regLimit,
 		subFuncs:   []*funcInfo{},
 		constants:  map[interface{}]int{},
 		upvalues:   map[string]upvalInfo{},
@@ -48,9 +64,14 @@ func newFuncInfo(parent *funcInfo, fd *FuncDefExp) *funcInfo {
 		locVars:    make([]*locVarInfo, 0, 8),
 		breaks:     make([][]int, 1),
 		insts:      make([]uint32, 1, 8),
+		lineInfo:   []uint32{uint32(fd.Line)},
 		isVararg:   fd.IsVararg,
 		numParams:  len(fd.ParList),
 		upvalNames: make([]string, 0, 8),
+		line:       fd.Line,
+		lastLine:   fd.LastLine,
+		chunkName:  chunkName,
+		curLine:    fd.Line,
 	}
 }
 
@@ -60,6 +81,27 @@ type locVarInfo struct {
 	scopeLv  int         // 变量的作用域层级
 	slot     int         // 变量的寄存器索引
 	captured bool        // 是否被闭包捕获
+	attrib   string      // 变量属性(5.4)："const"、"close"或者""
+	startPC  int         // 变量开始活跃的pc
+	endPC    int         // 变量不再活跃的pc
+}
+
+// 标签
+type labelInfo struct {
+	name     string // 标签名
+	line     int    // 标签所在行号
+	pc       int    // 标签之后第一条指令的pc
+	scopeLv  int    // 标签的作用域层级
+	nActVars int    // 标签处活跃的局部变量占用的寄存器数量
+}
+
+// 等待确定跳转位置的goto语句
+type gotoInfo struct {
+	name     string // 标签名
+	line     int    // goto语句所在行号
+	pc       int    // 跳转指令的pc
+	scopeLv  int    // goto语句所在(或者已经跳出到)的作用域层级
+	nActVars int    // goto语句处活跃的局部变量占用的寄存器数量
 }
 
 type upvalInfo struct {
@@ -85,14 +127,15 @@ func (self *funcInfo) indexOfUpval(name string) int {
 	}
 	if self.parent != nil {
 		if locVar, found := self.parent.locNames[name]; found { // 如果是在外围函数中定义的局部变量
-			idx := len(self.upvalues)
+			idx := self.newUpvalIndex()
 			self.upvalues[name] = upvalInfo{locVar.slot, -1, idx}
 			self.upvalNames = append(self.upvalNames, name)
 			locVar.captured = true
 			return idx
 		}
-		if idx := self.parent.indexOfUpval(name); idx >= 0 { // 如果是在外围函数的Upvalue表中(不用捕获)
-			self.upvalues[name] = upvalInfo{-1, idx, idx}
+		if uvIdx := self.parent.indexOfUpval(name); uvIdx >= 0 { // 如果是在外围函数的Upvalue表中(不用捕获)
+			idx := self.newUpvalIndex()
+			self.upvalues[name] = upvalInfo{-1, uvIdx, idx}
 			self.upvalNames = append(self.upvalNames, name)
 			return idx
 		}
@@ -100,11 +143,40 @@ func (self *funcInfo) indexOfUpval(name string) int {
 	return -1
 }
 
+// 新Upvalue的索引，Upvalue表里的索引只有一个字节
+func (self *funcInfo) newUpvalIndex() int {
+	idx := len(self.upvalues)
+	if idx >= MAXUPVAL {
+		self.errorLimit(MAXUPVAL, "upvalues")
+	}
+	return idx
+}
+
+// 代码生成阶段发现的错误，和语法错误一样以*SyntaxError的形式抛出
+// lua-5.3.4/src/lparser.c#semerror()
+func (self *funcInfo) errorAt(line int, f string, a ...interface{}) {
+	panic(&SyntaxError{
+		ChunkName: self.chunkName,
+		Line:      line,
+		Msg:       fmt.Sprintf(f, a...),
+	})
+}
+
+// 超出限制时报错
+// lua-5.3.4/src/lparser.c#errorlimit()
+func (self *funcInfo) errorLimit(limit int, what string) {
+	where := "main function"
+	if self.line != 0 {
+		where = fmt.Sprintf("function at line %d", self.line)
+	}
+	self.errorAt(self.curLine, "too many %s (limit is %d) in %s", what, limit, where)
+}
+
 // 分配一个寄存器
 func (self *funcInfo) allocReg() int {
 	self.usedRegs++
-	if self.usedRegs >= 255 {
-		panic("function or expression needs too many registers")
+	if self.usedRegs >= self.regLimit {
+		self.errorAt(self.curLine, "function or expression needs too many registers")
 	}
 	if self.usedRegs > self.maxRegs { // 必要时更新最大寄存器数量
 		self.maxRegs = self.usedRegs
@@ -147,12 +219,46 @@ func (self *funcInfo) addLocVar(name string) int {
 		name:    name,
 		scopeLv: self.scopeLv,
 		slot:    self.allocReg(),
+		startPC: len(self.insts),
 	}
 	self.locVars = append(self.locVars, newVar)
 	self.locNames[name] = newVar
 	return newVar.slot
 }
 
+// 给当前作用域中最后添加的同名局部变量设置属性，待关闭变量需要生成TBC指令标记寄存器
+func (self *funcInfo) setLocVarAttrib(name, attrib string) {
+	locVar := self.locNames[name]
+	locVar.attrib = attrib
+	if attrib == "close" {
+		self.emitTBC(locVar.slot)
+	}
+}
+
+// 判断变量是否是只读的(const或close)，名字按照局部变量、Upvalue的顺序解析
+func (self *funcInfo) isReadOnlyVar(name string) bool {
+	if locVar, found := self.locNames[name]; found {
+		return locVar.attrib != ""
+	}
+	if self.parent != nil {
+		return self.parent.isReadOnlyVar(name)
+	}
+	return false
+}
+
+// 返回作用域层级不低于scopeLv的待关闭变量中最小的寄存器索引，没有时返回-1
+func (self *funcInfo) minSlotOfTBCVars(scopeLv int) int {
+	minSlot := -1
+	for _, locVar := range self.locNames {
+		for v := locVar; v != nil && v.scopeLv >= scopeLv; v = v.prev {
+			if v.attrib == "close" && (minSlot < 0 || v.slot < minSlot) {
+				minSlot = v.slot
+			}
+		}
+	}
+	return minSlot
+}
+
 // 检查局部变量名是否已经和某个寄存器绑定，如果是则返回其寄存器索引，否则返回-1
 func (self *funcInfo) slotOfLocVar(name string) int {
 	if locVar, found := self.locNames[name]; found {
@@ -167,7 +273,12 @@ func (self *funcInfo) exitScope() {
 	self.breaks = self.breaks[:len(self.breaks)-1]      // 删除末尾Break数组
 	a := self.getJmpArgA()                              // 是否需要关闭Upvalue
 	for _, pc := range pendingBreakJmps {               // 遍历break数组
-		sBx := self.pc() - pc                     // 计算跳转偏移量
+		sBx := self.pc() - pc // 计算跳转偏移量
+		a := a
+		if tbcA := int(self.insts[pc] >> 6 & 0xFF); tbcA > 0 && (a == 0 || tbcA < a) { // break时已经确定需要关闭待关闭变量
+			a = tbcA
+		}
+		self.checkSbx(sBx)
 		i := (sBx+MAXARG_sBx)<<14 | a<<6 | OP_JMP // 组装指令
 		self.insts[pc] = uint32(i)                // 修改指令(break的时候会生成指令，但不能确定跳转偏移量，所以先用0占位)
 	}
@@ -177,11 +288,135 @@ func (self *funcInfo) exitScope() {
 			self.removeLocVar(locVar)
 		}
 	}
+	self.moveGotosOut(a)
+}
+
+// 退出作用域时删除其中的标签，把其中没有找到标签的goto移到外层作用域，
+// 如果块里有需要关闭的局部变量(a不为0)，跳出块的goto也要关闭它们。
+// 移出来的goto再和外层作用域里已经定义的标签匹配，函数结束时还有goto没有匹配就报错
+// lua-5.3.4/src/lparser.c#movegotosout()
+func (self *funcInfo) moveGotosOut(a int) {
+	n := 0
+	for _, label := range self.labels {
+		if label.scopeLv <= self.scopeLv {
+			self.labels[n] = label
+			n++
+		}
+	}
+	self.labels = self.labels[:n]
+
+	n = 0
+	for _, gt := range self.gotos {
+		if gt.scopeLv > self.scopeLv {
+			if gt.nActVars > self.usedRegs {
+				if a > 0 {
+					self.fixJmpA(gt.pc, a)
+				}
+				gt.nActVars = self.usedRegs
+			}
+			gt.scopeLv = self.scopeLv
+			if label := self.findLabel(gt.name); label != nil {
+				self.closeGoto(gt, label)
+				continue
+			}
+		}
+		self.gotos[n] = gt
+		n++
+	}
+	self.gotos = self.gotos[:n]
+
+	if self.scopeLv < 0 && len(self.gotos) > 0 {
+		gt := self.gotos[0]
+		self.errorAt(gt.line, "no visible label '%s' for <goto> at line %d", gt.name, gt.line)
+	}
+}
+
+// 在当前作用域中查找标签，找不到时返回nil
+func (self *funcInfo) findLabel(name string) *labelInfo {
+	for i := range self.labels {
+		if label := &self.labels[i]; label.scopeLv == self.scopeLv && label.name == name {
+			return label
+		}
+	}
+	return nil
+}
+
+// 在当前作用域中定义标签，同时确定当前作用域中等待这个标签的goto的跳转位置
+// 块末尾的标签处的局部变量已经离开作用域，nActVars是进入块时的寄存器数量
+// lua-5.3.4/src/lparser.c#labelstat()
+func (self *funcInfo) addLabel(name string, line, nActVars int) {
+	if label := self.findLabel(name); label != nil {
+		self.errorAt(line, "label '%s' already defined on line %d", name, label.line)
+	}
+	label := labelInfo{name, line, self.pc() + 1, self.scopeLv, nActVars}
+	self.labels = append(self.labels, label)
+
+	n := 0
+	for _, gt := range self.gotos {
+		if gt.scopeLv == self.scopeLv && gt.name == name {
+			self.closeGoto(gt, &label)
+		} else {
+			self.gotos[n] = gt
+			n++
+		}
+	}
+	self.gotos = self.gotos[:n]
+}
+
+// 添加goto语句对应的跳转指令，标签已经定义时直接确定跳转位置，否则等待标签
+// lua-5.3.4/src/lparser.c#gotostat()
+func (self *funcInfo) addGoto(name string, line int) {
+	gt := gotoInfo{name, line, self.emitJmp(0, 0), self.scopeLv, self.usedRegs}
+	if label := self.findLabel(name); label != nil {
+		self.closeGoto(gt, label)
+	} else {
+		self.gotos = append(self.gotos, gt)
+	}
+}
+
+// 确定goto的跳转位置：向前跳转不能跳进局部变量的作用域，
+// 向后跳转时标签之后声明的局部变量如果被捕获或者需要关闭，跳转的同时关闭它们
+// lua-5.3.4/src/lparser.c#closegoto()
+// lua-5.3.4/src/lparser.c#findlabel()
+func (self *funcInfo) closeGoto(gt gotoInfo, label *labelInfo) {
+	if gt.nActVars < label.nActVars {
+		self.errorAt(gt.line, "<goto %s> at line %d jumps into the scope of local '%s'",
+			gt.name, gt.line, self.nameOfLocVar(gt.nActVars))
+	}
+	if gt.nActVars > label.nActVars && self.needsClose(label.nActVars) {
+		self.fixJmpA(gt.pc, label.nActVars+1)
+	}
+	self.fixSbx(gt.pc, label.pc-gt.pc-1)
+}
+
+// 判断寄存器索引不小于slot的活跃局部变量中是否有被捕获的或者待关闭的
+func (self *funcInfo) needsClose(slot int) bool {
+	for _, locVar := range self.locNames {
+		for v := locVar; v != nil; v = v.prev {
+			if v.slot >= slot && (v.captured || v.attrib == "close") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 返回占用寄存器slot的活跃局部变量的名字
+func (self *funcInfo) nameOfLocVar(slot int) string {
+	for _, locVar := range self.locNames {
+		for v := locVar; v != nil; v = v.prev {
+			if v.slot == slot {
+				return v.name
+			}
+		}
+	}
+	return "?"
 }
 
 // 移除一个局部变量:解绑局部变量名，回收寄存器
 func (self *funcInfo) removeLocVar(locVar *locVarInfo) {
 	self.freeReg() // 回收寄存器
+	locVar.endPC = len(self.insts)
 	if locVar.prev == nil {
 		delete(self.locNames, locVar.name) // 解绑局部变量名
 	} else if locVar.prev.scopeLv == locVar.scopeLv {
@@ -191,15 +426,27 @@ func (self *funcInfo) removeLocVar(locVar *locVarInfo) {
 	}
 }
 
-// 把break语句对应的跳转指令添加到最近的循环块内
-func (self *funcInfo) addBreakJmp(pc int) {
+// 把break语句对应的跳转指令添加到最近的循环块内，line是break语句所在的行号
+// lua-5.3.4/src/lparser.c#undefgoto()
+func (self *funcInfo) addBreakJmp(pc, line int) {
 	for i := self.scopeLv; i >= 0; i-- {
 		if self.breaks[i] != nil {
 			self.breaks[i] = append(self.breaks[i], pc)
 			return
 		}
 	}
-	panic("<break> at line ? not inside a loop!")
+	self.errorAt(line, "<break> at line %d not inside a loop", line)
+}
+
+// 获取break语句跳转指令的A操作数：跳出的作用域(一直到最近的循环块)里有待关闭变量时，
+// 需要从最小的待关闭变量开始关闭，否则返回0，等到退出循环块时再决定是否关闭Upvalue
+func (self *funcInfo) getBreakJmpArgA() int {
+	for i := self.scopeLv; i >= 0; i-- {
+		if self.breaks[i] != nil {
+			return self.minSlotOfTBCVars(i) + 1
+		}
+	}
+	return 0
 }
 
 // 获取JMP指令的A操作数，操作数A决定了Upvalue的数量
@@ -209,7 +456,7 @@ func (self *funcInfo) getJmpArgA() int {
 	for _, locVar := range self.locNames { // 遍历局部变量名表
 		if locVar.scopeLv == self.scopeLv { // 作用域层级相同，说明需要关闭
 			for v := locVar; v != nil && v.scopeLv == self.scopeLv; v = v.prev { // 遍历同名局部变量
-				if v.captured { // 是否被捕获
+				if v.captured || v.attrib == "close" { // 是否被捕获，待关闭变量也需要关闭
 					hasCapturedLocVars = true
 				}
 				if v.slot < minSlotOfLocVars && v.name[0] != '(' { // 获取到最小的local变量寄存器索引
@@ -232,12 +479,22 @@ func (self *funcInfo) pc() int {
 
 // 填充指令中的sBx字段
 func (self *funcInfo) fixSbx(pc, sBx int) {
+	self.checkSbx(sBx)
 	i := self.insts[pc]
 	i = i << 18 >> 18                 // 清除sBx字段
 	i |= uint32(sBx+MAXARG_sBx) << 14 // 重新设置sBx字段
 	self.insts[pc] = i
 }
 
+// 设置跳转指令的A操作数，已经设置过时取较小的值(关闭更多的Upvalue)
+// lua-5.3.4/src/lcode.c#luaK_patchclose()
+func (self *funcInfo) fixJmpA(pc, a int) {
+	i := self.insts[pc]
+	if old := int(i >> 6 & 0xFF); old == 0 || a < old {
+		self.insts[pc] = i&^(0xFF<<6) | uint32(a)<<6
+	}
+}
+
 // 关闭未关闭的upvalue
 func (self *funcInfo) closeOpenUpvals() {
 	a := self.getJmpArgA()
@@ -246,29 +503,44 @@ func (self *funcInfo) closeOpenUpvals() {
 	}
 }
 
+// 跳转偏移量超出sBx字段的范围时报错
+// lua-5.3.4/src/lcode.c#fixjump()
+func (self *funcInfo) checkSbx(sBx int) {
+	if sBx < -MAXARG_sBx || sBx > MAXARG_sBx {
+		self.errorAt(self.curLine, "control structure too long")
+	}
+}
+
+// 添加一条指令，行号是正在生成代码的语句或表达式的行号
+func (self *funcInfo) emit(i int) {
+	self.insts = append(self.insts, uint32(i))
+	self.lineInfo = append(self.lineInfo, uint32(self.curLine))
+}
+
 // 四种编码生成
 // ABC
 func (self *funcInfo) emitABC(op, a, b, c int) {
 	i := b<<23 | c<<14 | a<<6 | op
-	self.insts = append(self.insts, uint32(i))
+	self.emit(i)
 }
 
 // ABx
 func (self *funcInfo) emitABx(op, a, bx int) {
 	i := bx<<14 | a<<6 | op
-	self.insts = append(self.insts, uint32(i))
+	self.emit(i)
 }
 
 // AsBx
 func (self *funcInfo) emitAsBx(op, a, sbx int) {
+	self.checkSbx(sbx)
 	i := (sbx+MAXARG_sBx)<<14 | a<<6 | op
-	self.insts = append(self.insts, uint32(i))
+	self.emit(i)
 }
 
 // Ax
 func (self *funcInfo) emitAx(op, ax int) {
 	i := ax<<6 | op
-	self.insts = append(self.insts, uint32(i))
+	self.emit(i)
 }
 
 // r[a] = r[b]
@@ -314,8 +586,17 @@ func (self *funcInfo) emitNewTable(a, nArr, nRec int) {
 }
 
 // r[a][(c-1)*FPF+i] := r[a+i], 1 <= i <= b
+// c超过C字段的范围时C为0，c放在下一条EXTRAARG指令里
+// lua-5.3.4/src/lcode.c#luaK_setlist()
 func (self *funcInfo) emitSetList(a, b, c int) {
-	self.emitABC(OP_SETLIST, a, b, c)
+	if c <= MAXARG_C {
+		self.emitABC(OP_SETLIST, a, b, c)
+	} else if c <= MAXARG_Ax {
+		self.emitABC(OP_SETLIST, a, b, 0)
+		self.emitAx(OP_EXTRAARG, c)
+	} else {
+		self.errorAt(self.curLine, "constructor too long")
+	}
 }
 
 // r[a] := r[b][rk(c)]
@@ -403,6 +684,11 @@ func (self *funcInfo) emitTForLoop(a, sBx int) {
 	self.emitAsBx(OP_TFORLOOP, a, sBx)
 }
 
+// mark r[a] as to-be-closed
+func (self *funcInfo) emitTBC(a int) {
+	self.emitABC(OP_TBC, a, 0, 0)
+}
+
 // r[a] = op r[b]
 func (self *funcInfo) emitUnaryOp(op, a, b int) {
 	switch op {
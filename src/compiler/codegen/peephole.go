@@ -0,0 +1,407 @@
+package codegen
+
+import (
+	. "lua/src/binchunk"
+	. "lua/src/vm"
+)
+
+// 窥孔优化：在生成的字节码上做局部的改写，不改变程序的行为
+//   - 删除MOVE A A和不跳转也不关闭Upvalue的JMP(每个函数开头都有一条占位的MOVE 0 0)
+//   - 结果先写进临时寄存器再MOVE到目标寄存器时，让产生结果的指令直接写目标寄存器
+//   - 紧跟在MOVE A B后面的MOVE B A
+//   - 跳转到无条件跳转的跳转指令直接跳到最终的目标
+//   - 相邻的LOADNIL合并成一条
+//
+// 删除指令之后重新计算跳转偏移，行号信息和局部变量的有效范围也随之调整
+func Peephole(proto *Prototype) {
+	for _, p := range proto.Protos {
+		Peephole(p)
+	}
+	ph := &peephole{f: proto}
+	ph.threadJumps()
+	for ph.pass() {
+	}
+}
+
+type peephole struct {
+	f         *Prototype
+	targets   []bool   // 指令是否是跳转目标(包括测试指令跳过下一条指令之后的位置)
+	liveOut   []regSet // 每条指令执行之后还会被读取的寄存器
+	protected regSet   // 被闭包捕获的寄存器和待关闭变量，不能当作临时寄存器
+}
+
+// 一组寄存器
+type regSet [4]uint64
+
+func (self *regSet) add(r int) {
+	self[r>>6] |= 1 << uint(r&63)
+}
+
+// 加入[from, to]范围内的寄存器
+func (self *regSet) addRange(from, to int) {
+	if to > 0xFF {
+		to = 0xFF
+	}
+	for r := from; r <= to; r++ {
+		self.add(r)
+	}
+}
+
+func (self *regSet) has(r int) bool {
+	return self[r>>6]&(1<<uint(r&63)) != 0
+}
+
+/* 跳转 */
+
+// 跳转指令的目标，不是跳转指令时返回-1
+func jumpTarget(i Instruction, pc int) int {
+	switch i.Opcode() {
+	case OP_JMP, OP_FORLOOP, OP_FORPREP, OP_TFORLOOP:
+		_, sBx := i.AsBx()
+		return pc + 1 + sBx
+	}
+	return -1
+}
+
+func setSbx(i Instruction, sBx int) uint32 {
+	return uint32(i)<<18>>18 | uint32(sBx+MAXARG_sBx)<<14
+}
+
+// 条件成立时跳过下一条指令的指令
+func isSkipper(i Instruction) bool {
+	switch i.Opcode() {
+	case OP_EQ, OP_LT, OP_LE, OP_TEST, OP_TESTSET:
+		return true
+	case OP_LOADBOOL:
+		_, _, c := i.ABC()
+		return c != 0
+	}
+	return false
+}
+
+// 跳转到无条件跳转的跳转指令直接跳到最终的目标
+// 中间的跳转指令要关闭Upvalue时不能跳过它；死循环最多沿着跳转走len(code)步
+func (self *peephole) threadJumps() {
+	code := self.f.Code
+	for pc, ins := range code {
+		i := Instruction(ins)
+		if i.Opcode() != OP_JMP {
+			continue
+		}
+		target := jumpTarget(i, pc)
+		for n := 0; n < len(code) && target >= 0 && target < len(code); n++ {
+			next := Instruction(code[target])
+			if a, _ := next.AsBx(); next.Opcode() != OP_JMP || a != 0 || jumpTarget(next, target) == target {
+				break
+			}
+			target = jumpTarget(next, target)
+		}
+		if target >= 0 && target < len(code) {
+			code[pc] = setSbx(i, target-pc-1)
+		}
+	}
+}
+
+/* 寄存器的读写 */
+
+// 指令读取的寄存器、一定会写入的寄存器和可能的后继指令
+func (self *peephole) effects(pc int) (use, def regSet, succ []int) {
+	i := Instruction(self.f.Code[pc])
+	a, b, c := i.ABC()
+	_, bx := i.ABx()
+	rk := func(x int) {
+		if x < 0x100 { // 不是常量索引
+			use.add(x)
+		}
+	}
+	succ = []int{pc + 1}
+
+	switch op := i.Opcode(); op {
+	case OP_MOVE, OP_UNM, OP_BNOT, OP_NOT, OP_LEN:
+		use.add(b)
+		def.add(a)
+	case OP_LOADK, OP_GETUPVAL, OP_NEWTABLE:
+		def.add(a)
+	case OP_LOADKX:
+		def.add(a)
+		succ = []int{pc + 2}
+	case OP_LOADBOOL:
+		def.add(a)
+		if c != 0 {
+			succ = []int{pc + 2}
+		}
+	case OP_LOADNIL:
+		def.addRange(a, a+b)
+	case OP_GETTABUP:
+		rk(c)
+		def.add(a)
+	case OP_GETTABLE:
+		use.add(b)
+		rk(c)
+		def.add(a)
+	case OP_SETTABUP:
+		rk(b)
+		rk(c)
+	case OP_SETUPVAL, OP_TBC:
+		use.add(a)
+	case OP_SETTABLE:
+		use.add(a)
+		rk(b)
+		rk(c)
+	case OP_SELF:
+		use.add(b)
+		rk(c)
+		def.addRange(a, a+1)
+	case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV,
+		OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+		rk(b)
+		rk(c)
+		def.add(a)
+	case OP_CONCAT:
+		use.addRange(b, c)
+		def.add(a)
+	case OP_JMP:
+		if a != 0 { // 关闭Upvalue时读取寄存器的值
+			use.addRange(a-1, 0xFF)
+		}
+		succ = []int{jumpTarget(i, pc)}
+	case OP_EQ, OP_LT, OP_LE:
+		rk(b)
+		rk(c)
+		succ = append(succ, pc+2)
+	case OP_TEST:
+		use.add(a)
+		succ = append(succ, pc+2)
+	case OP_TESTSET: // 条件不成立时不写入R(A)
+		use.add(b)
+		succ = append(succ, pc+2)
+	case OP_CALL:
+		if b == 0 { // 参数一直到栈顶
+			use.addRange(a, 0xFF)
+		} else {
+			use.addRange(a, a+b-1)
+		}
+		if c >= 2 {
+			def.addRange(a, a+c-2)
+		}
+	case OP_TAILCALL, OP_RETURN, OP_SETLIST:
+		if b == 0 {
+			use.addRange(a, 0xFF)
+		} else if op == OP_SETLIST {
+			use.addRange(a, a+b)
+		} else if op == OP_TAILCALL {
+			use.addRange(a, a+b-1)
+		} else {
+			use.addRange(a, a+b-2)
+		}
+		if op == OP_RETURN {
+			succ = nil
+		} else if op == OP_SETLIST && c == 0 {
+			succ = []int{pc + 2}
+		}
+	case OP_FORLOOP, OP_FORPREP, OP_TFORLOOP:
+		use.addRange(a, a+2)
+		target := jumpTarget(i, pc)
+		succ = append(succ, target)
+		if op == OP_FORPREP { // 5.4方言不进入循环时跳过FORLOOP
+			succ = append(succ, target+1)
+		}
+	case OP_TFORCALL:
+		use.addRange(a, a+2)
+		def.addRange(a+3, a+2+c)
+	case OP_CLOSURE:
+		for _, uv := range self.f.Protos[bx].Upvalues {
+			if uv.Instack == 1 {
+				use.add(int(uv.Idx))
+			}
+		}
+		def.add(a)
+	case OP_VARARG:
+		if b >= 2 {
+			def.addRange(a, a+b-2)
+		}
+	}
+	return
+}
+
+// 计算跳转目标、活跃的寄存器和受保护的寄存器
+func (self *peephole) analyze() {
+	code := self.f.Code
+	n := len(code)
+	self.targets = make([]bool, n+1)
+	self.protected = regSet{}
+	uses := make([]regSet, n)
+	defs := make([]regSet, n)
+	succs := make([][]int, n)
+	for pc := range code {
+		uses[pc], defs[pc], succs[pc] = self.effects(pc)
+		i := Instruction(code[pc])
+		if target := jumpTarget(i, pc); target >= 0 && target <= n {
+			self.targets[target] = true
+			if i.Opcode() == OP_FORPREP && target+1 <= n {
+				self.targets[target+1] = true
+			}
+		}
+		if isSkipper(i) && pc+2 <= n {
+			self.targets[pc+2] = true
+		}
+		switch i.Opcode() {
+		case OP_TBC:
+			a, _, _ := i.ABC()
+			self.protected.add(a)
+		case OP_CLOSURE:
+			_, bx := i.ABx()
+			for _, uv := range self.f.Protos[bx].Upvalues {
+				if uv.Instack == 1 {
+					self.protected.add(int(uv.Idx))
+				}
+			}
+		}
+	}
+
+	// liveIn = use | (liveOut &^ def)，从后往前迭代到不再变化为止
+	self.liveOut = make([]regSet, n)
+	liveIn := make([]regSet, n)
+	for changed := true; changed; {
+		changed = false
+		for pc := n - 1; pc >= 0; pc-- {
+			var out regSet
+			for _, s := range succs[pc] {
+				if s >= 0 && s < n {
+					for k := range out {
+						out[k] |= liveIn[s][k]
+					}
+				}
+			}
+			var in regSet
+			for k := range in {
+				in[k] = uses[pc][k] | out[k]&^defs[pc][k]
+			}
+			if in != liveIn[pc] || out != self.liveOut[pc] {
+				liveIn[pc], self.liveOut[pc] = in, out
+				changed = true
+			}
+		}
+	}
+}
+
+/* 改写 */
+
+// 前一条指令是否可能跳过这条指令
+func (self *peephole) skippable(pc int) bool {
+	return pc > 0 && isSkipper(Instruction(self.f.Code[pc-1]))
+}
+
+// 只写入R(A)的指令，并且在写入之前读取全部操作数，可以直接改写它的A
+func writesOnlyA(i Instruction) bool {
+	switch i.Opcode() {
+	case OP_MOVE, OP_LOADK, OP_LOADBOOL, OP_GETUPVAL, OP_GETTABUP, OP_GETTABLE, OP_NEWTABLE,
+		OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV,
+		OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR,
+		OP_UNM, OP_BNOT, OP_NOT, OP_LEN, OP_CONCAT, OP_CLOSURE:
+		return true
+	case OP_LOADNIL:
+		_, b, _ := i.ABC()
+		return b == 0
+	}
+	return false
+}
+
+func setA(i Instruction, a int) uint32 {
+	return uint32(i)&^(0xFF<<6) | uint32(a)<<6
+}
+
+// 扫描一遍指令，做完所有可以做的改写，有改写时返回true
+func (self *peephole) pass() bool {
+	self.analyze()
+	code := self.f.Code
+	deleted := make([]bool, len(code))
+	changed := false
+	for pc := 0; pc < len(code); pc++ {
+		i := Instruction(code[pc])
+		a, b, _ := i.ABC()
+		_, sBx := i.AsBx()
+		switch {
+		case i.Opcode() == OP_MOVE && a == b,
+			i.Opcode() == OP_JMP && a == 0 && sBx == 0:
+			if !self.skippable(pc) { // 跳到这里的指令会跳到下一条指令
+				deleted[pc] = true
+			}
+		case pc > 0 && !deleted[pc-1] && !self.targets[pc] && !self.skippable(pc) && !self.skippable(pc-1):
+			prev := Instruction(code[pc-1])
+			pa, pb, _ := prev.ABC()
+			switch {
+			case prev.Opcode() == OP_LOADNIL && i.Opcode() == OP_LOADNIL &&
+				a <= pa+pb+1 && pa <= a+b+1: // 两个范围相交或者相邻
+				from, to := min(pa, a), max(pa+pb, a+b)
+				code[pc-1] = uint32(from<<6 | (to-from)<<23 | OP_LOADNIL)
+				deleted[pc] = true
+			case i.Opcode() == OP_MOVE && writesOnlyA(prev) && pa == b &&
+				!self.liveOut[pc].has(b) && !self.protected.has(b):
+				code[pc-1] = setA(prev, a)
+				deleted[pc] = true
+			case i.Opcode() == OP_MOVE && prev.Opcode() == OP_MOVE && pa == b && pb == a:
+				deleted[pc] = true
+			}
+		}
+		if deleted[pc] {
+			changed = true
+			pc++ // 下一条指令的前一条已经删除或者改写过，留到下一遍
+		}
+	}
+	if changed {
+		self.compact(deleted)
+	}
+	return changed
+}
+
+// 删除指令并修正跳转偏移，跳到被删除的指令的跳转改为跳到它后面的第一条指令
+func (self *peephole) compact(deleted []bool) {
+	f := self.f
+	n := len(f.Code)
+	newPC := make([]int, n+1) // 原来的pc之前保留下来的指令数，也就是原来的pc处(或之后)第一条指令的新pc
+	for pc := 0; pc < n; pc++ {
+		newPC[pc+1] = newPC[pc]
+		if !deleted[pc] {
+			newPC[pc+1]++
+		}
+	}
+
+	code := make([]uint32, 0, newPC[n])
+	var lineInfo []uint32
+	for pc, ins := range f.Code {
+		if deleted[pc] {
+			continue
+		}
+		i := Instruction(ins)
+		if target := jumpTarget(i, pc); target >= 0 && target <= n {
+			ins = setSbx(i, newPC[target]-newPC[pc]-1)
+		}
+		code = append(code, ins)
+		if len(f.LineInfo) == n {
+			lineInfo = append(lineInfo, f.LineInfo[pc])
+		}
+	}
+	f.Code = code
+	if len(f.LineInfo) == n {
+		f.LineInfo = lineInfo
+	}
+	for k := range f.LocVars {
+		f.LocVars[k].StartPC = uint32(newPC[f.LocVars[k].StartPC])
+		f.LocVars[k].EndPC = uint32(newPC[f.LocVars[k].EndPC])
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
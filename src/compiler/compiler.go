@@ -1,12 +1,178 @@
 package compiler
 
 import (
+	"errors"
+	"fmt"
 	. "lua/src/binchunk"
+	. "lua/src/compiler/ast"
 	. "lua/src/compiler/codegen"
+	. "lua/src/compiler/lexer"
+	"lua/src/compiler/optimizer"
+	"lua/src/compiler/options"
 	. "lua/src/compiler/parser"
+	"runtime"
+	"strings"
 )
 
-func Compile(chunk, chunkname string) *Prototype {
-	ast := Parse(chunk, chunkname)
-	return GenProto(ast)
+// 编译选项，定义在options包里
+type CompileOptions = options.CompileOptions
+
+// 可选的优化遍，按位组合
+const (
+	OPT_CONST_PROP  = 1 << iota // 常量传播：从未被重新赋值的局部常量替换成字面量
+	OPT_DEAD_BRANCH             // 删除条件为常量的if分支和while false循环
+	OPT_PEEPHOLE                // 字节码窥孔优化：多余的MOVE、跳转到跳转、相邻的LOADNIL
+	OPT_NONE        = 0
+	OPT_ALL         = OPT_CONST_PROP | OPT_DEAD_BRANCH | OPT_PEEPHOLE
+)
+
+// 优化遍的名字，命令行上用逗号分隔的名字选择单独的优化遍，比如-Oconst,peephole
+var passNames = []struct {
+	name string
+	pass int
+}{
+	{"const", OPT_CONST_PROP},
+	{"dead", OPT_DEAD_BRANCH},
+	{"peephole", OPT_PEEPHOLE},
+}
+
+// 把逗号分隔的优化遍名字转换成OPT_*的组合，空字符串表示全部优化遍
+func ParsePasses(s string) (int, error) {
+	if s == "" {
+		return OPT_ALL, nil
+	}
+	passes := OPT_NONE
+	for _, name := range strings.Split(s, ",") {
+		found := false
+		for _, p := range passNames {
+			if p.name == name {
+				passes |= p.pass
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown optimization pass '%s'", name)
+		}
+	}
+	return passes, nil
+}
+
+// 按照选项编译源代码，opts为nil时使用默认选项
+// 词法、语法错误和超出限制之类的编译错误以error返回
+// 生成的函数原型记录方言，虚拟机据此选择for循环等指令的语义，Dump据此选择chunk格式
+func Compile(chunk string, opts *CompileOptions) (proto *Prototype, err error) {
+	return compileWith(opts, func(chunkName string, dialect byte) *Block {
+		return ParseDialect(chunk, chunkName, dialect)
+	})
+}
+
+// 按照选项编译语法树，比如ast.DecodeJSON()解码出来的语法树，选项和错误的处理与Compile()相同
+// 优化遍和预定义的局部变量会直接修改block
+func CompileAST(block *Block, opts *CompileOptions) (proto *Prototype, err error) {
+	return compileWith(opts, func(string, byte) *Block {
+		return block
+	})
+}
+
+// 检查选项，用parse得到语法树后编译
+func compileWith(opts *CompileOptions, parse func(chunkName string, dialect byte) *Block) (proto *Prototype, err error) {
+	if opts == nil {
+		opts = &CompileOptions{}
+	}
+	dialect := opts.Dialect
+	switch dialect {
+	case 0:
+		dialect = LUA_DIALECT_53
+	case LUA_DIALECT_53, LUA_DIALECT_54:
+	default:
+		return nil, fmt.Errorf("unsupported dialect 0x%02x", dialect)
+	}
+	for _, name := range opts.Locals {
+		if !IsName(name) {
+			return nil, fmt.Errorf("invalid local name '%s'", name)
+		}
+	}
+
+	// 解析器和代码生成器以panic的形式报告错误，这里把它们转换成error
+	// Go运行时错误是编译器本身的问题，照常抛出
+	defer func() {
+		if r := recover(); r != nil {
+			switch x := r.(type) {
+			case runtime.Error:
+				panic(r)
+			case error:
+				proto, err = nil, x
+			case string:
+				proto, err = nil, errors.New(x)
+			default:
+				panic(r)
+			}
+		}
+	}()
+
+	proto = compile(parse(opts.ChunkName, dialect), opts, dialect)
+	return proto, nil
+}
+
+// 编译时执行选项指定的优化遍：语法树上的优化在生成代码之前，窥孔优化在生成代码之后
+// 常量传播放在删除死分支之前，这样local DEBUG = false; if DEBUG then ... end整个被删除
+func compile(ast *Block, opts *CompileOptions, dialect byte) *Prototype {
+	if len(opts.Locals) > 0 { // 预定义的局部变量放在最前面，占用主函数最前面的寄存器
+		decl := &LocalVarDeclStat{NameList: opts.Locals, ExpList: []Exp{&VarargExp{}}}
+		ast.Stats = append([]Stat{decl}, ast.Stats...)
+	}
+	passes := optPasses(opts)
+	if passes&OPT_CONST_PROP != 0 {
+		optimizer.PropagateConstants(ast)
+	}
+	if passes&OPT_DEAD_BRANCH != 0 {
+		optimizer.EliminateDeadBranches(ast)
+	}
+	proto := GenProtoMaxRegs(ast, opts.ChunkName, opts.MaxRegisters)
+	if passes&OPT_PEEPHOLE != 0 {
+		Peephole(proto)
+	}
+	setSource(proto, opts.ChunkName, dialect)
+	if opts.StripDebug {
+		stripDebug(proto)
+	}
+	return proto
+}
+
+// 选项对应的优化遍，Passes优先于OptLevel
+func optPasses(opts *CompileOptions) int {
+	switch {
+	case opts.Passes != 0:
+		return opts.Passes
+	case opts.OptLevel <= 0:
+		return OPT_NONE
+	case opts.OptLevel == 1:
+		return OPT_PEEPHOLE
+	default:
+		return OPT_ALL
+	}
+}
+
+// 记录源文件名和语言方言，子函数与主函数共享同一个源
+func setSource(proto *Prototype, source string, dialect byte) {
+	proto.Source = source
+	proto.Dialect = dialect
+	for _, p := range proto.Protos {
+		setSource(p, source, dialect)
+	}
+}
+
+// 去掉调试信息，源文件名和官方去掉调试信息的函数一样是"=?"
+// lua-5.3.4/src/ldebug.c#funcinfo()
+func stripDebug(proto *Prototype) {
+	proto.Source = "=?"
+	proto.LineInfo = []uint32{}
+	proto.LocVars = []LocVar{}
+	proto.UpvalueNames = []string{}
+	for i := range proto.Upvalues {
+		proto.Upvalues[i].Name = ""
+	}
+	for _, p := range proto.Protos {
+		stripDebug(p)
+	}
 }
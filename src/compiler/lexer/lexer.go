@@ -3,58 +3,102 @@ package lexer
 import (
 	"bytes"
 	"fmt"
-	"regexp"
-	"strconv"
+	"lua/src/binchunk"
+	"lua/src/number"
 	"strings"
 )
 
-var reNewLine = regexp.MustCompile("\r\n|\n\r|\n|\r")
-var reIdentifier = regexp.MustCompile(`^[_\d\w]+`)
-var reNumber = regexp.MustCompile(`^0[xX][0-9a-fA-F]*(\.[0-9a-fA-F]*)?([pP][+\-]?[0-9]+)?|^[0-9]*(\.[0-9]*)?([eE][+\-]?[0-9]+)?`)
-var reShortStr = regexp.MustCompile(`(?s)(^'(\\\\|\\'|\\\n|\\z\s*|[^'\n])*')|(^"(\\\\|\\"|\\\n|\\z\s*|[^"\n])*")`)
-var reOpeningLongBracket = regexp.MustCompile(`^\[=*\[`)
+// 手写的词法分析器，按字节扫描源代码
+// lua-5.3.4/src/llex.c
+type Lexer struct {
+	source     string       // 源代码
+	chunkName  string       // 源代码名字
+	pos        int          // 下一个要读取的字节的偏移
+	scanLine   int          // 扫描到的位置所在的行号
+	lineStart  int          // 扫描到的位置所在行的起始偏移
+	line       int          // 最近一个token的行号
+	tokenStart int          // 最近一个token在源代码中的起始偏移
+	tokenEnd   int          // 最近一个token在源代码中的结束偏移
+	ahead      scannedToken // 预读的token
+	hasAhead   bool         // 是否有预读的token
+	dialect    byte         // 语言方言，决定是否接受5.4的语法扩展
+	scanStart  int          // 正在扫描的token的起始偏移
+	scanning   bool         // 正在扫描token，出错时说明是词法错误
+	recovering bool         // 错误恢复模式
+	verbatim   bool         // 语法树保持源代码的形式，见SetVerbatim()
+	errors     []*SyntaxError
+	keepTrivia bool     // 保留空白字符和注释，见Tokenize()
+	trivia     []Trivia // 上一个token之后跳过的空白字符和注释
+}
 
-var reDecEscapeSeq = regexp.MustCompile(`^\\[0-9]{1,3}`)
-var reHexEscapeSeq = regexp.MustCompile(`^\\x[0-9a-fA-F]{2}`)
-var reUnicodeEscapeSeq = regexp.MustCompile(`^\\u\{[0-9a-fA-F]+\}`)
+// 扫描出来的token
+type scannedToken struct {
+	line       int    // 行号(token结束处)
+	kind       int    // 类型
+	text       string // 内容，字符串字面量是转义之后的值
+	start, end int    // 在源代码中的偏移
+}
 
-type Lexer struct {
-	chunk         string // 源代码
-	chunkName     string // 源代码名字
-	line          int    // 当前行号
-	nextToken     string // 下一个Token
-	nextTokenKind int    // 下一个Token的类型
-	nextTokenLine int    // 下一个Token的行号
+// 根据文件名和源代码创建Lexer结构体，并将初始行号设置为1
+func NewLexer(chunk, chunkName string) *Lexer {
+	return &Lexer{
+		source:    chunk,
+		chunkName: chunkName,
+		scanLine:  1,
+		line:      1,
+		dialect:   binchunk.LUA_DIALECT_53,
+	}
 }
 
-// 获取下一个token的类型然后恢复
+// 设置语言方言(binchunk.LUA_DIALECT_53或binchunk.LUA_DIALECT_54)
+func (self *Lexer) SetDialect(dialect byte) {
+	self.dialect = dialect
+}
+
+// 返回语言方言
+func (self *Lexer) Dialect() byte {
+	return self.dialect
+}
+
+// 获取下一个token的类型，token被缓存起来留给NextToken()
 func (self *Lexer) LookAhead() int {
-	if self.nextTokenLine > 0 {
-		return self.nextTokenKind
+	if !self.hasAhead {
+		self.ahead = self.scan()
+		self.hasAhead = true
 	}
-	currentLine := self.line
-	line, kind, token := self.NextToken()
-	self.line = currentLine
-	self.nextTokenLine = line
-	self.nextTokenKind = kind
-	self.nextToken = token
-	return kind
+	return self.ahead.kind
 }
 
-// 根据文件名和源代码创建Lexer结构体，并将初始行号设置为1
-func NewLexer(chunk, chunkName string) *Lexer {
-	return &Lexer{chunk, chunkName, 1, "", 0, 0}
+// 返回下一个token的行号
+func (self *Lexer) LookAheadLine() int {
+	self.LookAhead()
+	return self.ahead.line
 }
 
-// 提取指定类型的token
+// 提取指定类型的token，类型不对时报错，出错的token留给错误恢复使用
+// lua-5.3.4/src/lparser.c#checknext()
 func (self *Lexer) NextTokenOfKind(kind int) (line int, token string) {
-	line, kind_, token := self.NextToken()
-	if kind_ != kind {
-		self.error("syntax error near '%s'", token)
+	if self.LookAhead() != kind {
+		self.ErrorNear("%s expected", tokenToString(kind))
 	}
+	line, _, token = self.NextToken()
 	return
 }
 
+// 提取与前面第line行的who配对的token，比如与function配对的end
+// lua-5.3.4/src/lparser.c#check_match()
+func (self *Lexer) CheckMatch(what, who, line int) (int, string) {
+	if self.LookAhead() != what {
+		if self.ahead.line == line {
+			self.ErrorNear("%s expected", tokenToString(what))
+		}
+		self.ErrorNear("%s expected (to close %s at line %d)",
+			tokenToString(what), tokenToString(who), line)
+	}
+	line_, _, token := self.NextToken()
+	return line_, token
+}
+
 // 提取标识符
 func (self *Lexer) NextIdentifier() (line int, name string) {
 	return self.NextTokenOfKind(TOKEN_IDENTIFIER)
@@ -65,221 +109,338 @@ func (self *Lexer) Line() int {
 	return self.line
 }
 
+// 返回最近一个token的起始列号(从1开始)
+func (self *Lexer) Column() int {
+	_, column := self.position(self.tokenStart)
+	return column
+}
+
 // 跳过空白字符和注释，返回下一个token
 func (self *Lexer) NextToken() (line, kind int, token string) {
-	// 查看是否有预读的token
-	if self.nextTokenLine > 0 {
-		line = self.nextTokenLine
-		kind = self.nextTokenKind
-		token = self.nextToken
-		self.line = self.nextTokenLine
-		self.nextTokenLine = 0
-		return
+	var tok scannedToken
+	if self.hasAhead { // 查看是否有预读的token
+		tok = self.ahead
+		self.hasAhead = false
+	} else {
+		tok = self.scan()
 	}
+	self.line = tok.line
+	self.tokenStart, self.tokenEnd = tok.start, tok.end
+	return tok.line, tok.kind, tok.text
+}
+
+// 跳过空白字符和注释，扫描一个token
+func (self *Lexer) scan() scannedToken {
+	self.scanning = true
 	self.skipWhiteSpaces()
-	if len(self.chunk) == 0 {
-		return self.line, TOKEN_EOF, "EOF"
+	start := self.pos
+	self.scanStart = start
+	kind, text := self.scanToken(start)
+	self.scanning = false
+	return scannedToken{line: self.scanLine, kind: kind, text: text, start: start, end: self.pos}
+}
+
+// 扫描一个token，调用前已经跳过了空白字符和注释
+func (self *Lexer) scanToken(start int) (kind int, token string) {
+	if self.pos == len(self.source) {
+		return TOKEN_EOF, "EOF"
 	}
 
-	switch self.chunk[0] {
+	switch self.source[self.pos] {
 	case ';':
 		self.next(1)
-		return self.line, TOKEN_SEP_SEMI, ";"
+		return TOKEN_SEP_SEMI, ";"
 	case ',':
 		self.next(1)
-		return self.line, TOKEN_SEP_COMMA, ","
+		return TOKEN_SEP_COMMA, ","
 	case '(':
 		self.next(1)
-		return self.line, TOKEN_SEP_LPAREN, "("
+		return TOKEN_SEP_LPAREN, "("
 	case ')':
 		self.next(1)
-		return self.line, TOKEN_SEP_RPAREN, ")"
+		return TOKEN_SEP_RPAREN, ")"
 	case ']':
 		self.next(1)
-		return self.line, TOKEN_SEP_RBRACK, "]"
+		return TOKEN_SEP_RBRACK, "]"
 	case '{':
 		self.next(1)
-		return self.line, TOKEN_SEP_LCURLY, "{"
+		return TOKEN_SEP_LCURLY, "{"
 	case '}':
 		self.next(1)
-		return self.line, TOKEN_SEP_RCURLY, "}"
+		return TOKEN_SEP_RCURLY, "}"
 	case '+':
 		self.next(1)
-		return self.line, TOKEN_OP_ADD, "+"
+		return TOKEN_OP_ADD, "+"
 	case '-':
 		self.next(1)
-		return self.line, TOKEN_OP_MINUS, "-"
+		return TOKEN_OP_MINUS, "-"
 	case '*':
 		self.next(1)
-		return self.line, TOKEN_OP_MUL, "*"
+		return TOKEN_OP_MUL, "*"
 	case '^':
 		self.next(1)
-		return self.line, TOKEN_OP_POW, "^"
+		return TOKEN_OP_POW, "^"
 	case '%':
 		self.next(1)
-		return self.line, TOKEN_OP_MOD, "%"
+		return TOKEN_OP_MOD, "%"
 	case '&':
 		self.next(1)
-		return self.line, TOKEN_OP_BAND, "&"
+		return TOKEN_OP_BAND, "&"
 	case '|':
 		self.next(1)
-		return self.line, TOKEN_OP_BOR, "|"
+		return TOKEN_OP_BOR, "|"
 	case '#':
 		self.next(1)
-		return self.line, TOKEN_OP_LEN, "#"
+		return TOKEN_OP_LEN, "#"
 	case ':':
 		if self.test("::") {
 			self.next(2)
-			return self.line, TOKEN_SEP_LABEL, "::"
+			return TOKEN_SEP_LABEL, "::"
 		} else {
 			self.next(1)
-			return self.line, TOKEN_SEP_COLON, ":"
+			return TOKEN_SEP_COLON, ":"
 		}
 	case '/':
 		if self.test("//") {
 			self.next(2)
-			return self.line, TOKEN_OP_IDIV, "//"
+			return TOKEN_OP_IDIV, "//"
 		} else {
 			self.next(1)
-			return self.line, TOKEN_OP_DIV, "/"
+			return TOKEN_OP_DIV, "/"
 		}
 	case '~':
 		if self.test("~=") {
 			self.next(2)
-			return self.line, TOKEN_OP_NE, "~="
+			return TOKEN_OP_NE, "~="
 		} else {
 			self.next(1)
-			return self.line, TOKEN_OP_WAVE, "~"
+			return TOKEN_OP_WAVE, "~"
 		}
 	case '=':
 		if self.test("==") {
 			self.next(2)
-			return self.line, TOKEN_OP_EQ, "=="
+			return TOKEN_OP_EQ, "=="
 		} else {
 			self.next(1)
-			return self.line, TOKEN_OP_ASSIGN, "="
+			return TOKEN_OP_ASSIGN, "="
 		}
 	case '<':
 		if self.test("<<") {
 			self.next(2)
-			return self.line, TOKEN_OP_SHL, "<<"
+			return TOKEN_OP_SHL, "<<"
 		} else if self.test("<=") {
 			self.next(2)
-			return self.line, TOKEN_OP_LE, "<="
+			return TOKEN_OP_LE, "<="
 		} else {
 			self.next(1)
-			return self.line, TOKEN_OP_LT, "<"
+			return TOKEN_OP_LT, "<"
 		}
 	case '>':
 		if self.test(">>") {
 			self.next(2)
-			return self.line, TOKEN_OP_SHR, ">>"
+			return TOKEN_OP_SHR, ">>"
 		} else if self.test(">=") {
 			self.next(2)
-			return self.line, TOKEN_OP_GE, ">="
+			return TOKEN_OP_GE, ">="
 		} else {
 			self.next(1)
-			return self.line, TOKEN_OP_GT, ">"
+			return TOKEN_OP_GT, ">"
 		}
 	case '.':
 		if self.test("...") {
 			self.next(3)
-			return self.line, TOKEN_VARARG, "..."
+			return TOKEN_VARARG, "..."
 		} else if self.test("..") {
 			self.next(2)
-			return self.line, TOKEN_OP_CONCAT, ".."
-		} else if len(self.chunk) == 1 || !isDigit(self.chunk[1]) {
+			return TOKEN_OP_CONCAT, ".."
+		} else if self.pos+1 == len(self.source) || !isDigit(self.source[self.pos+1]) {
 			self.next(1)
-			return self.line, TOKEN_SEP_DOT, "."
+			return TOKEN_SEP_DOT, "."
 		}
 	case '[':
-		if self.test("[[") || self.test("[=") {
-			return self.line, TOKEN_STRING, self.scanLongString()
-		} else {
-			self.next(1)
-			return self.line, TOKEN_SEP_LBRACK, "["
+		if sep, ok := self.longBracket(); ok {
+			return TOKEN_STRING, self.scanLongString(sep, "string")
+		} else if sep > 0 {
+			self.errorAt(start, "'"+self.source[start:start+sep+1]+"'", "invalid long string delimiter")
 		}
+		self.next(1)
+		return TOKEN_SEP_LBRACK, "["
 	case '\'', '"':
-		return self.line, TOKEN_STRING, self.scanShortString()
+		return TOKEN_STRING, self.scanShortString(start)
 	}
 
 	// 数字字面量
-	c := self.chunk[0]
+	c := self.source[self.pos]
 	if c == '.' || isDigit(c) {
-		token := self.scanNumber()
-		return self.line, TOKEN_NUMBER, token
+		return TOKEN_NUMBER, self.scanNumber(start)
 	}
 	// 标识符和关键字
 	if c == '_' || isLetter(c) {
 		token := self.scanIdentifier()
 		// 判断是否是关键字
 		if kind, found := keywords[token]; found {
-			return self.line, kind, token // keyword
+			return kind, token // keyword
 		} else {
-			return self.line, TOKEN_IDENTIFIER, token
+			return TOKEN_IDENTIFIER, token
 		}
 	}
 
-	self.error("unexpected symbol near %q", c)
+	near := fmt.Sprintf("'%c'", c)
+	if c < ' ' || c >= 0x7F { // 不可打印的字符显示为编号
+		near = fmt.Sprintf("'<\\%d>'", c)
+	}
+	self.errorAt(start, near, "unexpected symbol")
 	return
 }
 
+// 在最近一个token的位置报告语法分析器发现的错误，错误信息不带"near"
+// lua-5.3.4/src/lparser.c#semerror()
+func (self *Lexer) Error(f string, a ...interface{}) {
+	self.errorAt(self.tokenStart, "", f, a...)
+}
+
+// 报告下一个token处的语法错误，比如"unexpected symbol near 'x'"
+// lua-5.3.4/src/llex.c#luaX_syntaxerror()
+func (self *Lexer) ErrorNear(f string, a ...interface{}) {
+	self.LookAhead()
+	near := self.txtToken(self.ahead.kind, self.ahead.start, self.ahead.end)
+	self.errorAt(self.ahead.start, near, f, a...)
+}
+
 // 判断是否是数字
 func isDigit(c byte) bool {
 	return '0' <= c && c <= '9'
 }
 
+// 判断是否是十六进制数字
+func isHexDigit(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// 十六进制数字的值
+func hexValue(c byte) int {
+	if isDigit(c) {
+		return int(c - '0')
+	}
+	return int(c|0x20-'a') + 10
+}
+
 // 判断是否是字母
 func isLetter(c byte) bool {
 	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
 }
 
-// 扫描并返回单词
-func (self *Lexer) scanIdentifier() string {
-	return self.scan(reIdentifier)
+// 判断是否是字母、数字或下划线
+func isAlnum(c byte) bool {
+	return c == '_' || isLetter(c) || isDigit(c)
 }
 
-// 扫描并返回数字
-func (self *Lexer) scanNumber() string {
-	return self.scan(reNumber)
+// 判断字符串能不能用作名字：由字母、数字和下划线组成，不以数字开头，不是关键字
+func IsName(s string) bool {
+	if s == "" || isDigit(s[0]) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isAlnum(s[i]) {
+			return false
+		}
+	}
+	_, found := keywords[s]
+	return !found
 }
 
-// 扫描并返回数字或标识符
-func (self *Lexer) scan(re *regexp.Regexp) string {
-	if token := re.FindString(self.chunk); token != "" {
-		self.next(len(token))
-		return token
+// 扫描并返回单词
+func (self *Lexer) scanIdentifier() string {
+	start := self.pos
+	for self.pos < len(self.source) && isAlnum(self.source[self.pos]) {
+		self.pos++
 	}
-	panic("unreachable")
+	return self.source[start:self.pos]
 }
 
-// 跳过空白字符和注释
-func (self *Lexer) skipWhiteSpaces() {
-	for len(self.chunk) > 0 {
-		if self.test("--") {
-			self.skipComment()
-		} else if self.test("\r\n") || self.test("\n\r") {
-			self.next(2)
-			self.line++
-		} else if isNewLine(self.chunk[0]) {
-			self.next(1)
-			self.line++
-		} else if isWhiteSpace(self.chunk[0]) {
-			self.next(1)
+// 扫描并返回数字，先按照数字的样子读入，再检查格式是否正确
+// 紧跟在数字后面的字母也会被读入，所以"3x"会报告malformed number
+// lua-5.3.4/src/llex.c#read_numeral()
+func (self *Lexer) scanNumber(start int) string {
+	src := self.source
+	expo1, expo2 := byte('E'), byte('e')
+	i := self.pos
+	if self.test("0x") || self.test("0X") {
+		expo1, expo2 = 'P', 'p'
+		i += 2
+	}
+	for i < len(src) {
+		if c := src[i]; c == expo1 || c == expo2 {
+			i++
+			if i < len(src) && (src[i] == '+' || src[i] == '-') {
+				i++
+			}
+		} else if isHexDigit(c) || c == '.' {
+			i++
 		} else {
 			break
 		}
 	}
+	if i < len(src) && (src[i] == '_' || isLetter(src[i])) {
+		i++
+	}
+	token := src[self.pos:i]
+	self.pos = i
+	if _, ok := number.ParseInteger(token); !ok {
+		if _, ok := number.ParseFloat(token); !ok {
+			self.errorAt(start, "'"+token+"'", "malformed number")
+		}
+	}
+	return token
+}
+
+// 跳过空白字符和注释
+func (self *Lexer) skipWhiteSpaces() {
+	src := self.source
+	for self.pos < len(src) {
+		start, line, lineStart := self.pos, self.scanLine, self.lineStart
+		var kind int
+		switch c := src[self.pos]; c {
+		case '\n', '\r':
+			self.newLine()
+			kind = TRIVIA_NEWLINE
+		case ' ', '\t', '\v', '\f':
+			self.pos++
+			kind = TRIVIA_WHITESPACE
+		case '-':
+			if !self.test("--") {
+				return
+			}
+			kind = self.skipComment()
+		default:
+			return
+		}
+		if self.keepTrivia {
+			self.addTrivia(kind, start, line, start-lineStart+1)
+		}
+	}
+}
+
+// 跳过一个换行符("\n"、"\r"、"\r\n"或"\n\r")并增加行号
+// lua-5.3.4/src/llex.c#inclinenumber()
+func (self *Lexer) newLine() {
+	c := self.source[self.pos]
+	self.pos++
+	if self.pos < len(self.source) && isNewLine(self.source[self.pos]) && self.source[self.pos] != c {
+		self.pos++
+	}
+	self.scanLine++
+	self.lineStart = self.pos
 }
 
 // 判断剩余的源代码是否以某种字符串开头
 func (self *Lexer) test(s string) bool {
-	return strings.HasPrefix(self.chunk, s)
+	return strings.HasPrefix(self.source[self.pos:], s)
 }
 
 // 跳过n个字符
 func (self *Lexer) next(n int) {
-	self.chunk = self.chunk[n:]
+	self.pos += n
 }
 
 // 判断字符是否是空白字符
@@ -296,170 +457,240 @@ func isNewLine(c byte) bool {
 	return c == '\n' || c == '\r'
 }
 
-// 跳过注释
-func (self *Lexer) skipComment() {
-	self.next(2) // 跳过"--"
-	if self.test("[") {
-		if reOpeningLongBracket.FindString(self.chunk) != "" { // 长注释
-			self.scanLongString()
-			return
-		}
+// 跳过注释，返回注释的种类
+func (self *Lexer) skipComment() int {
+	self.next(2)                           // 跳过"--"
+	if sep, ok := self.longBracket(); ok { // 长注释
+		self.scanLongString(sep, "comment")
+		return TRIVIA_LONG_COMMENT
 	}
 	// 跳过单行注释
-	for len(self.chunk) > 0 && !isNewLine(self.chunk[0]) {
-		self.next(1)
+	for self.pos < len(self.source) && !isNewLine(self.source[self.pos]) {
+		self.pos++
 	}
+	return TRIVIA_COMMENT
 }
 
-// 扫描并返回一个长字符串
-func (self *Lexer) scanLongString() string {
-	// 使用正则表达式寻找长字符串的开头
-	openingLongBracket := reOpeningLongBracket.FindString(self.chunk)
-	if openingLongBracket == "" {
-		self.error("invalid long string delimiter near '%s'", self.chunk[0:2])
+// 检查当前位置是不是长括号的开头，返回'['后面等号的个数
+// lua-5.3.4/src/llex.c#skip_sep()
+func (self *Lexer) longBracket() (sep int, ok bool) {
+	src := self.source
+	if self.pos >= len(src) || src[self.pos] != '[' {
+		return 0, false
 	}
-	// 查找]]
-	closingLongBracket := strings.Replace(openingLongBracket, "[", "]", -1)
-	closingLongBracketIndex := strings.Index(self.chunk, closingLongBracket)
-	// 没找到报错
-	if closingLongBracketIndex < 0 {
-		self.error("unfinished long string or comment")
+	i := self.pos + 1
+	for i < len(src) && src[i] == '=' {
+		i++
 	}
-	// 截取长字符串中间的有效部分
-	str := self.chunk[len(openingLongBracket):closingLongBracketIndex]
-	self.next(closingLongBracketIndex + len(closingLongBracket))
-
-	// 把所有换行符替换为单个换行符,这样做的目的是，即使长字符串中包含多种不同的换行符（例如，Windows 和 Unix 风格的换行符），也可以将它们统一为单个换行符。
-	str = reNewLine.ReplaceAllString(str, "\n")
-	// 统计长字符串中的行数
-	self.line += strings.Count(str, "\n")
+	return i - self.pos - 1, i < len(src) && src[i] == '['
+}
 
-	// 如果字符串以换行符开头，将其删除()
-	// 这样做的原因是，长字符串的开始标记 [[ 和结束标记 ]] 通常都会出现在独立的一行，因此长字符串本身不应该包含这一行
-	if len(str) > 0 && str[0] == '\n' {
-		str = str[1:]
+// 扫描并返回一个长字符串，sep是等号的个数，what是"string"或"comment"，用于生成错误信息
+// lua-5.3.4/src/llex.c#read_long_string()
+func (self *Lexer) scanLongString(sep int, what string) string {
+	line := self.scanLine
+	self.next(sep + 2) // 跳过开头的长括号
+	closing := "]" + strings.Repeat("=", sep) + "]"
+	end := strings.Index(self.source[self.pos:], closing)
+	if end < 0 {
+		self.errorAt(len(self.source), EOFMARK, "unfinished long %s (starting at line %d)", what, line)
+	}
+	end += self.pos
+	if self.pos < end && isNewLine(self.source[self.pos]) { // 跳过紧跟在开头长括号后面的换行符
+		self.newLine()
+	}
+	start := self.pos
+	// 统计行数，所有换行符都替换为"\n"
+	plain := true
+	for self.pos < end {
+		if c := self.source[self.pos]; isNewLine(c) {
+			if c == '\r' || self.pos+1 < end && self.source[self.pos+1] == '\r' {
+				plain = false
+			}
+			self.newLine()
+		} else {
+			self.pos++
+		}
+	}
+	str := self.source[start:end]
+	self.pos = end + len(closing)
+	if plain {
+		return str
 	}
-	return str
+	return normalizeNewLines(str)
 }
 
-// 抛出错误信息
-func (self *Lexer) error(f string, a ...interface{}) {
-	err := fmt.Sprintf(f, a...)
-	err = fmt.Sprintf("%s:%d: %s", self.chunkName, self.line, err)
-	panic(err)
+// 把"\r\n"、"\n\r"和"\r"都替换为"\n"
+func normalizeNewLines(str string) string {
+	buf := make([]byte, 0, len(str))
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if isNewLine(c) {
+			if i+1 < len(str) && isNewLine(str[i+1]) && str[i+1] != c {
+				i++
+			}
+			c = '\n'
+		}
+		buf = append(buf, c)
+	}
+	return string(buf)
 }
 
 // 扫描并返回短字符串
-func (self *Lexer) scanShortString() string {
-	// 使用正则表达式提取短字符串
-	if str := reShortStr.FindString(self.chunk); str != "" {
-		self.next(len(str))
-		// 去掉两段引号
-		str = str[1 : len(str)-1]
-		// 替换转义字符
-		if strings.Index(str, `\`) >= 0 {
-			self.line += len(reNewLine.FindAllString(str, -1))
-			str = self.escape(str)
-		}
+// lua-5.3.4/src/llex.c#read_string()
+func (self *Lexer) scanShortString(start int) string {
+	src := self.source
+	quote := src[self.pos]
+	self.pos++
+	// 没有转义字符的字符串直接返回源代码的片段
+	i := self.pos
+	for i < len(src) && src[i] != quote && src[i] != '\\' && !isNewLine(src[i]) {
+		i++
+	}
+	if i < len(src) && src[i] == quote {
+		str := src[self.pos:i]
+		self.pos = i + 1
 		return str
 	}
-	self.error("unfinished string")
-	return ""
-}
 
-// 替换转义字符
-func (self *Lexer) escape(str string) string {
 	var buf bytes.Buffer
-
-	for len(str) > 0 {
-		if str[0] != '\\' {
-			buf.WriteByte(str[0])
-			str = str[1:]
-			continue
+	buf.WriteString(src[self.pos:i])
+	self.pos = i
+	for {
+		if self.pos == len(src) {
+			self.errorAt(len(src), EOFMARK, "unfinished string")
 		}
-
-		if len(str) == 1 {
-			self.error("unfinished string")
+		switch c := src[self.pos]; {
+		case c == quote:
+			self.pos++
+			return buf.String()
+		case isNewLine(c):
+			self.errorAt(start, "'"+src[start:self.pos]+"'", "unfinished string")
+		case c == '\\':
+			self.escape(start, &buf)
+		default:
+			buf.WriteByte(c)
+			self.pos++
 		}
+	}
+}
 
-		switch str[1] {
-		case 'a':
-			buf.WriteByte('\a')
-			str = str[2:]
-			continue
-		case 'b':
-			buf.WriteByte('\b')
-			str = str[2:]
-			continue
-		case 'f':
-			buf.WriteByte('\f')
-			str = str[2:]
-			continue
-		case 'n', '\n':
-			buf.WriteByte('\n')
-			str = str[2:]
-			continue
-		case 'r':
-			buf.WriteByte('\r')
-			str = str[2:]
-			continue
-		case 't':
-			buf.WriteByte('\t')
-			str = str[2:]
-			continue
-		case 'v':
-			buf.WriteByte('\v')
-			str = str[2:]
-			continue
-		case '"':
-			buf.WriteByte('"')
-			str = str[2:]
-			continue
-		case '\'':
-			buf.WriteByte('\'')
-			str = str[2:]
-			continue
-		case '\\':
-			buf.WriteByte('\\')
-			str = str[2:]
-			continue
-		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9': // \ddd(ASCII 码)
-			// 查找转义序列
-			if found := reDecEscapeSeq.FindString(str); found != "" {
-				d, _ := strconv.ParseInt(found[1:], 10, 32)
-				if d <= 0xFF { // 0 <= d <= 255 超过报错
-					buf.WriteByte(byte(d))
-					str = str[len(found):]
-					continue
-				}
-				self.error("decimal escape too large near '%s'", found)
-			}
-		case 'x': // \xXX (十六进制)
-			if found := reHexEscapeSeq.FindString(str); found != "" {
-				d, _ := strconv.ParseInt(found[2:], 16, 32)
-				buf.WriteByte(byte(d))
-				str = str[len(found):]
-				continue
-			}
-		case 'u': // \u{XXX} (Unicode)
-			if found := reUnicodeEscapeSeq.FindString(str); found != "" {
-				d, err := strconv.ParseInt(found[3:len(found)-1], 16, 32)
-				if err == nil && d <= 0x10FFFF {
-					buf.WriteRune(rune(d))
-					str = str[len(found):]
-					continue
-				}
-				self.error("UTF-8 value too large near '%s'", found)
-			}
-		case 'z': // \z (空白)
-			str = str[2:]
-			for len(str) > 0 && isWhiteSpace(str[0]) { // todo
-				str = str[1:]
+// 处理转义序列，当前位置是反斜杠
+func (self *Lexer) escape(start int, buf *bytes.Buffer) {
+	src := self.source
+	self.pos++ // 跳过反斜杠
+	if self.pos == len(src) {
+		return // 由调用者报告unfinished string
+	}
+	switch c := src[self.pos]; c {
+	case 'a':
+		buf.WriteByte('\a')
+	case 'b':
+		buf.WriteByte('\b')
+	case 'f':
+		buf.WriteByte('\f')
+	case 'n':
+		buf.WriteByte('\n')
+	case 'r':
+		buf.WriteByte('\r')
+	case 't':
+		buf.WriteByte('\t')
+	case 'v':
+		buf.WriteByte('\v')
+	case '\\', '"', '\'':
+		buf.WriteByte(c)
+	case '\n', '\r': // 反斜杠加换行
+		buf.WriteByte('\n')
+		self.newLine()
+		return
+	case 'x': // \xXX (十六进制)
+		self.pos++
+		r := self.hexDigit(start) << 4
+		self.pos++
+		r += self.hexDigit(start)
+		buf.WriteByte(byte(r))
+	case 'u': // \u{XXX} (Unicode)
+		self.utf8Escape(start, buf)
+	case 'z': // \z (跳过后面的空白和换行)
+		self.pos++
+		for self.pos < len(src) && isWhiteSpace(src[self.pos]) {
+			if isNewLine(src[self.pos]) {
+				self.newLine()
+			} else {
+				self.pos++
 			}
-			continue
 		}
-		self.error("invalid escape sequence near '\\%c'", str[1])
+		return
+	default:
+		if !isDigit(c) {
+			self.escapeCheck(start, false, "invalid escape sequence")
+		}
+		// \ddd(ASCII 码)，最多3位十进制数字
+		r := 0
+		for i := 0; i < 3 && self.pos < len(src) && isDigit(src[self.pos]); i++ {
+			r = r*10 + int(src[self.pos]-'0')
+			self.pos++
+		}
+		self.escapeCheck(start, r <= 0xFF, "decimal escape too large")
+		buf.WriteByte(byte(r))
+		return
 	}
+	self.pos++
+}
 
-	return buf.String()
+// 读取一个十六进制数字
+func (self *Lexer) hexDigit(start int) int {
+	self.escapeCheck(start, self.pos < len(self.source) && isHexDigit(self.source[self.pos]),
+		"hexadecimal digit expected")
+	return hexValue(self.source[self.pos])
+}
+
+// 处理\u{XXX}，编码方式和官方Lua一样，代理区的码点也按照UTF-8的规则编码
+// lua-5.3.4/src/llex.c#utf8esc()
+func (self *Lexer) utf8Escape(start int, buf *bytes.Buffer) {
+	src := self.source
+	self.pos++
+	self.escapeCheck(start, self.pos < len(src) && src[self.pos] == '{', "missing '{'")
+	self.pos++
+	r := self.hexDigit(start) // 至少要有一个数字
+	for self.pos++; self.pos < len(src) && isHexDigit(src[self.pos]); self.pos++ {
+		r = r<<4 + hexValue(src[self.pos])
+		self.escapeCheck(start, r <= 0x10FFFF, "UTF-8 value too large")
+	}
+	self.escapeCheck(start, self.pos < len(src) && src[self.pos] == '}', "missing '}'")
+	buf.Write(utf8Encode(r))
+}
+
+// 把码点编码成UTF-8
+// lua-5.3.4/src/lobject.c#luaO_utf8esc()
+func utf8Encode(x int) []byte {
+	if x < 0x80 {
+		return []byte{byte(x)}
+	}
+	var buf [8]byte
+	n := 1
+	mfb := 0x3f // 第一个字节能放下的最大值
+	for {
+		buf[8-n] = byte(0x80 | x&0x3f)
+		n++
+		x >>= 6
+		mfb >>= 1
+		if x <= mfb {
+			break
+		}
+	}
+	buf[8-n] = byte(^mfb<<1 | x)
+	return buf[8-n:]
+}
+
+// 检查转义序列，不满足条件时报错，错误信息显示从字符串开头到出错位置的原始文本
+// lua-5.3.4/src/llex.c#esccheck()
+func (self *Lexer) escapeCheck(start int, ok bool, msg string) {
+	if !ok {
+		end := self.pos
+		if end < len(self.source) {
+			end++ // 包括出错的字符
+		}
+		self.errorAt(start, "'"+self.source[start:end]+"'", msg)
+	}
 }
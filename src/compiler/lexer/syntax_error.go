@@ -0,0 +1,155 @@
+package lexer
+
+import (
+	"fmt"
+	"lua/src/binchunk"
+)
+
+// 语法错误，词法分析和语法分析阶段发现的错误都以*SyntaxError的形式抛出
+// Error()返回的信息和官方Lua一致，交互模式和编辑器可以直接使用其中的位置信息
+type SyntaxError struct {
+	ChunkName string // 源代码名字
+	Line      int    // 出错的行号
+	Column    int    // 出错的列号(从1开始，按字节计算)
+	Token     string // 出错位置的token，如"'x'"或"<eof>"，为空表示不附加"near"
+	Msg       string // 错误描述
+}
+
+// lua-5.3.4/src/llex.c#lexerror()
+func (self *SyntaxError) Error() string {
+	msg := fmt.Sprintf("%s:%d: %s", binchunk.ChunkID(self.ChunkName), self.Line, self.Msg)
+	if self.Token != "" {
+		msg += " near " + self.Token
+	}
+	return msg
+}
+
+// 输入是否在结束之前就出错了，交互模式据此判断还需要继续读入
+func (self *SyntaxError) Incomplete() bool {
+	return self.Token == EOFMARK
+}
+
+// 表示输入结束的token文本
+const EOFMARK = "<eof>"
+
+// 在源代码偏移为offset的位置抛出语法错误
+func (self *Lexer) errorAt(offset int, near, f string, a ...interface{}) {
+	line, column := self.position(offset)
+	panic(&SyntaxError{
+		ChunkName: self.chunkName,
+		Line:      line,
+		Column:    column,
+		Token:     near,
+		Msg:       fmt.Sprintf(f, a...),
+	})
+}
+
+// 计算偏移对应的行号和列号，换行符的处理和skipWhiteSpaces()一致
+func (self *Lexer) position(offset int) (line, column int) {
+	if self.lineStart <= offset && offset <= self.pos { // 在正在扫描的行上
+		return self.scanLine, offset - self.lineStart + 1
+	}
+	line, lineStart := 1, 0
+	for i := 0; i < offset; i++ {
+		if c := self.source[i]; isNewLine(c) {
+			if i+1 < len(self.source) && isNewLine(self.source[i+1]) && self.source[i+1] != c {
+				i++ // \r\n或\n\r
+			}
+			line++
+			lineStart = i + 1
+		}
+	}
+	return line, offset - lineStart + 1
+}
+
+// 返回token在错误信息中的文本：源代码中的原始文本加引号，输入结束为<eof>
+// lua-5.3.4/src/llex.c#txtToken()
+func (self *Lexer) txtToken(kind, start, end int) string {
+	if kind == TOKEN_EOF {
+		return EOFMARK
+	}
+	return "'" + self.source[start:end] + "'"
+}
+
+// 返回token类型在错误信息中的名字
+// lua-5.3.4/src/llex.c#luaX_token2str()
+func tokenToString(kind int) string {
+	switch kind {
+	case TOKEN_EOF:
+		return EOFMARK
+	case TOKEN_IDENTIFIER:
+		return "<name>"
+	case TOKEN_STRING:
+		return "<string>"
+	case TOKEN_NUMBER:
+		return "<number>"
+	}
+	if s, ok := symbols[kind]; ok {
+		return "'" + s + "'"
+	}
+	for name, k := range keywords {
+		if k == kind {
+			return "'" + name + "'"
+		}
+	}
+	return "?"
+}
+
+// 开启或关闭错误恢复模式，开启后语法分析器遇到错误时记录下来并继续分析
+func (self *Lexer) SetRecovering(recovering bool) {
+	self.recovering = recovering
+}
+
+// 是否处于错误恢复模式
+func (self *Lexer) Recovering() bool {
+	return self.recovering
+}
+
+// 开启或关闭verbatim模式，开启后语法分析器不折叠常量，并且保留所有圆括号，
+// 生成的语法树和源代码一一对应，供格式化工具使用
+func (self *Lexer) SetVerbatim(verbatim bool) {
+	self.verbatim = verbatim
+}
+
+// 是否处于verbatim模式
+func (self *Lexer) Verbatim() bool {
+	return self.verbatim
+}
+
+// 返回错误恢复模式下记录的全部错误
+func (self *Lexer) Errors() []*SyntaxError {
+	return self.errors
+}
+
+// 记录一个错误，如果是词法错误还要跳过出错的源代码，保证下次读取token时能够前进
+// 同一位置的重复错误只记录一次
+func (self *Lexer) Recover(err *SyntaxError) {
+	if n := len(self.errors); n == 0 ||
+		self.errors[n-1].Line != err.Line || self.errors[n-1].Column != err.Column {
+		self.errors = append(self.errors, err)
+	}
+	if !self.scanning {
+		return
+	}
+	self.scanning = false
+	src := self.source
+	switch {
+	case err.Token == EOFMARK: // 没有结束的字符串或长注释，剩下的源代码都属于它
+		self.pos = len(src)
+	case src[self.scanStart] == '\'' || src[self.scanStart] == '"': // 跳过出错的短字符串
+		quote := src[self.scanStart]
+		i := self.scanStart + 1
+		for ; i < len(src) && src[i] != quote && !isNewLine(src[i]); i++ {
+			if src[i] == '\\' && i+1 < len(src) && !isNewLine(src[i+1]) {
+				i++
+			}
+		}
+		if i < len(src) && src[i] == quote {
+			i++
+		}
+		self.pos = i
+	case self.pos > self.scanStart: // 出错的token已经读完了
+	default:
+		self.pos++
+	}
+}
@@ -90,3 +90,40 @@ var keywords = map[string]int{
 	"until":    TOKEN_KW_UNTIL,
 	"while":    TOKEN_KW_WHILE,
 }
+
+// 分隔符和运算符的文本，用于生成错误信息
+var symbols = map[int]string{
+	TOKEN_VARARG:     "...",
+	TOKEN_SEP_SEMI:   ";",
+	TOKEN_SEP_COMMA:  ",",
+	TOKEN_SEP_DOT:    ".",
+	TOKEN_SEP_COLON:  ":",
+	TOKEN_SEP_LABEL:  "::",
+	TOKEN_SEP_LPAREN: "(",
+	TOKEN_SEP_RPAREN: ")",
+	TOKEN_SEP_LBRACK: "[",
+	TOKEN_SEP_RBRACK: "]",
+	TOKEN_SEP_LCURLY: "{",
+	TOKEN_SEP_RCURLY: "}",
+	TOKEN_OP_ASSIGN:  "=",
+	TOKEN_OP_MINUS:   "-",
+	TOKEN_OP_WAVE:    "~",
+	TOKEN_OP_ADD:     "+",
+	TOKEN_OP_MUL:     "*",
+	TOKEN_OP_DIV:     "/",
+	TOKEN_OP_IDIV:    "//",
+	TOKEN_OP_POW:     "^",
+	TOKEN_OP_MOD:     "%",
+	TOKEN_OP_BAND:    "&",
+	TOKEN_OP_BOR:     "|",
+	TOKEN_OP_SHR:     ">>",
+	TOKEN_OP_SHL:     "<<",
+	TOKEN_OP_CONCAT:  "..",
+	TOKEN_OP_LT:      "<",
+	TOKEN_OP_LE:      "<=",
+	TOKEN_OP_GT:      ">",
+	TOKEN_OP_GE:      ">=",
+	TOKEN_OP_EQ:      "==",
+	TOKEN_OP_NE:      "~=",
+	TOKEN_OP_LEN:     "#",
+}
@@ -0,0 +1,125 @@
+package lexer
+
+import "strings"
+
+// 无损的token流，供格式化、文档提取等工具使用
+// 空白字符、换行符和注释不会被丢弃，而是作为trivia挂在相邻的token上：
+// 如果token和下一个token之间有换行，token后面同一行上的trivia(不含换行符)是这个token的Trailing，
+// 其余的trivia都是下一个token的Leading。把所有token按顺序拼接起来(见Source())正好得到源代码
+
+const (
+	TRIVIA_WHITESPACE   = iota // 空格、制表符等，连续的空白字符合并成一个
+	TRIVIA_NEWLINE             // 一个换行符("\n"、"\r"、"\r\n"或"\n\r")
+	TRIVIA_COMMENT             // 单行注释，不含结尾的换行符
+	TRIVIA_LONG_COMMENT        // 长注释--[[ ]]
+	TRIVIA_SHEBANG             // 第一行以'#'开头的注释(比如Unix的shebang)，不含结尾的换行符
+)
+
+type Trivia struct {
+	Kind   int    // TRIVIA_*
+	Text   string // 源代码中的原始文本
+	Offset int    // 在源代码中的字节偏移
+	Line   int    // 起始行号
+	Column int    // 起始列号(从1开始，按字节计算)
+}
+
+type Token struct {
+	Kind     int    // TOKEN_*
+	Text     string // 源代码中的原始文本，TOKEN_EOF为空
+	Value    string // 和Lexer.NextToken()返回的一样，字符串字面量是转义之后的值
+	Offset   int    // 在源代码中的字节偏移
+	Line     int    // 起始行号
+	LastLine int    // 结束行号，长字符串可能跨越多行
+	Column   int    // 起始列号(从1开始，按字节计算)
+	Leading  []Trivia
+	Trailing []Trivia
+}
+
+// 记录跳过的trivia，连续的空白字符合并成一个
+func (self *Lexer) addTrivia(kind, start, line, column int) {
+	if n := len(self.trivia); n > 0 && kind == TRIVIA_WHITESPACE {
+		if last := &self.trivia[n-1]; last.Kind == TRIVIA_WHITESPACE && last.Offset+len(last.Text) == start {
+			last.Text = self.source[last.Offset:self.pos]
+			return
+		}
+	}
+	self.trivia = append(self.trivia, Trivia{kind, self.source[start:self.pos], start, line, column})
+}
+
+// 第一行以'#'开头(比如Unix的shebang)时跳过这一行，保留换行符使行号不变
+// LoadFile()、luac和各个工具都用它处理源文件的第一行
+// lua-5.3.4/src/lauxlib.c#skipcomment()
+func SkipShebang(chunk string) string {
+	if strings.HasPrefix(chunk, "#") {
+		if i := strings.IndexAny(chunk, "\r\n"); i >= 0 {
+			return chunk[i:]
+		}
+		return ""
+	}
+	return chunk
+}
+
+// 把源代码切分成带trivia的token，最后一个token是TOKEN_EOF
+// 遇到词法错误时返回已经切分出来的token和*SyntaxError
+func Tokenize(chunk, chunkName string, dialect byte) (tokens []*Token, err error) {
+	l := NewLexer(chunk, chunkName)
+	l.SetDialect(dialect)
+	l.keepTrivia = true
+	if end := len(chunk) - len(SkipShebang(chunk)); end > 0 {
+		l.trivia = append(l.trivia, Trivia{TRIVIA_SHEBANG, chunk[:end], 0, 1, 1})
+		l.pos = end
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*SyntaxError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	var prev *Token
+	for prev == nil || prev.Kind != TOKEN_EOF {
+		l.scanning = true
+		l.skipWhiteSpaces()
+		start := l.pos
+		tok := &Token{Offset: start, Line: l.scanLine, Column: start - l.lineStart + 1}
+		l.scanStart = start
+		tok.Kind, tok.Value = l.scanToken(start)
+		l.scanning = false
+		tok.Text, tok.LastLine = chunk[start:l.pos], l.scanLine
+
+		trivia := l.trivia
+		l.trivia = nil
+		if prev != nil { // 同一行上的trivia属于前一个token
+			i := 0
+			for i < len(trivia) && trivia[i].Kind != TRIVIA_NEWLINE {
+				i++
+			}
+			if i == len(trivia) && tok.Kind != TOKEN_EOF {
+				i = 0 // 两个token之间没有换行时，trivia属于后一个token
+			}
+			prev.Trailing, trivia = trivia[:i], trivia[i:]
+		}
+		tok.Leading = trivia
+		tokens = append(tokens, tok)
+		prev = tok
+	}
+	return tokens, nil
+}
+
+// 把token按顺序拼接起来，还原源代码
+func Source(tokens []*Token) string {
+	var buf strings.Builder
+	for _, tok := range tokens {
+		for _, t := range tok.Leading {
+			buf.WriteString(t.Text)
+		}
+		buf.WriteString(tok.Text)
+		for _, t := range tok.Trailing {
+			buf.WriteString(t.Text)
+		}
+	}
+	return buf.String()
+}
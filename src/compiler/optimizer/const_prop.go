@@ -0,0 +1,196 @@
+package optimizer
+
+import (
+	. "lua/src/compiler/ast"
+	"lua/src/compiler/parser"
+)
+
+/* 常量传播 */
+
+// 用字面量初始化并且在作用域内(包括内层函数)从来没有被重新赋值的局部变量，
+// 把读取它的地方替换成字面量，然后重新折叠常量表达式
+// 局部变量的声明保留不动，寄存器分配和没有优化时一样
+// 替换之后新得到的常量(比如local b = a + 1)在下一轮传播，直到没有变化为止
+func PropagateConstants(block *Block) {
+	for {
+		p := &propagator{refs: map[*NameExp]*constVar{}}
+		p.block(block)
+		changed := false
+		Rewrite(block, func(node Node) Node {
+			switch x := node.(type) {
+			case *NameExp:
+				if v := p.refs[x]; v != nil && v.value != nil && !v.assigned {
+					changed = true
+					return copyLiteral(v.value, x.Line)
+				}
+			case *ParensExp:
+				if isLiteral(x.Exp) { // 圆括号只对多重返回值有意义
+					return x.Exp
+				}
+			case *BinopExp, *UnopExp:
+				return parser.Fold(x)
+			}
+			return node
+		})
+		if !changed {
+			return
+		}
+	}
+}
+
+// 局部变量，value是初始化它的字面量，不能传播时为nil
+type constVar struct {
+	value    Exp
+	assigned bool // 是否被重新赋值过
+}
+
+// 按作用域解析名字，记录每个读取局部变量的NameExp对应的变量
+type propagator struct {
+	scopes []map[string]*constVar
+	refs   map[*NameExp]*constVar
+}
+
+func (self *propagator) enterScope() {
+	self.scopes = append(self.scopes, map[string]*constVar{})
+}
+
+func (self *propagator) exitScope() {
+	self.scopes = self.scopes[:len(self.scopes)-1]
+}
+
+func (self *propagator) declare(name string, value Exp) {
+	self.scopes[len(self.scopes)-1][name] = &constVar{value: value}
+}
+
+// 名字对应的局部变量，全局变量返回nil
+func (self *propagator) lookup(name string) *constVar {
+	for i := len(self.scopes) - 1; i >= 0; i-- {
+		if v, ok := self.scopes[i][name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+func (self *propagator) block(block *Block) {
+	self.enterScope()
+	self.stats(block)
+	self.exitScope()
+}
+
+// 不进入新的作用域，repeat的条件表达式可以看到循环体里的局部变量
+func (self *propagator) stats(block *Block) {
+	for _, stat := range block.Stats {
+		self.stat(stat)
+	}
+	self.exps(block.RetExps)
+}
+
+func (self *propagator) stat(stat Stat) {
+	switch x := stat.(type) {
+	case *DoStat:
+		self.block(x.Block)
+	case *WhileStat:
+		self.exp(x.Exp)
+		self.block(x.Block)
+	case *RepeatStat:
+		self.enterScope()
+		self.stats(x.Block)
+		self.exp(x.Exp)
+		self.exitScope()
+	case *IfStat:
+		for i, exp := range x.Exps {
+			self.exp(exp)
+			self.block(x.Blocks[i])
+		}
+	case *ForNumStat:
+		self.exps([]Exp{x.InitExp, x.LimitExp, x.StepExp})
+		self.enterScope()
+		self.declare(x.VarName, nil)
+		self.block(x.Block)
+		self.exitScope()
+	case *ForInStat:
+		self.exps(x.ExpList)
+		self.enterScope()
+		for _, name := range x.NameList {
+			self.declare(name, nil)
+		}
+		self.block(x.Block)
+		self.exitScope()
+	case *LocalVarDeclStat:
+		self.exps(x.ExpList)
+		for i, name := range x.NameList {
+			var value Exp
+			if i < len(x.ExpList) && isLiteral(x.ExpList[i]) && name != "_ENV" &&
+				(x.AttribList == nil || x.AttribList[i] != "close") {
+				value = x.ExpList[i]
+			}
+			self.declare(name, value)
+		}
+	case *LocalFuncDefStat:
+		self.declare(x.Name, nil)
+		self.exp(x.Exp)
+	case *AssignStat:
+		for _, v := range x.VarList {
+			switch v := v.(type) {
+			case *NameExp:
+				if lv := self.lookup(v.Name); lv != nil {
+					lv.assigned = true
+				}
+			case *TableAccessExp:
+				self.prefixExp(v.PrefixExp)
+				self.exp(v.KeyExp)
+			}
+		}
+		self.exps(x.ExpList)
+	case *FuncCallStat:
+		self.exp(x)
+	}
+}
+
+func (self *propagator) exps(exps []Exp) {
+	for _, exp := range exps {
+		self.exp(exp)
+	}
+}
+
+func (self *propagator) exp(exp Exp) {
+	switch x := exp.(type) {
+	case *NameExp:
+		if v := self.lookup(x.Name); v != nil {
+			self.refs[x] = v
+		}
+	case *UnopExp:
+		self.exp(x.Exp)
+	case *BinopExp:
+		self.exp(x.Exp1)
+		self.exp(x.Exp2)
+	case *ConcatExp:
+		self.exps(x.Exps)
+	case *ParensExp:
+		self.exp(x.Exp)
+	case *TableConstructorExp:
+		self.exps(x.KeyExps)
+		self.exps(x.ValExps)
+	case *FuncDefExp:
+		self.enterScope()
+		for _, param := range x.ParList {
+			self.declare(param, nil)
+		}
+		self.block(x.Block)
+		self.exitScope()
+	case *TableAccessExp:
+		self.prefixExp(x.PrefixExp)
+		self.exp(x.KeyExp)
+	case *FuncCallExp:
+		self.prefixExp(x.PrefixExp)
+		self.exps(x.Args)
+	}
+}
+
+// 被调用或者被索引的表达式保持原样，nil()和nil.x这样的代码没有意义
+func (self *propagator) prefixExp(exp Exp) {
+	if _, ok := exp.(*NameExp); !ok {
+		self.exp(exp)
+	}
+}
@@ -0,0 +1,111 @@
+package optimizer
+
+import (
+	. "lua/src/compiler/ast"
+)
+
+/* 删除死分支 */
+
+// 删除条件一定为假的if分支和while false循环，条件一定为真的分支之后的分支也执行不到
+// 只剩下一个条件为真的分支时，if语句变成do语句，保留代码块的作用域
+// 有些错误要到生成代码时才能发现，包含这些代码的分支不删除，让错误照常报告
+func EliminateDeadBranches(block *Block) {
+	readOnly := readOnlyNames(block)
+	Rewrite(block, func(node Node) Node {
+		switch x := node.(type) {
+		case *IfStat:
+			return eliminateIf(x, readOnly)
+		case *WhileStat:
+			if isFalse(x.Exp) && removable(x.Block, readOnly) {
+				return nil
+			}
+		}
+		return node
+	})
+}
+
+func eliminateIf(stat *IfStat, readOnly map[string]bool) Stat {
+	var exps []Exp
+	var blocks []*Block
+	for i, exp := range stat.Exps {
+		if isFalse(exp) && removable(stat.Blocks[i], readOnly) {
+			continue
+		}
+		exps = append(exps, exp)
+		blocks = append(blocks, stat.Blocks[i])
+		if isTrue(exp) { // 后面的分支执行不到
+			for _, b := range stat.Blocks[i+1:] {
+				if !removable(b, readOnly) {
+					exps = append(exps, stat.Exps[i+1:]...)
+					blocks = append(blocks, stat.Blocks[i+1:]...)
+					break
+				}
+			}
+			break
+		}
+	}
+	if len(exps) == 0 {
+		return nil
+	}
+	if len(exps) == 1 && isTrue(exps[0]) {
+		return &DoStat{Line: stat.Line, LastLine: stat.LastLine, Block: blocks[0]}
+	}
+	stat.Exps, stat.Blocks = exps, blocks
+	return stat
+}
+
+// 代码块能否删除：不含goto和标签(生成代码时报错)、不在可变参数函数里的...、
+// 不在循环里的break，并且没有给和const或close变量同名的变量赋值
+// 代码块所在的函数是不是可变参数函数这里不知道，所以代码块本身的...也不删除
+func removable(block *Block, readOnly map[string]bool) bool {
+	ok := true
+	var visit func(node Node, inLoop, vararg bool)
+	visit = func(node Node, inLoop, vararg bool) {
+		Inspect(node, func(n Node) bool {
+			if n == node || n == nil {
+				return ok
+			}
+			switch x := n.(type) {
+			case *GotoStat, *LabelStat:
+				ok = false
+			case *VarargExp:
+				ok = ok && vararg
+			case *BreakStat:
+				ok = ok && inLoop
+			case *AssignStat:
+				for _, v := range x.VarList {
+					if name, isName := v.(*NameExp); isName && readOnly[name.Name] {
+						ok = false
+					}
+				}
+			case *WhileStat, *RepeatStat, *ForNumStat, *ForInStat:
+				if !inLoop {
+					visit(n, true, vararg)
+					return false
+				}
+			case *FuncDefExp: // 函数体里的break和...只和这个函数有关
+				visit(x.Block, false, x.IsVararg)
+				return false
+			}
+			return ok
+		})
+	}
+	visit(block, false, false)
+	return ok
+}
+
+// 声明时带有const或close属性的局部变量名
+func readOnlyNames(block *Block) map[string]bool {
+	names := map[string]bool{}
+	Inspect(block, func(n Node) bool {
+		if x, ok := n.(*LocalVarDeclStat); ok {
+			for i, attrib := range x.AttribList {
+				if attrib != "" {
+					names[x.NameList[i]] = true
+				}
+			}
+		}
+		return true
+	})
+	return names
+}
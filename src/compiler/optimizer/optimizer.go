@@ -0,0 +1,55 @@
+package optimizer
+
+import (
+	. "lua/src/compiler/ast"
+)
+
+// 语法树上的优化遍，在解析之后、生成代码之前执行，只做不改变程序语义的变换
+// 解析时已经折叠了字面量上的运算，这里的优化遍在替换或删除节点之后会再次折叠
+
+// 字面量：nil、布尔值、数字和字符串
+func isLiteral(exp Exp) bool {
+	switch exp.(type) {
+	case *NilExp, *TrueExp, *FalseExp, *IntegerExp, *FloatExp, *StringExp:
+		return true
+	}
+	return false
+}
+
+// 复制字面量，新节点使用引用处的行号
+// 解析时的折叠会直接修改字面量节点(比如取负)，所以同一个节点不能放到多个地方
+func copyLiteral(exp Exp, line int) Exp {
+	switch x := exp.(type) {
+	case *NilExp:
+		return &NilExp{Line: line}
+	case *TrueExp:
+		return &TrueExp{Line: line}
+	case *FalseExp:
+		return &FalseExp{Line: line}
+	case *IntegerExp:
+		return &IntegerExp{Line: line, Val: x.Val}
+	case *FloatExp:
+		return &FloatExp{Line: line, Val: x.Val}
+	case *StringExp:
+		return &StringExp{Line: line, Str: x.Str}
+	}
+	panic("not a literal")
+}
+
+// 值一定为假的字面量
+func isFalse(exp Exp) bool {
+	switch exp.(type) {
+	case *NilExp, *FalseExp:
+		return true
+	}
+	return false
+}
+
+// 值一定为真的字面量
+func isTrue(exp Exp) bool {
+	switch exp.(type) {
+	case *TrueExp, *IntegerExp, *FloatExp, *StringExp:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,14 @@
+package options
+
+// 编译文本chunk的选项，零值表示默认选项：5.3方言、不优化、保留调试信息
+// 单独放在这个包里而不是compiler包里，是因为compiler包间接依赖api包，api包的LoadWithOptions()又要用到它
+// compiler包里的compiler.CompileOptions是它的别名
+type CompileOptions struct {
+	ChunkName    string   // chunk名字，用在错误信息和函数原型的源文件名里
+	Dialect      byte     // 语言方言，0等同于binchunk.LUA_DIALECT_53
+	OptLevel     int      // 优化级别：0不优化，1只做字节码窥孔优化，2及以上执行全部优化遍
+	Passes       int      // 按位指定优化遍(compiler.OPT_*)，不为0时代替OptLevel
+	StripDebug   bool     // 去掉调试信息：源文件名、行号表、局部变量表和Upvalue名
+	Locals       []string // 预定义的局部变量，依次取得主函数的参数，相当于在源代码前面加上local a, b = ...
+	MaxRegisters int      // 每个函数可以使用的寄存器数量(不含)，0或者超过255时为255
+}
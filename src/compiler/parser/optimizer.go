@@ -7,6 +7,36 @@ import (
 	"math"
 )
 
+// verbatim模式下不做优化，语法树保持源代码的形式
+func _optimize(l *Lexer, exp *BinopExp, optimize func(*BinopExp) Exp) Exp {
+	if l.Verbatim() {
+		return exp
+	}
+	return optimize(exp)
+}
+
+// 折叠已经解析好的表达式，规则和解析时一样，只处理exp本身，不会递归折叠子表达式
+// 供语法树上的优化遍在替换了子表达式之后使用
+func Fold(exp Exp) Exp {
+	switch x := exp.(type) {
+	case *BinopExp:
+		switch x.Op {
+		case TOKEN_OP_OR:
+			return optimizeLogicalOr(x)
+		case TOKEN_OP_AND:
+			return optimizeLogicalAnd(x)
+		case TOKEN_OP_BOR, TOKEN_OP_BXOR, TOKEN_OP_BAND, TOKEN_OP_SHL, TOKEN_OP_SHR:
+			return optimizeBitwiseBinaryOp(x)
+		case TOKEN_OP_ADD, TOKEN_OP_SUB, TOKEN_OP_MUL, TOKEN_OP_DIV,
+			TOKEN_OP_IDIV, TOKEN_OP_MOD, TOKEN_OP_POW:
+			return optimizeArithBinaryOp(x)
+		}
+	case *UnopExp:
+		return optimizeUnaryOp(x)
+	}
+	return exp
+}
+
 func optimizeLogicalOr(exp *BinopExp) Exp {
 	if isTrue(exp.Exp1) {
 		return exp.Exp1 // true or x => true
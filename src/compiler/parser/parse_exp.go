@@ -53,7 +53,7 @@ func parseExp12(l *Lexer) Exp {
 	for l.LookAhead() == TOKEN_OP_OR { // 左结合，直接for遍历
 		line, op, _ := l.NextToken()
 		lor := &BinopExp{line, op, exp, parseExp11(l)}
-		exp = optimizeLogicalOr(lor)
+		exp = _optimize(l, lor, optimizeLogicalOr)
 	}
 	return exp
 }
@@ -64,7 +64,7 @@ func parseExp11(l *Lexer) Exp {
 	for l.LookAhead() == TOKEN_OP_AND {
 		line, op, _ := l.NextToken()
 		land := &BinopExp{line, op, exp, parseExp10(l)}
-		exp = optimizeLogicalAnd(land)
+		exp = _optimize(l, land, optimizeLogicalAnd)
 	}
 	return exp
 }
@@ -91,7 +91,7 @@ func parseExp9(l *Lexer) Exp {
 	for l.LookAhead() == TOKEN_OP_BOR {
 		line, op, _ := l.NextToken()
 		bor := &BinopExp{line, op, exp, parseExp8(l)}
-		exp = optimizeBitwiseBinaryOp(bor)
+		exp = _optimize(l, bor, optimizeBitwiseBinaryOp)
 	}
 	return exp
 }
@@ -102,7 +102,7 @@ func parseExp8(l *Lexer) Exp {
 	for l.LookAhead() == TOKEN_OP_BXOR {
 		line, op, _ := l.NextToken()
 		bxor := &BinopExp{line, op, exp, parseExp7(l)}
-		exp = optimizeBitwiseBinaryOp(bxor)
+		exp = _optimize(l, bxor, optimizeBitwiseBinaryOp)
 	}
 	return exp
 }
@@ -113,7 +113,7 @@ func parseExp7(l *Lexer) Exp {
 	for l.LookAhead() == TOKEN_OP_BAND {
 		line, op, _ := l.NextToken()
 		band := &BinopExp{line, op, exp, parseExp6(l)}
-		exp = optimizeBitwiseBinaryOp(band)
+		exp = _optimize(l, band, optimizeBitwiseBinaryOp)
 	}
 	return exp
 }
@@ -126,7 +126,7 @@ func parseExp6(l *Lexer) Exp {
 		case TOKEN_OP_SHL, TOKEN_OP_SHR:
 			line, op, _ := l.NextToken()
 			shx := &BinopExp{line, op, exp, parseExp5(l)}
-			exp = optimizeBitwiseBinaryOp(shx)
+			exp = _optimize(l, shx, optimizeBitwiseBinaryOp)
 		default:
 			return exp
 		}
@@ -158,7 +158,7 @@ func parseExp4(l *Lexer) Exp {
 		case TOKEN_OP_ADD, TOKEN_OP_SUB:
 			line, op, _ := l.NextToken()
 			arith := &BinopExp{line, op, exp, parseExp3(l)}
-			exp = optimizeArithBinaryOp(arith)
+			exp = _optimize(l, arith, optimizeArithBinaryOp)
 		default:
 			return exp
 		}
@@ -174,7 +174,7 @@ func parseExp3(l *Lexer) Exp {
 		case TOKEN_OP_MUL, TOKEN_OP_MOD, TOKEN_OP_DIV, TOKEN_OP_IDIV:
 			line, op, _ := l.NextToken()
 			arith := &BinopExp{line, op, exp, parseExp2(l)}
-			exp = optimizeArithBinaryOp(arith)
+			exp = _optimize(l, arith, optimizeArithBinaryOp)
 		default:
 			return exp
 		}
@@ -188,6 +188,9 @@ func parseExp2(l *Lexer) Exp {
 	case TOKEN_OP_UNM, TOKEN_OP_BNOT, TOKEN_OP_LEN, TOKEN_OP_NOT:
 		line, op, _ := l.NextToken()
 		exp := &UnopExp{line, op, parseExp2(l)}
+		if l.Verbatim() {
+			return exp
+		}
 		return optimizeUnaryOp(exp)
 	}
 	return parseExp1(l) // 递归调用实现右结合性
@@ -200,6 +203,9 @@ func parseExp1(l *Lexer) Exp { // pow is right associative
 		line, op, _ := l.NextToken()
 		exp = &BinopExp{line, op, exp, parseExp2(l)}
 	}
+	if l.Verbatim() {
+		return exp
+	}
 	return optimizePow(exp)
 }
 
@@ -238,7 +244,7 @@ func parseNumberExp(l *Lexer) Exp {
 		return &IntegerExp{line, i}
 	} else if f, ok := number.ParseFloat(token); ok {
 		return &FloatExp{line, f}
-	} else { // todo
+	} else { // 词法分析器已经检查过格式
 		panic("not a number: " + token)
 	}
 }
@@ -246,12 +252,12 @@ func parseNumberExp(l *Lexer) Exp {
 // functiondef ::= function funcbody
 // funcbody ::= ‘(’ [parlist] ‘)’ block end
 func parseFuncDefExp(l *Lexer) *FuncDefExp {
-	line := l.Line()                               // function
-	l.NextTokenOfKind(TOKEN_SEP_LPAREN)            // (
-	parList, isVararg := _parseParList(l)          // [parlist]
-	l.NextTokenOfKind(TOKEN_SEP_RPAREN)            // )
-	block := parseBlock(l)                         // block
-	lastLine, _ := l.NextTokenOfKind(TOKEN_KW_END) // end
+	line := l.Line()                                                   // function
+	l.NextTokenOfKind(TOKEN_SEP_LPAREN)                                // (
+	parList, isVararg := _parseParList(l)                              // [parlist]
+	l.NextTokenOfKind(TOKEN_SEP_RPAREN)                                // )
+	block := parseBlock(l)                                             // block
+	lastLine, _ := l.CheckMatch(TOKEN_KW_END, TOKEN_KW_FUNCTION, line) // end
 	return &FuncDefExp{line, lastLine, parList, isVararg, block}
 }
 
@@ -285,9 +291,9 @@ func _parseParList(l *Lexer) (names []string, isVararg bool) {
 // tableconstructor ::= ‘{’ [fieldlist] ‘}’
 func parseTableConstructorExp(l *Lexer) *TableConstructorExp {
 	line := l.Line()
-	l.NextTokenOfKind(TOKEN_SEP_LCURLY)    // {
-	keyExps, valExps := _parseFieldList(l) // [fieldlist]
-	l.NextTokenOfKind(TOKEN_SEP_RCURLY)    // }
+	lineOfCurly, _ := l.NextTokenOfKind(TOKEN_SEP_LCURLY)         // {
+	keyExps, valExps := _parseFieldList(l)                        // [fieldlist]
+	l.CheckMatch(TOKEN_SEP_RCURLY, TOKEN_SEP_LCURLY, lineOfCurly) // }
 	lastLine := l.Line()
 	return &TableConstructorExp{line, lastLine, keyExps, valExps}
 }
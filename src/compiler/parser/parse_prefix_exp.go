@@ -22,21 +22,26 @@ func parsePrefixExp(l *Lexer) Exp {
 	if l.LookAhead() == TOKEN_IDENTIFIER { // 先前瞻一个token看是不是标识符
 		line, name := l.NextIdentifier() // Name
 		exp = &NameExp{line, name}
-	} else { // ‘(’ exp ‘)’
+	} else if l.LookAhead() == TOKEN_SEP_LPAREN { // ‘(’ exp ‘)’
 		exp = parseParensExp(l) // 圆括号表达式
+	} else {
+		l.ErrorNear("unexpected symbol")
 	}
 	return _finishPrefixExp(l, exp)
 }
 
 func parseParensExp(l *Lexer) Exp {
-	l.NextTokenOfKind(TOKEN_SEP_LPAREN) // (
-	exp := parseExp(l)                  // exp
-	l.NextTokenOfKind(TOKEN_SEP_RPAREN) // )
+	line, _ := l.NextTokenOfKind(TOKEN_SEP_LPAREN)                        // (
+	exp := parseExp(l)                                                    // exp
+	lastLine, _ := l.CheckMatch(TOKEN_SEP_RPAREN, TOKEN_SEP_LPAREN, line) // )
 
+	if l.Verbatim() {
+		return &ParensExp{line, lastLine, exp}
+	}
 	switch exp.(type) {
 	// 只有这四种情况需要保留圆括号，因为圆括号会改变语义
 	case *VarargExp, *FuncCallExp, *NameExp, *TableAccessExp:
-		return &ParensExp{exp}
+		return &ParensExp{line, lastLine, exp}
 	}
 
 	// no need to keep parens
@@ -88,16 +93,18 @@ func _parseNameExp(lexer *Lexer) *StringExp {
 func _parseArgs(l *Lexer) (args []Exp) {
 	switch l.LookAhead() {
 	case TOKEN_SEP_LPAREN: // ‘(’ [explist] ‘)’
-		l.NextToken() // TOKEN_SEP_LPAREN
+		line, _, _ := l.NextToken() // TOKEN_SEP_LPAREN
 		if l.LookAhead() != TOKEN_SEP_RPAREN {
 			args = parseExpList(l)
 		}
-		l.NextTokenOfKind(TOKEN_SEP_RPAREN)
+		l.CheckMatch(TOKEN_SEP_RPAREN, TOKEN_SEP_LPAREN, line)
 	case TOKEN_SEP_LCURLY: // ‘{’ [fieldlist] ‘}’
 		args = []Exp{parseTableConstructorExp(l)}
-	default: // LiteralString
-		line, str := l.NextTokenOfKind(TOKEN_STRING)
+	case TOKEN_STRING: // LiteralString
+		line, _, str := l.NextToken()
 		args = []Exp{&StringExp{line, str}}
+	default:
+		l.ErrorNear("function arguments expected")
 	}
 	return
 }
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"lua/src/binchunk"
 	. "lua/src/compiler/ast"
 	. "lua/src/compiler/lexer"
 )
@@ -37,8 +38,8 @@ func parseStat(l *Lexer) Stat {
 
 // 空语句：分号 跳过
 func parseEmptyStat(l *Lexer) *EmptyStat {
-	l.NextTokenOfKind(TOKEN_SEP_SEMI) // skip `;`
-	return &EmptyStat{}
+	line, _ := l.NextTokenOfKind(TOKEN_SEP_SEMI) // skip `;`
+	return &EmptyStat{Line: line}
 }
 
 // break语句 记录行号
@@ -49,44 +50,44 @@ func parseBreakStat(l *Lexer) *BreakStat {
 
 // label语句 跳过分隔符并记录标签名
 func parseLabelStat(l *Lexer) *LabelStat {
-	l.NextTokenOfKind(TOKEN_SEP_LABEL)             // skip `::`
-	_, name := l.NextTokenOfKind(TOKEN_IDENTIFIER) // name
-	l.NextTokenOfKind(TOKEN_SEP_LABEL)             // skip `::`
-	return &LabelStat{Name: name}
+	l.NextTokenOfKind(TOKEN_SEP_LABEL)                // skip `::`
+	line, name := l.NextTokenOfKind(TOKEN_IDENTIFIER) // name
+	l.NextTokenOfKind(TOKEN_SEP_LABEL)                // skip `::`
+	return &LabelStat{Line: line, Name: name}
 }
 
 // goto语句 跳过关键字并记录标签名
 func parseGotoStat(l *Lexer) *GotoStat {
-	l.NextTokenOfKind(TOKEN_KW_GOTO)               // skip `goto`
-	_, name := l.NextTokenOfKind(TOKEN_IDENTIFIER) // name
-	return &GotoStat{Name: name}
+	l.NextTokenOfKind(TOKEN_KW_GOTO)                  // skip `goto`
+	line, name := l.NextTokenOfKind(TOKEN_IDENTIFIER) // name
+	return &GotoStat{Line: line, Name: name}
 }
 
 // do语句 跳过关键字并解析块
 func parseDoStat(l *Lexer) *DoStat {
-	l.NextTokenOfKind(TOKEN_KW_DO) // skip `do`
+	line, _ := l.NextTokenOfKind(TOKEN_KW_DO) // skip `do`
 	block := parseBlock(l)
-	l.NextTokenOfKind(TOKEN_KW_END) // skip `end`
-	return &DoStat{Block: block}
+	lastLine, _ := l.CheckMatch(TOKEN_KW_END, TOKEN_KW_DO, line) // skip `end`
+	return &DoStat{Line: line, LastLine: lastLine, Block: block}
 }
 
 // while语句 跳过关键字并解析条件和块
 func parseWhileStat(l *Lexer) *WhileStat {
-	l.NextTokenOfKind(TOKEN_KW_WHILE) // skip `while`
+	line, _ := l.NextTokenOfKind(TOKEN_KW_WHILE) // skip `while`
 	exp := parseExp(l)
 	l.NextTokenOfKind(TOKEN_KW_DO) // skip `do`
 	block := parseBlock(l)
-	l.NextTokenOfKind(TOKEN_KW_END) // skip `end`
-	return &WhileStat{Exp: exp, Block: block}
+	lastLine, _ := l.CheckMatch(TOKEN_KW_END, TOKEN_KW_WHILE, line) // skip `end`
+	return &WhileStat{Line: line, LastLine: lastLine, Exp: exp, Block: block}
 }
 
 // repeat语句 跳过关键字并解析块和条件
 func parseRepeatStat(l *Lexer) *RepeatStat {
-	l.NextTokenOfKind(TOKEN_KW_REPEAT) // skip `repeat`
+	line, _ := l.NextTokenOfKind(TOKEN_KW_REPEAT) // skip `repeat`
 	block := parseBlock(l)
-	l.NextTokenOfKind(TOKEN_KW_UNTIL) // skip `until`
+	l.CheckMatch(TOKEN_KW_UNTIL, TOKEN_KW_REPEAT, line) // skip `until`
 	exp := parseExp(l)
-	return &RepeatStat{Block: block, Exp: exp}
+	return &RepeatStat{Line: line, Block: block, Exp: exp}
 }
 
 // if语句
@@ -94,10 +95,10 @@ func parseIfStat(l *Lexer) *IfStat {
 	exps := make([]Exp, 0, 4)
 	blocks := make([]*Block, 0, 4)
 
-	l.NextTokenOfKind(TOKEN_KW_IF)         // skip `if`
-	exps = append(exps, parseExp(l))       // exp
-	l.NextTokenOfKind(TOKEN_KW_THEN)       // skip `then`
-	blocks = append(blocks, parseBlock(l)) // block
+	line, _ := l.NextTokenOfKind(TOKEN_KW_IF) // skip `if`
+	exps = append(exps, parseExp(l))          // exp
+	l.NextTokenOfKind(TOKEN_KW_THEN)          // skip `then`
+	blocks = append(blocks, parseBlock(l))    // block
 
 	for l.LookAhead() == TOKEN_KW_ELSEIF { // {
 		l.NextToken()                          // skip `elseif`
@@ -112,8 +113,8 @@ func parseIfStat(l *Lexer) *IfStat {
 		blocks = append(blocks, parseBlock(l))  // block
 	}
 
-	l.NextTokenOfKind(TOKEN_KW_END) // skip `end`
-	return &IfStat{Exps: exps, Blocks: blocks}
+	lastLine, _ := l.CheckMatch(TOKEN_KW_END, TOKEN_KW_IF, line) // skip `end`
+	return &IfStat{Line: line, LastLine: lastLine, Exps: exps, Blocks: blocks}
 }
 
 // for语句
@@ -123,7 +124,7 @@ func parseForStat(l *Lexer) Stat {
 	if l.LookAhead() == TOKEN_OP_ASSIGN { // 前瞻下一个token 如果是等号，按照数值for循环来解析
 		return _finishForNumStat(l, lineOfFor, name)
 	} else {
-		return _finishForInStat(l, name)
+		return _finishForInStat(l, lineOfFor, name)
 	}
 }
 
@@ -144,9 +145,10 @@ func _finishForNumStat(l *Lexer, lineOfFor int, varName string) *ForNumStat {
 
 	lineOfDo, _ := l.NextTokenOfKind(TOKEN_KW_DO) // skip `do`
 	block := parseBlock(l)
-	l.NextTokenOfKind(TOKEN_KW_END) // skip `end`
+	lastLine, _ := l.CheckMatch(TOKEN_KW_END, TOKEN_KW_FOR, lineOfFor) // skip `end`
 
 	return &ForNumStat{
+		LastLine:  lastLine,
 		LineOfFor: lineOfFor,
 		LineOfDo:  lineOfDo,
 		VarName:   varName,
@@ -158,14 +160,21 @@ func _finishForNumStat(l *Lexer, lineOfFor int, varName string) *ForNumStat {
 }
 
 // 泛型for循环
-func _finishForInStat(l *Lexer, name0 string) *ForInStat {
+func _finishForInStat(l *Lexer, lineOfFor int, name0 string) *ForInStat {
 	name := _finishNameList(l, name0)
 	l.NextTokenOfKind(TOKEN_KW_IN) // skip `in`
 	expList := parseExpList(l)
 	lineOfDo, _ := l.NextTokenOfKind(TOKEN_KW_DO) // skip `do`
 	block := parseBlock(l)
-	l.NextTokenOfKind(TOKEN_KW_END) // skip `end`
-	return &ForInStat{LineOfDo: lineOfDo, NameList: name, ExpList: expList, Block: block}
+	lastLine, _ := l.CheckMatch(TOKEN_KW_END, TOKEN_KW_FOR, lineOfFor) // skip `end`
+	return &ForInStat{
+		LineOfFor: lineOfFor,
+		LineOfDo:  lineOfDo,
+		NameList:  name,
+		ExpList:   expList,
+		Block:     block,
+		LastLine:  lastLine,
+	}
 }
 
 // 解析循环变量名列表
@@ -181,44 +190,97 @@ func _finishNameList(l *Lexer, name0 string) []string {
 
 // 局部变量声明和局部函数定义
 func parseLocalAssignOrFuncDefStat(l *Lexer) Stat {
-	l.NextTokenOfKind(TOKEN_KW_LOCAL)       // skip `local`
-	if l.LookAhead() == TOKEN_KW_FUNCTION { // `function`
-		return _finishLocalFuncDefStat(l)
+	line, _ := l.NextTokenOfKind(TOKEN_KW_LOCAL) // skip `local`
+	if l.LookAhead() == TOKEN_KW_FUNCTION {      // `function`
+		return _finishLocalFuncDefStat(l, line)
 	} else {
-		return _finishLocalAssignStat(l)
+		return _finishLocalAssignStat(l, line)
 	}
 }
 
 // 局部函数定义
-func _finishLocalFuncDefStat(l *Lexer) *LocalFuncDefStat {
+func _finishLocalFuncDefStat(l *Lexer, line int) *LocalFuncDefStat {
 	l.NextTokenOfKind(TOKEN_KW_FUNCTION) // skip `function`
 	_, name := l.NextIdentifier()
 	fdExp := parseFuncDefExp(l)
-	return &LocalFuncDefStat{Name: name, Exp: fdExp}
+	return &LocalFuncDefStat{Line: line, Name: name, Exp: fdExp}
 }
 
 // 局部变量声明
-func _finishLocalAssignStat(l *Lexer) *LocalVarDeclStat {
-	_, name0 := l.NextIdentifier()
-	names := _finishNameList(l, name0)
+func _finishLocalAssignStat(l *Lexer, line int) *LocalVarDeclStat {
+	var names, attribs []string
+	if l.Dialect() == binchunk.LUA_DIALECT_54 {
+		names, attribs = _finishAttNameList(l)
+	} else {
+		_, name0 := l.NextIdentifier()
+		names = _finishNameList(l, name0)
+	}
 	var exps []Exp = nil
 	if l.LookAhead() == TOKEN_OP_ASSIGN { // `=`
 		l.NextToken() // skip `=`
 		exps = parseExpList(l)
 	}
 	lastLine := l.Line()
-	return &LocalVarDeclStat{LastLine: lastLine, NameList: names, ExpList: exps}
+	return &LocalVarDeclStat{Line: line, LastLine: lastLine, NameList: names, ExpList: exps, AttribList: attribs}
+}
+
+// 解析带属性的变量名列表(5.4)，没有任何属性时attribs为nil
+// attnamelist ::= Name attrib {',' Name attrib}
+// lua-5.4.6/src/lparser.c#localstat()
+func _finishAttNameList(l *Lexer) (names, attribs []string) {
+	hasAttrib, nClose := false, 0
+	for {
+		_, name := l.NextIdentifier()
+		attrib := _parseAttrib(l)
+		if attrib != "" {
+			hasAttrib = true
+		}
+		if attrib == "close" {
+			if nClose++; nClose > 1 {
+				l.Error("multiple to-be-closed variables in local list")
+			}
+		}
+		names = append(names, name)
+		attribs = append(attribs, attrib)
+		if l.LookAhead() != TOKEN_SEP_COMMA {
+			break
+		}
+		l.NextToken() // skip `,`
+	}
+	if !hasAttrib {
+		attribs = nil
+	}
+	return
+}
+
+// 解析变量属性 attrib ::= ['<' Name '>']
+// lua-5.4.6/src/lparser.c#getlocalattribute()
+func _parseAttrib(l *Lexer) string {
+	if l.LookAhead() != TOKEN_OP_LT { // `<`
+		return ""
+	}
+	l.NextToken() // skip `<`
+	_, attrib := l.NextIdentifier()
+	l.NextTokenOfKind(TOKEN_OP_GT) // skip `>`
+	if attrib != "const" && attrib != "close" {
+		l.Error("unknown attribute '%s'", attrib)
+	}
+	return attrib
 }
 
 // 赋值和函数调用语句
 func parseAssignOrFuncCallStat(l *Lexer) Stat {
 	// 先解析前缀表达式
+	// lua-5.3.4/src/lparser.c#exprstat()
 	prefixExp := parsePrefixExp(l)
+	if kind := l.LookAhead(); kind == TOKEN_OP_ASSIGN || kind == TOKEN_SEP_COMMA { // var表达式
+		return parseAssignStat(l, prefixExp)
+	}
 	if fc, ok := prefixExp.(*FuncCallExp); ok { // 如果解析出来的前缀表达式时是函数调用表达式
 		return fc
-	} else { // 否则是var表达式
-		return parseAssignStat(l, prefixExp)
 	}
+	l.ErrorNear("syntax error")
+	return nil
 }
 
 // 解析赋值语句
@@ -248,7 +310,7 @@ func _checkVar(l *Lexer, exp Exp) Exp {
 	case *NameExp, *TableAccessExp:
 		return exp
 	default:
-		l.NextTokenOfKind(-1) // 报错
+		l.ErrorNear("syntax error")
 		return nil
 	}
 }
@@ -280,15 +342,15 @@ func _finishFuncName(l *Lexer) (exp Exp, hasColon bool) {
 		l.NextToken()                    // skip `.`
 		line, name := l.NextIdentifier() // 获取下一个标识符
 		idx := &StringExp{Line: line, Str: name}
-		exp = &TableAccessExp{PrefixExp: exp, KeyExp: idx} // 生成表达式 `a.b.c` => `a["b"]["c"]`
+		exp = &TableAccessExp{LastLine: line, PrefixExp: exp, KeyExp: idx} // 生成表达式 `a.b.c` => `a["b"]["c"]`
 	}
 
 	if l.LookAhead() == TOKEN_SEP_COLON { // 如果有冒号
 		l.NextToken() // skip `:`
 		line, name := l.NextIdentifier()
 		idx := &StringExp{Line: line, Str: name}
-		exp = &TableAccessExp{PrefixExp: exp, KeyExp: idx} // 生成表达式 `a:b()` => `a["b"]`
-		hasColon = true                                    // 标记函数名是以冒号开头的
+		exp = &TableAccessExp{LastLine: line, PrefixExp: exp, KeyExp: idx} // 生成表达式 `a:b()` => `a["b"]`
+		hasColon = true                                                    // 标记函数名是以冒号开头的
 	}
 
 	return
@@ -1,13 +1,53 @@
 package parser
 
 import (
+	"lua/src/binchunk"
 	"lua/src/compiler/ast"
 	. "lua/src/compiler/lexer"
 )
 
 func Parse(chunk, chunkName string) *ast.Block {
+	return ParseDialect(chunk, chunkName, binchunk.LUA_DIALECT_53)
+}
+
+// 按照指定的语言方言解析源代码，5.4方言接受<const>和<close>等语法扩展
+func ParseDialect(chunk, chunkName string, dialect byte) *ast.Block {
+	l := NewLexer(chunk, chunkName)
+	l.SetDialect(dialect)
+	block := parseBlock(l)
+	l.NextTokenOfKind(TOKEN_EOF)
+	return block
+}
+
+// 以verbatim模式解析源代码：不折叠常量，保留所有圆括号，生成的语法树和源代码一一对应
+// 这样的语法树仍然可以编译，供格式化等需要还原源代码的工具使用
+func ParseVerbatim(chunk, chunkName string, dialect byte) *ast.Block {
 	l := NewLexer(chunk, chunkName)
+	l.SetDialect(dialect)
+	l.SetVerbatim(true)
 	block := parseBlock(l)
 	l.NextTokenOfKind(TOKEN_EOF)
 	return block
 }
+
+// 以错误恢复模式解析源代码，遇到语法错误时不会中止，而是在语句边界重新同步后继续解析
+// 返回尽可能完整的语法树和全部语法错误，供编辑器和静态检查工具使用
+// 和verbatim模式一样不折叠常量，`false and x`里的x这样的名字也留在语法树里
+func ParseRecovering(chunk, chunkName string, dialect byte) (*ast.Block, []*SyntaxError) {
+	l := NewLexer(chunk, chunkName)
+	l.SetDialect(dialect)
+	l.SetRecovering(true)
+	l.SetVerbatim(true)
+	block := parseBlock(l)
+	for _lookAheadRecovering(l) != TOKEN_EOF { // 多余的end、until等，跳过后继续解析
+		_try(l, func() { l.NextTokenOfKind(TOKEN_EOF) })
+		l.NextToken()
+		more := parseBlock(l)
+		block.Stats = append(block.Stats, more.Stats...)
+		if len(more.RetExps) > 0 || block.RetExps == nil {
+			block.RetExps = more.RetExps
+		}
+		block.LastLine = more.LastLine
+	}
+	return block, l.Errors()
+}
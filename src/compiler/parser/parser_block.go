@@ -7,6 +7,9 @@ import (
 
 // 创建Block结构体实例
 func parseBlock(l *Lexer) *Block {
+	if l.Recovering() {
+		return _parseBlockRecovering(l)
+	}
 	return &Block{
 		Stats:    parseStats(l),   // 解析语句序列
 		RetExps:  parseRetExps(l), // 解析返回值
@@ -26,6 +29,77 @@ func parseStats(l *Lexer) []Stat {
 	return stats
 }
 
+// 错误恢复模式下解析块：出错的语句被丢弃，跳到下一条语句的开头继续解析
+func _parseBlockRecovering(l *Lexer) *Block {
+	stats := make([]Stat, 0, 8)
+	for !_isReturnOrBlockEnd(_lookAheadRecovering(l)) {
+		var stat Stat
+		if !_try(l, func() { stat = parseStat(l) }) {
+			_synchronize(l)
+			continue
+		}
+		if _, ok := stat.(*EmptyStat); !ok {
+			stats = append(stats, stat)
+		}
+	}
+	var retExps []Exp
+	if !_try(l, func() { retExps = parseRetExps(l) }) {
+		retExps = []Exp{}
+		_synchronize(l)
+	}
+	return &Block{Stats: stats, RetExps: retExps, LastLine: l.Line()}
+}
+
+// 执行f，把f抛出的语法错误记录到Lexer里，出错时返回false
+func _try(l *Lexer, f func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			err, isSyntaxError := r.(*SyntaxError)
+			if !isSyntaxError {
+				panic(r)
+			}
+			l.Recover(err)
+			ok = false
+		}
+	}()
+	f()
+	return true
+}
+
+// 前瞻一个token，遇到词法错误时记录下来并跳过出错的源代码
+func _lookAheadRecovering(l *Lexer) (kind int) {
+	for !_try(l, func() { kind = l.LookAhead() }) {
+	}
+	return
+}
+
+// 出错后跳过token，直到遇到可以开始一条语句的关键字或者块的结束
+// 出错之后另起一行的名字和圆括号也被当作新语句的开头
+func _synchronize(l *Lexer) {
+	errs := l.Errors()
+	line := errs[len(errs)-1].Line
+	for {
+		kind := _lookAheadRecovering(l)
+		if _isStatStart(kind) || _isReturnOrBlockEnd(kind) {
+			return
+		}
+		if (kind == TOKEN_IDENTIFIER || kind == TOKEN_SEP_LPAREN) && l.LookAheadLine() > line {
+			return
+		}
+		l.NextToken()
+	}
+}
+
+// 判断token是否是语句开头的关键字
+func _isStatStart(tokenKind int) bool {
+	switch tokenKind {
+	case TOKEN_SEP_SEMI, TOKEN_KW_BREAK, TOKEN_SEP_LABEL, TOKEN_KW_GOTO, TOKEN_KW_DO, TOKEN_KW_WHILE,
+		TOKEN_KW_REPEAT, TOKEN_KW_IF, TOKEN_KW_FOR, TOKEN_KW_FUNCTION, TOKEN_KW_LOCAL:
+		return true
+	}
+	return false
+}
+
 // 判断块是否结束
 func _isReturnOrBlockEnd(tokenKind int) bool {
 	switch tokenKind {
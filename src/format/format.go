@@ -0,0 +1,104 @@
+package format
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"lua/src/binchunk"
+	"lua/src/compiler/ast"
+	"lua/src/compiler/codegen"
+	"lua/src/compiler/lexer"
+	"lua/src/compiler/parser"
+)
+
+// 源代码格式化：用verbatim模式解析出语法树，再按统一的风格重新输出
+// 语法树里没有的信息(注释、数字的写法、长字符串、f{...}和f"..."形式的调用)从lexer.Tokenize()的token流中取
+
+type Config struct {
+	Indent   string // 一级缩进
+	Quote    byte   // 短字符串的引号，'"'或'\''；字符串里有这种引号而没有另一种时换用另一种
+	MaxWidth int    // 表构造器在一行里放不下时每个字段占一行
+	Dialect  byte   // 语言方言
+}
+
+var DefaultConfig = Config{
+	Indent:   "    ",
+	Quote:    '"',
+	MaxWidth: 100,
+	Dialect:  binchunk.LUA_DIALECT_53,
+}
+
+// 格式化源代码，语法错误以*lexer.SyntaxError返回
+// 格式化之后重新编译两份源代码，确认生成的字节码(不含调试信息)完全相同，否则返回错误而不是输出错误的结果
+func Source(src []byte, chunkName string, cfg Config) (out []byte, err error) {
+	if cfg.Quote != '\'' {
+		cfg.Quote = '"'
+	}
+	chunk := string(src)
+	tokens, err := lexer.Tokenize(chunk, chunkName, cfg.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	var block *ast.Block
+	if err = catch(func() {
+		block = parser.ParseVerbatim(lexer.SkipShebang(chunk), chunkName, cfg.Dialect)
+	}); err != nil {
+		return nil, err
+	}
+
+	p := newPrinter(cfg, tokens)
+	p.chunk(block)
+	out = p.buf.Bytes()
+
+	if err = check(chunk, string(out), chunkName, cfg.Dialect); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// 编译格式化前后的源代码，比较去掉调试信息之后的字节码
+func check(before, after, chunkName string, dialect byte) error {
+	var want, got []byte
+	if err := catch(func() { want = compile(before, chunkName, dialect) }); err != nil {
+		return err
+	}
+	if err := catch(func() { got = compile(after, chunkName, dialect) }); err != nil {
+		return fmt.Errorf("%s: formatted source does not compile: %v", binchunk.ChunkID(chunkName), err)
+	}
+	if !bytes.Equal(want, got) {
+		return fmt.Errorf("%s: formatting would change the compiled code", binchunk.ChunkID(chunkName))
+	}
+	return nil
+}
+
+func compile(chunk, chunkName string, dialect byte) []byte {
+	proto := codegen.GenProto(parser.ParseDialect(lexer.SkipShebang(chunk), chunkName, dialect))
+	clearLines(proto)
+	return binchunk.Dump(*proto, true)
+}
+
+// 去掉调试信息之后函数原型里仍然有起止行号，格式化会改变它们
+func clearLines(proto *binchunk.Prototype) {
+	proto.LineDefined, proto.LastLineDefined = 0, 0
+	for _, p := range proto.Protos {
+		clearLines(p)
+	}
+}
+
+// 语法错误和编译错误以panic的形式抛出，这里把它们转换成error
+func catch(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch x := r.(type) {
+			case error:
+				err = x
+			case string:
+				err = errors.New(x)
+			default:
+				panic(r)
+			}
+		}
+	}()
+	f()
+	return nil
+}
@@ -0,0 +1,1036 @@
+package format
+
+import (
+	"bytes"
+	. "lua/src/compiler/ast"
+	"lua/src/compiler/lexer"
+	"lua/src/number"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type comment struct {
+	text           string
+	line, lastLine int
+	short          bool // 单行注释，后面必须换行
+}
+
+// 按源代码顺序输出语法树
+// 语法树的节点只有行号，注释按行号插到语句、表字段和块结尾之前，或者接在同一行的末尾
+type printer struct {
+	cfg    Config
+	buf    *bytes.Buffer
+	column int // 当前行已经输出的字节数
+	indent int
+
+	tokens      []*lexer.Token
+	comments    []comment
+	commentAt   []int // commentAt[i]是源代码中在tokens[i]之前的注释数
+	closerAt    []int // closerAt[i]是从tokens[i]开始的第一个结束代码块的token的位置
+	nextComment int
+	commentEnd  int // 只输出这之前的注释，换行输出的括号里面只输出括号里的注释
+	// token流中的位置，输出对应的语法树节点时向前移动
+	numPos, strPos, curlyPos, parenPos, closerPos, headerPos int
+
+	lastLine   int  // 最近输出的内容在源代码中的结束行号，用来保留空行
+	blockStart bool // 刚开始一个代码块，不输出空行
+	flat       bool // 只是为了测量宽度，表构造器不换行，不输出注释
+}
+
+func newPrinter(cfg Config, tokens []*lexer.Token) *printer {
+	p := &printer{cfg: cfg, buf: &bytes.Buffer{}, tokens: tokens, blockStart: true}
+	for _, tok := range tokens {
+		p.addComments(tok.Leading)
+		p.commentAt = append(p.commentAt, len(p.comments))
+		p.addComments(tok.Trailing)
+	}
+	p.commentEnd = len(p.comments)
+	p.closerAt = make([]int, len(tokens)+1)
+	p.closerAt[len(tokens)] = len(tokens)
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if p.closerAt[i] = p.closerAt[i+1]; isCloser(tokens[i]) {
+			p.closerAt[i] = i
+		}
+	}
+	return p
+}
+
+func (self *printer) addComments(list []lexer.Trivia) {
+	for _, t := range list {
+		if t.Kind == lexer.TRIVIA_COMMENT || t.Kind == lexer.TRIVIA_LONG_COMMENT {
+			text := t.Text
+			if t.Kind == lexer.TRIVIA_COMMENT {
+				text = strings.TrimRight(text, " \t\v\f")
+			}
+			self.comments = append(self.comments, comment{
+				text:     text,
+				line:     t.Line,
+				lastLine: t.Line + countLines(t.Text),
+				short:    t.Kind == lexer.TRIVIA_COMMENT,
+			})
+		}
+	}
+}
+
+// 统计字符串里的换行符，"\r\n"和"\n\r"算一个
+func countLines(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\n' || c == '\r' {
+			if i+1 < len(s) && (s[i+1] == '\n' || s[i+1] == '\r') && s[i+1] != c {
+				i++
+			}
+			n++
+		}
+	}
+	return n
+}
+
+func (self *printer) chunk(block *Block) {
+	if len(self.tokens) > 0 && len(self.tokens[0].Leading) > 0 {
+		if t := self.tokens[0].Leading[0]; t.Kind == lexer.TRIVIA_SHEBANG {
+			self.write(t.Text)
+			self.lastLine = 1
+			self.blockStart = false
+		}
+	}
+	self.stats(block)
+	self.ownLineComments(math.MaxInt32)
+	if self.buf.Len() > 0 {
+		self.buf.WriteByte('\n')
+	}
+}
+
+/* 输出 */
+
+func (self *printer) write(s string) {
+	self.buf.WriteString(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		self.column = len(s) - i - 1
+	} else {
+		self.column += len(s)
+	}
+}
+
+// 换行并缩进，输出的开头不换行
+func (self *printer) newline() {
+	if self.buf.Len() > 0 {
+		self.write("\n")
+	}
+	self.write(strings.Repeat(self.cfg.Indent, self.indent))
+}
+
+// 源代码中line行和上面输出的内容之间有空行时，输出一个空行
+func (self *printer) gap(line int) {
+	if !self.flat && !self.blockStart && self.buf.Len() > 0 && line > self.lastLine+1 {
+		self.buf.WriteByte('\n')
+	}
+	self.blockStart = false
+}
+
+func (self *printer) setLastLine(line int) {
+	if line > self.lastLine {
+		self.lastLine = line
+	}
+}
+
+/* 注释 */
+
+// 是否还有在line行之前的注释没有输出
+func (self *printer) hasCommentBefore(line int) bool {
+	return !self.flat && self.nextComment < self.commentEnd && self.comments[self.nextComment].line < line
+}
+
+// 在line行之前的注释，每个占一行
+func (self *printer) ownLineComments(line int) {
+	for self.hasCommentBefore(line) {
+		c := self.comments[self.nextComment]
+		self.nextComment++
+		self.gap(c.line)
+		self.newline()
+		self.write(c.text)
+		self.setLastLine(c.lastLine)
+	}
+}
+
+// 不晚于line行的注释，接在当前行的末尾；单行注释后面的注释另起一行，和当前的缩进对齐
+// 下一个结束代码块的token(比如同一行的else)后面的注释不属于当前行的内容，留给它后面的代码块
+func (self *printer) trailingComments(line int) {
+	commentEnd := self.commentEnd
+	if i := self.closerAt[self.closerPos]; i < len(self.tokens) {
+		self.commentEnd = min(commentEnd, self.commentAt[i])
+	}
+	defer func() { self.commentEnd = commentEnd }()
+	sep := " "
+	for self.hasCommentBefore(line + 1) {
+		c := self.comments[self.nextComment]
+		self.nextComment++
+		self.write(sep + c.text)
+		self.setLastLine(c.lastLine)
+		sep = " "
+		if c.short && self.hasCommentBefore(line+1) {
+			self.newline()
+			sep = ""
+		}
+	}
+}
+
+// 源代码中写在tokens[i]前面、和它在同一行的长注释(比如`x = --[[c]] 1`)，原样写在它前面
+// 中间有单行注释时不行，这些注释留给trailingComments()
+func (self *printer) inlineComments(i int) {
+	end := self.commentAt[i]
+	if self.flat || end > self.commentEnd || self.nextComment >= end || self.comments[end-1].lastLine != self.tokens[i].Line {
+		return
+	}
+	for _, c := range self.comments[self.nextComment:end] {
+		if c.short {
+			return
+		}
+	}
+	if b := self.buf.Bytes(); len(b) > 0 && !strings.ContainsRune("\n ([{", rune(b[len(b)-1])) {
+		self.write(" ") // 比如"- --[[c]] 1"，避免和前面的符号连起来
+	}
+	for ; self.nextComment < end; self.nextComment++ {
+		self.write(self.comments[self.nextComment].text + " ")
+	}
+}
+
+// 语句前面、和它在同一行的长注释(比如`--[[c]] b = 2`)，原样写在语句前面
+// 语句的第一个token就是line行的第一个token，否则前面的注释已经作为上一条语句或者代码块开头的注释输出了
+func (self *printer) leadingComments(line int) {
+	i := sort.Search(len(self.tokens), func(i int) bool { return self.tokens[i].Line >= line })
+	if i < len(self.tokens) {
+		self.inlineComments(i)
+	}
+}
+
+// 找出tokens[open]处的左括号里直接分隔各项的逗号、分号和配对的右括号的位置，以及括号里面直接有没有注释
+// 嵌套的括号和函数体里面的注释不算，它们由里面的表构造器、参数列表和代码块输出
+func (self *printer) bracketComments(open int) (seps []int, inside bool) {
+	if open < 0 {
+		return nil, false
+	}
+	depth := 0
+	for i := open; i < len(self.tokens); i++ {
+		switch self.tokens[i].Kind {
+		case lexer.TOKEN_SEP_LPAREN, lexer.TOKEN_SEP_LBRACK, lexer.TOKEN_SEP_LCURLY,
+			lexer.TOKEN_KW_FUNCTION, lexer.TOKEN_KW_DO, lexer.TOKEN_KW_IF, lexer.TOKEN_KW_REPEAT:
+			depth++
+		case lexer.TOKEN_SEP_RPAREN, lexer.TOKEN_SEP_RBRACK, lexer.TOKEN_SEP_RCURLY,
+			lexer.TOKEN_KW_END, lexer.TOKEN_KW_UNTIL:
+			if depth--; depth == 0 {
+				return append(seps, i), inside
+			}
+		case lexer.TOKEN_SEP_COMMA, lexer.TOKEN_SEP_SEMI:
+			if depth == 1 {
+				seps = append(seps, i)
+			}
+		}
+		// tokens[i]和下一个token之间的注释
+		if depth == 1 && i+1 < len(self.tokens) && self.commentAt[i+1] > max(self.commentAt[i], self.nextComment) {
+			inside = true
+		}
+	}
+	return nil, false
+}
+
+// 括号里的第i项可以输出的注释的结束位置：in是它后面的分隔符之前，after还包括分隔符后面的注释
+// 这样每一项后面接着输出同一行的注释，但不会输出下一项里面的注释；它们都不超过括号外面的限制end
+func (self *printer) itemComments(seps []int, i, end int) (in, after int) {
+	if len(seps) == 0 {
+		return end, end
+	}
+	sep := seps[min(i, len(seps)-1)]
+	in, after = self.commentAt[sep], self.commentAt[sep]
+	if sep != seps[len(seps)-1] {
+		after = self.commentAt[sep+1]
+	}
+	return min(in, end), min(after, end)
+}
+
+/* token流 */
+
+// 从*pos开始找下一个满足条件的token，找到时把*pos移到它后面
+func (self *printer) findToken(pos *int, match func(*lexer.Token) bool) *lexer.Token {
+	for i := *pos; i < len(self.tokens); i++ {
+		if match(self.tokens[i]) {
+			*pos = i + 1
+			return self.tokens[i]
+		}
+	}
+	return nil
+}
+
+// 下一个结束代码块的token(return、end、else、elseif或until)
+// 语法树按源代码顺序输出，所以它们和语法树里的代码块一一对应
+func (self *printer) nextCloser() *lexer.Token {
+	tok := self.findToken(&self.closerPos, isCloser)
+	if tok == nil {
+		return &lexer.Token{Kind: lexer.TOKEN_EOF}
+	}
+	return tok
+}
+
+func isCloser(tok *lexer.Token) bool {
+	switch tok.Kind {
+	case lexer.TOKEN_KW_RETURN, lexer.TOKEN_KW_END, lexer.TOKEN_KW_ELSE, lexer.TOKEN_KW_ELSEIF, lexer.TOKEN_KW_UNTIL:
+		return true
+	}
+	return false
+}
+
+// 下一个开始代码块的then、do或repeat的位置，和nextCloser()一样按源代码顺序一一对应
+func (self *printer) nextHeader() int {
+	self.findToken(&self.headerPos, func(tok *lexer.Token) bool {
+		switch tok.Kind {
+		case lexer.TOKEN_KW_THEN, lexer.TOKEN_KW_DO, lexer.TOKEN_KW_REPEAT:
+			return true
+		}
+		return false
+	})
+	return self.headerPos - 1
+}
+
+/* 代码块和语句 */
+
+// 输出代码块中的语句，每条语句占一行
+func (self *printer) stats(block *Block) {
+	for _, stat := range block.Stats {
+		self.stat(stat)
+	}
+	if block.RetExps != nil {
+		line := self.nextCloser().Line // return
+		self.ownLineComments(line)
+		self.gap(line)
+		self.newline()
+		self.write("return")
+		if len(block.RetExps) > 0 {
+			self.write(" ")
+			self.expList(block.RetExps)
+			line = endLine(block.RetExps[len(block.RetExps)-1])
+		}
+		self.setLastLine(line)
+		self.trailingComments(line)
+	}
+}
+
+// 输出块的内容和结尾的换行，返回结束代码块的token，由调用者输出对应的关键字
+// tokens[hdr]是块开头的关键字(比如do、then、else)或者参数列表的右括号，compact为true时空的块和关键字写在同一行
+// 和它在同一行、写在块里第一条语句前面的注释接在关键字后面
+func (self *printer) body(block *Block, hdr int, compact bool) *lexer.Token {
+	header := self.tokens[hdr].LastLine
+	if len(block.Stats) == 0 && block.RetExps == nil {
+		closer := self.nextCloser()
+		if compact && !self.hasCommentBefore(closer.Line) {
+			self.write(" ")
+			return closer
+		}
+		self.indent++
+		self.trailingComments(min(header, closer.Line-1))
+		self.blockStart = true
+		self.ownLineComments(closer.Line)
+		self.indent--
+		self.newline()
+		return closer
+	}
+
+	self.indent++
+	commentEnd := self.commentEnd
+	self.commentEnd = min(commentEnd, self.commentAt[hdr+1])
+	self.trailingComments(header)
+	self.commentEnd = commentEnd
+	self.blockStart = true
+	self.stats(block)
+	closer := self.nextCloser()
+	self.ownLineComments(closer.Line)
+	self.indent--
+	self.newline()
+	return closer
+}
+
+func (self *printer) stat(stat Stat) {
+	line, lastLine := stat.Pos()
+	self.ownLineComments(line)
+	self.gap(line)
+	self.newline()
+	self.leadingComments(line)
+	if startsWithParen(stat) { // 避免和上一条语句连起来被当作函数调用
+		self.write(";")
+	}
+
+	switch s := stat.(type) {
+	case *EmptyStat:
+	case *BreakStat:
+		self.write("break")
+	case *LabelStat:
+		self.write("::" + s.Name + "::")
+	case *GotoStat:
+		self.write("goto " + s.Name)
+	case *DoStat:
+		self.write("do")
+		self.body(s.Block, self.nextHeader(), true)
+		self.write("end")
+	case *WhileStat:
+		self.write("while ")
+		self.exp(s.Exp)
+		self.write(" do")
+		self.body(s.Block, self.nextHeader(), true)
+		self.write("end")
+	case *RepeatStat:
+		self.write("repeat")
+		self.body(s.Block, self.nextHeader(), true)
+		self.write("until ")
+		self.exp(s.Exp)
+	case *IfStat:
+		self.ifStat(s)
+	case *ForNumStat:
+		self.write("for " + s.VarName + " = ")
+		self.exp(s.InitExp)
+		self.write(", ")
+		self.exp(s.LimitExp)
+		if step, ok := s.StepExp.(*IntegerExp); !ok || step.Val != 1 { // 省略默认的步长1
+			self.write(", ")
+			self.exp(s.StepExp)
+		}
+		self.write(" do")
+		self.body(s.Block, self.nextHeader(), true)
+		self.write("end")
+	case *ForInStat:
+		self.write("for " + strings.Join(s.NameList, ", ") + " in ")
+		self.expList(s.ExpList)
+		self.write(" do")
+		self.body(s.Block, self.nextHeader(), true)
+		self.write("end")
+	case *LocalVarDeclStat:
+		self.write("local ")
+		for i, name := range s.NameList {
+			if i > 0 {
+				self.write(", ")
+			}
+			self.write(name)
+			if s.AttribList != nil && s.AttribList[i] != "" {
+				self.write(" <" + s.AttribList[i] + ">")
+			}
+		}
+		if len(s.ExpList) > 0 {
+			self.write(" = ")
+			self.expList(s.ExpList)
+		}
+	case *LocalFuncDefStat:
+		self.write("local function " + s.Name)
+		self.funcBody(s.Exp, false)
+	case *AssignStat:
+		if name, method, ok := funcStatName(s); ok { // function a.b:c() ... end
+			self.write("function " + name)
+			self.funcBody(s.ExpList[0].(*FuncDefExp), method)
+		} else {
+			self.expList(s.VarList)
+			self.write(" = ")
+			self.expList(s.ExpList)
+		}
+	case *FuncCallExp:
+		self.exp(s)
+	}
+
+	self.setLastLine(lastLine)
+	self.trailingComments(lastLine)
+}
+
+func (self *printer) ifStat(s *IfStat) {
+	self.write("if ")
+	self.exp(s.Exps[0])
+	self.write(" then")
+	closer := self.body(s.Blocks[0], self.nextHeader(), len(s.Exps) == 1)
+	for i := 1; i < len(s.Exps); i++ {
+		hdr := self.closerPos - 1
+		if closer.Kind == lexer.TOKEN_KW_ELSE { // else被解析成elseif true
+			self.write("else")
+		} else {
+			self.write("elseif ")
+			self.exp(s.Exps[i])
+			self.write(" then")
+			hdr = self.nextHeader()
+		}
+		closer = self.body(s.Blocks[i], hdr, false)
+	}
+	self.write("end")
+}
+
+// 赋值语句是不是由函数定义语句`function a.b:c() ... end`解析来的，返回函数名和是不是方法
+func funcStatName(s *AssignStat) (name string, method, ok bool) {
+	if len(s.VarList) != 1 || len(s.ExpList) != 1 {
+		return "", false, false
+	}
+	fd, ok := s.ExpList[0].(*FuncDefExp)
+	if !ok {
+		return "", false, false
+	}
+	var _funcName func(exp Exp) (string, bool)
+	_funcName = func(exp Exp) (string, bool) {
+		switch x := exp.(type) {
+		case *NameExp:
+			return x.Name, true
+		case *TableAccessExp:
+			key, ok := x.KeyExp.(*StringExp)
+			if !ok || !lexer.IsName(key.Str) {
+				return "", false
+			}
+			prefix, ok := _funcName(x.PrefixExp)
+			return prefix + "." + key.Str, ok
+		}
+		return "", false
+	}
+	if name, ok = _funcName(s.VarList[0]); !ok {
+		return "", false, false
+	}
+	if _, isField := s.VarList[0].(*TableAccessExp); isField && len(fd.ParList) > 0 && fd.ParList[0] == "self" {
+		i := strings.LastIndexByte(name, '.')
+		return name[:i] + ":" + name[i+1:], true, true
+	}
+	return name, false, true
+}
+
+// 语句的第一个token是不是左圆括号
+func startsWithParen(stat Stat) bool {
+	var exp Exp
+	switch s := stat.(type) {
+	case *FuncCallExp:
+		exp = s
+	case *AssignStat:
+		if _, _, ok := funcStatName(s); ok {
+			return false
+		}
+		exp = s.VarList[0]
+	default:
+		return false
+	}
+	for {
+		switch x := exp.(type) {
+		case *FuncCallExp:
+			exp = x.PrefixExp
+		case *TableAccessExp:
+			exp = x.PrefixExp
+		case *NameExp:
+			return false
+		default:
+			return true
+		}
+	}
+}
+
+func (self *printer) funcBody(fd *FuncDefExp, method bool) {
+	params := fd.ParList
+	if method {
+		params = params[1:]
+	}
+	if fd.IsVararg {
+		params = append(params[:len(params):len(params)], "...")
+	}
+	self.findToken(&self.parenPos, isLParen)
+	rparen := self.parenPos
+	self.findToken(&rparen, func(tok *lexer.Token) bool { return tok.Kind == lexer.TOKEN_SEP_RPAREN })
+	self.write("(" + strings.Join(params, ", ") + ")")
+	self.body(fd.Block, rparen-1, true)
+	self.write("end")
+}
+
+/* 表达式 */
+
+// 运算符优先级，数字越大优先级越高
+// lua-5.3.4/src/lparser.c#priority
+const (
+	precOr = iota + 1
+	precAnd
+	precCompare
+	precBor
+	precBxor
+	precBand
+	precShift
+	precConcat
+	precAdd
+	precMul
+	precUnary
+	precPow
+	precAtom
+)
+
+var binops = map[int]struct {
+	symbol string
+	prec   int
+}{
+	lexer.TOKEN_OP_OR:   {"or", precOr},
+	lexer.TOKEN_OP_AND:  {"and", precAnd},
+	lexer.TOKEN_OP_LT:   {"<", precCompare},
+	lexer.TOKEN_OP_LE:   {"<=", precCompare},
+	lexer.TOKEN_OP_GT:   {">", precCompare},
+	lexer.TOKEN_OP_GE:   {">=", precCompare},
+	lexer.TOKEN_OP_EQ:   {"==", precCompare},
+	lexer.TOKEN_OP_NE:   {"~=", precCompare},
+	lexer.TOKEN_OP_BOR:  {"|", precBor},
+	lexer.TOKEN_OP_BXOR: {"~", precBxor},
+	lexer.TOKEN_OP_BAND: {"&", precBand},
+	lexer.TOKEN_OP_SHL:  {"<<", precShift},
+	lexer.TOKEN_OP_SHR:  {">>", precShift},
+	lexer.TOKEN_OP_ADD:  {"+", precAdd},
+	lexer.TOKEN_OP_SUB:  {"-", precAdd},
+	lexer.TOKEN_OP_MUL:  {"*", precMul},
+	lexer.TOKEN_OP_DIV:  {"/", precMul},
+	lexer.TOKEN_OP_IDIV: {"//", precMul},
+	lexer.TOKEN_OP_MOD:  {"%", precMul},
+	lexer.TOKEN_OP_POW:  {"^", precPow},
+}
+
+var unops = map[int]string{
+	lexer.TOKEN_OP_UNM:  "-",
+	lexer.TOKEN_OP_NOT:  "not ",
+	lexer.TOKEN_OP_LEN:  "#",
+	lexer.TOKEN_OP_BNOT: "~",
+}
+
+func prec(exp Exp) int {
+	switch x := exp.(type) {
+	case *BinopExp:
+		return binops[x.Op].prec
+	case *ConcatExp:
+		return precConcat
+	case *UnopExp:
+		return precUnary
+	case *IntegerExp:
+		if x.Val < 0 {
+			return precUnary
+		}
+	case *FloatExp:
+		if x.Val < 0 || math.Signbit(x.Val) {
+			return precUnary
+		}
+	}
+	return precAtom
+}
+
+// 输出表达式，优先级低于minPrec时加上圆括号
+func (self *printer) operand(exp Exp, minPrec int) {
+	if prec(exp) < minPrec {
+		self.write("(")
+		self.exp(exp)
+		self.write(")")
+	} else {
+		self.exp(exp)
+	}
+}
+
+func (self *printer) expList(exps []Exp) {
+	for i, exp := range exps {
+		if i > 0 {
+			self.write(", ")
+		}
+		self.exp(exp)
+	}
+}
+
+func (self *printer) exp(exp Exp) {
+	switch x := exp.(type) {
+	case *NilExp:
+		self.write("nil")
+	case *TrueExp:
+		self.write("true")
+	case *FalseExp:
+		self.write("false")
+	case *VarargExp:
+		self.write("...")
+	case *IntegerExp:
+		self.integer(x.Val)
+	case *FloatExp:
+		self.float(x.Val)
+	case *StringExp:
+		self.string(x.Str)
+	case *NameExp:
+		self.write(x.Name)
+	case *UnopExp:
+		self.write(unops[x.Op])
+		if x.Op == lexer.TOKEN_OP_UNM && prec(x.Exp) == precUnary { // "- -x"，避免写成注释
+			if neg, ok := x.Exp.(*UnopExp); !ok || neg.Op == lexer.TOKEN_OP_UNM {
+				self.write(" ")
+			}
+		}
+		self.operand(x.Exp, precUnary)
+	case *BinopExp:
+		op := binops[x.Op]
+		left, right := op.prec, op.prec+1 // 左结合
+		if x.Op == lexer.TOKEN_OP_POW {   // 右结合，右边可以是一元运算
+			left, right = op.prec+1, precUnary
+		}
+		self.operand(x.Exp1, left)
+		self.write(" " + op.symbol + " ")
+		self.operand(x.Exp2, right)
+	case *ConcatExp:
+		for i, e := range x.Exps {
+			if i > 0 {
+				self.write(" .. ")
+			}
+			self.operand(e, precConcat+1) // 嵌套的..要保留圆括号，否则会被合并成一个ConcatExp
+		}
+	case *TableConstructorExp:
+		self.table(x)
+	case *FuncDefExp:
+		self.write("function")
+		self.funcBody(x, false)
+	case *ParensExp:
+		if self.findToken(&self.parenPos, isLParen) != nil {
+			self.inlineComments(self.parenPos - 1)
+		}
+		self.write("(")
+		self.exp(x.Exp)
+		self.write(")")
+	case *TableAccessExp:
+		self.prefixExp(x.PrefixExp)
+		if key, ok := x.KeyExp.(*StringExp); ok && lexer.IsName(key.Str) {
+			self.write("." + key.Str)
+		} else {
+			self.write("[")
+			self.exp(x.KeyExp)
+			self.write("]")
+		}
+	case *FuncCallExp:
+		self.prefixExp(x.PrefixExp)
+		if x.NameExp != nil {
+			self.write(":" + x.NameExp.Str)
+		}
+		self.args(x.Args, afterName(x))
+	}
+}
+
+// 只有名字、圆括号表达式、表访问和函数调用可以直接作为前缀表达式
+func (self *printer) prefixExp(exp Exp) {
+	switch exp.(type) {
+	case *NameExp, *ParensExp, *TableAccessExp, *FuncCallExp:
+		self.exp(exp)
+	default:
+		self.write("(")
+		self.exp(exp)
+		self.write(")")
+	}
+}
+
+// 函数调用的参数，源代码中写成f{...}和f"..."的保持原来的写法
+// 紧跟在名字后面的字符串参数前面加一个空格(比如`require "mod"`)，接在其他调用或者括号后面的都不加，比如`f(1)"s"{x}`
+func (self *printer) args(args []Exp, spaced bool) {
+	if len(args) == 1 {
+		switch arg := args[0].(type) {
+		case *TableConstructorExp:
+			if self.withoutParens(self.curlyPos, func(tok *lexer.Token) bool { return tok.Kind == lexer.TOKEN_SEP_LCURLY }) {
+				self.exp(arg)
+				return
+			}
+		case *StringExp:
+			if self.withoutParens(self.strPos, func(tok *lexer.Token) bool { return matchString(tok, arg.Str) }) {
+				if spaced {
+					self.write(" ")
+				}
+				self.exp(arg)
+				return
+			}
+		}
+	}
+	line, open := 0, -1
+	if paren := self.findToken(&self.parenPos, isLParen); paren != nil {
+		line, open = paren.Line, self.parenPos-1
+	}
+	self.write("(")
+	seps, inside := self.bracketComments(open)
+	if self.flat || !inside || len(args) == 0 {
+		self.expList(args)
+		self.write(")")
+		return
+	}
+
+	// 参数列表里有注释时每个参数占一行，注释留在原来的参数旁边
+	commentEnd := self.commentEnd
+	self.indent++
+	self.commentEnd, _ = self.itemComments(seps, 0, commentEnd)
+	self.trailingComments(min(line, startLine(args[0])-1))
+	self.blockStart = true
+	for i, arg := range args {
+		in, after := self.itemComments(seps, i, commentEnd)
+		self.commentEnd = in
+		self.ownLineComments(startLine(arg))
+		self.gap(startLine(arg))
+		self.newline()
+		self.exp(arg)
+		if i < len(args)-1 {
+			self.write(",")
+		}
+		self.commentEnd = after
+		self.setLastLine(endLine(arg))
+		self.trailingComments(endLine(arg))
+	}
+	_, self.commentEnd = self.itemComments(seps, len(seps), commentEnd)
+	self.ownLineComments(math.MaxInt32)
+	self.commentEnd = commentEnd
+	self.indent--
+	self.newline()
+	self.write(")")
+}
+
+// 函数调用的参数列表是不是直接接在名字后面(比如f、t.k、obj:m)，而不是接在右括号或者其他参数后面
+func afterName(call *FuncCallExp) bool {
+	if call.NameExp != nil {
+		return true
+	}
+	switch x := call.PrefixExp.(type) {
+	case *NameExp:
+		return true
+	case *TableAccessExp:
+		key, ok := x.KeyExp.(*StringExp)
+		return ok && lexer.IsName(key.Str)
+	}
+	return false
+}
+
+func isLParen(tok *lexer.Token) bool {
+	return tok.Kind == lexer.TOKEN_SEP_LPAREN
+}
+
+// 源代码中下一个满足条件的token前面是不是没有左圆括号
+func (self *printer) withoutParens(pos int, match func(*lexer.Token) bool) bool {
+	tok := self.findToken(&pos, match)
+	return tok != nil && pos >= 2 && self.tokens[pos-2].Kind != lexer.TOKEN_SEP_LPAREN
+}
+
+func (self *printer) table(t *TableConstructorExp) {
+	line, open := t.Line, -1
+	if curly := self.findToken(&self.curlyPos, func(tok *lexer.Token) bool { return tok.Kind == lexer.TOKEN_SEP_LCURLY }); curly != nil {
+		line, open = curly.Line, self.curlyPos-1
+		self.inlineComments(open)
+	}
+	if len(t.ValExps) == 0 {
+		self.write("{}")
+		return
+	}
+
+	// 源代码中第一个字段另起一行，表构造器里有注释，或者一行写不下时，每个字段占一行
+	first := startLine(t.ValExps[0])
+	if t.KeyExps[0] != nil {
+		first = startLine(t.KeyExps[0])
+	}
+	seps, inside := self.bracketComments(open)
+	wrap := !self.flat && (first > line || inside)
+	if !self.flat && !wrap {
+		measure := *self
+		measure.buf, measure.flat = &bytes.Buffer{}, true
+		measure.fields(t)
+		width := measure.buf.String()
+		if i := strings.IndexByte(width, '\n'); i >= 0 {
+			width = width[:i]
+		}
+		wrap = self.column+len(width)+2 > self.cfg.MaxWidth
+	}
+	if !wrap {
+		self.write("{")
+		self.fields(t)
+		self.write("}")
+		return
+	}
+
+	commentEnd := self.commentEnd
+	self.write("{")
+	self.indent++
+	self.commentEnd, _ = self.itemComments(seps, 0, commentEnd)
+	self.trailingComments(min(line, first-1))
+	self.blockStart = true
+	for i, val := range t.ValExps {
+		in, after := self.itemComments(seps, i, commentEnd)
+		self.commentEnd = in
+		key := t.KeyExps[i]
+		fieldLine := startLine(val)
+		if key != nil {
+			fieldLine = startLine(key)
+		}
+		self.ownLineComments(fieldLine)
+		self.gap(fieldLine)
+		self.newline()
+		self.field(key, val)
+		self.write(",")
+		self.commentEnd = after
+		self.setLastLine(endLine(val))
+		self.trailingComments(endLine(val))
+	}
+	_, self.commentEnd = self.itemComments(seps, len(seps), commentEnd)
+	self.ownLineComments(math.MaxInt32)
+	self.commentEnd = commentEnd
+	self.indent--
+	self.newline()
+	self.write("}")
+}
+
+func (self *printer) fields(t *TableConstructorExp) {
+	for i, val := range t.ValExps {
+		if i > 0 {
+			self.write(", ")
+		}
+		self.field(t.KeyExps[i], val)
+	}
+}
+
+func (self *printer) field(key, val Exp) {
+	if key != nil {
+		if s, ok := key.(*StringExp); ok && lexer.IsName(s.Str) {
+			self.write(s.Str)
+		} else {
+			self.write("[")
+			self.exp(key)
+			self.write("]")
+		}
+		self.write(" = ")
+	}
+	self.exp(val)
+}
+
+/* 字面量 */
+
+// 整数和浮点数保持源代码中的写法(比如0xFF、1e3)
+func (self *printer) integer(val int64) {
+	tok := self.findToken(&self.numPos, func(tok *lexer.Token) bool {
+		i, ok := number.ParseInteger(tok.Value)
+		return tok.Kind == lexer.TOKEN_NUMBER && ok && i == val
+	})
+	switch {
+	case tok != nil:
+		self.inlineComments(self.numPos - 1)
+		self.write(tok.Text)
+	case val == math.MinInt64:
+		self.write("(-9223372036854775807 - 1)")
+	default:
+		self.write(strconv.FormatInt(val, 10))
+	}
+}
+
+func (self *printer) float(val float64) {
+	tok := self.findToken(&self.numPos, func(tok *lexer.Token) bool {
+		if tok.Kind != lexer.TOKEN_NUMBER {
+			return false
+		}
+		if _, ok := number.ParseInteger(tok.Value); ok {
+			return false
+		}
+		f, ok := number.ParseFloat(tok.Value)
+		return ok && f == val
+	})
+	switch {
+	case tok != nil:
+		self.inlineComments(self.numPos - 1)
+		self.write(tok.Text)
+	case math.IsInf(val, 1):
+		self.write("(1 / 0)")
+	case math.IsInf(val, -1):
+		self.write("(-1 / 0)")
+	case math.IsNaN(val):
+		self.write("(0 / 0)")
+	default:
+		s := strconv.FormatFloat(val, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		self.write(s)
+	}
+}
+
+func matchString(tok *lexer.Token, s string) bool {
+	return tok.Kind == lexer.TOKEN_STRING && tok.Value == s
+}
+
+// 长字符串保持原样，短字符串统一用配置的引号重新转义
+func (self *printer) string(s string) {
+	tok := self.findToken(&self.strPos, func(tok *lexer.Token) bool { return matchString(tok, s) })
+	if tok != nil {
+		self.inlineComments(self.strPos - 1)
+	}
+	if tok != nil && tok.Text[0] == '[' {
+		self.write(tok.Text)
+	} else {
+		self.write(quote(s, self.cfg.Quote))
+	}
+}
+
+func quote(s string, q byte) string {
+	other := byte('\'')
+	if q == '\'' {
+		other = '"'
+	}
+	if strings.IndexByte(s, q) >= 0 && strings.IndexByte(s, other) < 0 {
+		q = other
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(q)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == q || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c == '\a':
+			buf.WriteString(`\a`)
+		case c == '\b':
+			buf.WriteString(`\b`)
+		case c == '\f':
+			buf.WriteString(`\f`)
+		case c == '\n':
+			buf.WriteString(`\n`)
+		case c == '\r':
+			buf.WriteString(`\r`)
+		case c == '\t':
+			buf.WriteString(`\t`)
+		case c == '\v':
+			buf.WriteString(`\v`)
+		case c < ' ' || c == 0x7f:
+			if i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9' {
+				buf.WriteString("\\" + leftPad(strconv.Itoa(int(c)), 3))
+			} else {
+				buf.WriteString("\\" + strconv.Itoa(int(c)))
+			}
+		case c >= utf8.RuneSelf:
+			if r, size := utf8.DecodeRuneInString(s[i:]); r != utf8.RuneError || size > 1 {
+				buf.WriteString(s[i : i+size])
+				i += size
+				continue
+			}
+			buf.WriteString(`\x` + strconv.FormatUint(uint64(c)|0x100, 16)[1:])
+		default:
+			buf.WriteByte(c)
+		}
+		i++
+	}
+	buf.WriteByte(q)
+	return buf.String()
+}
+
+func leftPad(s string, n int) string {
+	return strings.Repeat("0", n-len(s)) + s
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func startLine(node Node) int {
+	line, _ := node.Pos()
+	return line
+}
+
+func endLine(node Node) int {
+	_, lastLine := node.Pos()
+	return lastLine
+}
@@ -0,0 +1,434 @@
+package lint
+
+import (
+	"fmt"
+	. "lua/src/compiler/ast"
+	. "lua/src/compiler/lexer"
+	"strings"
+)
+
+// 语法树里只有行号，列号从lexer.Tokenize()的token流中取：
+// 按照源代码的顺序遍历语法树，名字和字符串依次和同一行上还没有用过的token对应起来
+type checker struct {
+	file        string
+	cfg         Config
+	tokens      []*Token
+	lines       map[int][]int // 每一行上的token在tokens中的索引
+	cursors     map[int]int   // 每一行上下一个可以使用的token在lines[line]中的位置
+	fs          *funcScope
+	partial     bool // 有语法错误，出错的语句不在语法树里
+	diagnostics []*Diagnostic
+	decls       []*Decl
+	refs        []*Ref
+}
+
+func newChecker(file string, cfg Config, tokens []*Token) *checker {
+	c := &checker{
+		file:    file,
+		cfg:     cfg,
+		tokens:  tokens,
+		lines:   map[int][]int{},
+		cursors: map[int]int{},
+	}
+	for i, tok := range tokens {
+		if tok.Kind != TOKEN_EOF {
+			c.lines[tok.LastLine] = append(c.lines[tok.LastLine], i)
+		}
+	}
+	return c
+}
+
+func (self *checker) report(line, column int, code, f string, a ...interface{}) {
+	self.diagnostics = append(self.diagnostics, &Diagnostic{
+		File:    self.file,
+		Line:    line,
+		Column:  column,
+		Code:    code,
+		Message: fmt.Sprintf(f, a...),
+	})
+}
+
+/* 列号 */
+
+// 在line行上找到下一个值为value的名字或者字符串，返回它在tokens中的索引，找不到时返回-1
+func (self *checker) consume(line int, value string, kinds ...int) int {
+	idxs := self.lines[line]
+	for i := self.cursors[line]; i < len(idxs); i++ {
+		tok := self.tokens[idxs[i]]
+		if tok.Value == value && isKind(tok.Kind, kinds) {
+			self.cursors[line] = i + 1
+			return idxs[i]
+		}
+	}
+	return -1
+}
+
+// 名字所在的列号，找不到对应的token时返回1
+func (self *checker) nameColumn(line int, name string) int {
+	if i := self.consume(line, name, TOKEN_IDENTIFIER); i >= 0 {
+		return self.tokens[i].Column
+	}
+	return 1
+}
+
+// line行上还没有用过的第一个指定种类的token所在的列号，用来定位语句的开头
+func (self *checker) firstColumn(line int, kinds ...int) int {
+	idxs := self.lines[line]
+	for i := self.cursors[line]; i < len(idxs); i++ {
+		if tok := self.tokens[idxs[i]]; isKind(tok.Kind, kinds) {
+			return tok.Column
+		}
+	}
+	return 1
+}
+
+func isKind(kind int, kinds []int) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+/* 作用域 */
+
+// 主函数的作用域一直到源代码结束
+func (self *checker) checkMain(block *Block) {
+	lastLine := block.LastLine
+	if n := len(self.tokens); n > 0 && self.tokens[n-1].LastLine > lastLine {
+		lastLine = self.tokens[n-1].LastLine
+	}
+	self.fs = newFuncScope(nil)
+	self.checkBlock(block, lastLine)
+}
+
+// 检查语句块，lastLine是块结束的行号(end、else等关键字所在的行)
+func (self *checker) checkBlock(block *Block, lastLine int) {
+	self.fs.enterScope()
+	self.checkStats(block)
+	self.exitScope(lastLine)
+}
+
+func (self *checker) exitScope(lastLine int) {
+	dead, unresolved := self.fs.exitScope()
+	for _, locVar := range dead {
+		decl := locVar.decl
+		decl.EndLine = lastLine
+		if self.partial || locVar.used || strings.HasPrefix(decl.Name, "_") || locVar.attrib == "close" {
+			continue
+		}
+		switch decl.Kind {
+		case VAR_LOCAL:
+			self.report(decl.Line, decl.Column, UNUSED_LOCAL, "unused variable '%s'", decl.Name)
+		case VAR_FUNCTION:
+			self.report(decl.Line, decl.Column, UNUSED_LOCAL, "unused function '%s'", decl.Name)
+		case VAR_LOOP:
+			self.report(decl.Line, decl.Column, UNUSED_LOCAL, "unused loop variable '%s'", decl.Name)
+		case VAR_PARAM:
+			self.report(decl.Line, decl.Column, UNUSED_PARAM, "unused argument '%s'", decl.Name)
+		}
+	}
+	for _, g := range unresolved {
+		self.report(g.line, g.column, UNDEFINED_LABEL, "no visible label '%s' for goto", g.name)
+	}
+}
+
+// 声明局部变量，和可见的同名局部变量冲突时报告
+func (self *checker) declare(name string, kind, line, column int) *locVarInfo {
+	if kind != VAR_SELF && name != "_" {
+		if prev, upval := self.fs.lookup(name); prev != nil && prev.decl.Kind != VAR_SELF {
+			if upval {
+				self.report(line, column, SHADOWED_LOCAL,
+					"shadowing upvalue '%s' on line %d", name, prev.decl.Line)
+			} else if prev.scopeLv == self.fs.scopeLv {
+				self.report(line, column, SHADOWED_LOCAL,
+					"variable '%s' was previously defined on line %d", name, prev.decl.Line)
+			} else {
+				self.report(line, column, SHADOWED_LOCAL,
+					"shadowing definition of variable '%s' on line %d", name, prev.decl.Line)
+			}
+		}
+	}
+	decl := &Decl{Name: name, Kind: kind, Line: line, Column: column}
+	self.decls = append(self.decls, decl)
+	return self.fs.addLocVar(decl)
+}
+
+// 记录名字的一次读写，返回它引用的局部变量，全局变量返回nil
+func (self *checker) reference(name string, line, column int, write bool) *locVarInfo {
+	locVar, _ := self.fs.lookup(name)
+	ref := &Ref{Name: name, Line: line, Column: column, Write: write}
+	if locVar != nil {
+		ref.Decl = locVar.decl
+	}
+	self.refs = append(self.refs, ref)
+	return locVar
+}
+
+/* 语句 */
+
+func (self *checker) checkStats(block *Block) {
+	dead, reported := false, false
+	for _, stat := range block.Stats {
+		if _, ok := stat.(*LabelStat); ok {
+			dead, reported = false, false // 可以通过goto到达
+		} else if dead && !reported {
+			line, _ := stat.Pos()
+			self.report(line, self.statColumn(stat, line), UNREACHABLE_CODE, "unreachable code")
+			reported = true
+		}
+		self.checkStat(stat)
+		if terminates(stat) {
+			dead = true
+		}
+	}
+	if block.RetExps != nil {
+		if dead && !reported {
+			line := block.LastLine
+			if len(block.RetExps) > 0 {
+				line, _ = block.RetExps[0].Pos()
+			}
+			self.report(line, self.firstColumn(line, TOKEN_KW_RETURN), UNREACHABLE_CODE, "unreachable code")
+		}
+		self.checkExps(block.RetExps)
+	}
+}
+
+// 语句开头所在的列号
+func (self *checker) statColumn(stat Stat, line int) int {
+	switch stat.(type) {
+	case *BreakStat:
+		return self.firstColumn(line, TOKEN_KW_BREAK)
+	case *GotoStat:
+		return self.firstColumn(line, TOKEN_KW_GOTO)
+	case *DoStat:
+		return self.firstColumn(line, TOKEN_KW_DO)
+	case *WhileStat:
+		return self.firstColumn(line, TOKEN_KW_WHILE)
+	case *RepeatStat:
+		return self.firstColumn(line, TOKEN_KW_REPEAT)
+	case *IfStat:
+		return self.firstColumn(line, TOKEN_KW_IF)
+	case *ForNumStat, *ForInStat:
+		return self.firstColumn(line, TOKEN_KW_FOR)
+	case *LocalVarDeclStat, *LocalFuncDefStat:
+		return self.firstColumn(line, TOKEN_KW_LOCAL)
+	default: // 赋值、函数定义和函数调用
+		return self.firstColumn(line, TOKEN_IDENTIFIER, TOKEN_SEP_LPAREN, TOKEN_KW_FUNCTION)
+	}
+}
+
+// 语句执行完之后是否一定不会执行后面的语句
+func terminates(stat Stat) bool {
+	switch x := stat.(type) {
+	case *BreakStat, *GotoStat:
+		return true
+	case *DoStat:
+		return blockTerminates(x.Block)
+	case *IfStat:
+		if _, ok := x.Exps[len(x.Exps)-1].(*TrueExp); !ok { // 没有else分支
+			return false
+		}
+		for _, block := range x.Blocks {
+			if !blockTerminates(block) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func blockTerminates(block *Block) bool {
+	if block.RetExps != nil {
+		return true
+	}
+	n := len(block.Stats)
+	return n > 0 && terminates(block.Stats[n-1])
+}
+
+func (self *checker) checkStat(stat Stat) {
+	switch x := stat.(type) {
+	case *LabelStat:
+		self.nameColumn(x.Line, x.Name)
+		self.fs.block.labels[x.Name] = true
+	case *GotoStat:
+		column := self.nameColumn(x.Line, x.Name)
+		self.fs.block.gotos = append(self.fs.block.gotos, gotoInfo{x.Name, x.Line, column})
+	case *DoStat:
+		self.checkBlock(x.Block, x.LastLine)
+	case *WhileStat:
+		self.checkExp(x.Exp)
+		self.checkBlock(x.Block, x.LastLine)
+	case *RepeatStat: // until后面的条件可以访问循环体中的局部变量
+		self.fs.enterScope()
+		self.checkStats(x.Block)
+		self.checkExp(x.Exp)
+		_, lastLine := x.Pos()
+		self.exitScope(lastLine)
+	case *IfStat:
+		for i, exp := range x.Exps {
+			self.checkExp(exp)
+			lastLine := x.LastLine
+			if i+1 < len(x.Exps) { // 下一个elseif或else所在的行
+				lastLine, _ = x.Exps[i+1].Pos()
+			}
+			self.checkBlock(x.Blocks[i], lastLine)
+		}
+	case *ForNumStat:
+		column := self.nameColumn(x.LineOfFor, x.VarName)
+		self.checkExps([]Exp{x.InitExp, x.LimitExp, x.StepExp})
+		self.fs.enterScope()
+		self.declare(x.VarName, VAR_LOOP, x.LineOfFor, column)
+		self.checkBlock(x.Block, x.LastLine)
+		self.exitScope(x.LastLine)
+	case *ForInStat:
+		columns := self.nameColumns(x.LineOfFor, x.NameList)
+		self.checkExps(x.ExpList)
+		self.fs.enterScope()
+		for i, name := range x.NameList {
+			self.declare(name, VAR_LOOP, x.LineOfFor, columns[i])
+		}
+		self.checkBlock(x.Block, x.LastLine)
+		self.exitScope(x.LastLine)
+	case *LocalVarDeclStat:
+		columns := self.nameColumns(x.Line, x.NameList)
+		self.checkExps(x.ExpList)
+		for i, name := range x.NameList {
+			locVar := self.declare(name, VAR_LOCAL, x.Line, columns[i])
+			if x.AttribList != nil {
+				locVar.attrib = x.AttribList[i]
+			}
+		}
+	case *LocalFuncDefStat: // 函数体中可以递归调用自己，所以先声明
+		column := self.nameColumn(x.Line, x.Name)
+		self.declare(x.Name, VAR_FUNCTION, x.Line, column)
+		self.checkFuncDefExp(x.Exp, 0, 0)
+	case *AssignStat:
+		for _, v := range x.VarList {
+			self.checkVar(v)
+		}
+		for i, exp := range x.ExpList {
+			if fd, ok := exp.(*FuncDefExp); ok && i == 0 {
+				line, column := self.methodName(x, fd)
+				self.checkFuncDefExp(fd, line, column)
+			} else {
+				self.checkExp(exp)
+			}
+		}
+	case *FuncCallStat:
+		self.checkExp(x)
+	}
+}
+
+// 局部变量声明等语句的名字列表都在同一行上，解析器只记录了这一行
+func (self *checker) nameColumns(line int, names []string) []int {
+	columns := make([]int, len(names))
+	for i, name := range names {
+		columns[i] = self.nameColumn(line, name)
+	}
+	return columns
+}
+
+// 判断赋值语句是否是方法定义`function a.b:c() end`，它的第一个参数self不在源代码里
+// 方法名前面是冒号，而且它的token刚刚在checkVar()中用过；是方法定义时返回方法名的位置，否则返回0
+func (self *checker) methodName(stat *AssignStat, fd *FuncDefExp) (line, column int) {
+	if len(stat.VarList) != 1 || len(fd.ParList) == 0 || fd.ParList[0] != "self" {
+		return 0, 0
+	}
+	access, ok := stat.VarList[0].(*TableAccessExp)
+	if !ok {
+		return 0, 0
+	}
+	key, ok := access.KeyExp.(*StringExp)
+	if !ok {
+		return 0, 0
+	}
+	line = access.LastLine
+	if n := self.cursors[line]; n > 0 {
+		if i := self.lines[line][n-1]; i > 0 && self.tokens[i].Value == key.Str &&
+			self.tokens[i-1].Kind == TOKEN_SEP_COLON {
+			return line, self.tokens[i].Column
+		}
+	}
+	return 0, 0
+}
+
+// 赋值语句左边的变量
+func (self *checker) checkVar(exp Exp) {
+	switch x := exp.(type) {
+	case *NameExp:
+		column := self.nameColumn(x.Line, x.Name)
+		if locVar := self.reference(x.Name, x.Line, column, true); locVar == nil && !self.cfg.Globals[x.Name] {
+			self.report(x.Line, column, GLOBAL_WRITE, "setting non-standard global variable '%s'", x.Name)
+		}
+	default:
+		self.checkExp(exp)
+	}
+}
+
+/* 表达式 */
+
+func (self *checker) checkExps(exps []Exp) {
+	for _, exp := range exps {
+		self.checkExp(exp)
+	}
+}
+
+func (self *checker) checkExp(exp Exp) {
+	switch x := exp.(type) {
+	case *NameExp:
+		column := self.nameColumn(x.Line, x.Name)
+		if locVar := self.reference(x.Name, x.Line, column, false); locVar != nil {
+			locVar.used = true
+		} else if !self.cfg.Globals[x.Name] {
+			self.report(x.Line, column, UNDEFINED_GLOBAL, "accessing undefined variable '%s'", x.Name)
+		}
+	case *StringExp: // 字符串字面量，或者a.b、a:b()和{b = c}中的名字
+		self.consume(x.Line, x.Str, TOKEN_STRING, TOKEN_IDENTIFIER)
+	case *UnopExp:
+		self.checkExp(x.Exp)
+	case *BinopExp:
+		self.checkExp(x.Exp1)
+		self.checkExp(x.Exp2)
+	case *ConcatExp:
+		self.checkExps(x.Exps)
+	case *ParensExp:
+		self.checkExp(x.Exp)
+	case *TableConstructorExp:
+		for i, k := range x.KeyExps {
+			if k != nil {
+				self.checkExp(k)
+			}
+			self.checkExp(x.ValExps[i])
+		}
+	case *FuncDefExp:
+		self.checkFuncDefExp(x, 0, 0)
+	case *TableAccessExp:
+		self.checkExp(x.PrefixExp)
+		self.checkExp(x.KeyExp)
+	case *FuncCallExp:
+		self.checkExp(x.PrefixExp)
+		if x.NameExp != nil {
+			self.checkExp(x.NameExp)
+		}
+		self.checkExps(x.Args)
+	}
+}
+
+// 函数定义，selfLine大于0表示第一个参数是隐含的self，把它的位置记为方法名的位置
+func (self *checker) checkFuncDefExp(fd *FuncDefExp, selfLine, selfColumn int) {
+	self.fs = newFuncScope(self.fs)
+	self.fs.enterScope()
+	for i, name := range fd.ParList {
+		if i == 0 && selfLine > 0 {
+			self.declare(name, VAR_SELF, selfLine, selfColumn)
+		} else {
+			self.declare(name, VAR_PARAM, fd.Line, self.nameColumn(fd.Line, name))
+		}
+	}
+	self.checkBlock(fd.Block, fd.LastLine)
+	self.exitScope(fd.LastLine)
+	self.fs = self.fs.parent
+}
@@ -0,0 +1,105 @@
+package lint
+
+import (
+	"fmt"
+	"lua/src/api"
+	"lua/src/binchunk"
+	"lua/src/compiler/lexer"
+	"lua/src/compiler/parser"
+	"lua/src/state"
+	"sort"
+)
+
+// 静态检查：未定义的全局变量、没有使用的局部变量和参数、遮蔽外层的局部变量、
+// break/goto/return之后执行不到的代码、找不到标签的goto
+
+// 检查结果的种类
+const (
+	SYNTAX_ERROR     = "syntax-error"
+	UNDEFINED_GLOBAL = "undefined-global" // 读取不在允许列表里的全局变量
+	GLOBAL_WRITE     = "global-write"     // 给不在允许列表里的全局变量赋值
+	UNUSED_LOCAL     = "unused-local"     // 局部变量、局部函数或者循环变量没有被读取过
+	UNUSED_PARAM     = "unused-param"     // 参数没有被读取过
+	SHADOWED_LOCAL   = "shadowed-local"   // 局部变量和可见的同名局部变量冲突
+	UNREACHABLE_CODE = "unreachable-code"
+	UNDEFINED_LABEL  = "undefined-label" // goto找不到可见的标签
+)
+
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"` // 从1开始，按字节计算
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// file:line:col: message (code)
+func (self *Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s (%s)", self.File, self.Line, self.Column, self.Message, self.Code)
+}
+
+type Config struct {
+	Globals map[string]bool // 允许读写的全局变量
+	Dialect byte
+}
+
+// 默认允许OpenLibs()注册的全局变量
+func DefaultConfig() Config {
+	return Config{Globals: StdGlobals(), Dialect: binchunk.LUA_DIALECT_53}
+}
+
+// 返回OpenLibs()之后全局表里的所有名字
+func StdGlobals() map[string]bool {
+	ls := state.New()
+	ls.OpenLibs()
+	globals := map[string]bool{}
+	ls.PushGlobalTable()
+	ls.PushNil()
+	for ls.Next(-2) {
+		if ls.Type(-2) == api.LUA_TSTRING {
+			globals[ls.ToString(-2)] = true
+		}
+		ls.Pop(1)
+	}
+	ls.Pop(1)
+	return globals
+}
+
+// 检查一个源文件，返回按位置排序的结果
+// 有语法错误时以错误恢复模式解析，语法错误和其余部分的检查结果一起返回
+func Check(src []byte, chunkName string, cfg Config) []*Diagnostic {
+	return Analyze(src, chunkName, cfg).Diagnostics
+}
+
+// 检查的结果，以及检查过程中解析出来的局部变量声明和名字的引用，供编辑器等工具使用
+type Analysis struct {
+	Diagnostics []*Diagnostic // 按位置排序
+	Decls       []*Decl       // 按声明的顺序排列
+	Refs        []*Ref        // 按源代码的顺序排列
+}
+
+func Analyze(src []byte, chunkName string, cfg Config) *Analysis {
+	chunk := string(src)
+	tokens, _ := lexer.Tokenize(chunk, chunkName, cfg.Dialect)
+	block, errs := parser.ParseRecovering(lexer.SkipShebang(chunk), chunkName, cfg.Dialect)
+
+	c := newChecker(binchunk.ChunkID(chunkName), cfg, tokens)
+	for _, err := range errs {
+		msg := err.Msg
+		if err.Token != "" {
+			msg += " near " + err.Token
+		}
+		c.report(err.Line, err.Column, SYNTAX_ERROR, msg)
+	}
+	c.partial = len(errs) > 0 // 被丢弃的语句里可能用到了局部变量，不再报告没有使用的变量
+	c.checkMain(block)
+
+	sort.SliceStable(c.diagnostics, func(i, j int) bool {
+		a, b := c.diagnostics[i], c.diagnostics[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return &Analysis{Diagnostics: c.diagnostics, Decls: c.decls, Refs: c.refs}
+}
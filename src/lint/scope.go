@@ -0,0 +1,128 @@
+package lint
+
+// 作用域跟踪，和codegen的funcInfo一样按函数记录局部变量，名字按照局部变量、Upvalue、全局变量的顺序解析
+
+// 局部变量的种类
+const (
+	VAR_LOCAL    = iota // local声明的变量
+	VAR_FUNCTION        // local function声明的函数
+	VAR_LOOP            // for循环变量
+	VAR_PARAM           // 函数参数
+	VAR_SELF            // 方法定义中隐含的self参数
+)
+
+// 局部变量的声明，EndLine在离开作用域时才确定
+type Decl struct {
+	Name    string
+	Kind    int // VAR_*
+	Line    int // 声明的位置，隐含的self参数是方法名的位置
+	Column  int
+	EndLine int // 作用域结束的行号
+}
+
+// 名字的一次读写，Decl为nil表示全局变量
+type Ref struct {
+	Name   string
+	Line   int
+	Column int
+	Decl   *Decl
+	Write  bool // 是否是赋值
+}
+
+type locVarInfo struct {
+	prev    *locVarInfo // 前一个同名局部变量
+	decl    *Decl       // 变量名、种类和位置
+	attrib  string      // 变量属性(5.4)："const"、"close"或者""
+	scopeLv int         // 变量的作用域层级
+	used    bool        // 是否被读取过
+}
+
+// goto语句，在所在的块和外围块中寻找标签
+type gotoInfo struct {
+	name   string
+	line   int
+	column int
+}
+
+// 一个块中的标签和还没有找到标签的goto语句
+type blockInfo struct {
+	parent *blockInfo // 同一个函数中的外围块
+	labels map[string]bool
+	gotos  []gotoInfo
+}
+
+type funcScope struct {
+	parent   *funcScope             // 外围函数
+	scopeLv  int                    // 作用域层级
+	locVars  []*locVarInfo          // 局部变量表
+	locNames map[string]*locVarInfo // 局部变量名表
+	block    *blockInfo             // 当前块
+}
+
+func newFuncScope(parent *funcScope) *funcScope {
+	return &funcScope{
+		parent:   parent,
+		locVars:  make([]*locVarInfo, 0, 8),
+		locNames: map[string]*locVarInfo{},
+	}
+}
+
+// 进入新的作用域，每个块都是一个作用域
+func (self *funcScope) enterScope() {
+	self.scopeLv++
+	self.block = &blockInfo{parent: self.block, labels: map[string]bool{}}
+}
+
+// 在当前作用域中添加一个局部变量
+func (self *funcScope) addLocVar(decl *Decl) *locVarInfo {
+	newVar := &locVarInfo{
+		prev:    self.locNames[decl.Name],
+		decl:    decl,
+		scopeLv: self.scopeLv,
+	}
+	self.locVars = append(self.locVars, newVar)
+	self.locNames[decl.Name] = newVar
+	return newVar
+}
+
+// 查找可见的同名局部变量，upval表示它属于外围函数
+func (self *funcScope) lookup(name string) (locVar *locVarInfo, upval bool) {
+	for fs := self; fs != nil; fs = fs.parent {
+		if locVar, found := fs.locNames[name]; found {
+			return locVar, fs != self
+		}
+	}
+	return nil, false
+}
+
+// 退出当前作用域，返回离开作用域的局部变量和找不到标签的goto语句
+// 块中没有找到标签的goto语句交给外围块继续寻找，函数的最外层块没有外围块
+func (self *funcScope) exitScope() (dead []*locVarInfo, unresolved []gotoInfo) {
+	self.scopeLv--
+	n := len(self.locVars)
+	for n > 0 && self.locVars[n-1].scopeLv > self.scopeLv {
+		n--
+		locVar := self.locVars[n]
+		if locVar.prev == nil {
+			delete(self.locNames, locVar.decl.Name)
+		} else {
+			self.locNames[locVar.decl.Name] = locVar.prev
+		}
+		dead = append(dead, locVar)
+	}
+	self.locVars = self.locVars[:n]
+
+	block := self.block
+	self.block = block.parent
+	for _, g := range block.gotos {
+		if block.labels[g.name] {
+			continue
+		}
+		if self.block != nil {
+			self.block.gotos = append(self.block.gotos, g)
+		} else {
+			unresolved = append(unresolved, g)
+		}
+	}
+	return
+}
@@ -0,0 +1,289 @@
+package lsp
+
+import (
+	"lua/src/binchunk"
+	"lua/src/compiler"
+	"lua/src/compiler/ast"
+	"lua/src/compiler/lexer"
+	"lua/src/compiler/parser"
+	"lua/src/lint"
+	"net/url"
+	"unicode/utf16"
+)
+
+// 打开的文档，每次修改之后重新分析
+// 内部的行号和列号和编译器一样从1开始，列号按字节计算；和客户端交换的位置是LSP的Position
+type document struct {
+	uri        string
+	version    int
+	text       string
+	lines      []string // 每一行的内容，不含换行符
+	lineStarts []int    // 每一行在text中的偏移
+	tokens     []*lexer.Token
+	lineTokens map[int][]int // 每一行上的token在tokens中的索引
+	block      *ast.Block    // 错误恢复模式解析出来的语法树
+	errs       []*lexer.SyntaxError
+	analysis   *lint.Analysis
+	symbols    []DocumentSymbol
+	funcs      []*funcDef
+	requires   map[requireKey]string // 用require()的结果初始化的变量
+	proto      *binchunk.Prototype   // 没有语法错误时编译出来的主函数原型
+}
+
+// 函数定义和它的名字在源代码中的位置，匿名函数的位置是function关键字
+type funcDef struct {
+	name   string // "f"、"a.b"、"a:b"，匿名函数为空
+	line   int
+	column int
+	width  int
+	exp    *ast.FuncDefExp
+}
+
+// 局部变量按照声明的位置区分，全局变量的line为0
+type requireKey struct {
+	line int
+	name string
+}
+
+func newDocument(uri string, version int, text string, cfg lint.Config) *document {
+	doc := &document{uri: uri, version: version, text: text}
+	doc.splitLines()
+	chunkName := doc.chunkName()
+	doc.tokens, _ = lexer.Tokenize(text, chunkName, cfg.Dialect)
+	doc.lineTokens = map[int][]int{}
+	for i, tok := range doc.tokens {
+		if tok.Kind != lexer.TOKEN_EOF {
+			doc.lineTokens[tok.LastLine] = append(doc.lineTokens[tok.LastLine], i)
+		}
+	}
+	doc.analysis = lint.Analyze([]byte(text), chunkName, cfg)
+	doc.block, doc.errs = parser.ParseRecovering(lexer.SkipShebang(text), chunkName, cfg.Dialect)
+	doc.requires = map[requireKey]string{}
+	c := &symbolCollector{doc: doc, usedKeywords: map[int]bool{}}
+	doc.symbols = c.block(doc.block)
+	doc.funcs = c.funcs
+	if len(doc.errs) == 0 {
+		doc.proto, _ = compiler.Compile(lexer.SkipShebang(text), &compiler.CompileOptions{ChunkName: chunkName, Dialect: cfg.Dialect})
+	}
+	return doc
+}
+
+// 按照和词法分析器一样的规则分行："\n"、"\r"、"\r\n"和"\n\r"都是一个换行符
+func (self *document) splitLines() {
+	text := self.text
+	start := 0
+	for i := 0; i < len(text); i++ {
+		if c := text[i]; c == '\n' || c == '\r' {
+			self.lines = append(self.lines, text[start:i])
+			self.lineStarts = append(self.lineStarts, start)
+			if i+1 < len(text) && (text[i+1] == '\n' || text[i+1] == '\r') && text[i+1] != c {
+				i++
+			}
+			start = i + 1
+		}
+	}
+	self.lines = append(self.lines, text[start:])
+	self.lineStarts = append(self.lineStarts, start)
+}
+
+// 文件的uri作为"@路径"，其他uri原样显示
+func (self *document) chunkName() string {
+	if path := uriToPath(self.uri); path != "" {
+		return "@" + path
+	}
+	return "=" + self.uri
+}
+
+func uriToPath(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		return u.Path
+	}
+	return ""
+}
+
+func pathToURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+/* 位置 */
+
+// 第line行的内容，行号从1开始
+func (self *document) lineText(line int) string {
+	if line < 1 || line > len(self.lines) {
+		return ""
+	}
+	return self.lines[line-1]
+}
+
+// 行号和字节列号转换成LSP的位置
+func (self *document) position(line, column int) Position {
+	text := self.lineText(line)
+	if column-1 > len(text) {
+		column = len(text) + 1
+	}
+	character := 0
+	for _, r := range text[:max(column-1, 0)] {
+		character += utf16.RuneLen(r) // 不是UTF-8的字节是RuneError，按一个字符计算
+	}
+	return Position{Line: line - 1, Character: character}
+}
+
+// LSP的位置转换成行号和字节列号
+func (self *document) offset(pos Position) (line, column int) {
+	line = pos.Line + 1
+	text := self.lineText(line)
+	character := 0
+	for i, r := range text {
+		if character >= pos.Character {
+			return line, i + 1
+		}
+		character += utf16.RuneLen(r)
+	}
+	return line, len(text) + 1
+}
+
+// LSP的位置转换成text中的偏移
+func (self *document) textOffset(pos Position) int {
+	if pos.Line >= len(self.lines) {
+		return len(self.text)
+	}
+	line, column := self.offset(pos)
+	return self.lineStarts[line-1] + column - 1
+}
+
+// 一行上从column开始的width个字节
+func (self *document) rangeOf(line, column, width int) Range {
+	return Range{self.position(line, column), self.position(line, column+width)}
+}
+
+// 从startLine行的开头到lastLine行的末尾
+func (self *document) linesRange(startLine, lastLine int) Range {
+	return Range{
+		Position{Line: startLine - 1},
+		self.position(lastLine, len(self.lineText(lastLine))+1),
+	}
+}
+
+// 修改文档，没有Range时替换整个文档
+func (self *document) applyChange(change TextDocumentContentChangeEvent) string {
+	if change.Range == nil {
+		return change.Text
+	}
+	start := self.textOffset(change.Range.Start)
+	end := self.textOffset(change.Range.End)
+	if end < start {
+		end = start
+	}
+	return self.text[:start] + change.Text + self.text[end:]
+}
+
+/* token */
+
+// 位置所在的token，不在任何token上时返回nil
+func (self *document) tokenAt(line, column int) *lexer.Token {
+	for _, i := range self.lineTokens[line] {
+		tok := self.tokens[i]
+		if tok.Line == line && tok.Column <= column && column < tok.Column+len(tok.Text) {
+			return tok
+		}
+	}
+	return nil
+}
+
+// line行上第一个指定种类并且值为value的token，找不到时返回-1
+func (self *document) findToken(line int, value string, kinds ...int) int {
+	for _, i := range self.lineTokens[line] {
+		tok := self.tokens[i]
+		if tok.Value == value {
+			for _, kind := range kinds {
+				if tok.Kind == kind {
+					return i
+				}
+			}
+		}
+	}
+	return -1
+}
+
+/* 名字 */
+
+// 位置上的名字引用的局部变量，或者局部变量的声明
+func (self *document) refAt(line, column int) (*lint.Ref, *lint.Decl) {
+	for _, ref := range self.analysis.Refs {
+		if ref.Line == line && ref.Column <= column && column <= ref.Column+len(ref.Name) {
+			return ref, ref.Decl
+		}
+	}
+	for _, decl := range self.analysis.Decls {
+		if decl.Kind != lint.VAR_SELF && decl.Line == line &&
+			decl.Column <= column && column <= decl.Column+len(decl.Name) {
+			return nil, decl
+		}
+	}
+	return nil, nil
+}
+
+// 位置之前最近的可见的局部变量，同名的只保留最内层的
+func (self *document) visibleDecls(line, column int) []*lint.Decl {
+	var decls []*lint.Decl
+	seen := map[string]int{}
+	for _, decl := range self.analysis.Decls {
+		if decl.Line > line || decl.Line == line && decl.Column >= column || decl.EndLine < line {
+			continue
+		}
+		if i, ok := seen[decl.Name]; ok {
+			decls[i] = decl // 后声明的在内层
+		} else {
+			seen[decl.Name] = len(decls)
+			decls = append(decls, decl)
+		}
+	}
+	return decls
+}
+
+// 第一次给全局变量赋值的位置
+func (self *document) globalDef(name string) *lint.Ref {
+	for _, ref := range self.analysis.Refs {
+		if ref.Decl == nil && ref.Write && ref.Name == name {
+			return ref
+		}
+	}
+	return nil
+}
+
+// 名字所在位置上定义的函数
+func (self *document) funcAt(line, column int) *funcDef {
+	for _, fd := range self.funcs {
+		if fd.line == line && fd.column <= column && column <= fd.column+fd.width {
+			return fd
+		}
+	}
+	return nil
+}
+
+// 函数定义对应的函数原型，按起止行号查找
+func (self *document) protoOf(fd *ast.FuncDefExp) *binchunk.Prototype {
+	var find func(p *binchunk.Prototype) *binchunk.Prototype
+	find = func(p *binchunk.Prototype) *binchunk.Prototype {
+		for _, sub := range p.Protos {
+			if int(sub.LineDefined) == fd.Line && int(sub.LastLineDefined) == fd.LastLine {
+				return sub
+			}
+			if found := find(sub); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	if self.proto == nil {
+		return nil
+	}
+	return find(self.proto)
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
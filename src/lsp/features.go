@@ -0,0 +1,191 @@
+package lsp
+
+import (
+	"bytes"
+	"fmt"
+	"lua/src/Tools"
+	"lua/src/lint"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/* 跳转到定义 */
+
+// 局部变量和Upvalue跳转到声明，全局变量跳转到文档中第一次给它赋值的地方
+func (self *Server) definition(doc *document, line, column int) interface{} {
+	ref, decl := doc.refAt(line, column)
+	if decl != nil {
+		width := len(decl.Name)
+		if decl.Kind == lint.VAR_SELF { // 隐含的self参数定位到方法名
+			if tok := doc.tokenAt(decl.Line, decl.Column); tok != nil {
+				width = len(tok.Text)
+			}
+		}
+		return []Location{{doc.uri, doc.rangeOf(decl.Line, decl.Column, width)}}
+	}
+	if ref != nil {
+		if def := doc.globalDef(ref.Name); def != nil {
+			return []Location{{doc.uri, doc.rangeOf(def.Line, def.Column, len(def.Name))}}
+		}
+	}
+	return []Location{}
+}
+
+/* 悬停提示 */
+
+// 函数显示签名和Tools.List格式的反汇编，变量显示种类和声明的位置
+func (self *Server) hover(doc *document, line, column int) interface{} {
+	fd := doc.funcAt(line, column)
+	ref, decl := doc.refAt(line, column)
+	if fd == nil && decl != nil && decl.Kind == lint.VAR_FUNCTION {
+		fd = doc.funcAt(decl.Line, decl.Column)
+	}
+	if fd == nil && ref != nil && decl == nil {
+		if def := doc.globalDef(ref.Name); def != nil {
+			fd = doc.funcAt(def.Line, def.Column)
+		}
+	}
+	if fd != nil {
+		return &Hover{Contents: MarkupContent{"markdown", self.funcHover(doc, fd)}}
+	}
+
+	var text string
+	switch {
+	case decl != nil:
+		kinds := map[int]string{
+			lint.VAR_LOCAL:    "local",
+			lint.VAR_FUNCTION: "local function",
+			lint.VAR_LOOP:     "(loop variable)",
+			lint.VAR_PARAM:    "(parameter)",
+			lint.VAR_SELF:     "(self)",
+		}
+		text = fmt.Sprintf("```lua\n%s %s\n```\ndeclared on line %d", kinds[decl.Kind], decl.Name, decl.Line)
+	case ref != nil:
+		if g := self.std[ref.Name]; g != nil {
+			text = fmt.Sprintf("```lua\n(global) %s: %s\n```\nstandard library", ref.Name, g.typeName)
+		} else if def := doc.globalDef(ref.Name); def != nil {
+			text = fmt.Sprintf("```lua\n(global) %s\n```\nassigned on line %d", ref.Name, def.Line)
+		} else {
+			text = fmt.Sprintf("```lua\n(global) %s\n```\nundefined", ref.Name)
+		}
+	default:
+		return nil
+	}
+	var r Range
+	if ref != nil {
+		r = doc.rangeOf(ref.Line, ref.Column, len(ref.Name))
+	} else {
+		r = doc.rangeOf(decl.Line, decl.Column, len(decl.Name))
+	}
+	return &Hover{Contents: MarkupContent{"markdown", text}, Range: &r}
+}
+
+func (self *Server) funcHover(doc *document, fd *funcDef) string {
+	params := fd.exp.ParList
+	if strings.Contains(fd.name, ":") && len(params) > 0 { // 方法的self参数是隐含的
+		params = params[1:]
+	}
+	params = append([]string{}, params...)
+	if fd.exp.IsVararg {
+		params = append(params, "...")
+	}
+	name := fd.name
+	if name != "" {
+		name = " " + name
+	}
+	text := fmt.Sprintf("```lua\nfunction%s(%s)\n```\n", name, strings.Join(params, ", "))
+	if proto := doc.protoOf(fd.exp); proto != nil {
+		var buf bytes.Buffer
+		Tools.Fprint(&buf, proto, false, false)
+		text += "```\n" + strings.TrimLeft(buf.String(), "\n") + "```"
+	} else {
+		text += "bytecode unavailable: the document does not compile"
+	}
+	return text
+}
+
+/* 自动补全 */
+
+var requirePrefix = regexp.MustCompile(`\brequire\s*\(?\s*["']([\w.]*)$`)
+var fieldPrefix = regexp.MustCompile(`([A-Za-z_][\w]*)\s*[.:]\s*\w*$`)
+
+// require的参数补全模块名，a.和a:之后补全标准库或者require的模块中的字段，
+// 其他地方补全可见的局部变量、标准库的全局变量和关键字
+func (self *Server) completion(doc *document, line, column int) interface{} {
+	before := doc.lineText(line)
+	if column-1 < len(before) {
+		before = before[:column-1]
+	}
+	items := []CompletionItem{}
+	if requirePrefix.MatchString(before) {
+		for _, module := range self.modules() {
+			items = append(items, CompletionItem{Label: module, Kind: COMPLETION_MODULE, Detail: "module"})
+		}
+		return &CompletionList{Items: items}
+	}
+	if m := fieldPrefix.FindStringSubmatchIndex(before); m != nil {
+		name := before[m[2]:m[3]]
+		method := strings.ContainsRune(before[m[3]:], ':')
+		for _, field := range self.fieldsOf(doc, line, m[2]+1, name) {
+			if method && field.Kind != COMPLETION_FUNCTION && field.Kind != COMPLETION_METHOD {
+				continue
+			}
+			items = append(items, field)
+		}
+		return &CompletionList{Items: items}
+	}
+
+	for _, decl := range doc.visibleDecls(line, column) {
+		kind := COMPLETION_VARIABLE
+		if decl.Kind == lint.VAR_FUNCTION {
+			kind = COMPLETION_FUNCTION
+		}
+		items = append(items, CompletionItem{Label: decl.Name, Kind: kind, Detail: "local"})
+	}
+	for _, name := range self.stdNames() {
+		kind := COMPLETION_VARIABLE
+		switch self.std[name].typeName {
+		case "function":
+			kind = COMPLETION_FUNCTION
+		case "table":
+			kind = COMPLETION_MODULE
+		}
+		items = append(items, CompletionItem{Label: name, Kind: kind, Detail: self.std[name].typeName})
+	}
+	for _, kw := range luaKeywords {
+		items = append(items, CompletionItem{Label: kw, Kind: COMPLETION_KEYWORD})
+	}
+	return &CompletionList{Items: items}
+}
+
+// name的字段：name是require()的结果时取模块的字段，是标准库的表时取表的字段
+func (self *Server) fieldsOf(doc *document, line, column int, name string) []CompletionItem {
+	var items []CompletionItem
+	key := requireKey{0, name} // 全局变量
+	if _, decl := doc.refAt(line, column); decl != nil {
+		key = requireKey{decl.Line, decl.Name}
+	} else { // 正在输入的语句可能有语法错误，不在语法树里
+		for _, d := range doc.visibleDecls(line, column) {
+			if d.Name == name {
+				key = requireKey{d.Line, d.Name}
+			}
+		}
+	}
+	if module, ok := doc.requires[key]; ok {
+		return self.moduleFields(module)
+	}
+	if key.line == 0 {
+		if g := self.std[name]; g != nil {
+			for field, typeName := range g.fields {
+				kind := COMPLETION_FIELD
+				if typeName == "function" {
+					kind = COMPLETION_FUNCTION
+				}
+				items = append(items, CompletionItem{Label: field, Kind: kind, Detail: typeName})
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	return items
+}
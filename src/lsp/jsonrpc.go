@@ -0,0 +1,108 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// JSON-RPC 2.0，每条消息前面有"Content-Length: n\r\n\r\n"形式的头部，后面是n字节的JSON
+// https://microsoft.github.io/language-server-protocol/specifications/base/0.9/specification/
+
+// JSON-RPC的错误码
+const (
+	PARSE_ERROR            = -32700
+	INVALID_REQUEST        = -32600
+	METHOD_NOT_FOUND       = -32601
+	INVALID_PARAMS         = -32602
+	INTERNAL_ERROR         = -32603
+	SERVER_NOT_INITIALIZED = -32002
+)
+
+// 收到的请求或者通知，通知没有id
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+func (self *request) isNotification() bool {
+	return len(self.ID) == 0
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"` // 成功时即使结果是null也要有这个字段
+	Error   *responseError  `json:"error,omitempty"`
+}
+
+type responseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (self *responseError) Error() string {
+	return self.Message
+}
+
+func newError(code int, f string, a ...interface{}) *responseError {
+	return &responseError{Code: code, Message: fmt.Sprintf(f, a...)}
+}
+
+// 服务器发给客户端的通知
+type notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// 读取一条消息的内容，输入结束时返回io.EOF
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line == "" && length < 0 {
+				return nil, io.EOF
+			}
+			return nil, io.ErrUnexpectedEOF
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" { // 头部结束
+			break
+		}
+		if i := strings.IndexByte(line, ':'); i >= 0 &&
+			strings.EqualFold(strings.TrimSpace(line[:i]), "Content-Length") {
+			n, err := strconv.Atoi(strings.TrimSpace(line[i+1:]))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad Content-Length: %s", line[i+1:])
+			}
+			length = n
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("missing Content-Length header")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
+// 写出一条消息
+func writeMessage(w io.Writer, msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(data)); err == nil {
+		_, err = w.Write(data)
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+package lsp
+
+import (
+	"lua/src/compiler/ast"
+	"lua/src/compiler/lexer"
+	"lua/src/compiler/parser"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 按照package.path查找模块，和require()的luaSearcher一样把模块名中的'.'换成目录分隔符，
+// 路径模板中的相对路径以工作区的根目录为基准
+
+const maxModules = 500 // 列出模块时最多返回的数量
+const maxDepth = 4     // 列出模块时最多进入的目录层数
+
+// 路径模板，相对路径转换成绝对路径
+func (self *Server) templates() []string {
+	var templates []string
+	for _, t := range strings.Split(self.path, ";") {
+		if t = strings.TrimSpace(t); t == "" || !strings.Contains(t, "?") {
+			continue
+		}
+		if !filepath.IsAbs(t) {
+			t = filepath.Join(self.root, t)
+		}
+		templates = append(templates, t)
+	}
+	return templates
+}
+
+// 模块文件的路径，找不到时返回""
+func (self *Server) searchPath(module string) string {
+	name := strings.Replace(module, ".", string(os.PathSeparator), -1)
+	for _, t := range self.templates() {
+		filename := strings.Replace(t, "?", name, -1)
+		if info, err := os.Stat(filename); err == nil && !info.IsDir() {
+			return filename
+		}
+	}
+	return ""
+}
+
+// 按照路径模板列出可以require的模块名
+// 模板"dir/prefix?suffix"匹配dir下面以prefix开头、以suffix结尾的文件，中间的部分是模块名
+func (self *Server) modules() []string {
+	seen := map[string]bool{}
+	var modules []string
+	for _, t := range self.templates() {
+		i := strings.Index(t, "?")
+		dir, prefix := filepath.Split(t[:i])
+		suffix := filepath.ToSlash(t[i+1:])
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || len(modules) >= maxModules {
+				return filepath.SkipDir
+			}
+			rel, _ := filepath.Rel(dir, path)
+			rel = filepath.ToSlash(rel)
+			if info.IsDir() {
+				if rel != "." && (strings.HasPrefix(info.Name(), ".") || strings.Count(rel, "/") >= maxDepth) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasPrefix(rel, prefix) || !strings.HasSuffix(rel, suffix) {
+				return nil
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(rel, prefix), suffix)
+			name = strings.Replace(name, "/", ".", -1)
+			if isModuleName(name) && !seen[name] {
+				seen[name] = true
+				modules = append(modules, name)
+			}
+			return nil
+		})
+	}
+	sort.Strings(modules)
+	return modules
+}
+
+// 模块名的每一段都由字母、数字、下划线和减号组成
+func isModuleName(name string) bool {
+	for _, part := range strings.Split(name, ".") {
+		if part == "" || strings.Trim(part, "_-0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// 模块导出的字段：主函数返回的表构造器中的字段，或者返回的局部变量在模块中被赋值的字段
+func (self *Server) moduleFields(module string) []CompletionItem {
+	filename := self.searchPath(module)
+	if filename == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	block, _ := parser.ParseRecovering(lexer.SkipShebang(string(data)), "@"+filename, self.cfg.Dialect)
+	if len(block.RetExps) != 1 {
+		return nil
+	}
+
+	fields := map[string]int{}
+	addFields := func(tc *ast.TableConstructorExp) {
+		for i, k := range tc.KeyExps {
+			if key, ok := k.(*ast.StringExp); ok && lexer.IsName(key.Str) {
+				fields[key.Str] = fieldKind(tc.ValExps[i])
+			}
+		}
+	}
+	switch x := block.RetExps[0].(type) {
+	case *ast.TableConstructorExp:
+		addFields(x)
+	case *ast.NameExp:
+		for _, stat := range block.Stats {
+			switch s := stat.(type) {
+			case *ast.LocalVarDeclStat:
+				for i, name := range s.NameList {
+					if tc, ok := nth(s.ExpList, i).(*ast.TableConstructorExp); ok && name == x.Name {
+						addFields(tc)
+					}
+				}
+			case *ast.AssignStat: // M.f = ... 或者 function M.f() ... end
+				for i, v := range s.VarList {
+					access, ok := v.(*ast.TableAccessExp)
+					if !ok {
+						continue
+					}
+					prefix, ok := access.PrefixExp.(*ast.NameExp)
+					key, isStr := access.KeyExp.(*ast.StringExp)
+					if ok && isStr && prefix.Name == x.Name && lexer.IsName(key.Str) {
+						fields[key.Str] = fieldKind(nth(s.ExpList, i))
+					}
+				}
+			}
+		}
+	}
+
+	items := make([]CompletionItem, 0, len(fields))
+	for name, kind := range fields {
+		items = append(items, CompletionItem{Label: name, Kind: kind, Detail: module})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	return items
+}
+
+func fieldKind(exp ast.Exp) int {
+	if _, ok := exp.(*ast.FuncDefExp); ok {
+		return COMPLETION_FUNCTION
+	}
+	return COMPLETION_FIELD
+}
+
+func nth(exps []ast.Exp, i int) ast.Exp {
+	if i < len(exps) {
+		return exps[i]
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lua/src/api"
+	"lua/src/lint"
+	"lua/src/state"
+	"os"
+	"sort"
+)
+
+// 语言服务器：在一对输入输出流上处理JSON-RPC消息
+// 文档全量同步，每次打开或修改文档时重新分析并推送诊断
+
+type Server struct {
+	in          *bufio.Reader
+	out         io.Writer
+	log         io.Writer // 调试日志，为nil时不输出
+	docs        map[string]*document
+	root        string // 工作区的根目录，package.path中的相对路径以它为基准
+	cfg         lint.Config
+	std         map[string]*stdGlobal // OpenLibs()注册的全局变量
+	path        string                // package.path
+	initialized bool
+	shutdown    bool
+}
+
+// 标准库的全局变量，表的字段名映射到值的类型名
+type stdGlobal struct {
+	typeName string
+	fields   map[string]string
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	self := &Server{
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: map[string]*document{},
+		cfg:  lint.DefaultConfig(),
+	}
+	self.root, _ = os.Getwd()
+	self.loadStdLib()
+	return self
+}
+
+// 设置调试日志的输出，收到的每个请求都会记录一行
+func (self *Server) SetLog(w io.Writer) {
+	self.log = w
+}
+
+// 设置语言方言
+func (self *Server) SetDialect(dialect byte) {
+	self.cfg.Dialect = dialect
+}
+
+// 从OpenLibs()之后的全局表里取得标准库的名字和package.path
+// 全局表里有_G本身，遍历全局表时不能同时遍历它的值，所以先取得所有的名字
+func (self *Server) loadStdLib() {
+	ls := state.New()
+	ls.OpenLibs()
+	self.std = map[string]*stdGlobal{}
+	ls.PushGlobalTable()
+	ls.PushNil()
+	for ls.Next(-2) {
+		if ls.Type(-2) == api.LUA_TSTRING {
+			self.std[ls.ToString(-2)] = &stdGlobal{typeName: ls.TypeName(ls.Type(-1))}
+		}
+		ls.Pop(1)
+	}
+	ls.Pop(1)
+	for name, g := range self.std {
+		if ls.GetGlobal(name) == api.LUA_TTABLE {
+			g.fields = map[string]string{}
+			ls.PushNil()
+			for ls.Next(-2) {
+				if ls.Type(-2) == api.LUA_TSTRING {
+					g.fields[ls.ToString(-2)] = ls.TypeName(ls.Type(-1))
+				}
+				ls.Pop(1)
+			}
+		}
+		ls.Pop(1)
+	}
+	if ls.GetGlobal("package") == api.LUA_TTABLE {
+		ls.GetField(-1, "path")
+		self.path = ls.ToString(-1)
+	}
+}
+
+// 处理消息直到收到exit通知或者输入结束，返回进程的退出码：
+// 先收到shutdown请求时为0，否则为1
+func (self *Server) Run() int {
+	for {
+		data, err := readMessage(self.in)
+		if err != nil {
+			if err != io.EOF {
+				self.logf("read error: %v", err)
+			}
+			break
+		}
+		var req request
+		if err := json.Unmarshal(data, &req); err != nil {
+			self.reply(json.RawMessage("null"), nil, newError(PARSE_ERROR, "%v", err))
+			continue
+		}
+		self.logf("<- %s", req.Method)
+		if req.Method == "exit" {
+			break
+		}
+		result, rerr := self.dispatch(&req)
+		if !req.isNotification() {
+			self.reply(req.ID, result, rerr)
+		} else if rerr != nil {
+			self.logf("%s: %s", req.Method, rerr.Message)
+		}
+	}
+	if self.shutdown {
+		return 0
+	}
+	return 1
+}
+
+func (self *Server) logf(f string, a ...interface{}) {
+	if self.log != nil {
+		fmt.Fprintf(self.log, f+"\n", a...)
+	}
+}
+
+func (self *Server) reply(id json.RawMessage, result interface{}, rerr *responseError) {
+	resp := response{JSONRPC: "2.0", ID: id}
+	if rerr != nil {
+		resp.Error = rerr
+	} else if data, err := json.Marshal(result); err != nil {
+		resp.Error = newError(INTERNAL_ERROR, "%v", err)
+	} else {
+		resp.Result = data
+	}
+	if err := writeMessage(self.out, resp); err != nil {
+		self.logf("write error: %v", err)
+	}
+}
+
+func (self *Server) notify(method string, params interface{}) {
+	if err := writeMessage(self.out, notification{JSONRPC: "2.0", Method: method, Params: params}); err != nil {
+		self.logf("write error: %v", err)
+	}
+}
+
+// 按方法名分发请求和通知，不认识的通知忽略
+func (self *Server) dispatch(req *request) (interface{}, *responseError) {
+	if req.Method == "initialize" {
+		return self.initialize(req.Params)
+	}
+	if !self.initialized {
+		return nil, newError(SERVER_NOT_INITIALIZED, "server not initialized")
+	}
+	if self.shutdown && req.Method != "shutdown" {
+		return nil, newError(INVALID_REQUEST, "server is shutting down")
+	}
+	switch req.Method {
+	case "initialized", "textDocument/didSave":
+		return nil, nil
+	case "shutdown":
+		self.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		return decode(req.Params, &params, func() (interface{}, *responseError) {
+			self.update(params.TextDocument.URI, params.TextDocument.Version, params.TextDocument.Text)
+			return nil, nil
+		})
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		return decode(req.Params, &params, func() (interface{}, *responseError) {
+			return nil, self.didChange(&params)
+		})
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		return decode(req.Params, &params, func() (interface{}, *responseError) {
+			delete(self.docs, params.TextDocument.URI)
+			self.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{
+				URI: params.TextDocument.URI, Diagnostics: []Diagnostic{}})
+			return nil, nil
+		})
+	case "textDocument/documentSymbol":
+		var params DocumentSymbolParams
+		return decode(req.Params, &params, func() (interface{}, *responseError) {
+			doc, err := self.document(params.TextDocument.URI)
+			if err != nil {
+				return nil, err
+			}
+			if doc.symbols == nil {
+				return []DocumentSymbol{}, nil
+			}
+			return doc.symbols, nil
+		})
+	case "textDocument/definition":
+		return self.positionRequest(req.Params, self.definition)
+	case "textDocument/hover":
+		return self.positionRequest(req.Params, self.hover)
+	case "textDocument/completion":
+		return self.positionRequest(req.Params, self.completion)
+	}
+	if req.isNotification() {
+		return nil, nil
+	}
+	return nil, newError(METHOD_NOT_FOUND, "method not found: %s", req.Method)
+}
+
+// 解码参数后执行f
+func decode(data json.RawMessage, params interface{},
+	f func() (interface{}, *responseError)) (interface{}, *responseError) {
+	if err := json.Unmarshal(data, params); err != nil {
+		return nil, newError(INVALID_PARAMS, "%v", err)
+	}
+	return f()
+}
+
+// 参数是文档和位置的请求
+func (self *Server) positionRequest(data json.RawMessage,
+	f func(doc *document, line, column int) interface{}) (interface{}, *responseError) {
+	var params TextDocumentPositionParams
+	return decode(data, &params, func() (interface{}, *responseError) {
+		doc, err := self.document(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		line, column := doc.offset(params.Position)
+		return f(doc, line, column), nil
+	})
+}
+
+func (self *Server) document(uri string) (*document, *responseError) {
+	if doc, ok := self.docs[uri]; ok {
+		return doc, nil
+	}
+	return nil, newError(INVALID_PARAMS, "unknown document: %s", uri)
+}
+
+func (self *Server) initialize(data json.RawMessage) (interface{}, *responseError) {
+	var params InitializeParams
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &params); err != nil {
+			return nil, newError(INVALID_PARAMS, "%v", err)
+		}
+	}
+	if path := uriToPath(params.RootURI); path != "" {
+		self.root = path
+	} else if params.RootPath != "" {
+		self.root = params.RootPath
+	}
+	self.initialized = true
+	return map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"textDocumentSync":       map[string]interface{}{"openClose": true, "change": 1}, // 全量同步
+			"documentSymbolProvider": true,
+			"definitionProvider":     true,
+			"hoverProvider":          true,
+			"completionProvider": map[string]interface{}{
+				"triggerCharacters": []string{".", ":", "\"", "'"},
+			},
+		},
+		"serverInfo": map[string]string{"name": "lualsp"},
+	}, nil
+}
+
+func (self *Server) didChange(params *DidChangeTextDocumentParams) *responseError {
+	doc, err := self.document(params.TextDocument.URI)
+	if err != nil {
+		return err
+	}
+	text := doc.text
+	for _, change := range params.ContentChanges {
+		text = doc.applyChange(change)
+		if change.Range != nil { // 后面的修改以修改之后的文档为准
+			doc = &document{text: text}
+			doc.splitLines()
+		}
+	}
+	self.update(params.TextDocument.URI, params.TextDocument.Version, text)
+	return nil
+}
+
+// 重新分析文档并推送诊断
+func (self *Server) update(uri string, version int, text string) {
+	doc := newDocument(uri, version, text, self.cfg)
+	self.docs[uri] = doc
+	diagnostics := make([]Diagnostic, 0, len(doc.analysis.Diagnostics))
+	for _, d := range doc.analysis.Diagnostics {
+		severity := SEVERITY_WARNING
+		width := 0
+		switch d.Code {
+		case lint.SYNTAX_ERROR:
+			severity = SEVERITY_ERROR
+		case lint.UNUSED_LOCAL, lint.UNUSED_PARAM, lint.UNREACHABLE_CODE:
+			severity = SEVERITY_HINT
+		}
+		if tok := doc.tokenAt(d.Line, d.Column); tok != nil && tok.Column == d.Column {
+			width = len(tok.Text)
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Range:    doc.rangeOf(d.Line, d.Column, width),
+			Severity: severity,
+			Code:     d.Code,
+			Source:   "lualint",
+			Message:  d.Message,
+		})
+	}
+	self.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{
+		URI: uri, Version: &version, Diagnostics: diagnostics})
+}
+
+// 按名字排序的标准库全局变量
+func (self *Server) stdNames() []string {
+	names := make([]string, 0, len(self.std))
+	for name := range self.std {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
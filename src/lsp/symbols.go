@@ -0,0 +1,268 @@
+package lsp
+
+import (
+	. "lua/src/compiler/ast"
+	. "lua/src/compiler/lexer"
+)
+
+// 遍历语法树，收集文档符号(函数、局部变量、表的字段)和所有的函数定义
+// 语法树里只有行号，名字的列号在同一行的token里查找
+type symbolCollector struct {
+	doc          *document
+	funcs        []*funcDef
+	usedKeywords map[int]bool // 已经对应到匿名函数的function关键字
+}
+
+func (self *symbolCollector) block(block *Block) []DocumentSymbol {
+	var symbols []DocumentSymbol
+	for _, stat := range block.Stats {
+		symbols = append(symbols, self.stat(stat)...)
+	}
+	for _, exp := range block.RetExps {
+		symbols = append(symbols, self.exp(exp)...)
+	}
+	return symbols
+}
+
+func (self *symbolCollector) stat(stat Stat) []DocumentSymbol {
+	switch x := stat.(type) {
+	case *DoStat:
+		return self.block(x.Block)
+	case *WhileStat:
+		return append(self.exp(x.Exp), self.block(x.Block)...)
+	case *RepeatStat:
+		return append(self.block(x.Block), self.exp(x.Exp)...)
+	case *IfStat:
+		var symbols []DocumentSymbol
+		for i, exp := range x.Exps {
+			symbols = append(symbols, self.exp(exp)...)
+			symbols = append(symbols, self.block(x.Blocks[i])...)
+		}
+		return symbols
+	case *ForNumStat:
+		symbols := self.exps(x.InitExp, x.LimitExp, x.StepExp)
+		return append(symbols, self.block(x.Block)...)
+	case *ForInStat:
+		return append(self.exps(x.ExpList...), self.block(x.Block)...)
+	case *LocalVarDeclStat:
+		var symbols []DocumentSymbol
+		for i, name := range x.NameList {
+			var exp Exp
+			if i < len(x.ExpList) {
+				exp = x.ExpList[i]
+			}
+			if module, ok := requiredModule(exp); ok {
+				self.doc.requires[requireKey{x.Line, name}] = module
+			}
+			symbols = append(symbols, self.named(name, "local", SYMBOL_VARIABLE, x.Line, exp)...)
+		}
+		for i := len(x.NameList); i < len(x.ExpList); i++ {
+			symbols = append(symbols, self.exp(x.ExpList[i])...)
+		}
+		return symbols
+	case *LocalFuncDefStat:
+		return self.named(x.Name, "local function", SYMBOL_FUNCTION, x.Line, x.Exp)
+	case *AssignStat:
+		var symbols []DocumentSymbol
+		for i, v := range x.VarList {
+			var exp Exp
+			if i < len(x.ExpList) {
+				exp = x.ExpList[i]
+			}
+			name, line := self.varName(v)
+			switch {
+			case name == "":
+				symbols = append(symbols, self.exp(v)...)
+				symbols = append(symbols, self.exp(exp)...)
+			case isName(v):
+				if module, ok := requiredModule(exp); ok {
+					self.doc.requires[requireKey{0, name}] = module
+				}
+				if _, decl := self.doc.refAt(line, self.column(line, name)); decl != nil {
+					symbols = append(symbols, self.exp(exp)...) // 给局部变量赋值
+				} else {
+					symbols = append(symbols, self.named(name, "global", SYMBOL_VARIABLE, line, exp)...)
+				}
+			default:
+				symbols = append(symbols, self.named(name, "field", SYMBOL_FIELD, line, exp)...)
+			}
+		}
+		for i := len(x.VarList); i < len(x.ExpList); i++ {
+			symbols = append(symbols, self.exp(x.ExpList[i])...)
+		}
+		return symbols
+	case *FuncCallStat:
+		return self.exp(x)
+	}
+	return nil
+}
+
+func (self *symbolCollector) exps(exps ...Exp) []DocumentSymbol {
+	var symbols []DocumentSymbol
+	for _, exp := range exps {
+		symbols = append(symbols, self.exp(exp)...)
+	}
+	return symbols
+}
+
+// 表达式中的匿名函数和表构造器里的符号
+func (self *symbolCollector) exp(exp Exp) []DocumentSymbol {
+	switch x := exp.(type) {
+	case *UnopExp:
+		return self.exp(x.Exp)
+	case *BinopExp:
+		return self.exps(x.Exp1, x.Exp2)
+	case *ConcatExp:
+		return self.exps(x.Exps...)
+	case *ParensExp:
+		return self.exp(x.Exp)
+	case *TableAccessExp:
+		return self.exps(x.PrefixExp, x.KeyExp)
+	case *FuncCallExp:
+		return append(self.exp(x.PrefixExp), self.exps(x.Args...)...)
+	case *TableConstructorExp:
+		return self.fields(x)
+	case *FuncDefExp:
+		column := 1
+		if i := self.anonymousKeyword(x.Line); i >= 0 {
+			column = self.doc.tokens[i].Column
+		}
+		self.funcs = append(self.funcs, &funcDef{"", x.Line, column, len("function"), x})
+		return self.block(x.Block)
+	}
+	return nil
+}
+
+// 表构造器中以名字为键的字段
+func (self *symbolCollector) fields(tc *TableConstructorExp) []DocumentSymbol {
+	var symbols []DocumentSymbol
+	for i, k := range tc.KeyExps {
+		if key, ok := k.(*StringExp); ok && IsName(key.Str) {
+			symbols = append(symbols, self.named(key.Str, "field", SYMBOL_FIELD, key.Line, tc.ValExps[i])...)
+		} else {
+			symbols = append(symbols, self.exps(k, tc.ValExps[i])...)
+		}
+	}
+	return symbols
+}
+
+// 有名字的符号，值是函数时是函数符号，值是表构造器时把字段作为子符号
+func (self *symbolCollector) named(name, detail string, kind, line int, exp Exp) []DocumentSymbol {
+	last := name // 多级名字a.b.c选中最后一级
+	for i := len(name) - 1; i >= 0; i-- {
+		if name[i] == '.' || name[i] == ':' {
+			last = name[i+1:]
+			break
+		}
+	}
+	column := self.column(line, last)
+	symbol := DocumentSymbol{
+		Name:           name,
+		Detail:         detail,
+		Kind:           kind,
+		Range:          self.doc.linesRange(line, line),
+		SelectionRange: self.doc.rangeOf(line, column, len(last)),
+	}
+	switch x := exp.(type) {
+	case *FuncDefExp:
+		if kind != SYMBOL_FUNCTION {
+			symbol.Kind, symbol.Detail = SYMBOL_FUNCTION, "function"
+			if last != name && name[len(name)-len(last)-1] == ':' {
+				symbol.Kind, symbol.Detail = SYMBOL_METHOD, "method"
+			}
+			if detail == "local" {
+				symbol.Detail = detail
+			}
+		}
+		symbol.Range = self.doc.linesRange(min(line, x.Line), x.LastLine)
+		self.funcs = append(self.funcs, &funcDef{name, line, column, len(last), x})
+		symbol.Children = self.block(x.Block)
+	case *TableConstructorExp:
+		symbol.Kind = SYMBOL_OBJECT
+		symbol.Range = self.doc.linesRange(min(line, x.Line), x.LastLine)
+		symbol.Children = self.fields(x)
+	case nil:
+	default:
+		if _, lastLine := x.Pos(); lastLine > line {
+			symbol.Range = self.doc.linesRange(line, lastLine)
+		}
+		return append([]DocumentSymbol{symbol}, self.exp(exp)...)
+	}
+	return []DocumentSymbol{symbol}
+}
+
+// 赋值语句左边的变量名：a、a.b.c或者a.b:c，其他形式的变量返回""
+func (self *symbolCollector) varName(exp Exp) (name string, line int) {
+	switch x := exp.(type) {
+	case *NameExp:
+		return x.Name, x.Line
+	case *TableAccessExp:
+		key, ok := x.KeyExp.(*StringExp)
+		if !ok || !IsName(key.Str) {
+			return "", 0
+		}
+		prefix, _ := self.varName(x.PrefixExp)
+		if prefix == "" {
+			return "", 0
+		}
+		sep := "."
+		if i := self.doc.findToken(key.Line, key.Str, TOKEN_IDENTIFIER); i > 0 &&
+			self.doc.tokens[i-1].Kind == TOKEN_SEP_COLON {
+			sep = ":"
+		}
+		return prefix + sep + key.Str, key.Line
+	}
+	return "", 0
+}
+
+// 名字在line行上的列号，找不到时返回1
+func (self *symbolCollector) column(line int, name string) int {
+	if i := self.doc.findToken(line, name, TOKEN_IDENTIFIER, TOKEN_STRING); i >= 0 {
+		return self.doc.tokens[i].Column
+	}
+	return 1
+}
+
+// line行上还没有对应到匿名函数的第一个function关键字
+func (self *symbolCollector) anonymousKeyword(line int) int {
+	for _, i := range self.doc.lineTokens[line] {
+		if self.doc.tokens[i].Kind == TOKEN_KW_FUNCTION && !self.usedKeywords[i] {
+			self.usedKeywords[i] = true
+			return i
+		}
+	}
+	return -1
+}
+
+// require "name"或者require("name")，返回模块名
+func requiredModule(exp Exp) (string, bool) {
+	call, ok := exp.(*FuncCallExp)
+	if !ok || call.NameExp != nil || len(call.Args) != 1 {
+		return "", false
+	}
+	if fn, ok := call.PrefixExp.(*NameExp); !ok || fn.Name != "require" {
+		return "", false
+	}
+	if arg, ok := call.Args[0].(*StringExp); ok {
+		return arg.Str, true
+	}
+	return "", false
+}
+
+func isName(exp Exp) bool {
+	_, ok := exp.(*NameExp)
+	return ok
+}
+
+// 补全的关键字
+var luaKeywords = []string{
+	"and", "break", "do", "else", "elseif", "end", "false", "for", "function", "goto", "if",
+	"in", "local", "nil", "not", "or", "repeat", "return", "then", "true", "until", "while",
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
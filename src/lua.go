@@ -1,15 +1,465 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
+	. "lua/src/api"
+	"lua/src/binchunk"
+	"lua/src/compiler"
 	"lua/src/state"
 	"os"
+	"strings"
+)
+
+// 独立解释器，参照lua-5.3.4/src/lua.c实现
+
+const LUA_PROMPT = "> "   // 交互模式的提示符
+const LUA_PROMPT2 = ">> " // 输入不完整时的提示符
+const LUA_COPYRIGHT = "Lua 5.3.4  Copyright (C) 1994-2017 Lua.org, PUC-Rio"
+const LUA_INIT_VAR = "LUA_INIT"
+const LUA_INITVARVERSION = LUA_INIT_VAR + "_5_3"
+const EOFMARK = "<eof>" // 语法错误信息以它结尾说明输入不完整
+
+var progName = "lua"
+var optPasses = compiler.OPT_ALL // -O选择的优化遍
+var stdin = bufio.NewReader(os.Stdin)
+
+/* bits of various argument indicators in 'args' */
+const (
+	has_error = 1  /* bad option */
+	has_i     = 2  /* -i */
+	has_v     = 4  /* -v */
+	has_e     = 8  /* -e */
+	has_E     = 16 /* -E */
+	has_54    = 32 /* -5.4 */
+	has_O     = 64 /* -O */
 )
 
 func main() {
-	if len(os.Args) > 1 {
-		ls := state.New()
-		ls.OpenLibs()
-		ls.LoadFile(os.Args[1])
-		ls.Call(0, -1)
+	ls := state.New()
+	ls.PushGoFunction(luaMain)  /* to call 'pmain' in protected mode */
+	status := ls.PCall(0, 1, 0) /* do the call */
+	result := ls.ToBoolean(-1)  /* get result */
+	report(ls, status)
+	if result && status == LUA_OK {
+		os.Exit(0)
+	}
+	os.Exit(1)
+}
+
+// 以保护模式运行的主函数，返回true表示执行成功
+// lua-5.3.4/src/lua.c#pmain()
+func luaMain(ls LuaState) int {
+	argv := os.Args
+	if len(argv) > 0 && argv[0] != "" {
+		progName = argv[0]
+	}
+	args, script := collectArgs(argv)
+	if args&has_error != 0 { /* bad arg? */
+		printUsage(argv[script]) /* 'script' has index of bad arg. */
+		return 0
+	}
+	if args&has_v != 0 { /* option '-v'? */
+		printVersion()
+	}
+	if args&has_E != 0 { /* option '-E'? */
+		ls.PushBoolean(true) /* signal for libraries to ignore env. vars. */
+		ls.SetField(LUA_REGISTRYINDEX, "LUA_NOENV")
+	}
+	if args&has_54 != 0 { /* option '-5.4'? */
+		ls.SetDialect(binchunk.LUA_DIALECT_54) /* 库函数和之后编译的代码都使用5.4方言 */
+	}
+	if args&has_O != 0 { /* option '-O'? */
+		ls.SetOptimization(optPasses) /* 之后编译的代码都执行选择的优化遍 */
+	}
+	ls.OpenLibs()                    /* open standard libraries */
+	createArgTable(ls, argv, script) /* create table 'arg' */
+	if args&has_E == 0 {             /* no option '-E'? */
+		if handleLuaInit(ls) != LUA_OK { /* run LUA_INIT */
+			return 0 /* error running LUA_INIT */
+		}
+	}
+	if !runArgs(ls, argv, script) { /* execute arguments -e and -l */
+		return 0 /* something failed */
+	}
+	if script < len(argv) && /* execute main script (if there is one) */
+		handleScript(ls, argv, script) != LUA_OK {
+		return 0
+	}
+	if args&has_i != 0 { /* -i option? */
+		doREPL(ls) /* do read-eval-print loop */
+	} else if script == len(argv) && args&(has_e|has_v) == 0 { /* no arguments? */
+		if isTerminal(os.Stdin) { /* running in interactive mode? */
+			printVersion()
+			doREPL(ls) /* do read-eval-print loop */
+		} else {
+			doFile(ls, "") /* executes stdin as a file */
+		}
+	}
+	ls.PushBoolean(true) /* signal no errors */
+	return 1
+}
+
+// 检查参数，返回参数标志和脚本在argv中的索引(没有脚本时等于len(argv))
+// 遇到错误时，返回的索引指向出错的参数
+// lua-5.3.4/src/lua.c#collectargs()
+func collectArgs(argv []string) (args, script int) {
+	i := 1
+	for ; i < len(argv); i++ {
+		arg := argv[i]
+		if arg == "" || arg[0] != '-' { /* not an option? */
+			return args, i /* stop handling options */
+		}
+		switch arg[1:] {
+		case "-": /* '--' */
+			if i+1 < len(argv) {
+				return args, i + 1
+			}
+			return args, len(argv)
+		case "": /* '-' */
+			return args, i /* script "name" is '-' */
+		case "E":
+			args |= has_E
+		case "i":
+			args |= has_i | has_v /* (-i implies -v) */
+		case "v":
+			args |= has_v
+		case "5.4":
+			args |= has_54
+		case "O":
+			args |= has_O
+		case "e", "l":
+			if arg[1] == 'e' {
+				args |= has_e /* both options need an argument */
+			}
+			i++ /* try next 'argv' */
+			if i >= len(argv) || strings.HasPrefix(argv[i], "-") {
+				return has_error, i - 1 /* no next argument or it is another option */
+			}
+		default:
+			if strings.HasPrefix(arg, "-O") { /* 只执行列出的优化遍，比如-Oconst,dead */
+				passes, err := compiler.ParsePasses(arg[2:])
+				if err != nil {
+					return has_error, i
+				}
+				args |= has_O
+				optPasses = passes
+			} else if strings.HasPrefix(arg, "-e") {
+				args |= has_e
+			} else if !strings.HasPrefix(arg, "-l") { /* invalid option */
+				return has_error, i
+			}
+			/* 参数直接跟在选项后面，比如-lmod */
+		}
+	}
+	return args, len(argv) /* no script name */
+}
+
+// 创建全局表arg，脚本名放在索引0，脚本参数从1开始，解释器和选项放在负数索引
+// lua-5.3.4/src/lua.c#createargtable()
+func createArgTable(ls LuaState, argv []string, script int) {
+	if script == len(argv) {
+		script = 0 /* no script name? */
+	}
+	narg := len(argv) - (script + 1) /* number of positive indices */
+	ls.CreateTable(narg, script+1)
+	for i, arg := range argv {
+		ls.PushString(arg)
+		ls.RawSetI(-2, int64(i-script))
+	}
+	ls.SetGlobal("arg")
+}
+
+// 执行环境变量LUA_INIT_5_3或LUA_INIT的内容，以'@'开头时表示文件名
+// lua-5.3.4/src/lua.c#handle_luainit()
+func handleLuaInit(ls LuaState) int {
+	name := "=" + LUA_INITVARVERSION
+	init, ok := os.LookupEnv(LUA_INITVARVERSION)
+	if !ok {
+		name = "=" + LUA_INIT_VAR
+		init, ok = os.LookupEnv(LUA_INIT_VAR) /* try alternative name */
+	}
+	if !ok {
+		return LUA_OK
+	} else if strings.HasPrefix(init, "@") {
+		return doFile(ls, init[1:])
+	} else {
+		return doString(ls, init, name)
+	}
+}
+
+// 按顺序处理-e和-l选项，出错时返回false
+// lua-5.3.4/src/lua.c#runargs()
+func runArgs(ls LuaState, argv []string, n int) bool {
+	for i := 1; i < n; i++ {
+		option := argv[i][1]
+		if option != 'e' && option != 'l' {
+			continue
+		}
+		extra := argv[i][2:] /* both options need an argument */
+		if extra == "" {
+			i++
+			extra = argv[i]
+		}
+		var status int
+		if option == 'e' {
+			status = doString(ls, extra, "=(command line)")
+		} else {
+			status = doLibrary(ls, extra)
+		}
+		if status != LUA_OK {
+			return false
+		}
+	}
+	return true
+}
+
+// 加载并执行脚本，剩余的命令行参数作为脚本的参数
+// lua-5.3.4/src/lua.c#handle_script()
+func handleScript(ls LuaState, argv []string, script int) int {
+	fname := argv[script]
+	if fname == "-" && argv[script-1] != "--" {
+		fname = "" /* stdin */
+	}
+	status := ls.LoadFile(fname)
+	if status == LUA_OK {
+		args := argv[script+1:]
+		for _, arg := range args { /* push arguments to script */
+			ls.PushString(arg)
+		}
+		status = docall(ls, len(args), LUA_MULTRET)
+	}
+	return report(ls, status)
+}
+
+// 调用require(name)并把结果赋给全局变量name
+// lua-5.3.4/src/lua.c#dolibrary()
+func doLibrary(ls LuaState, name string) int {
+	ls.GetGlobal("require")
+	ls.PushString(name)
+	status := docall(ls, 1, 1) /* call 'require(name)' */
+	if status == LUA_OK {
+		ls.SetGlobal(name) /* global[name] = require return */
+	}
+	return report(ls, status)
+}
+
+func doFile(ls LuaState, name string) int {
+	return doChunk(ls, ls.LoadFile(name))
+}
+
+func doString(ls LuaState, s, name string) int {
+	return doChunk(ls, ls.Load([]byte(s), name, "bt"))
+}
+
+func doChunk(ls LuaState, status int) int {
+	if status == LUA_OK {
+		status = docall(ls, 0, 0)
+	}
+	return report(ls, status)
+}
+
+// 消息处理函数，给错误信息加上栈回溯
+// lua-5.3.4/src/lua.c#msghandler()
+func msgHandler(ls LuaState) int {
+	msg, ok := ls.ToStringX(1)
+	if !ok { /* is error object not a string? */
+		if ls.CallMeta(1, "__tostring") && /* does it have a metamethod */
+			ls.Type(-1) == LUA_TSTRING { /* that produces a string? */
+			return 1 /* that is the message */
+		}
+		msg = fmt.Sprintf("(error object is a %s value)", ls.TypeName2(1))
+	}
+	ls.Traceback(ls, msg, 1) /* append a standard traceback */
+	return 1                 /* return the traceback */
+}
+
+// 以保护模式调用函数，并使用msgHandler处理错误
+// lua-5.3.4/src/lua.c#docall()
+func docall(ls LuaState, narg, nres int) int {
+	base := ls.GetTop() - narg    /* function index */
+	ls.PushGoFunction(msgHandler) /* push message handler */
+	ls.Insert(base)               /* put it under function and args */
+	status := ls.PCall(narg, nres, base)
+	ls.Remove(base) /* remove message handler from the stack */
+	return status
+}
+
+// 如果执行出错，把栈顶的错误信息打印到标准错误
+// lua-5.3.4/src/lua.c#report()
+func report(ls LuaState, status int) int {
+	if status != LUA_OK {
+		msg, ok := ls.ToStringX(-1)
+		if !ok {
+			msg = fmt.Sprintf("(error object is a %s value)", ls.TypeName2(-1))
+		}
+		lMessage(progName, msg)
+		ls.Pop(1) /* remove message */
+	}
+	return status
+}
+
+func lMessage(pname, msg string) {
+	if pname != "" {
+		fmt.Fprintf(os.Stderr, "%s: ", pname)
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+func printVersion() {
+	fmt.Println(LUA_COPYRIGHT)
+}
+
+// lua-5.3.4/src/lua.c#print_usage()
+func printUsage(badoption string) {
+	fmt.Fprintf(os.Stderr, "%s: ", progName)
+	if len(badoption) > 1 && (badoption[1] == 'e' || badoption[1] == 'l') {
+		fmt.Fprintf(os.Stderr, "'%s' needs argument\n", badoption)
+	} else {
+		fmt.Fprintf(os.Stderr, "unrecognized option '%s'\n", badoption)
+	}
+	fmt.Fprintf(os.Stderr,
+		"usage: %s [options] [script [args]]\n"+
+			"Available options are:\n"+
+			"  -e stat  execute string 'stat'\n"+
+			"  -i       enter interactive mode after executing 'script'\n"+
+			"  -l name  require library 'name'\n"+
+			"  -v       show version information\n"+
+			"  -E       ignore environment variables\n"+
+			"  -5.4     use the Lua 5.4 dialect (source level only: binary chunks keep the\n"+
+			"           5.3 layout with a private format byte, real 5.4 bytecode is rejected)\n"+
+			"  -O       optimize compiled chunks\n"+
+			"  -Olist   run only the listed passes (const,dead,peephole)\n"+
+			"  --       stop handling options\n"+
+			"  -        stop handling options and execute stdin\n",
+		progName)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+/* REPL */
+
+// 交互模式：读取一行(或多行)输入，执行并打印结果
+// lua-5.3.4/src/lua.c#doREPL()
+func doREPL(ls LuaState) {
+	oldProgName := progName
+	progName = "" /* no 'progName' on errors in interactive mode */
+	for {
+		status, ok := loadLine(ls)
+		if !ok {
+			break
+		}
+		if status == LUA_OK {
+			status = docall(ls, 0, LUA_MULTRET)
+		}
+		if status == LUA_OK {
+			lPrint(ls)
+		} else {
+			report(ls, status)
+		}
+	}
+	ls.SetTop(0) /* clear stack */
+	fmt.Println()
+	progName = oldProgName
+}
+
+// 读取一行并编译，先尝试作为表达式，再尝试作为语句；没有输入时返回false
+// lua-5.3.4/src/lua.c#loadline()
+func loadLine(ls LuaState) (int, bool) {
+	ls.SetTop(0)
+	if !pushLine(ls, true) {
+		return 0, false /* no input */
+	}
+	status := addReturn(ls) /* 'return ...' did not work? */
+	if status != LUA_OK {
+		status = multiLine(ls) /* try as command, maybe with continuation lines */
+	}
+	ls.Remove(1) /* remove line from the stack */
+	return status, true
+}
+
+// 显示提示符并读取一行，推入栈顶
+// lua-5.3.4/src/lua.c#pushline()
+func pushLine(ls LuaState, firstline bool) bool {
+	fmt.Print(getPrompt(ls, firstline))
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return false /* no input */
+	}
+	line = strings.TrimSuffix(line, "\n")          /* remove it */
+	if firstline && strings.HasPrefix(line, "=") { /* for compatibility with 5.2, ... */
+		line = "return " + line[1:] /* change '=' to 'return' */
+	}
+	ls.PushString(line)
+	return true
+}
+
+// lua-5.3.4/src/lua.c#get_prompt()
+func getPrompt(ls LuaState, firstline bool) string {
+	name, prompt := "_PROMPT2", LUA_PROMPT2
+	if firstline {
+		name, prompt = "_PROMPT", LUA_PROMPT
+	}
+	ls.GetGlobal(name)
+	if p, ok := ls.ToStringX(-1); ok {
+		prompt = p
+	}
+	ls.Pop(1)
+	return prompt
+}
+
+// 尝试把输入编译为"return <line>;"，这样表达式的值会被打印出来
+// lua-5.3.4/src/lua.c#addreturn()
+func addReturn(ls LuaState) int {
+	line := ls.ToString(-1) /* original line */
+	retline := "return " + line + ";"
+	status := ls.Load([]byte(retline), "=stdin", "bt")
+	if status != LUA_OK {
+		ls.Pop(1) /* pop result from 'Load' */
+	}
+	return status
+}
+
+// 输入不完整时继续读取下一行，直到得到完整的语句
+// lua-5.3.4/src/lua.c#multiline()
+func multiLine(ls LuaState) int {
+	for { /* repeat until gets a complete statement */
+		line := ls.ToString(1)                          /* get what it has */
+		status := ls.Load([]byte(line), "=stdin", "bt") /* try it */
+		if !incomplete(ls, status) || !pushLine(ls, false) {
+			return status /* cannot or should not try to add continuation line */
+		}
+		ls.PushString("\n") /* add newline... */
+		ls.Insert(-2)       /* ...between the two lines */
+		ls.Concat(3)        /* join them */
+	}
+}
+
+// 语法错误信息以"<eof>"结尾说明语句还没有输入完
+// lua-5.3.4/src/lua.c#incomplete()
+func incomplete(ls LuaState, status int) bool {
+	if status == LUA_ERRSYNTAX {
+		if msg := ls.ToString(-1); strings.HasSuffix(msg, EOFMARK) {
+			ls.Pop(1)
+			return true
+		}
+	}
+	return false /* else... */
+}
+
+// 打印栈上的所有值
+// lua-5.3.4/src/lua.c#l_print()
+func lPrint(ls LuaState) {
+	n := ls.GetTop()
+	if n > 0 { /* any result to be printed? */
+		ls.CheckStack2(LUA_MINSTACK, "too many results to print")
+		ls.GetGlobal("print")
+		ls.Insert(1)
+		if ls.PCall(n, 0, 0) != LUA_OK {
+			lMessage(progName, fmt.Sprintf("error calling 'print' (%s)", ls.ToString(-1)))
+		}
 	}
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"lua/src/aot"
+	"lua/src/api"
+	. "lua/src/binchunk"
+	"lua/src/compiler"
+	"lua/src/state"
+	"os"
+)
+
+// 把Lua源文件或者luac编译好的二进制chunk翻译成Go源代码
+// 生成的包用Load(ls)加载chunk，包名为main时可以直接编译成和lua命令一样运行脚本的程序
+
+const PROGNAME = "luaaot"
+
+var progname = PROGNAME
+var output = "" // 为空表示输出到标准输出
+var cfg = aot.Config{Package: "main"}
+var optimizing = false // 执行全部优化遍
+var dialect byte = LUA_DIALECT_53
+
+// 打印错误信息和用法后退出
+func usage(message string) {
+	if message[0] == '-' {
+		fmt.Fprintf(os.Stderr, "%s: unrecognized option '%s'\n", progname, message)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", progname, message)
+	}
+	fmt.Fprintf(os.Stderr,
+		"usage: %s [options] filename\n"+
+			"Available options are:\n"+
+			"  -o name    output to file 'name' (default is stdout)\n"+
+			"  -pkg name  name of the generated package (default is \"main\")\n"+
+			"  -s         strip debug information from the embedded chunk\n"+
+			"  -5.4       compile with the Lua 5.4 dialect (the embedded chunk keeps the\n"+
+			"             5.3 layout with a private format byte)\n"+
+			"  -O         optimize (constant propagation, dead branches, peephole)\n"+
+			"  --         stop handling options\n"+
+			"  -          stop handling options and process stdin\n",
+		progname)
+	os.Exit(1)
+}
+
+func fatal(message string) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", progname, message)
+	os.Exit(1)
+}
+
+// 参数处理，返回输入文件的索引
+func doArgs(argv []string) int {
+	argc := len(argv)
+	if argc > 0 && argv[0] != "" {
+		progname = argv[0]
+	}
+	// 带参数的选项
+	optArg := func(i int) string {
+		if i == argc || argv[i] == "" || (argv[i][0] == '-' && argv[i] != "-") {
+			usage(fmt.Sprintf("'%s' needs argument", argv[i-1]))
+		}
+		return argv[i]
+	}
+	i := 1
+	for ; i < argc; i++ {
+		if argv[i] == "" || argv[i][0] != '-' { /* end of options; keep it */
+			break
+		} else if argv[i] == "--" { /* end of options; skip it */
+			i++
+			break
+		} else if argv[i] == "-" { /* end of options; use stdin */
+			break
+		} else if argv[i] == "-o" { /* output file */
+			i++
+			if output = optArg(i); output == "-" {
+				output = ""
+			}
+		} else if argv[i] == "-pkg" { /* package name */
+			i++
+			cfg.Package = optArg(i)
+		} else if argv[i] == "-s" { /* strip debug information */
+			cfg.Strip = true
+		} else if argv[i] == "-5.4" { /* Lua 5.4 dialect */
+			dialect = LUA_DIALECT_54
+		} else if argv[i] == "-O" { /* optimize */
+			optimizing = true
+		} else { /* unknown option */
+			usage(argv[i])
+		}
+	}
+	return i
+}
+
+func main() {
+	argv := os.Args
+	i := doArgs(argv)
+	if i == len(argv) {
+		usage("no input file given")
+	} else if i+1 < len(argv) {
+		usage("only one input file can be translated")
+	}
+	filename := argv[i]
+	if filename == "-" {
+		filename = ""
+	}
+
+	L := state.New()
+	L.SetDialect(dialect)
+	if optimizing {
+		L.SetOptimization(compiler.OPT_ALL)
+	}
+	if L.LoadFile(filename) != api.LUA_OK { // 源文件和二进制chunk都可以
+		fatal(L.ToString(-1))
+	}
+	src, err := aot.Generate(L.ToProto(-1), cfg)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if output == "" {
+		_, err = os.Stdout.Write(src)
+	} else {
+		err = os.WriteFile(output, src, 0666)
+	}
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok {
+			err = pe.Err
+		}
+		fatal(fmt.Sprintf("cannot write %s: %v", output, err))
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lua/src/Tools"
+	"lua/src/api"
+	"lua/src/asm"
+	. "lua/src/binchunk"
+	"lua/src/compiler"
+	"lua/src/compiler/ast"
+	"lua/src/compiler/lexer"
+	"lua/src/compiler/parser"
+	"lua/src/state"
+	"os"
+	"strings"
+)
+
+// 编译器命令，参照lua-5.3.4/src/luac.c实现
+
+const PROGNAME = "luac"          // 默认程序名
+const OUTPUT = PROGNAME + ".out" // 默认输出文件
+const LUA_COPYRIGHT = "Lua 5.3.4  Copyright (C) 1994-2017 Lua.org, PUC-Rio"
+
+var progname = PROGNAME
+var output = OUTPUT // 为空表示输出到标准输出
+var listing = 0     // 大于1时打印完整列表
+var dumping = true
+var stripping = false
+var printingAST = false // 打印语法树的JSON，不编译
+var assembling = false  // 输入文件是汇编文本
+var fromJSON = false    // 输入文件是-ast输出的语法树JSON
+var listingAsm = false  // 输出汇编文本而不是二进制chunk
+var optimizing = false  // 执行优化遍
+var optPasses = compiler.OPT_ALL
+var dialect byte = LUA_DIALECT_53
+var hasOutput = false // 命令行上指定了-o，-ast没有指定时输出到标准输出而不是OUTPUT
+
+// 打印错误信息和用法后退出
+func usage(message string) {
+	if message[0] == '-' {
+		fmt.Fprintf(os.Stderr, "%s: unrecognized option '%s'\n", progname, message)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", progname, message)
+	}
+	fmt.Fprintf(os.Stderr,
+		"usage: %s [options] [filenames]\n"+
+			"Available options are:\n"+
+			"  -l       list (use -l -l for full listing)\n"+
+			"  -o name  output to file 'name' (default is \"%s\")\n"+
+			"  -p       parse only\n"+
+			"  -s       strip debug information\n"+
+			"  -v       show version information\n"+
+			"  -5.4     compile with the Lua 5.4 dialect; the output keeps the 5.3 layout\n"+
+			"           with a private format byte, so real Lua 5.4 cannot load it and\n"+
+			"           real Lua 5.4 bytecode cannot be loaded here\n"+
+			"  -O       optimize (constant propagation, dead branches, peephole)\n"+
+			"  -ast     print the syntax tree as JSON instead of compiling\n"+
+			"  -a       input files are assembly listings\n"+
+			"  -j       input files are syntax trees printed by '-ast'\n"+
+			"  -S       output an assembly listing instead of a binary chunk\n"+
+			"  --       stop handling options\n"+
+			"  -        stop handling options and process stdin\n",
+		progname, OUTPUT)
+	os.Exit(1)
+}
+
+func fatal(message string) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", progname, message)
+	os.Exit(1)
+}
+
+func cannot(what string, err error) {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	fmt.Fprintf(os.Stderr, "%s: cannot %s %s: %v\n", progname, what, output, err)
+	os.Exit(1)
+}
+
+// 参数处理，返回第一个输入文件的索引
+// lua-5.3.4/src/luac.c#doargs()
+func doArgs(argv []string) ([]string, int) {
+	argc := len(argv)
+	version := 0
+	if argc > 0 && argv[0] != "" {
+		progname = argv[0]
+	}
+	i := 1
+	for ; i < argc; i++ {
+		if argv[i] == "" || argv[i][0] != '-' { /* end of options; keep it */
+			break
+		} else if argv[i] == "--" { /* end of options; skip it */
+			i++
+			if version != 0 {
+				version++
+			}
+			break
+		} else if argv[i] == "-" { /* end of options; use stdin */
+			break
+		} else if argv[i] == "-l" { /* list */
+			listing++
+		} else if argv[i] == "-o" { /* output file */
+			i++
+			if i == argc || argv[i] == "" || (argv[i][0] == '-' && argv[i] != "-") {
+				usage("'-o' needs argument")
+			}
+			output = argv[i]
+			hasOutput = true
+			if output == "-" {
+				output = ""
+			}
+		} else if argv[i] == "-p" { /* parse only */
+			dumping = false
+		} else if argv[i] == "-s" { /* strip debug information */
+			stripping = true
+		} else if argv[i] == "-v" { /* show version */
+			version++
+		} else if argv[i] == "-5.4" { /* Lua 5.4 dialect */
+			dialect = LUA_DIALECT_54
+		} else if strings.HasPrefix(argv[i], "-O") { /* optimize, -Olist runs only the listed passes */
+			passes, err := compiler.ParsePasses(argv[i][2:])
+			if err != nil {
+				usage(argv[i])
+			}
+			optimizing, optPasses = true, passes
+		} else if argv[i] == "-ast" { /* print syntax tree */
+			printingAST = true
+		} else if argv[i] == "-a" { /* assemble */
+			assembling = true
+		} else if argv[i] == "-j" { /* compile syntax trees */
+			fromJSON = true
+		} else if argv[i] == "-S" { /* output assembly */
+			listingAsm = true
+		} else { /* unknown option */
+			usage(argv[i])
+		}
+	}
+	if printingAST && (listing > 0 || stripping || optimizing || assembling || listingAsm) {
+		usage("'-ast' cannot be combined with '-l', '-s', '-O', '-a' or '-S'")
+	}
+	if assembling && fromJSON {
+		usage("'-a' cannot be combined with '-j'")
+	}
+	if i == argc && (listing > 0 || !dumping) {
+		dumping = false
+		argv = append(argv, OUTPUT)
+	}
+	if version != 0 {
+		fmt.Println(LUA_COPYRIGHT)
+		if version == argc-1 {
+			os.Exit(0)
+		}
+	}
+	return argv, i
+}
+
+// 把多个文件的主函数合并成一个主函数，依次调用各个文件
+// lua-5.3.4/src/luac.c#combine()
+func combine(L api.LuaState, n int) *Prototype {
+	if n == 1 {
+		return L.ToProto(-1)
+	}
+	chunk := strings.Repeat("(function()end)();", n)
+	if L.Load([]byte(chunk), "="+PROGNAME, "t") != api.LUA_OK {
+		fatal(L.ToString(-1))
+	}
+	f := L.ToProto(-1)
+	for i := 0; i < n; i++ {
+		f.Protos[i] = L.ToProto(i - n - 1)
+		if len(f.Protos[i].Upvalues) > 0 {
+			f.Protos[i].Upvalues[0].Instack = 0
+		}
+	}
+	f.LineInfo = nil
+	return f
+}
+
+// lua-5.3.4/src/luac.c#pmain()
+func pmain(files []string) api.GoFunction {
+	return func(L api.LuaState) int {
+		if !L.CheckStack(len(files)) {
+			fatal("too many input files")
+		}
+		for _, filename := range files {
+			if filename == "-" {
+				filename = ""
+			}
+			if assembling {
+				loadAsm(L, filename)
+			} else if fromJSON {
+				loadJSON(L, filename)
+			} else if L.LoadFile(filename) != api.LUA_OK {
+				fatal(L.ToString(-1))
+			}
+		}
+		f := combine(L, len(files))
+		if listing > 0 {
+			Tools.List(f, listing > 1)
+		}
+		if dumping {
+			data := Dump(*f, stripping)
+			if listingAsm {
+				if stripping { // 用去掉调试信息后的函数原型生成汇编文本
+					f, _ = Undump(data)
+				}
+				data = []byte(asm.Disassemble(f))
+			}
+			if output == "" {
+				if _, err := os.Stdout.Write(data); err != nil {
+					cannot("write", err)
+				}
+			} else if err := os.WriteFile(output, data, 0666); err != nil {
+				cannot("open", err)
+			}
+		}
+		return 0
+	}
+}
+
+// 汇编文件并把得到的函数原型推入栈顶，filename为空表示标准输入
+// 函数原型先转储成二进制chunk再加载，这样也会经过字节码校验
+func loadAsm(L api.LuaState, filename string) {
+	chunkName, data := readInput(filename)
+	proto, err := asm.Assemble(string(data), chunkName)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if L.Load(Dump(*proto, false), chunkName, "b") != api.LUA_OK {
+		fatal(L.ToString(-1))
+	}
+}
+
+// 把-ast输出的语法树JSON编译成函数原型并推入栈顶，filename为空表示标准输入
+// 和loadAsm()一样先转储成二进制chunk再加载
+func loadJSON(L api.LuaState, filename string) {
+	_, data := readInput(filename)
+	chunkName, block, err := ast.DecodeJSON(data)
+	if err != nil {
+		fatal(err.Error())
+	}
+	opts := &compiler.CompileOptions{ChunkName: chunkName, Dialect: dialect}
+	if optimizing {
+		opts.Passes = optPasses
+	}
+	proto, err := compiler.CompileAST(block, opts)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if L.Load(Dump(*proto, false), chunkName, "b") != api.LUA_OK {
+		fatal(L.ToString(-1))
+	}
+}
+
+// 读取输入文件，filename为空或者"-"表示标准输入，返回chunk名字和文件内容
+func readInput(filename string) (string, []byte) {
+	chunkName := "=stdin"
+	var data []byte
+	var err error
+	if filename == "" || filename == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		chunkName = "@" + filename
+		data, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok {
+			err = pe.Err
+		}
+		fatal(fmt.Sprintf("cannot read %s: %v", chunkName[1:], err))
+	}
+	return chunkName, data
+}
+
+// 解析每个文件，按顺序输出语法树的JSON文档，每个文件一个
+// 和-j一起使用时输入文件是语法树JSON，解码后重新编码，用来检查JSON格式能否无损往返
+func printAST(files []string) {
+	var out bytes.Buffer
+	for _, filename := range files {
+		chunkName, data := readInput(filename)
+		var doc []byte
+		var err error
+		if fromJSON {
+			doc, err = reencodeAST(data)
+		} else {
+			doc, err = encodeAST(lexer.SkipShebang(string(data)), chunkName)
+		}
+		if err != nil {
+			fatal(err.Error())
+		}
+		json.Indent(&out, doc, "", "  ")
+		out.WriteByte('\n')
+	}
+	if output == "" || !hasOutput {
+		if _, err := os.Stdout.Write(out.Bytes()); err != nil {
+			cannot("write", err)
+		}
+	} else if err := os.WriteFile(output, out.Bytes(), 0666); err != nil {
+		cannot("open", err)
+	}
+}
+
+// 按照verbatim模式解析，语法树和源代码一一对应(不折叠常量，保留圆括号)
+// 语法错误以panic的形式抛出，这里把它转换成error
+func encodeAST(chunk, chunkName string) (doc []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	return ast.EncodeJSON(chunkName, parser.ParseVerbatim(chunk, chunkName, dialect))
+}
+
+// 解码语法树JSON再重新编码
+func reencodeAST(data []byte) ([]byte, error) {
+	chunkName, block, err := ast.DecodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return ast.EncodeJSON(chunkName, block)
+}
+
+func main() {
+	argv, i := doArgs(os.Args)
+	files := argv[i:]
+	if len(files) <= 0 {
+		usage("no input files given")
+	}
+	if printingAST {
+		printAST(files)
+		return
+	}
+	L := state.New()
+	L.SetDialect(dialect)
+	if optimizing {
+		L.SetOptimization(optPasses)
+	}
+	L.PushGoFunction(pmain(files))
+	if L.PCall(0, 0, 0) != api.LUA_OK {
+		fatal(L.ToString(-1))
+	}
+}
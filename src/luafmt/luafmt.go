@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"lua/src/binchunk"
+	"lua/src/format"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 源代码格式化命令，用法参照gofmt：没有文件名时格式化标准输入，结果输出到标准输出
+
+const PROGNAME = "luafmt"
+
+var progname = PROGNAME
+var listing = false // 只列出格式不对的文件
+var writing = false // 把结果写回源文件
+var cfg = format.DefaultConfig
+var status = 0
+
+// 打印错误信息和用法后退出
+func usage(message string) {
+	if message[0] == '-' {
+		fmt.Fprintf(os.Stderr, "%s: unrecognized option '%s'\n", progname, message)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", progname, message)
+	}
+	fmt.Fprintf(os.Stderr,
+		"usage: %s [options] [filenames]\n"+
+			"Available options are:\n"+
+			"  -l       list files whose formatting differs\n"+
+			"  -w       write result to the source file instead of stdout\n"+
+			"  -i n     indent with n spaces, 0 means a tab (default is %d)\n"+
+			"  -q c     quote short strings with c, ' or \" (default is %c)\n"+
+			"  -m n     wrap table constructors longer than n columns (default is %d)\n"+
+			"  -5.4     parse with the Lua 5.4 dialect\n"+
+			"  --       stop handling options\n"+
+			"  -        stop handling options and process stdin\n",
+		progname, len(format.DefaultConfig.Indent), format.DefaultConfig.Quote, format.DefaultConfig.MaxWidth)
+	os.Exit(2)
+}
+
+func report(message string) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", progname, message)
+	status = 1
+}
+
+// 参数处理，返回第一个输入文件的索引
+func doArgs(argv []string) int {
+	argc := len(argv)
+	if argc > 0 && argv[0] != "" {
+		progname = argv[0]
+	}
+	// 带参数的选项
+	optArg := func(i int) string {
+		if i == argc || argv[i] == "" {
+			usage(fmt.Sprintf("'%s' needs argument", argv[i-1]))
+		}
+		return argv[i]
+	}
+	i := 1
+	for ; i < argc; i++ {
+		if argv[i] == "" || argv[i][0] != '-' { /* end of options; keep it */
+			break
+		} else if argv[i] == "--" { /* end of options; skip it */
+			i++
+			break
+		} else if argv[i] == "-" { /* end of options; use stdin */
+			break
+		} else if argv[i] == "-l" {
+			listing = true
+		} else if argv[i] == "-w" {
+			writing = true
+		} else if argv[i] == "-i" {
+			i++
+			n, err := strconv.Atoi(optArg(i))
+			if err != nil || n < 0 {
+				usage("'-i' needs a number of spaces")
+			}
+			cfg.Indent = strings.Repeat(" ", n)
+			if n == 0 {
+				cfg.Indent = "\t"
+			}
+		} else if argv[i] == "-q" {
+			i++
+			if q := optArg(i); q == "'" || q == "\"" {
+				cfg.Quote = q[0]
+			} else {
+				usage("'-q' needs ' or \"")
+			}
+		} else if argv[i] == "-m" {
+			i++
+			n, err := strconv.Atoi(optArg(i))
+			if err != nil || n <= 0 {
+				usage("'-m' needs a positive width")
+			}
+			cfg.MaxWidth = n
+		} else if argv[i] == "-5.4" {
+			cfg.Dialect = binchunk.LUA_DIALECT_54
+		} else { /* unknown option */
+			usage(argv[i])
+		}
+	}
+	return i
+}
+
+// 格式化一个文件，filename为空表示标准输入
+func processFile(filename string) {
+	var src []byte
+	var err error
+	chunkName := "=stdin"
+	if filename == "" {
+		src, err = io.ReadAll(os.Stdin)
+	} else {
+		chunkName = "@" + filename
+		src, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		report(err.Error())
+		return
+	}
+
+	out, err := format.Source(src, chunkName, cfg)
+	if err != nil {
+		report(err.Error())
+		return
+	}
+	if listing {
+		if !bytes.Equal(src, out) {
+			if filename == "" {
+				filename = "<standard input>"
+			}
+			fmt.Println(filename)
+		}
+	}
+	if writing && filename != "" {
+		if !bytes.Equal(src, out) {
+			if err := os.WriteFile(filename, out, 0666); err != nil {
+				report(err.Error())
+			}
+		}
+	} else if !listing {
+		os.Stdout.Write(out)
+	}
+}
+
+func main() {
+	i := doArgs(os.Args)
+	files := os.Args[i:]
+	if len(files) == 0 {
+		if writing {
+			usage("cannot use -w with standard input")
+		}
+		files = []string{"-"}
+	}
+	for _, filename := range files {
+		if filename == "-" {
+			filename = ""
+		}
+		processFile(filename)
+	}
+	os.Exit(status)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"lua/src/binchunk"
+	"lua/src/lint"
+	"os"
+	"strings"
+)
+
+// 静态检查命令：没有文件名时检查标准输入，每个问题输出一行file:line:col: message (code)
+// 用-j输出JSON数组，供CI使用；发现问题时退出码为1
+
+const PROGNAME = "lualint"
+
+var progname = PROGNAME
+var jsonOutput = false // 以JSON格式输出
+var cfg = lint.DefaultConfig()
+var diagnostics = []*lint.Diagnostic{}
+var status = 0
+
+// 打印错误信息和用法后退出
+func usage(message string) {
+	if message[0] == '-' {
+		fmt.Fprintf(os.Stderr, "%s: unrecognized option '%s'\n", progname, message)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", progname, message)
+	}
+	fmt.Fprintf(os.Stderr,
+		"usage: %s [options] [filenames]\n"+
+			"Available options are:\n"+
+			"  -g names allow the comma-separated global variables besides the standard library\n"+
+			"  -G       allow no global variables, not even the standard library\n"+
+			"  -j       print diagnostics as a JSON array\n"+
+			"  -5.4     parse with the Lua 5.4 dialect\n"+
+			"  --       stop handling options\n"+
+			"  -        stop handling options and process stdin\n",
+		progname)
+	os.Exit(2)
+}
+
+func report(message string) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", progname, message)
+	status = 1
+}
+
+// 参数处理，返回第一个输入文件的索引
+func doArgs(argv []string) int {
+	argc := len(argv)
+	if argc > 0 && argv[0] != "" {
+		progname = argv[0]
+	}
+	var extra []string
+	i := 1
+	for ; i < argc; i++ {
+		if argv[i] == "" || argv[i][0] != '-' { /* end of options; keep it */
+			break
+		} else if argv[i] == "--" { /* end of options; skip it */
+			i++
+			break
+		} else if argv[i] == "-" { /* end of options; use stdin */
+			break
+		} else if argv[i] == "-g" {
+			i++
+			if i == argc || argv[i] == "" {
+				usage("'-g' needs argument")
+			}
+			extra = append(extra, strings.Split(argv[i], ",")...)
+		} else if argv[i] == "-G" {
+			cfg.Globals = map[string]bool{}
+		} else if argv[i] == "-j" {
+			jsonOutput = true
+		} else if argv[i] == "-5.4" {
+			cfg.Dialect = binchunk.LUA_DIALECT_54
+		} else { /* unknown option */
+			usage(argv[i])
+		}
+	}
+	for _, name := range extra {
+		if name = strings.TrimSpace(name); name != "" {
+			cfg.Globals[name] = true
+		}
+	}
+	return i
+}
+
+// 检查一个文件，filename为空表示标准输入
+func processFile(filename string) {
+	var src []byte
+	var err error
+	chunkName := "=stdin"
+	if filename == "" {
+		src, err = io.ReadAll(os.Stdin)
+	} else {
+		chunkName = "@" + filename
+		src, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		report(err.Error())
+		return
+	}
+
+	for _, d := range lint.Check(src, chunkName, cfg) {
+		if !jsonOutput {
+			fmt.Println(d)
+		}
+		diagnostics = append(diagnostics, d)
+	}
+}
+
+func main() {
+	i := doArgs(os.Args)
+	files := os.Args[i:]
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, filename := range files {
+		if filename == "-" {
+			filename = ""
+		}
+		processFile(filename)
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		enc.Encode(diagnostics)
+	}
+	if len(diagnostics) > 0 {
+		status = 1
+	}
+	os.Exit(status)
+}
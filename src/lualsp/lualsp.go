@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"lua/src/binchunk"
+	"lua/src/lsp"
+	"os"
+)
+
+// 语言服务器命令，在标准输入输出上以JSON-RPC和编辑器通信
+
+const PROGNAME = "lualsp"
+
+// 打印错误信息和用法后退出
+func usage(message string) {
+	if message[0] == '-' {
+		fmt.Fprintf(os.Stderr, "%s: unrecognized option '%s'\n", PROGNAME, message)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", PROGNAME, message)
+	}
+	fmt.Fprintf(os.Stderr,
+		"usage: %s [options]\n"+
+			"Available options are:\n"+
+			"  -v       log received requests to stderr\n"+
+			"  -5.4     parse with the Lua 5.4 dialect\n",
+		PROGNAME)
+	os.Exit(2)
+}
+
+func main() {
+	server := lsp.NewServer(os.Stdin, os.Stdout)
+	for _, arg := range os.Args[1:] {
+		switch arg {
+		case "-v":
+			server.SetLog(os.Stderr)
+		case "-5.4":
+			server.SetDialect(binchunk.LUA_DIALECT_54)
+		default:
+			usage(arg)
+		}
+	}
+	os.Exit(server.Run())
+}
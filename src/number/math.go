@@ -20,9 +20,14 @@ func IMod(a, b int64) int64 {
 	return a - IFloorDiv(a, b)*b
 }
 
-// 浮点数取模
+// 浮点数取模，math.Mod的结果和被除数同号，余数不为0并且和除数异号时要加上除数
+// lua-5.3.4/src/llimits.h#luai_nummod()
 func FMod(a, b float64) float64 {
-	return a - float64(int(a/b))*b
+	m := math.Mod(a, b)
+	if m > 0 && b < 0 || m < 0 && b > 0 {
+		m += b
+	}
+	return m
 }
 
 // 左移
@@ -43,19 +48,11 @@ func ShiftRight(a, n int64) int64 {
 	}
 }
 
-// 浮点数转整数
+// 浮点数转整数，只有浮点数恰好是整数并且在int64范围内时才能转换
 func FloatToInteger(f float64) (int64, bool) {
-	i := int64(f)
-	return i, float64(i) == f
-}
-
-func _stringToInteger(s string, base int) (int64, bool) {
-	// 先判断字符串是否能转换成整数
-	if i, ok := ParseInteger(s); ok {
-		return i, true
-	}
-	if f, ok := ParseFloat(s); ok {
-		return FloatToInteger(f)
+	if f >= math.MinInt64 && f < -math.MinInt64 { // 比较的同时也排除了NaN
+		i := int64(f)
+		return i, float64(i) == f
 	}
 	return 0, false
 }
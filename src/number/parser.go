@@ -1,15 +1,206 @@
 package number
 
-import "strconv"
+import (
+	"math"
+	"strconv"
+	"strings"
+)
 
-// 将字符串解析为整数
+// 将字符串解析为整数，规则与lua_stringtonumber一致：
+// 允许前后空白和正负号，十六进制整数溢出时回绕，十进制整数溢出时解析失败(交给ParseFloat处理)
+// lua-5.3.4/src/lobject.c#l_str2int()
 func ParseInteger(str string) (int64, bool) {
-	i, err := strconv.ParseInt(str, 10, 64)
-	return i, err == nil
+	s, neg := trimSign(trimSpace(str))
+	var a uint64
+	empty := true
+	if isHexPrefix(s) { // 十六进制
+		for s = s[2:]; len(s) > 0 && isHexDigit(s[0]); s = s[1:] {
+			a = a*16 + uint64(hexValue(s[0]))
+			empty = false
+		}
+	} else { // 十进制
+		const maxBy10 = math.MaxInt64 / 10
+		const maxLastD = math.MaxInt64 % 10
+		for ; len(s) > 0 && isDigit(s[0]); s = s[1:] {
+			d := uint64(s[0] - '0')
+			if a >= maxBy10 && (a > maxBy10 || d > maxLastD+boolToUint(neg)) {
+				return 0, false // 溢出，不能作为整数接受
+			}
+			a = a*10 + d
+			empty = false
+		}
+	}
+	if empty || len(s) > 0 { // 没有数字或者有多余的字符
+		return 0, false
+	}
+	if neg {
+		return int64(0 - a), true
+	}
+	return int64(a), true
 }
 
-// 将字符串解析为浮点数
+// 将字符串解析为浮点数，规则与lua_stringtonumber一致：
+// 允许前后空白和正负号，支持十六进制浮点数(如0x1p4)，不接受inf和nan
+// lua-5.3.4/src/lobject.c#l_str2d()
 func ParseFloat(str string) (float64, bool) {
-	f, err := strconv.ParseFloat(str, 64)
-	return f, err == nil
+	if strings.ContainsAny(str, "nN") { // 拒绝'inf'和'nan'
+		return 0, false
+	}
+	s, neg := trimSign(trimSpace(str))
+	var f float64
+	var ok bool
+	if isHexPrefix(s) {
+		f, ok = parseHexFloat(s[2:])
+	} else {
+		f, ok = parseDecFloat(s)
+	}
+	if neg {
+		f = -f
+	}
+	return f, ok
+}
+
+// 把字符串转换为整数，浮点数形式的字符串只有在具有精确整数表示时才能转换
+func StringToInteger(s string) (int64, bool) {
+	if i, ok := ParseInteger(s); ok {
+		return i, true
+	}
+	if f, ok := ParseFloat(s); ok {
+		return FloatToInteger(f)
+	}
+	return 0, false
+}
+
+// 解析十进制浮点数(不含符号)
+func parseDecFloat(s string) (float64, bool) {
+	i, nDigits := 0, 0
+	for ; i < len(s) && isDigit(s[i]); i++ {
+		nDigits++
+	}
+	if i < len(s) && s[i] == '.' {
+		for i++; i < len(s) && isDigit(s[i]); i++ {
+			nDigits++
+		}
+	}
+	if nDigits == 0 {
+		return 0, false
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') { // 指数部分
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		if i == len(s) || !isDigit(s[i]) {
+			return 0, false
+		}
+		for ; i < len(s) && isDigit(s[i]); i++ {
+		}
+	}
+	if i != len(s) {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil && err.(*strconv.NumError).Err != strconv.ErrRange {
+		return 0, false
+	}
+	return f, true // 溢出时和strtod一样得到±HUGE_VAL
+}
+
+// 解析十六进制浮点数(不含符号和0x前缀)
+// lua-5.3.4/src/lobject.c#lua_strx2number()
+func parseHexFloat(s string) (float64, bool) {
+	const maxSigDig = 30
+	r := 0.0
+	e := 0          // 指数
+	sigDig := 0     // 有效数字个数
+	hasDot := false // 是否遇到小数点
+	hasDigit := false
+	for ; len(s) > 0; s = s[1:] {
+		c := s[0]
+		if c == '.' {
+			if hasDot {
+				break // 第二个小数点
+			}
+			hasDot = true
+		} else if isHexDigit(c) {
+			if sigDig > 0 || c != '0' { // 前导零不计入有效数字
+				if sigDig++; sigDig <= maxSigDig {
+					r = r*16 + float64(hexValue(c))
+				} else {
+					e++ // 有效数字太多，忽略，但仍然要调整指数
+				}
+			}
+			if hasDot {
+				e-- // 小数部分的数字要减小指数
+			}
+			hasDigit = true
+		} else {
+			break
+		}
+	}
+	if !hasDigit {
+		return 0, false
+	}
+	e *= 4                                          // 每个十六进制数字对应4个二进制位
+	if len(s) > 0 && (s[0] == 'p' || s[0] == 'P') { // 二进制指数部分
+		s, neg := trimSign(s[1:])
+		if len(s) == 0 || !isDigit(s[0]) {
+			return 0, false
+		}
+		exp := 0
+		for ; len(s) > 0 && isDigit(s[0]); s = s[1:] {
+			if exp < 1<<20 { // 防止溢出，超过这个值结果已经是0或者无穷大
+				exp = exp*10 + int(s[0]-'0')
+			}
+		}
+		if neg {
+			exp = -exp
+		}
+		return math.Ldexp(r, e+exp), len(s) == 0
+	}
+	return math.Ldexp(r, e), len(s) == 0
+}
+
+// 去掉前后的空白字符(与C语言的isspace一致)
+func trimSpace(s string) string {
+	return strings.Trim(s, " \f\n\r\t\v")
+}
+
+// 去掉正负号，返回是否为负数
+func trimSign(s string) (string, bool) {
+	if len(s) > 0 {
+		if s[0] == '-' {
+			return s[1:], true
+		} else if s[0] == '+' {
+			return s[1:], false
+		}
+	}
+	return s, false
+}
+
+func isHexPrefix(s string) bool {
+	return len(s) >= 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// 十六进制数字的值
+func hexValue(c byte) int {
+	if isDigit(c) {
+		return int(c - '0')
+	}
+	return int(c|0x20) - 'a' + 10
+}
+
+func boolToUint(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,54 @@
+package number
+
+import "math/bits"
+
+// xoshiro256**伪随机数生成器，与Lua 5.4的math.random使用相同的算法
+// 每个LuaState持有一个实例，相同的种子总能得到相同的序列
+// lua-5.4.6/src/lmathlib.c#nextrand()
+type Xoshiro256 struct {
+	s [4]uint64
+}
+
+// 创建生成器并用给定的种子初始化
+func NewXoshiro256(n1, n2 uint64) *Xoshiro256 {
+	x := &Xoshiro256{}
+	x.Seed(n1, n2)
+	return x
+}
+
+// 设置种子
+// lua-5.4.6/src/lmathlib.c#setseed()
+func (self *Xoshiro256) Seed(n1, n2 uint64) {
+	self.s[0] = n1
+	self.s[1] = 0xff /* avoid a zero state */
+	self.s[2] = n2
+	self.s[3] = 0
+	for i := 0; i < 16; i++ {
+		self.Next() /* discard initial values to "spread" seed */
+	}
+}
+
+// 生成下一个64位随机数
+func (self *Xoshiro256) Next() uint64 {
+	s := &self.s
+	res := bits.RotateLeft64(s[1]*5, 7) * 9
+	t := s[1] << 17
+	s[2] ^= s[0]
+	s[3] ^= s[1]
+	s[1] ^= s[2]
+	s[0] ^= s[3]
+	s[2] ^= t
+	s[3] = bits.RotateLeft64(s[3], 45)
+	return res
+}
+
+// 生成[0, 1)之间的随机浮点数
+func (self *Xoshiro256) Float64() float64 {
+	return RandomFloat(self.Next())
+}
+
+// 把64位随机数转换为[0, 1)之间的浮点数(取高53位)
+// lua-5.4.6/src/lmathlib.c#I2d()
+func RandomFloat(rv uint64) float64 {
+	return float64(rv>>11) * (0.5 / (1 << 52))
+}
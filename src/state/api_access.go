@@ -204,7 +204,9 @@ func (self *luaState) ToThread(idx int) LuaState {
 func (self *luaState) ToProto(idx int) *binchunk.Prototype {
 	val := self.stack.get(idx)
 	if c, ok := val.(*closure); ok {
-		return c.proto
+		if c.proto != nil {
+			return c.proto.Prototype
+		}
 	}
 	return nil
 }
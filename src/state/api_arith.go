@@ -1,7 +1,9 @@
 package state
 
 import (
+	"fmt"
 	api2 "lua/src/api"
+	. "lua/src/binchunk"
 	"lua/src/number"
 	"math"
 )
@@ -64,23 +66,42 @@ func (self *luaState) Arith(op api2.ArithOp) {
 		a = b
 	}
 
+	self.stack.push(self.arith(a, b, op))
+}
+
+// 对两个值进行算术运算，操作数不能转成数字时调用元方法，一元运算符的两个操作数相同
+func (self *luaState) arith(a, b luaValue, op api2.ArithOp) luaValue {
 	operator := operators[op]
+	is54 := self.arithDialect() == LUA_DIALECT_54
 
 	// 如果操作数都可以转成数字，那么进行常规的算术运算
-	if result := _arith(a, b, operator); result != nil {
-		self.stack.push(result)
-		return
+	if is54 {
+		if result := _arith54(a, b, op, operator); result != nil {
+			return result
+		}
+	} else if result := _arith(a, b, operator); result != nil {
+		return result
 	}
 
 	// 否则尝试调用元方法
 	mm := operator.metamethod
 	if result, ok := callMetamethod(a, b, mm, self); ok {
-		self.stack.push(result)
-		return
+		return result
 	}
 
 	// 找不到对应元方法就报错
-	panic("arithmetic error!")
+	if operator.floatFunc == nil { // 位运算
+		panic(self.bitwiseError(a, b))
+	}
+	panic(self.arithError(a, b))
+}
+
+// 算术运算使用的方言：正在执行的Lua函数编译时使用的方言，不在Lua函数中时使用Dialect()
+func (self *luaState) arithDialect() byte {
+	if c := self.stack.closure; c != nil && c.proto != nil {
+		return self.FuncDialect()
+	}
+	return self.Dialect()
 }
 
 // 执行计算
@@ -101,3 +122,72 @@ func _arith(a, b luaValue, op operator) luaValue {
 	}
 	return nil
 }
+
+// 5.4方言的算术运算，和5.3的区别在于：
+// 整除和取模只有两个操作数都是整数时才做整数运算，整数除数为0时报错，否则按浮点数计算；
+// 字符串按照它表示的数字字面量转换，"7"//"2"的结果是整数3而不是浮点数3.0。
+// 位运算的规则不变，操作数不能转换成整数时由arith()报告具体的错误
+// lua-5.4.6/src/lvm.c#luaV_idiv()
+// lua-5.4.6/src/lvm.c#luaV_mod()
+func _arith54(a, b luaValue, op api2.ArithOp, operator operator) luaValue {
+	if op != api2.LUA_OPIDIV && op != api2.LUA_OPMOD {
+		return _arith(a, b, operator)
+	}
+	x, ok1 := stringToNumber(a)
+	y, ok2 := stringToNumber(b)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	if m, ok := x.(int64); ok {
+		if n, ok := y.(int64); ok {
+			if n == 0 {
+				if op == api2.LUA_OPIDIV {
+					panic("attempt to perform 'n//0'")
+				}
+				panic("attempt to perform 'n%0'")
+			}
+			return operator.integerFunc(m, n)
+		}
+	}
+	f, _ := convertToFloat(x)
+	g, _ := convertToFloat(y)
+	return operator.floatFunc(f, g)
+}
+
+// 把字符串转换成它表示的整数或者浮点数，数字原样返回
+func stringToNumber(val luaValue) (luaValue, bool) {
+	switch x := val.(type) {
+	case int64, float64:
+		return x, true
+	case string:
+		if i, ok := number.ParseInteger(x); ok {
+			return i, true
+		}
+		if f, ok := number.ParseFloat(x); ok {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// 算术运算失败时的错误信息，报告第一个不能转换成数字的操作数的类型
+// lua-5.3.4/src/ldebug.c#luaG_opinterror()
+func (self *luaState) arithError(a, b luaValue) string {
+	if _, ok := convertToFloat(a); !ok {
+		b = a
+	}
+	return fmt.Sprintf("attempt to perform arithmetic on a %s value", self.TypeName(typeOf(b)))
+}
+
+// 位运算失败时的错误信息：两个操作数都是数字时说明有浮点数不能表示成整数，
+// 否则报告第一个不是数字的操作数的类型
+// lua-5.4.6/src/ltm.c#luaT_trybinTM()
+func (self *luaState) bitwiseError(a, b luaValue) string {
+	if typeOf(a) == api2.LUA_TNUMBER && typeOf(b) == api2.LUA_TNUMBER {
+		return "number has no integer representation"
+	}
+	if typeOf(a) != api2.LUA_TNUMBER {
+		b = a
+	}
+	return fmt.Sprintf("attempt to perform bitwise operation on a %s value", self.TypeName(typeOf(b)))
+}
@@ -1,31 +1,149 @@
 package state
 
 import (
+	"fmt"
 	. "lua/src/api"
 	. "lua/src/binchunk"
 	. "lua/src/compiler"
+	"lua/src/compiler/lexer"
 	. "lua/src/vm"
+	"strings"
 )
 
 // 加载二进制chunk，第一个参数是二进制chunk，第二个参数是chunk名字，第三个参数指定加载模式("b" 二进制 "t" 文本 "bt" 二进制或文本)
+// 加载失败时把错误信息推入栈顶，并返回LUA_ERRSYNTAX
+// 文本chunk按照SetDialect()和SetOptimization()设置的方言和优化遍编译
 func (self *luaState) Load(chunk []byte, chunkName, mode string) int {
+	return self.LoadWithOptions(chunk, mode, &CompileOptions{
+		ChunkName: chunkName,
+		Dialect:   self.Dialect(),
+		Passes:    self.passes,
+	})
+}
+
+// 和Load()一样加载chunk，文本chunk按照opts编译，opts为nil时使用默认选项
+// 二进制chunk只用到选项里的chunk名字
+func (self *luaState) LoadWithOptions(chunk []byte, mode string, opts *CompileOptions) (status int) {
+	if opts == nil {
+		opts = &CompileOptions{}
+	}
+	chunkName := opts.ChunkName
 	var proto *Prototype
-	if IsBinaryChunk(chunk) { // 如果是二进制chunk
-		proto = Undump(chunk) // 解析二进制chunk
+	isBinary := IsBinaryChunk(chunk)
+	// 检查chunk类型是否符合加载模式
+	if isBinary && !strings.Contains(mode, "b") {
+		self.stack.push(fmt.Sprintf("attempt to load a binary chunk (mode is '%s')", mode))
+		return LUA_ERRSYNTAX
+	} else if !isBinary && !strings.Contains(mode, "t") {
+		self.stack.push(fmt.Sprintf("attempt to load a text chunk (mode is '%s')", mode))
+		return LUA_ERRSYNTAX
+	}
+
+	// 二进制chunk的错误以panic的形式抛出，这里把它们和编译错误一起转换成错误码
+	// 只处理字符串和语法错误，运行时错误等其他panic原样抛出，和Compile()一致
+	defer func() {
+		if r := recover(); r != nil {
+			switch x := r.(type) {
+			case string:
+				self.stack.push(x)
+			case *lexer.SyntaxError:
+				self.stack.push(x.Error())
+			default:
+				panic(r)
+			}
+			status = LUA_ERRSYNTAX
+		}
+	}()
+
+	if isBinary { // 如果是二进制chunk
+		var err error
+		if proto, err = Undump(chunk); err != nil { // 解析二进制chunk
+			panic(fmt.Sprintf("%s: %s", undumpName(chunkName), err))
+		}
+		if !self.skipVerify { // 校验字节码，拒绝畸形的chunk
+			if err := Verify(proto); err != nil {
+				panic(fmt.Sprintf("%s: bad binary format (%s)", undumpName(chunkName), err))
+			}
+		}
 	} else {
-		proto = Compile(string(chunk), chunkName) // 编译文本chunk
+		var err error
+		if proto, err = Compile(string(chunk), opts); err != nil { // 编译文本chunk，二进制chunk自带方言
+			panic(err.Error())
+		}
 	}
 	//Tools.List(proto)
-	c := newLuaClosure(proto)
+	c := newLuaClosure(newLuaProto(proto))
 	self.stack.push(c)
 	// 判断是否需要Upvalue
 	if len(proto.Upvalues) > 0 {
 		env := self.registry.get(LUA_RIDX_GLOBALS) // 获取全局环境表
 		c.upvals[0] = &upvalue{&env}               // 把全局环境表作为第一个Upvalue
+		for i := 1; i < len(c.upvals); i++ {       // 其余Upvalue初始化为nil
+			var val luaValue
+			c.upvals[i] = &upvalue{&val}
+		}
+	}
+	return LUA_OK
+}
+
+// 加载luaaot生成的包里嵌入的二进制chunk，把主函数压入栈顶，返回值和Load()相同
+// natives是按先序排列的各个函数原型的Go实现，调用时代替解释执行
+func LoadNative(ls LuaState, chunk []byte, chunkName string, natives []func(LuaVM)) int {
+	self := ls.(*luaState)
+	if status := self.Load(chunk, chunkName, "b"); status != LUA_OK {
+		return status
 	}
+	n := 0
+	self.stack.get(-1).(*closure).proto.attach(natives, &n)
 	return LUA_OK
 }
 
+// 二进制chunk错误信息中使用的名字
+// lua-5.3.4/src/lundump.c#luaU_undump()
+func undumpName(chunkName string) string {
+	if chunkName != "" && (chunkName[0] == '@' || chunkName[0] == '=') {
+		return chunkName[1:]
+	} else if strings.HasPrefix(chunkName, LUA_SIGNATURE[:1]) {
+		return "binary string"
+	}
+	return chunkName
+}
+
+// 设置加载二进制chunk时是否校验字节码，默认校验
+// 只有在chunk来源可信时才应该关闭校验
+func (self *luaState) SetVerifyBytecode(verify bool) {
+	self.skipVerify = !verify
+}
+
+// 设置编译文本chunk时使用的语言方言(LUA_DIALECT_53或LUA_DIALECT_54)，默认是5.3
+// 只影响之后加载的chunk，已经加载的函数保持编译时的方言
+func (self *luaState) SetDialect(dialect byte) {
+	switch dialect {
+	case LUA_DIALECT_53, LUA_DIALECT_54:
+		self.dialect = dialect
+	default:
+		panic(fmt.Sprintf("unsupported dialect 0x%02x", dialect))
+	}
+}
+
+// 返回编译文本chunk时使用的语言方言
+func (self *luaState) Dialect() byte {
+	if self.dialect == 0 {
+		return LUA_DIALECT_53
+	}
+	return self.dialect
+}
+
+// 设置编译文本chunk时执行的优化遍(compiler.OPT_*按位组合)，默认不优化
+func (self *luaState) SetOptimization(passes int) {
+	self.passes = passes
+}
+
+// 返回编译文本chunk时执行的优化遍
+func (self *luaState) Optimization() int {
+	return self.passes
+}
+
 // 调用Lua函数
 // 第一个参数是参数个数，第二个参数是返回值个数
 func (self *luaState) Call(nArgs, nResults int) {
@@ -56,75 +174,140 @@ func (self *luaState) Call(nArgs, nResults int) {
 
 // 调用Lua函数
 func (self *luaState) callLuaClosure(nArgs, nResults int, c *closure) {
+	// 把函数和参数弹出，在新的调用帧里执行
+	funcAndArgs := self.stack.popN(nArgs + 1)
+	results := self.runLuaFrame(c, funcAndArgs[1:])
+
+	// 根据期望的返回值个数，把返回值传递给调用者
+	if nResults != 0 {
+		self.stack.check(len(results))      // 检查栈空间
+		self.stack.pushN(results, nResults) // 多退少补
+	}
+}
+
+// 调用Go函数
+func (self *luaState) callGoClosure(nArgs, nResults int, c *closure) {
+	// 拿到栈里的参数，再弹出函数
+	args := self.stack.popN(nArgs)
+	self.stack.pop()
+	results := self.runGoFrame(c, args)
+
+	// 把返回值压入主调用帧，多退少补
+	if nResults != 0 {
+		self.stack.check(len(results))
+		self.stack.pushN(results, nResults)
+	}
+}
+
+// 在新的调用帧里执行闭包，args是传给闭包的参数
+// 返回被调函数的全部返回值，返回的切片会被下一次调用复用，调用者要马上取走
+func (self *luaState) runClosure(c *closure, args []luaValue) []luaValue {
+	if c.proto != nil {
+		return self.runLuaFrame(c, args)
+	}
+	return self.runGoFrame(c, args)
+}
+
+func (self *luaState) runLuaFrame(c *closure, args []luaValue) []luaValue {
 	// 拿到编译器为我们事先准备好的信息
 	nRegs := int(c.proto.MaxStackSize)
 	nParams := int(c.proto.NumParams)
 	isVararg := c.proto.IsVararg == 1
 
 	// 创建Lua栈帧
-	newStack := newLuaStack(nRegs+LUA_MINSTACK, self)
+	newStack := self.newFrame(nRegs + LUA_MINSTACK)
 	// 把闭包和调用帧联系起来
 	newStack.closure = c
 
 	// 把参数传递给新的Lua栈帧
-	funcAndArgs := self.stack.popN(nArgs + 1) // 把函数和参数弹出
-	newStack.pushN(funcAndArgs[1:], nParams)  // 把参数传递给新的Lua栈帧
-	newStack.top = nRegs                      // 设置栈顶
-	if nArgs > nParams && isVararg {          // 如果参数个数大于参数个数，且是可变参数
-		newStack.varargs = funcAndArgs[nParams+1:] // 把多余的参数传递给可变参数
+	newStack.pushN(args, nParams)        // 固定参数放在最前面的寄存器里
+	newStack.top = nRegs                 // 设置栈顶
+	if len(args) > nParams && isVararg { // 如果参数个数大于参数个数，且是可变参数
+		// 把多余的参数传递给可变参数，args可能引用主调帧的寄存器，所以要复制一份
+		newStack.varargs = append([]luaValue(nil), args[nParams:]...)
 	}
 
 	// 把新的Lua栈帧压入Lua虚拟机栈
 	self.pushLuaStack(newStack)
-	// 执行Lua函数
-	self.runLuaClosure()
+	// 执行Lua函数，预先编译成Go代码的函数直接在栈帧上执行
+	if native := c.proto.native; native != nil {
+		native(self)
+	} else {
+		self.runLuaClosure()
+	}
 	// 弹出被调用帧
 	self.popLuaStack()
+	// RETURN指令把返回值留在了寄存器上面，取出来以后调用帧就可以复用了
+	self.rets = append(self.rets[:0], newStack.slots[nRegs:newStack.top]...)
+	self.freeFrame(newStack)
+	return self.rets
+}
 
-	// 根据期望的返回值个数，从新的Lua栈帧中弹出返回值
-	if nResults != 0 {
-		results := newStack.popN(newStack.top - nRegs) // 弹出返回值
-		self.stack.check(len(results))                 // 检查栈空间
-		self.stack.pushN(results, nResults)            // 把返回值传递给调用者
+const MAX_FREE_FRAMES = 32 // 最多保留的空闲调用帧
+
+// 取一个空闲的调用帧，容量不够时新建
+func (self *luaState) newFrame(size int) *luaStack {
+	if n := len(self.frames); n > 0 && cap(self.frames[n-1].slots) >= size {
+		stack := self.frames[n-1]
+		self.frames = self.frames[:n-1]
+		stack.slots = stack.slots[:size]
+		return stack
 	}
+	return newLuaStack(size, self)
 }
 
-// 调用Go函数
-func (self *luaState) callGoClosure(nArgs, nResults int, c *closure) {
+// 回收已经返回的调用帧，RETURN指令已经关闭了全部Upvalue，寄存器不会再被引用
+func (self *luaState) freeFrame(stack *luaStack) {
+	if len(self.frames) >= MAX_FREE_FRAMES || len(stack.openuvs) > 0 || len(stack.tbcs) > 0 {
+		return
+	}
+	if cap(stack.slots) > 0xFF+LUA_MINSTACK { // 用check()扩容过的大调用帧不保留
+		return
+	}
+	slots := stack.slots[:cap(stack.slots)]
+	for i := range slots {
+		slots[i] = nil
+	}
+	stack.top = 0
+	stack.closure = nil
+	stack.varargs = nil
+	stack.pc = 0
+	self.frames = append(self.frames, stack)
+}
+
+func (self *luaState) runGoFrame(c *closure, args []luaValue) []luaValue {
 	// 创建Lua栈帧
-	newStack := newLuaStack(nArgs+LUA_MINSTACK, self)
+	newStack := newLuaStack(len(args)+LUA_MINSTACK, self)
 	// 把闭包和调用帧联系起来
 	newStack.closure = c
-
-	// 拿到栈里的参数
-	args := self.stack.popN(nArgs)
-	// 压入调用帧
-	newStack.pushN(args, nArgs)
-	// 弹出函数名
-	self.stack.pop()
+	// 压入参数
+	newStack.pushN(args, -1)
 
 	// 把新的Lua栈帧压入Lua虚拟机栈
 	self.pushLuaStack(newStack)
 	// 执行Go函数
 	r := c.goFunc(self)
+	// 关闭Go函数用ToClose标记的待关闭变量，返回值在栈顶不受影响
+	if len(newStack.tbcs) > 0 {
+		self.closeTBCs(0, nil, false)
+	}
 	// 弹出被调用帧
 	self.popLuaStack()
-
-	// 把返回值压入主调用帧，多退少补
-	if nResults != 0 {
-		results := newStack.popN(r)
-		self.stack.check(len(results))
-		self.stack.pushN(results, nResults)
+	// 返回值是栈顶的r个值
+	if r > newStack.top {
+		panic("stack underflow!")
 	}
+	return newStack.slots[newStack.top-r : newStack.top]
 }
 
-// 执行被调函数
+// 执行被调函数，每个函数原型第一次执行时预先解码成Go闭包，之后直接在栈帧上执行
 func (self *luaState) runLuaClosure() {
+	stack := self.stack
+	code := decodeProto(stack.closure.proto)
 	for {
-		inst := Instruction(self.Fetch())
-		//Tools.PrintStack(self)
-		inst.Execute(self)
-		if inst.Opcode() == OP_RETURN {
+		pc := stack.pc
+		stack.pc++ // 和Fetch()一样，执行时pc已经指向下一条指令
+		if code[pc](self, stack) {
 			break
 		}
 	}
@@ -154,18 +337,36 @@ func (self *luaStack) pushN(vals []luaValue, n int) {
 	}
 }
 
-// 执行代码
+// 以保护模式调用函数
+// msgh不为0时表示消息处理函数在栈中的索引，出错时会在展开调用帧之前用错误对象调用它，其返回值作为最终的错误对象
 func (self *luaState) PCall(nArgs, nResults, msgh int) (status int) {
 	caller := self.stack
+	var handler luaValue
+	if msgh != 0 {
+		handler = self.stack.get(msgh)
+	}
 	status = LUA_ERRRUN
 
 	// 定义一个匿名函数延时执行，用来做错误处理
 	defer func() {
 		if err := recover(); err != nil {
-			if msgh != 0 {
-				panic(err)
+			if sig, ok := err.(coCloseSignal); ok { // 协程正在被关闭，关闭待关闭变量后继续向外展开
+				for self.stack != caller {
+					if e, replaced := self.closeTBCs(0, sig.err, true); replaced {
+						sig.err, sig.failed = e, true
+					}
+					self.popLuaStack()
+				}
+				panic(sig)
+			}
+			if e, ok := err.(error); ok { // Go运行时错误转换成字符串
+				err = e.Error()
+			}
+			if handler != nil { // 此时出错的调用帧还在，可以收集栈回溯信息
+				err, status = self.callMsgHandler(handler, err)
 			}
-			for self.stack != caller {
+			for self.stack != caller { // 展开调用帧，同时用错误对象关闭待关闭变量
+				err, _ = self.closeTBCs(0, err, true)
 				self.popLuaStack()
 			}
 			self.stack.push(err)
@@ -176,3 +377,17 @@ func (self *luaState) PCall(nArgs, nResults, msgh int) (status int) {
 	status = LUA_OK
 	return
 }
+
+// 调用消息处理函数，处理函数本身出错时返回LUA_ERRERR
+func (self *luaState) callMsgHandler(handler, err luaValue) (result luaValue, status int) {
+	defer func() {
+		if e := recover(); e != nil {
+			result, status = e, LUA_ERRERR
+		}
+	}()
+	self.stack.check(2)
+	self.stack.push(handler)
+	self.stack.push(err)
+	self.Call(1, 1)
+	return self.stack.pop(), LUA_ERRRUN
+}
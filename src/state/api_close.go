@@ -0,0 +1,76 @@
+package state
+
+// 待关闭变量(5.4)
+// 每个调用帧用tbcs记录待关闭变量所在的寄存器，离开作用域时按照和声明相反的顺序调用__close(value, err)：
+// 正常离开作用域(JMP、RETURN)时由CloseUpvalues关闭，出错时由PCall在展开调用帧之前关闭
+
+// 把指定索引处的值标记为待关闭变量，值必须是nil、false或者带有__close元方法
+// lua-5.4.6/src/lapi.c#lua_toclose()
+func (self *luaState) ToClose(idx int) {
+	idx = self.stack.absIndex(idx)
+	val := self.stack.get(idx)
+	if val != nil && val != false && getMetafield(val, "__close", self) == nil {
+		panic("variable '?' got a non-closable value") // 没有局部变量调试信息，无法给出变量名
+	}
+	self.stack.tbcs = append(self.stack.tbcs, idx-1)
+}
+
+// 关闭当前调用帧中寄存器索引不小于level的待关闭变量
+// protected为false时直接调用__close，它抛出的错误会继续向外传播(外层的待关闭变量由PCall关闭)；
+// protected为true时以保护模式调用，__close抛出的错误替换原来的错误对象，第二个返回值表示是否发生过这种替换
+// lua-5.4.6/src/lfunc.c#luaF_close()
+func (self *luaState) closeTBCs(level int, err luaValue, protected bool) (luaValue, bool) {
+	replaced := false
+	stack := self.stack
+	for n := len(stack.tbcs); n > 0 && stack.tbcs[n-1] >= level; n = len(stack.tbcs) {
+		slot := stack.tbcs[n-1]
+		stack.tbcs = stack.tbcs[:n-1] // 先移除，避免__close出错后被再次关闭
+		val := stack.slots[slot]
+		if val == nil || val == false {
+			continue
+		}
+		if !protected {
+			self.callCloseMethod(val, err)
+		} else if e, ok := self.pcallCloseMethod(val, err); !ok {
+			err, replaced = e, true
+		}
+	}
+	return err, replaced
+}
+
+// 调用__close(value, err)
+// lua-5.4.6/src/lfunc.c#callclosemethod()
+func (self *luaState) callCloseMethod(val, err luaValue) {
+	mm := getMetafield(val, "__close", self)
+	if mm == nil { // 标记之后元方法被删除了
+		panic("attempt to call a nil value (metamethod 'close')")
+	}
+	self.stack.check(3)
+	self.stack.push(mm)
+	self.stack.push(val)
+	self.stack.push(err)
+	self.Call(2, 0)
+}
+
+// 以保护模式调用__close，出错时返回错误对象和false
+func (self *luaState) pcallCloseMethod(val, err luaValue) (e luaValue, ok bool) {
+	caller := self.stack
+	top := caller.top
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(coCloseSignal); ok {
+				panic(r)
+			}
+			if re, ok := r.(error); ok {
+				r = re.Error()
+			}
+			for self.stack != caller {
+				self.popLuaStack()
+			}
+			self.SetTop(top)
+			e, ok = r, false
+		}
+	}()
+	self.callCloseMethod(val, err)
+	return nil, true
+}
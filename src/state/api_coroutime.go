@@ -7,7 +7,10 @@ import (
 // 创建一个新的线程，将一个新的调用帧压入栈，同时将线程作为返回值返回
 func (self *luaState) NewThread() LuaState {
 	t := &luaState{
-		registry: self.registry,
+		registry:   self.registry,
+		rand:       self.rand,
+		skipVerify: self.skipVerify,
+		dialect:    self.dialect,
 	}
 	t.pushLuaStack(newLuaStack(LUA_MINSTACK, t))
 	self.stack.push(t)
@@ -25,8 +28,23 @@ func (self *luaState) Resume(from LuaState, nArgs int) int {
 		self.coChan = make(chan int)
 		self.coCaller = lsFrom
 		go func() { // 执行主函数
+			defer func() {
+				if err := recover(); err != nil {
+					sig, ok := err.(coCloseSignal)
+					if !ok {
+						panic(err)
+					}
+					self.coStatus = LUA_OK // 被关闭的协程从这里结束
+					if sig.failed {        // __close出错
+						self.coStatus, self.coError = LUA_ERRRUN, sig.err
+					}
+				}
+				self.coCaller.coChan <- 1 // 向通道中随意写一个数值
+			}()
 			self.coStatus = self.PCall(nArgs, LUA_MULTRET, 0)
-			lsFrom.coChan <- 1 // 向通道中随意写一个数值
+			if self.coStatus != LUA_OK {
+				self.coError = self.stack.get(-1) // 错误对象会被移走，这里留一份
+			}
 		}()
 	} else {
 		// resume coroutine
@@ -47,9 +65,44 @@ func (self *luaState) Yield(nResult int) int {
 	self.coStatus = LUA_YIELD
 	self.coCaller.coChan <- 1 // 通知协作方恢复运行
 	<-self.coChan             // 等待再次恢复运行
+	if self.coClosing {       // 被coroutine.close唤醒，从这里展开协程的调用栈
+		self.coClosing = false
+		panic(coCloseSignal{})
+	}
 	return self.coStatus
 }
 
+// 关闭协程时在Yield处抛出，PCall不会捕获它，协程的主goroutine收到后正常结束
+// 展开调用帧时会关闭待关闭变量，err是传给__close的错误对象，failed表示是否有__close出错
+type coCloseSignal struct {
+	err    luaValue
+	failed bool
+}
+
+// 关闭挂起或已经结束的协程，之后协程处于死亡状态
+// 挂起的协程从Yield处展开调用栈；协程因出错而结束时返回错误码，错误对象留在协程栈顶
+// lua-5.4.6/src/lstate.c#lua_closethread()
+func (self *luaState) CloseThread(from LuaState) int {
+	if self.coStatus == LUA_YIELD {
+		lsFrom := from.(*luaState)
+		if lsFrom.coChan == nil {
+			lsFrom.coChan = make(chan int)
+		}
+		self.coCaller = lsFrom
+		self.coClosing = true
+		self.coChan <- 1
+		<-lsFrom.coChan // 等待协程展开完毕
+	}
+	status := self.coStatus
+	self.SetTop(0)
+	self.coStatus = LUA_OK
+	if status != LUA_OK {
+		self.stack.push(self.coError)
+		self.coError = nil
+	}
+	return status
+}
+
 // 返回当前线程状态
 func (self *luaState) Status() int {
 	return self.coStatus
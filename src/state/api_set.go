@@ -48,6 +48,7 @@ func (self *luaState) setTable(t, k, v luaValue, raw bool) {
 			switch x := mf.(type) {
 			case *luaTable: // 如果元方法是表，把k和v写入表
 				self.setTable(x, k, v, false)
+				return
 			case *closure: // 如果元方法是函数，调用函数
 				self.stack.push(mf)
 				self.stack.push(t)
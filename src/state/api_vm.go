@@ -1,5 +1,7 @@
 package state
 
+import . "lua/src/binchunk"
+
 func (self *luaState) PC() int {
 	return self.stack.pc
 }
@@ -49,7 +51,7 @@ func (self *luaState) LoadVararg(n int) {
 // 将指定子函数原型推入栈顶
 func (self *luaState) LoadProto(idx int) {
 	stack := self.stack
-	subProto := stack.closure.proto.Protos[idx]
+	subProto := stack.closure.proto.sub(idx)
 	closure := newLuaClosure(subProto)
 	stack.push(closure)
 	// 遍历子函数的upvalue表
@@ -77,7 +79,7 @@ func (self *luaState) LoadProto(idx int) {
 	}
 }
 
-// 关闭指定索引处的Upvalue
+// 关闭寄存器索引不小于a-1的Upvalue和待关闭变量
 func (self *luaState) CloseUpvalues(a int) {
 	for i, openuv := range self.stack.openuvs {
 		if i >= a-1 {
@@ -88,4 +90,15 @@ func (self *luaState) CloseUpvalues(a int) {
 			delete(self.stack.openuvs, i)
 		}
 	}
+	if len(self.stack.tbcs) > 0 {
+		self.closeTBCs(a-1, nil, false)
+	}
+}
+
+// 获取当前函数编译时使用的语言方言，0(旧的chunk)按5.3处理
+func (self *luaState) FuncDialect() byte {
+	if d := self.stack.closure.proto.Dialect; d != 0 {
+		return d
+	}
+	return LUA_DIALECT_53
 }
@@ -1,8 +1,12 @@
 package state
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	. "lua/src/api"
+	. "lua/src/binchunk"
+	"lua/src/compiler/lexer"
 	. "lua/src/stdlib"
 	"os"
 )
@@ -119,14 +123,33 @@ func (self *luaState) LoadFile(filename string) int {
 	return self.LoadFileX(filename, "bt")
 }
 
-// 加载文件
+// 加载文件，文件名为空时从标准输入读取
+// 如果第一行以'#'开头(比如Unix的shebang)，会跳过这一行
 func (self *luaState) LoadFileX(filename, mode string) int {
-	if data, err := os.ReadFile(filename); err == nil {
-		return self.Load(data, "@"+filename, mode)
+	var data []byte
+	var err error
+	chunkName := "=stdin"
+	if filename == "" {
+		data, err = io.ReadAll(os.Stdin)
 	} else {
-		self.PushString(err.Error())
+		chunkName = "@" + filename
+		data, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		what, name := "read", filename
+		if pe, ok := err.(*os.PathError); ok {
+			what, err = pe.Op, pe.Err
+		}
+		if filename == "" {
+			name = "stdin"
+		}
+		self.PushString(fmt.Sprintf("cannot %s %s: %s", what, name, err.Error()))
 		return LUA_ERRFILE
 	}
+	if len(data) > 0 && data[0] == '#' { /* first line is a comment (Unix exec. file)? */
+		data = []byte(lexer.SkipShebang(string(data)))
+	}
+	return self.Load(data, chunkName, mode)
 }
 
 // 加载字符串
@@ -233,6 +256,55 @@ func (self *luaState) CallMeta(obj int, event string) bool {
 	return true
 }
 
+const tbLevels1 = 10 /* size of the first part of the stack */
+const tbLevels2 = 11 /* size of the second part of the stack */
+
+// 生成线程l1的栈回溯信息并推入栈顶，level表示从第几层调用帧开始
+// lua-5.3.4/src/lauxlib.c#luaL_traceback()
+func (self *luaState) Traceback(l1 LuaState, msg string, level int) {
+	var frames []*luaStack
+	for stack := l1.(*luaState).stack; stack != nil; stack = stack.prev {
+		if stack.closure != nil { // 线程最底层的调用帧不对应任何函数
+			frames = append(frames, stack)
+		}
+	}
+
+	var buf bytes.Buffer
+	if msg != "" {
+		buf.WriteString(msg)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("stack traceback:")
+	for i := level; i < len(frames); i++ {
+		if len(frames)-level > tbLevels1+tbLevels2 && i == level+tbLevels1 {
+			buf.WriteString("\n\t...")      /* add a '...' */
+			i = len(frames) - tbLevels2 - 1 /* and skip to last ones */
+			continue
+		}
+		buf.WriteString("\n\t")
+		buf.WriteString(frameInfo(frames[i]))
+	}
+	self.PushString(buf.String())
+}
+
+// 描述一个调用帧：源文件、当前行和函数
+func frameInfo(stack *luaStack) string {
+	proto := stack.closure.proto
+	if proto == nil { // Go函数
+		return "[C]: in ?"
+	}
+	src := ChunkID(proto.Source)
+	if stack.pc > 0 && stack.pc <= len(proto.LineInfo) {
+		src = fmt.Sprintf("%s:%d:", src, proto.LineInfo[stack.pc-1])
+	} else {
+		src += ":"
+	}
+	if proto.LineDefined == 0 {
+		return src + " in main chunk"
+	}
+	return fmt.Sprintf("%s in function <%s:%d>", src, ChunkID(proto.Source), proto.LineDefined)
+}
+
 // 开启标准库
 func (self *luaState) OpenLibs() {
 	// 声明要开启的标准库
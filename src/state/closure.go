@@ -8,17 +8,47 @@ import (
 // 闭包
 // proto和goFunc必须有一个不为空
 type closure struct {
-	proto  *Prototype // Lua函数原型
+	proto  *luaProto  // Lua函数原型
 	goFunc GoFunction // Go函数原型
 	upvals []*upvalue // upvalue表
 }
 
+// 函数原型和它在运行时用到的数据，这些数据不属于二进制chunk，所以不放在binchunk.Prototype上
+// 每次加载chunk时创建，子函数原型在第一次创建闭包时创建，同一个函数原型的闭包共用一个
+type luaProto struct {
+	*Prototype
+	native func(LuaVM) // luaaot生成的Go实现，不为nil时代替解释执行
+	code   []instFunc  // 第一次执行时预先解码的指令
+	protos []*luaProto // 子函数原型，和Prototype.Protos一一对应
+}
+
+func newLuaProto(proto *Prototype) *luaProto {
+	return &luaProto{Prototype: proto, protos: make([]*luaProto, len(proto.Protos))}
+}
+
+// 按先序把natives[*n]开始的Go实现挂到函数原型和它的子函数原型上
+func (self *luaProto) attach(natives []func(LuaVM), n *int) {
+	self.native = natives[*n]
+	*n++
+	for i := range self.protos {
+		self.sub(i).attach(natives, n)
+	}
+}
+
+// 第idx个子函数原型
+func (self *luaProto) sub(idx int) *luaProto {
+	if self.protos[idx] == nil {
+		self.protos[idx] = newLuaProto(self.Protos[idx])
+	}
+	return self.protos[idx]
+}
+
 type upvalue struct {
 	val *luaValue // 指向upvalue的值
 }
 
 // 创建lua闭包
-func newLuaClosure(proto *Prototype) *closure {
+func newLuaClosure(proto *luaProto) *closure {
 	c := &closure{proto: proto}
 	// 判断是否有upvalue，有的话创建upvalue表
 	if nUpvals := len(proto.Upvalues); nUpvals > 0 {
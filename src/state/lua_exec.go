@@ -0,0 +1,534 @@
+package state
+
+import (
+	"fmt"
+	. "lua/src/api"
+	. "lua/src/binchunk"
+	. "lua/src/vm"
+	"strings"
+)
+
+// 预解码的执行引擎
+// 函数原型第一次执行时，把指令表逐条解码成Go闭包，操作数、常量和方言在解码时就确定下来，
+// 执行时不再取指令、解码和查指令表。常见的情况(整数运算、没有元方法的表访问、闭包之间的调用等)
+// 直接读写栈帧的slots，其他情况回退到vm包里的指令实现，所以两者的行为完全一致。
+// 指令表本身不变，Tools.List()和binchunk.Dump()看到的仍然是原来的指令
+
+// 解码后的指令，返回true表示函数已经返回
+type instFunc func(self *luaState, stack *luaStack) bool
+
+// 返回函数原型解码后的指令，结果缓存在luaProto上
+func decodeProto(proto *luaProto) []instFunc {
+	if proto.code != nil {
+		return proto.code
+	}
+	code := make([]instFunc, len(proto.Code))
+	for pc, i := range proto.Code {
+		code[pc] = decodeInst(proto.Prototype, Instruction(i))
+	}
+	proto.code = code
+	return code
+}
+
+// 没有专门实现的指令，以及专门实现处理不了的情况，交给vm包按指令执行
+func execInst(i Instruction) instFunc {
+	isReturn := i.Opcode() == OP_RETURN
+	return func(self *luaState, stack *luaStack) bool {
+		i.Execute(self)
+		return isReturn
+	}
+}
+
+// 检查用到的寄存器都在函数原型声明的范围内，没有校验过的畸形chunk交给vm包处理
+func isRegs(proto *Prototype, regs ...int) bool {
+	for _, r := range regs {
+		if r < 0 || r >= int(proto.MaxStackSize) {
+			return false
+		}
+	}
+	return true
+}
+
+// 解码RK操作数，常量返回(-1, 常量值)，寄存器返回(寄存器索引, nil)，第三个返回值表示操作数是否合法
+func decodeRK(proto *Prototype, rk int) (int, luaValue, bool) {
+	if rk > 0xFF { // constant
+		if idx := rk & 0xFF; idx < len(proto.Constants) {
+			return -1, proto.Constants[idx], true
+		}
+		return 0, nil, false
+	}
+	return rk, nil, isRegs(proto, rk)
+}
+
+// 取RK操作数的值
+func rk(stack *luaStack, idx int, k luaValue) luaValue {
+	if idx < 0 {
+		return k
+	}
+	return stack.slots[idx]
+}
+
+// 取当前闭包的Upvalue，索引无效时返回nil
+func getUpval(stack *luaStack, idx int) luaValue {
+	if uvs := stack.closure.upvals; idx < len(uvs) {
+		return *(uvs[idx].val)
+	}
+	return nil
+}
+
+// 从表中取值，表里没有这个键并且有__index元方法时和GetTable()一样处理
+func (self *luaState) index(t, k luaValue) luaValue {
+	if tbl, ok := t.(*luaTable); ok {
+		if v := tbl.get(k); v != nil || !tbl.hasMetafield("__index") {
+			return v
+		}
+	}
+	self.getTable(t, k, false)
+	return self.stack.pop()
+}
+
+// 解码一条指令，寄存器下标都从0开始
+func decodeInst(proto *Prototype, i Instruction) instFunc {
+	a, b, c := i.ABC()
+	switch i.Opcode() {
+	case OP_MOVE: // R(A) := R(B)
+		if isRegs(proto, a, b) {
+			return func(self *luaState, stack *luaStack) bool {
+				stack.slots[a] = stack.slots[b]
+				return false
+			}
+		}
+	case OP_LOADK: // R(A) := Kst(Bx)
+		if _, bx := i.ABx(); isRegs(proto, a) && bx < len(proto.Constants) {
+			k := proto.Constants[bx]
+			return func(self *luaState, stack *luaStack) bool {
+				stack.slots[a] = k
+				return false
+			}
+		}
+	case OP_LOADBOOL: // R(A) := (bool)B; if (C) pc++
+		if isRegs(proto, a) {
+			v := b != 0
+			return func(self *luaState, stack *luaStack) bool {
+				stack.slots[a] = v
+				if c != 0 {
+					stack.pc++
+				}
+				return false
+			}
+		}
+	case OP_LOADNIL: // R(A), R(A+1), ..., R(A+B) := nil
+		if isRegs(proto, a, a+b) {
+			return func(self *luaState, stack *luaStack) bool {
+				for j := a; j <= a+b; j++ {
+					stack.slots[j] = nil
+				}
+				return false
+			}
+		}
+	case OP_GETUPVAL: // R(A) := UpValue[B]
+		if isRegs(proto, a) {
+			return func(self *luaState, stack *luaStack) bool {
+				stack.slots[a] = getUpval(stack, b)
+				return false
+			}
+		}
+	case OP_SETUPVAL: // UpValue[B] := R(A)
+		if isRegs(proto, a) {
+			return func(self *luaState, stack *luaStack) bool {
+				if uvs := stack.closure.upvals; b < len(uvs) {
+					*(uvs[b].val) = stack.slots[a]
+				}
+				return false
+			}
+		}
+	case OP_GETTABUP: // R(A) := UpValue[B][RK(C)]
+		if ci, ck, ok := decodeRK(proto, c); ok && isRegs(proto, a) {
+			return func(self *luaState, stack *luaStack) bool {
+				stack.slots[a] = self.index(getUpval(stack, b), rk(stack, ci, ck))
+				return false
+			}
+		}
+	case OP_GETTABLE: // R(A) := R(B)[RK(C)]
+		if ci, ck, ok := decodeRK(proto, c); ok && isRegs(proto, a, b) {
+			return func(self *luaState, stack *luaStack) bool {
+				stack.slots[a] = self.index(stack.slots[b], rk(stack, ci, ck))
+				return false
+			}
+		}
+	case OP_SETTABUP: // UpValue[A][RK(B)] := RK(C)
+		bi, bk, ok1 := decodeRK(proto, b)
+		ci, ck, ok2 := decodeRK(proto, c)
+		if ok1 && ok2 {
+			return func(self *luaState, stack *luaStack) bool {
+				self.setTable(getUpval(stack, a), rk(stack, bi, bk), rk(stack, ci, ck), false)
+				return false
+			}
+		}
+	case OP_SETTABLE: // R(A)[RK(B)] := RK(C)
+		bi, bk, ok1 := decodeRK(proto, b)
+		ci, ck, ok2 := decodeRK(proto, c)
+		if ok1 && ok2 && isRegs(proto, a) {
+			return func(self *luaState, stack *luaStack) bool {
+				self.setTable(stack.slots[a], rk(stack, bi, bk), rk(stack, ci, ck), false)
+				return false
+			}
+		}
+	case OP_NEWTABLE: // R(A) := {} (size = B,C)
+		if isRegs(proto, a) {
+			nArr, nRec := Fb2int(b), Fb2int(c)
+			return func(self *luaState, stack *luaStack) bool {
+				stack.slots[a] = newLuaTable(nArr, nRec)
+				return false
+			}
+		}
+	case OP_SELF: // R(A+1) := R(B); R(A) := R(B)[RK(C)]
+		if ci, ck, ok := decodeRK(proto, c); ok && isRegs(proto, a, a+1, b) {
+			return func(self *luaState, stack *luaStack) bool {
+				obj := stack.slots[b]
+				stack.slots[a+1] = obj
+				stack.slots[a] = self.index(obj, rk(stack, ci, ck))
+				return false
+			}
+		}
+	case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV,
+		OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+		if f := decodeArith(proto, i); f != nil {
+			return f
+		}
+	case OP_UNM: // R(A) := -R(B)
+		if isRegs(proto, a, b) {
+			return func(self *luaState, stack *luaStack) bool {
+				x := stack.slots[b]
+				if n, ok := x.(int64); ok {
+					stack.slots[a] = -n
+				} else {
+					stack.slots[a] = self.arith(x, x, LUA_OPUNM)
+				}
+				return false
+			}
+		}
+	case OP_NOT: // R(A) := not R(B)
+		if isRegs(proto, a, b) {
+			return func(self *luaState, stack *luaStack) bool {
+				stack.slots[a] = !convertToBoolean(stack.slots[b])
+				return false
+			}
+		}
+	case OP_LEN: // R(A) := length of R(B)
+		if isRegs(proto, a, b) {
+			return func(self *luaState, stack *luaStack) bool {
+				switch x := stack.slots[b].(type) {
+				case string:
+					stack.slots[a] = int64(len(x))
+					return false
+				case *luaTable:
+					if x.metatable == nil {
+						stack.slots[a] = int64(x.len())
+						return false
+					}
+				}
+				i.Execute(self) // 元方法
+				return false
+			}
+		}
+	case OP_CONCAT: // R(A) := R(B).. ... ..R(C)
+		if b < c && isRegs(proto, a, b, c) {
+			return decodeConcat(i, a, b, c)
+		}
+	case OP_JMP: // pc+=sBx; if (A) close all upvalues >= R(A - 1)
+		_, sBx := i.AsBx()
+		return func(self *luaState, stack *luaStack) bool {
+			stack.pc += sBx
+			if a != 0 {
+				self.CloseUpvalues(a)
+			}
+			return false
+		}
+	case OP_EQ, OP_LT, OP_LE: // if ((RK(B) op RK(C)) ~= A) then pc++
+		if f := decodeCompare(proto, i); f != nil {
+			return f
+		}
+	case OP_TEST: // if not (R(A) <=> C) then pc++
+		if isRegs(proto, a) {
+			want := c != 0
+			return func(self *luaState, stack *luaStack) bool {
+				if convertToBoolean(stack.slots[a]) != want {
+					stack.pc++
+				}
+				return false
+			}
+		}
+	case OP_TESTSET: // if (R(B) <=> C) then R(A) := R(B) else pc++
+		if isRegs(proto, a, b) {
+			want := c != 0
+			return func(self *luaState, stack *luaStack) bool {
+				if v := stack.slots[b]; convertToBoolean(v) == want {
+					stack.slots[a] = v
+				} else {
+					stack.pc++
+				}
+				return false
+			}
+		}
+	case OP_CALL: // R(A), ... ,R(A+C-2) := R(A)(R(A+1), ... ,R(A+B-1))
+		if b != 0 && isRegs(proto, a, a+b-1) && (c < 2 || isRegs(proto, a+c-2)) {
+			return decodeCall(i, a, b-1, c-1)
+		}
+	case OP_TAILCALL: // return R(A)(R(A+1), ... ,R(A+B-1))
+		if b != 0 && isRegs(proto, a, a+b-1) {
+			return decodeCall(i, a, b-1, -1)
+		}
+	case OP_RETURN: // return R(A), ... ,R(A+B-2)
+		if b <= 1 || isRegs(proto, a, a+b-2) {
+			return decodeReturn(a, b)
+		}
+	case OP_FORLOOP, OP_FORPREP:
+		if isRegs(proto, a, a+3) {
+			return decodeFor(proto, i)
+		}
+	case OP_TFORCALL: // R(A+3), ... ,R(A+2+C) := R(A)(R(A+1), R(A+2));
+		if isRegs(proto, a, a+2+c) {
+			return func(self *luaState, stack *luaStack) bool {
+				if f, ok := stack.slots[a].(*closure); ok {
+					results := self.runClosure(f, stack.slots[a+1:a+3])
+					moveResults(stack, a+3, c, results)
+				} else {
+					i.Execute(self) // __call元方法
+				}
+				return false
+			}
+		}
+	case OP_TFORLOOP: // if R(A+1) ~= nil then { R(A)=R(A+1); pc += sBx }
+		if isRegs(proto, a, a+1) {
+			_, sBx := i.AsBx()
+			return func(self *luaState, stack *luaStack) bool {
+				if v := stack.slots[a+1]; v != nil {
+					stack.slots[a] = v
+					stack.pc += sBx
+				}
+				return false
+			}
+		}
+	case OP_VARARG: // R(A), R(A+1), ..., R(A+B-2) = vararg
+		if b > 1 && isRegs(proto, a, a+b-2) {
+			return func(self *luaState, stack *luaStack) bool {
+				moveResults(stack, a, b-1, stack.varargs)
+				return false
+			}
+		}
+	}
+	return execInst(i)
+}
+
+// 把n个返回值放到从a开始的寄存器里，多退少补
+func moveResults(stack *luaStack, a, n int, results []luaValue) {
+	for j := 0; j < n; j++ {
+		if j < len(results) {
+			stack.slots[a+j] = results[j]
+		} else {
+			stack.slots[a+j] = nil
+		}
+	}
+}
+
+// 二元算术和位运算，加减乘的两个操作数都是整数时直接计算，其他情况和Arith()一样
+func decodeArith(proto *Prototype, i Instruction) instFunc {
+	a, b, c := i.ABC()
+	bi, bk, ok1 := decodeRK(proto, b)
+	ci, ck, ok2 := decodeRK(proto, c)
+	if !ok1 || !ok2 || !isRegs(proto, a) {
+		return nil
+	}
+	switch op := i.Opcode(); op {
+	case OP_ADD:
+		return func(self *luaState, stack *luaStack) bool {
+			x, y := rk(stack, bi, bk), rk(stack, ci, ck)
+			if m, ok := x.(int64); ok {
+				if n, ok := y.(int64); ok {
+					stack.slots[a] = m + n
+					return false
+				}
+			}
+			stack.slots[a] = self.arith(x, y, LUA_OPADD)
+			return false
+		}
+	case OP_SUB:
+		return func(self *luaState, stack *luaStack) bool {
+			x, y := rk(stack, bi, bk), rk(stack, ci, ck)
+			if m, ok := x.(int64); ok {
+				if n, ok := y.(int64); ok {
+					stack.slots[a] = m - n
+					return false
+				}
+			}
+			stack.slots[a] = self.arith(x, y, LUA_OPSUB)
+			return false
+		}
+	case OP_MUL:
+		return func(self *luaState, stack *luaStack) bool {
+			x, y := rk(stack, bi, bk), rk(stack, ci, ck)
+			if m, ok := x.(int64); ok {
+				if n, ok := y.(int64); ok {
+					stack.slots[a] = m * n
+					return false
+				}
+			}
+			stack.slots[a] = self.arith(x, y, LUA_OPMUL)
+			return false
+		}
+	default:
+		arithOp := ArithOp(op - OP_ADD) // 操作码和运算符的顺序相同
+		return func(self *luaState, stack *luaStack) bool {
+			stack.slots[a] = self.arith(rk(stack, bi, bk), rk(stack, ci, ck), arithOp)
+			return false
+		}
+	}
+}
+
+// 比较指令，结果和A不一致时跳过下一条指令
+func decodeCompare(proto *Prototype, i Instruction) instFunc {
+	a, b, c := i.ABC()
+	bi, bk, ok1 := decodeRK(proto, b)
+	ci, ck, ok2 := decodeRK(proto, c)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	want := a != 0
+	var cmp func(a, b luaValue, ls *luaState) bool
+	switch i.Opcode() {
+	case OP_EQ:
+		cmp = _eq
+	case OP_LT:
+		cmp = _lt
+	default:
+		cmp = _le
+	}
+	return func(self *luaState, stack *luaStack) bool {
+		if cmp(rk(stack, bi, bk), rk(stack, ci, ck), self) != want {
+			stack.pc++
+		}
+		return false
+	}
+}
+
+// 操作数都是字符串或数字时直接拼接，否则和Concat()一样从右向左两两拼接并处理元方法
+func decodeConcat(i Instruction, a, b, c int) instFunc {
+	return func(self *luaState, stack *luaStack) bool {
+		var sb strings.Builder
+		for j := b; j <= c; j++ {
+			switch x := stack.slots[j].(type) {
+			case string:
+				sb.WriteString(x)
+			case int64, float64:
+				sb.WriteString(fmt.Sprintf("%v", x)) // 和ToString()的转换相同
+			default:
+				i.Execute(self)
+				return false
+			}
+		}
+		stack.slots[a] = sb.String()
+		return false
+	}
+}
+
+// 调用R(A)，被调用值是闭包时参数直接从寄存器复制到新的调用帧，返回值直接放到寄存器里；
+// nResults为-1时返回值留在栈顶，再压入a作为标记，和vm.PopResults()相同
+func decodeCall(i Instruction, a, nArgs, nResults int) instFunc {
+	return func(self *luaState, stack *luaStack) bool {
+		f, ok := stack.slots[a].(*closure)
+		if !ok { // __call元方法
+			i.Execute(self)
+			return false
+		}
+		results := self.runClosure(f, stack.slots[a+1:a+1+nArgs])
+		if nResults >= 0 {
+			moveResults(stack, a, nResults, results)
+		} else {
+			stack.check(len(results) + 1)
+			for _, v := range results {
+				stack.push(v)
+			}
+			stack.push(int64(a + 1))
+		}
+		return false
+	}
+}
+
+// 把返回值压入栈顶，b为0时返回值一直到栈顶，然后关闭全部Upvalue和待关闭变量
+func decodeReturn(a, b int) instFunc {
+	return func(self *luaState, stack *luaStack) bool {
+		if b > 1 {
+			stack.check(b - 1)
+			for j := a; j <= a+b-2; j++ {
+				stack.push(stack.slots[j])
+			}
+		} else if b == 0 {
+			FixStack(a+1, self)
+		}
+		if len(stack.openuvs) > 0 || len(stack.tbcs) > 0 {
+			self.CloseUpvalues(1)
+		}
+		return true
+	}
+}
+
+// 数值for循环，初始值、上限和步长都是整数时直接计算，其他情况交给vm包；方言在解码时确定
+func decodeFor(proto *Prototype, i Instruction) instFunc {
+	a, sBx := i.AsBx()
+	is54 := proto.Dialect == LUA_DIALECT_54
+	if i.Opcode() == OP_FORPREP {
+		if is54 { // 只在进入循环时执行一次
+			return execInst(i)
+		}
+		return func(self *luaState, stack *luaStack) bool { // R(A)-=R(A+2); pc+=sBx
+			if init, ok := stack.slots[a].(int64); ok {
+				if step, ok := stack.slots[a+2].(int64); ok {
+					stack.slots[a] = init - step
+					stack.pc += sBx
+					return false
+				}
+			}
+			i.Execute(self)
+			return false
+		}
+	}
+	if is54 { // R(A+1)是剩余的循环次数
+		return func(self *luaState, stack *luaStack) bool {
+			if step, ok := stack.slots[a+2].(int64); ok {
+				if count, ok := stack.slots[a+1].(int64); ok {
+					if idx, ok := stack.slots[a].(int64); ok {
+						if uint64(count) > 0 {
+							stack.slots[a+1] = count - 1
+							v := luaValue(idx + step)
+							stack.slots[a] = v
+							stack.slots[a+3] = v
+							stack.pc += sBx
+						}
+						return false
+					}
+				}
+			}
+			i.Execute(self)
+			return false
+		}
+	}
+	return func(self *luaState, stack *luaStack) bool { // R(A)+=R(A+2); if R(A) <?= R(A+1) then { pc+=sBx; R(A+3)=R(A) }
+		if idx, ok := stack.slots[a].(int64); ok {
+			if limit, ok := stack.slots[a+1].(int64); ok {
+				if step, ok := stack.slots[a+2].(int64); ok {
+					idx += step
+					v := luaValue(idx)
+					stack.slots[a] = v
+					if step >= 0 && idx <= limit || step < 0 && limit <= idx {
+						stack.slots[a+3] = v
+						stack.pc += sBx
+					}
+					return false
+				}
+			}
+		}
+		i.Execute(self)
+		return false
+	}
+}
@@ -14,6 +14,7 @@ type luaStack struct {
 	pc      int
 	state   *luaState
 	openuvs map[int]*upvalue // 存放所有打开的upvalue
+	tbcs    []int            // 待关闭变量所在的寄存器，按照标记的顺序排列
 }
 
 // 创建指定容量的栈
@@ -2,14 +2,24 @@ package state
 
 import (
 	. "lua/src/api"
+	"lua/src/number"
+	"time"
 )
 
 type luaState struct {
-	registry *luaTable // 注册表
-	stack    *luaStack
-	coCaller *luaState // 调用协程的协程
-	coStatus int       // 协程状态
-	coChan   chan int  // 协程通道
+	registry   *luaTable // 注册表
+	stack      *luaStack
+	coCaller   *luaState          // 调用协程的协程
+	coStatus   int                // 协程状态
+	coChan     chan int           // 协程通道
+	coClosing  bool               // 协程正在被coroutine.close关闭
+	coError    luaValue           // 协程出错结束时的错误对象，关闭协程时返回
+	rand       *number.Xoshiro256 // 伪随机数生成器，同一状态的所有线程共享
+	skipVerify bool               // 加载二进制chunk时不校验字节码
+	dialect    byte               // 编译文本chunk使用的语言方言，0表示默认的5.3
+	passes     int                // 编译文本chunk时执行的优化遍，见compiler.OPT_ALL
+	frames     []*luaStack        // 已经返回的Lua调用帧，留给之后的调用复用
+	rets       []luaValue         // Lua函数的返回值，在下一次调用之前有效
 }
 
 // 创建LuaState实例
@@ -21,6 +31,7 @@ func New() LuaState {
 	registry.put(LUA_RIDX_GLOBALS, newLuaTable(0, 20)) // 全局环境
 
 	ls.registry = registry
+	ls.rand = newRandState()
 	ls.pushLuaStack(newLuaStack(LUA_MINSTACK, ls)) // 创建Lua栈
 	return ls
 }
@@ -42,3 +53,15 @@ func (self *luaState) popLuaStack() {
 func (self *luaState) isMainThread() bool {
 	return self.registry.get(LUA_RIDX_MAINTHREAD) == self
 }
+
+// 用当前时间作为种子创建伪随机数生成器
+// lua-5.4.6/src/lmathlib.c#randseed()
+func newRandState() *number.Xoshiro256 {
+	now := time.Now()
+	return number.NewXoshiro256(uint64(now.Unix()), uint64(now.UnixNano()))
+}
+
+// 获取伪随机数生成器，可以用来在Go代码里设置种子
+func (self *luaState) RandState() *number.Xoshiro256 {
+	return self.rand
+}
@@ -13,8 +13,16 @@ type luaTable struct {
 	changed   bool                  // 是否改变
 }
 
+// 预估容量的上限，NEWTABLE指令的B、C操作数最大可以表示约1.6e10，
+// 不可信的二进制chunk用它们让宿主进程在分配内存时崩溃
+const MAX_TABLE_HINT = 1 << 24
+
 // 创建一个空的表，接受两个参数来预估表的用途和容量。
+// 预估的容量超过上限时和luaH_resize()一样报告table overflow
 func newLuaTable(nArr, nRec int) *luaTable {
+	if nArr > MAX_TABLE_HINT || nRec > MAX_TABLE_HINT {
+		panic("table overflow")
+	}
 	t := &luaTable{}
 	// 数组
 	if nArr > 0 {
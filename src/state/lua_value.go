@@ -51,9 +51,9 @@ func convertToInteger(val luaValue) (int64, bool) {
 	case int64:
 		return x, true
 	case float64:
-		return int64(x), true
+		return number.FloatToInteger(x)
 	case string:
-		return number.ParseInteger(x)
+		return number.StringToInteger(x)
 	default:
 		return 0, false
 	}
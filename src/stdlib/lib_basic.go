@@ -1,9 +1,10 @@
 package stdlib
 
+import "bytes"
 import "fmt"
-import "strconv"
 import "strings"
 import . "lua/src/api"
+import . "lua/src/binchunk"
 
 // 24个全局变量 其中22个是函数
 var baseFuncs = map[string]GoFunction{
@@ -42,7 +43,11 @@ func OpenBaseLib(ls LuaState) int {
 	ls.PushValue(-1)
 	ls.SetField(-2, "_G")
 	/* set global _VERSION */
-	ls.PushString("lua 5.3") // todo
+	if ls.Dialect() == LUA_DIALECT_54 {
+		ls.PushString("Lua 5.4")
+	} else {
+		ls.PushString("lua 5.3") // todo
+	}
 	ls.SetField(-2, "_VERSION")
 	return 1
 }
@@ -187,11 +192,46 @@ func baseLoad(ls LuaState) int {
 		chunkname := ls.OptString(2, chunk)
 		status = ls.Load([]byte(chunk), chunkname, mode)
 	} else { /* loading from a reader function */
-		panic("loading from a reader function") // todo
+		chunkname := ls.OptString(2, "=(load)")
+		ls.CheckType(1, LUA_TFUNCTION)
+		if data, ok := genericReader(ls); ok {
+			status = ls.Load(data, chunkname, mode)
+		} else {
+			status = LUA_ERRSYNTAX
+		}
 	}
 	return loadAux(ls, status, env)
 }
 
+// 反复调用reader函数，把返回的片段拼接起来，直到返回nil或空串为止
+// 读取失败时错误信息留在栈顶，返回false
+// lua-5.3.4/src/lbaselib.c#generic_reader()
+func genericReader(ls LuaState) ([]byte, bool) {
+	var buf bytes.Buffer
+	for {
+		ls.CheckStack2(2, "too many nested functions")
+		ls.PushValue(1) /* get function */
+		if ls.PCall(0, 1, 0) != LUA_OK {
+			return nil, false /* error message is on top of the stack */
+		}
+		if ls.IsNil(-1) {
+			ls.Pop(1) /* pop result */
+			break
+		} else if !ls.IsString(-1) {
+			ls.Pop(1)
+			ls.PushString("reader function must return a string")
+			return nil, false
+		}
+		piece := ls.ToString(-1)
+		ls.Pop(1)
+		if piece == "" {
+			break
+		}
+		buf.WriteString(piece)
+	}
+	return buf.Bytes(), true
+}
+
 // lua-5.3.4/src/lbaselib.c#load_aux()
 func loadAux(ls LuaState, status, envIdx int) int {
 	if status == LUA_OK {
@@ -212,7 +252,7 @@ func loadAux(ls LuaState, status, envIdx int) int {
 // lua-5.3.4/src/lbaselib.c#luaB_loadfile()
 func baseLoadFile(ls LuaState) int {
 	fname := ls.OptString(1, "")
-	mode := ls.OptString(1, "bt")
+	mode := ls.OptString(2, "bt")
 	env := 0 /* 'env' index or 0 if no 'env' */
 	if !ls.IsNone(3) {
 		env = 3
@@ -360,11 +400,11 @@ func baseToNumber(ls LuaState) int {
 			}
 		}
 	} else {
+		base := ls.CheckInteger(2)
 		ls.CheckType(1, LUA_TSTRING) /* no numbers as strings */
-		s := strings.TrimSpace(ls.ToString(1))
-		base := int(ls.CheckInteger(2))
+		s := ls.ToString(1)
 		ls.ArgCheck(2 <= base && base <= 36, 2, "base out of range")
-		if n, err := strconv.ParseInt(s, base, 64); err == nil {
+		if n, ok := bStr2Int(s, int(base)); ok {
 			ls.PushInteger(n)
 			return 1
 		} /* else not a number */
@@ -372,3 +412,48 @@ func baseToNumber(ls LuaState) int {
 	ls.PushNil() /* not a number */
 	return 1
 }
+
+// 按指定进制把字符串转换为整数，溢出时回绕
+// lua-5.3.4/src/lbaselib.c#b_str2int()
+func bStr2Int(s string, base int) (int64, bool) {
+	s = strings.TrimLeft(s, " \f\n\r\t\v") /* skip initial spaces */
+	neg := false
+	if len(s) > 0 && s[0] == '-' {
+		s = s[1:]
+		neg = true
+	} else if len(s) > 0 && s[0] == '+' {
+		s = s[1:]
+	}
+	if len(s) == 0 || !isAlnum(s[0]) {
+		return 0, false /* no digit */
+	}
+	var n uint64
+	for len(s) > 0 {
+		var digit int
+		c := s[0]
+		if '0' <= c && c <= '9' {
+			digit = int(c - '0')
+		} else if isAlnum(c) {
+			digit = int(c|0x20-'a') + 10
+		} else {
+			break
+		}
+		if digit >= base {
+			return 0, false /* invalid numeral */
+		}
+		n = n*uint64(base) + uint64(digit)
+		s = s[1:]
+	}
+	s = strings.TrimLeft(s, " \f\n\r\t\v") /* skip trailing spaces */
+	if len(s) > 0 {
+		return 0, false /* invalid trailing characters */
+	}
+	if neg {
+		return int64(0 - n), true
+	}
+	return int64(n), true
+}
+
+func isAlnum(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c|0x20 && c|0x20 <= 'z'
+}
@@ -2,6 +2,7 @@ package stdlib
 
 import (
 	. "lua/src/api"
+	. "lua/src/binchunk"
 )
 
 var coFuncs = map[string]GoFunction{
@@ -16,6 +17,10 @@ var coFuncs = map[string]GoFunction{
 
 func OpenCoroutineLib(ls LuaState) int {
 	ls.NewLib(coFuncs)
+	if ls.Dialect() == LUA_DIALECT_54 { // 5.4新增的函数
+		ls.PushGoFunction(coClose)
+		ls.SetField(-2, "close")
+	}
 	return 1
 }
 
@@ -95,26 +100,51 @@ func coYield(ls LuaState) int {
 func coStatus(ls LuaState) int {
 	co := ls.ToThread(1)
 	ls.ArgCheck(co != nil, 1, "thread expected")
+	ls.PushString(_auxStatus(ls, co))
+	return 1
+}
+
+// 获取协程状态的辅助函数
+// lua-5.4.6/src/lcorolib.c#auxstatus()
+func _auxStatus(ls, co LuaState) string {
 	if ls == co {
-		ls.PushString("running")
-	} else {
-		switch co.Status() {
-		case LUA_YIELD:
-			ls.PushString("suspended")
-		case LUA_OK:
-			if co.GetStack() { /* does it have frames? */
-				ls.PushString("normal") /* it is running */
-			} else if co.GetTop() == 0 {
-				ls.PushString("dead")
-			} else {
-				ls.PushString("suspended")
-			}
-		default: /* some error occurred */
-			ls.PushString("dead")
+		return "running"
+	}
+	switch co.Status() {
+	case LUA_YIELD:
+		return "suspended"
+	case LUA_OK:
+		if co.GetStack() { /* does it have frames? */
+			return "normal" /* it is running */
+		} else if co.GetTop() == 0 {
+			return "dead"
+		} else {
+			return "suspended" /* initial state */
 		}
+	default: /* some error occurred */
+		return "dead"
 	}
+}
 
-	return 1
+// coroutine.close (co)
+// http://www.lua.org/manual/5.4/manual.html#pdf-coroutine.close
+// lua-5.4.6/src/lcorolib.c#luaB_close()
+// 关闭协程(只在5.4方言中提供)
+func coClose(ls LuaState) int {
+	co := ls.ToThread(1)
+	ls.ArgCheck(co != nil, 1, "thread expected")
+	switch status := _auxStatus(ls, co); status {
+	case "dead", "suspended":
+		if co.CloseThread(ls) == LUA_OK {
+			ls.PushBoolean(true)
+			return 1
+		}
+		ls.PushBoolean(false)
+		co.XMove(ls, 1) /* move error message */
+		return 2
+	default: /* normal or running coroutine */
+		return ls.Error2("cannot close a %s coroutine", status)
+	}
 }
 
 // coroutine.isyieldable ()
@@ -5,7 +5,7 @@ import (
 	"lua/src/number"
 	"math"
 )
-import "math/rand"
+import "time"
 
 var mathLib = map[string]GoFunction{
 	"random":     mathRandom,
@@ -56,16 +56,23 @@ func OpenMathLib(ls LuaState) int {
 
 // math.random ([m [, n]])
 // http://www.lua.org/manual/5.3/manual.html#pdf-math.random
-// lua-5.3.4/src/lmathlib.c#math_random()
+// 使用当前状态自己的生成器，math.random(0)返回一个完整的64位随机整数
+// lua-5.4.6/src/lmathlib.c#math_random()
 func mathRandom(ls LuaState) int {
 	var low, up int64
+	g := ls.RandState()
+	rv := g.Next()       /* next pseudo-random value */
 	switch ls.GetTop() { /* check number of arguments */
 	case 0: /* no arguments */
-		ls.PushNumber(rand.Float64()) /* Number between 0 and 1 */
+		ls.PushNumber(number.RandomFloat(rv)) /* Number between 0 and 1 */
 		return 1
 	case 1: /* only upper limit */
 		low = 1
 		up = ls.CheckInteger(1)
+		if up == 0 { /* single 0 as argument? */
+			ls.PushInteger(int64(rv)) /* full random integer */
+			return 1
+		}
 	case 2: /* lower and upper limits */
 		low = ls.CheckInteger(1)
 		up = ls.CheckInteger(2)
@@ -75,23 +82,60 @@ func mathRandom(ls LuaState) int {
 
 	/* random integer in the interval [low, up] */
 	ls.ArgCheck(low <= up, 1, "interval is empty")
-	ls.ArgCheck(low >= 0 || up <= math.MaxInt64+low, 1,
-		"interval too large")
-	if up-low == math.MaxInt64 {
-		ls.PushInteger(low + rand.Int63())
-	} else {
-		ls.PushInteger(low + rand.Int63n(up-low+1))
-	}
+	/* project random integer into the interval [0, up - low] */
+	p := _project(rv, uint64(up)-uint64(low), g)
+	ls.PushInteger(int64(p + uint64(low)))
 	return 1
 }
 
-// math.randomseed (x)
+// 把随机数映射到区间[0, n]，用拒绝采样避免偏差
+// lua-5.4.6/src/lmathlib.c#project()
+func _project(ran, n uint64, g *number.Xoshiro256) uint64 {
+	if n&(n+1) == 0 { /* is 'n + 1' a power of 2? */
+		return ran & n /* no bias */
+	}
+	lim := n
+	/* compute the smallest (2^b - 1) not smaller than n */
+	lim |= lim >> 1
+	lim |= lim >> 2
+	lim |= lim >> 4
+	lim |= lim >> 8
+	lim |= lim >> 16
+	lim |= lim >> 32
+	for ran &= lim; ran > n; ran &= lim { /* project 'ran' into [0, lim] */
+		ran = g.Next() /* not inside [0, n]? Try again */
+	}
+	return ran
+}
+
+// math.randomseed ([x [, y]])
 // http://www.lua.org/manual/5.3/manual.html#pdf-math.randomseed
-// lua-5.3.4/src/lmathlib.c#math_randomseed()
+// 返回实际使用的两个种子，不带参数时用时间重新播种
+// lua-5.4.6/src/lmathlib.c#math_randomseed()
 func mathRandomSeed(ls LuaState) int {
-	x := ls.CheckNumber(1)
-	rand.Seed(int64(x))
-	return 0
+	var n1, n2 int64
+	if ls.IsNone(1) {
+		now := time.Now()
+		n1, n2 = now.Unix(), now.UnixNano()
+	} else {
+		n1 = _seedArg(ls, 1)
+		n2 = 0
+		if !ls.IsNoneOrNil(2) {
+			n2 = _seedArg(ls, 2)
+		}
+	}
+	ls.RandState().Seed(uint64(n1), uint64(n2))
+	ls.PushInteger(n1)
+	ls.PushInteger(n2)
+	return 2
+}
+
+// 种子可以是整数，也可以是浮点数(兼容Lua 5.3的用法)，没有整数表示的浮点数取其二进制位
+func _seedArg(ls LuaState, arg int) int64 {
+	if i, ok := ls.ToIntegerX(arg); ok {
+		return i
+	}
+	return int64(math.Float64bits(ls.CheckNumber(arg)))
 }
 
 /* max & min */
@@ -2,7 +2,8 @@ package stdlib
 
 import (
 	. "lua/src/api"
-	"sort"
+	"math"
+	"time"
 )
 import "strings"
 
@@ -154,9 +155,9 @@ func _checkTab(ls LuaState, arg, what int) {
 	if ls.Type(arg) != LUA_TTABLE { /* is it not a table? */
 		n := 1                     /* number of elements to pop */
 		if ls.GetMetatable(arg) && /* must have metatable */
-			(what&TAB_R != 0 || _checkField(ls, "__index", &n)) &&
-			(what&TAB_W != 0 || _checkField(ls, "__newindex", &n)) &&
-			(what&TAB_L != 0 || _checkField(ls, "__len", &n)) {
+			(what&TAB_R == 0 || _checkField(ls, "__index", &n)) &&
+			(what&TAB_W == 0 || _checkField(ls, "__newindex", &n)) &&
+			(what&TAB_L == 0 || _checkField(ls, "__len", &n)) {
 			ls.Pop(n) /* pop metatable and tested metamethods */
 		} else {
 			ls.CheckType(arg, LUA_TTABLE) /* force an error */
@@ -211,46 +212,199 @@ func tabUnpack(ls LuaState) int {
 
 /* sort */
 
+const RANLIMIT = 100 /* 区间长度超过这个值时才随机选择基准 */
+
+// 排序过程中对数组的访问(下标从1开始)
+type sortArray interface {
+	less(i, j int) bool // a[i] < a[j]
+	swap(i, j int)      // 交换a[i]和a[j]
+}
+
 // table.sort (list [, comp])
 // http://www.lua.org/manual/5.3/manual.html#pdf-table.sort
+// lua-5.3.4/src/ltablib.c#sort()
 func tabSort(ls LuaState) int {
-	w := wrapper{ls}
-	ls.ArgCheck(w.Len() < MAX_LEN, 1, "array too big")
-	sort.Sort(w)
+	n := _auxGetN(ls, 1, TAB_RW)
+	if n > 1 { /* non-trivial interval? */
+		ls.ArgCheck(n < math.MaxInt32, 1, "array too big")
+		if !ls.IsNoneOrNil(2) { /* is there a 2nd argument? */
+			ls.CheckType(2, LUA_TFUNCTION) /* must be a function */
+		}
+		ls.SetTop(2) /* make sure there are two arguments */
+		if ls.Type(1) == LUA_TTABLE && !_hasMetatable(ls, 1) {
+			_sortSnapshot(ls, int(n))
+		} else {
+			_auxSort(ls, tableArray{ls}, 1, int(n), 0)
+		}
+	}
 	return 0
 }
 
-type wrapper struct {
+// 没有元方法的表可以先把元素复制到栈上，排序完成后再一次性写回
+// 比较器出错时表保持原样
+func _sortSnapshot(ls LuaState, n int) {
+	ls.CheckStack2(n+LUA_MINSTACK, "array too big")
+	base := ls.GetTop() + 1
+	for i := 1; i <= n; i++ {
+		ls.RawGetI(1, int64(i))
+	}
+	a := snapshotArray{ls, base, make([]int, n)}
+	for i := range a.perm {
+		a.perm[i] = base + i
+	}
+	_auxSort(ls, a, 1, n, 0)
+	for i, idx := range a.perm { /* write sorted elements back */
+		ls.PushValue(idx)
+		ls.SetI(1, int64(i+1))
+	}
+	ls.SetTop(base - 1)
+}
+
+func _hasMetatable(ls LuaState, idx int) bool {
+	if ls.GetMetatable(idx) {
+		ls.Pop(1)
+		return true
+	}
+	return false
+}
+
+// 直接通过GetI/SetI操作表(或类似表的对象)
+type tableArray struct {
 	ls LuaState
 }
 
-func (self wrapper) Len() int {
-	return int(self.ls.Len2(1))
+func (self tableArray) less(i, j int) bool {
+	ls := self.ls
+	ls.GetI(1, int64(i))
+	ls.GetI(1, int64(j))
+	b := _sortComp(ls, -2, -1)
+	ls.Pop(2)
+	return b
 }
 
-func (self wrapper) Less(i, j int) bool {
+func (self tableArray) swap(i, j int) {
 	ls := self.ls
-	if ls.IsFunction(2) { // cmp is given
-		ls.PushValue(2)
-		ls.GetI(1, int64(i+1))
-		ls.GetI(1, int64(j+1))
-		ls.Call(2, 1)
-		b := ls.ToBoolean(-1)
-		ls.Pop(1)
-		return b
-	} else { // cmp is missing
-		ls.GetI(1, int64(i+1))
-		ls.GetI(1, int64(j+1))
-		b := ls.Compare(-2, -1, LUA_OPLT)
-		ls.Pop(2)
-		return b
+	ls.GetI(1, int64(i))
+	ls.GetI(1, int64(j))
+	ls.SetI(1, int64(i)) /* t[i] = value of t[j] */
+	ls.SetI(1, int64(j)) /* t[j] = value of t[i] */
+}
+
+// 在栈上的快照里排序，只交换栈索引，不移动值
+type snapshotArray struct {
+	ls   LuaState
+	base int   /* 快照在栈上的起始索引 */
+	perm []int /* perm[i-1]是a[i]所在的栈索引 */
+}
+
+func (self snapshotArray) less(i, j int) bool {
+	return _sortComp(self.ls, self.perm[i-1], self.perm[j-1])
+}
+
+func (self snapshotArray) swap(i, j int) {
+	self.perm[i-1], self.perm[j-1] = self.perm[j-1], self.perm[i-1]
+}
+
+// 用比较函数或'<'比较栈上的两个值
+// lua-5.3.4/src/ltablib.c#sort_comp()
+func _sortComp(ls LuaState, a, b int) bool {
+	if ls.IsNil(2) { /* no function? */
+		return ls.Compare(a, b, LUA_OPLT) /* a < b */
 	}
+	a, b = ls.AbsIndex(a), ls.AbsIndex(b)
+	ls.PushValue(2) /* push function */
+	ls.PushValue(a) /* 1st arg */
+	ls.PushValue(b) /* 2nd arg */
+	ls.Call(2, 1)   /* call function */
+	res := ls.ToBoolean(-1)
+	ls.Pop(1)
+	return res
 }
 
-func (self wrapper) Swap(i, j int) {
-	ls := self.ls
-	ls.GetI(1, int64(i+1))
-	ls.GetI(1, int64(j+1))
-	ls.SetI(1, int64(i+1))
-	ls.SetI(1, int64(j+1))
+// 把区间[lo, up]分成a[lo .. p-1] <= P == a[p] <= a[p+1 .. up]两部分
+// 调用前基准值P已经放在a[up-1]，并且a[lo] <= P <= a[up]
+// lua-5.3.4/src/ltablib.c#partition()
+func _partition(ls LuaState, a sortArray, lo, up int) int {
+	i := lo     /* will be incremented before first use */
+	j := up - 1 /* will be decremented before first use */
+	/* loop invariant: a[lo .. i] <= P <= a[j .. up], a[up - 1] == P */
+	for {
+		/* next loop: repeat ++i while a[i] < P */
+		for i++; a.less(i, up-1); i++ {
+			if i == up-1 { /* a[i] < P  but a[up - 1] == P  ?? */
+				ls.Error2("invalid order function for sorting")
+			}
+		}
+		/* after the loop, a[i] >= P and a[lo .. i - 1] < P */
+		/* next loop: repeat --j while P < a[j] */
+		for j--; a.less(up-1, j); j-- {
+			if j < i { /* j < i  but  a[j] > P ?? */
+				ls.Error2("invalid order function for sorting")
+			}
+		}
+		/* after the loop, a[j] <= P and a[j + 1 .. up] >= P */
+		if j < i { /* no elements to be exchanged? */
+			/* swap pivot (a[up - 1]) with a[i] to satisfy pred. */
+			a.swap(up-1, i)
+			return i
+		}
+		/* otherwise, swap a[i] - a[j] to restore invariant and repeat */
+		a.swap(i, j)
+	}
+}
+
+// 在区间[lo + (up-lo)/4, up - (up-lo)/4]中选择一个基准
+// lua-5.3.4/src/ltablib.c#choosePivot()
+func _choosePivot(lo, up int, rnd uint) int {
+	r4 := (up - lo) / 4 /* range/4 */
+	return int(rnd%uint(r4*2)) + (lo + r4)
+}
+
+// lua-5.3.4/src/ltablib.c#l_randomizePivot()
+func _randomizePivot() uint {
+	t := time.Now()
+	return uint(t.UnixNano()) + uint(t.Unix())
+}
+
+// lua-5.3.4/src/ltablib.c#auxsort()
+func _auxSort(ls LuaState, a sortArray, lo, up int, rnd uint) {
+	for lo < up { /* loop for tail recursion */
+		/* sort elements 'lo', 'p', and 'up' */
+		if a.less(up, lo) { /* a[up] < a[lo]? */
+			a.swap(lo, up)
+		}
+		if up-lo == 1 { /* only 2 elements? */
+			break /* already sorted */
+		}
+		var p int                         /* Pivot index */
+		if up-lo < RANLIMIT || rnd == 0 { /* small interval or no randomize? */
+			p = (lo + up) / 2 /* middle element is a good pivot */
+		} else { /* for larger intervals, it is expensive to compute something random */
+			p = _choosePivot(lo, up, rnd)
+		}
+		if a.less(p, lo) { /* a[p] < a[lo]? */
+			a.swap(p, lo)
+		} else if a.less(up, p) { /* a[up] < a[p]? */
+			a.swap(p, up)
+		}
+		if up-lo == 2 { /* only 3 elements? */
+			break /* already sorted */
+		}
+		a.swap(p, up-1) /* a[up - 1] = Pivot */
+		p = _partition(ls, a, lo, up)
+		var n int /* size of smaller interval */
+		/* a[lo .. p - 1] <= a[p] == P <= a[p + 1 .. up] */
+		if p-lo < up-p { /* lower interval is shorter? */
+			_auxSort(ls, a, lo, p-1, rnd) /* call recursively for lower interval */
+			n = p - lo
+			lo = p + 1 /* tail call for [p + 1 .. up] (upper interval) */
+		} else {
+			_auxSort(ls, a, p+1, up, rnd) /* call recursively for upper interval */
+			n = up - p
+			up = p - 1 /* tail call for [lo .. p - 1]  (lower interval) */
+		}
+		if (up-lo)/128 > n { /* partition too imbalanced? */
+			rnd = _randomizePivot() /* try a new randomization */
+		}
+	}
 }
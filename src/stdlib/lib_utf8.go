@@ -2,13 +2,14 @@ package stdlib
 
 import (
 	. "lua/src/api"
-	"unicode/utf8"
+	. "lua/src/binchunk"
 )
 
 /* pattern to match a single UTF-8 character */
 const UTF8PATT = "[\x00-\x7F\xC2-\xF4][\x80-\xBF]*"
 
 const MAX_UNICODE = 0x10FFFF
+const MAX_UTF = 0x7FFFFFFF /* lax模式下允许的最大编码(Lua 5.4) */
 
 var utf8Lib = map[string]GoFunction{
 	"len":       utfLen,
@@ -27,31 +28,73 @@ func OpenUTF8Lib(ls LuaState) int {
 	return 1
 }
 
-// utf8.len (s [, i [, j]])
+// 解码s[i:]开头的一个UTF-8字符，返回编码和字符占用的字节数，非法序列返回的字节数为0
+// strict为true时拒绝代理项和超过MAX_UNICODE的编码，否则接受最长6字节、最大2^31-1的编码
+// lua-5.4.6/src/lutf8lib.c#utf8_decode()
+func _utf8Decode(s string, i int, strict bool) (rune, int) {
+	limits := [...]uint32{^uint32(0), 0x80, 0x800, 0x10000, 0x200000, 0x4000000}
+	c := uint32(s[i])
+	var res uint32 /* final result */
+	count := 0     /* to count number of continuation bytes */
+	if c < 0x80 {  /* ascii? */
+		res = c
+	} else {
+		for ; c&0x40 != 0; c <<= 1 { /* while it needs continuation bytes... */
+			count++
+			if i+count >= len(s) || !_isCont(s[i+count]) { /* not a continuation byte? */
+				return 0, 0 /* invalid byte sequence */
+			}
+			res = res<<6 | uint32(s[i+count]&0x3F) /* add lower 6 bits from cont. byte */
+		}
+		if count > 5 { /* too many continuation bytes */
+			return 0, 0
+		}
+		res |= (c & 0x7F) << (count * 5) /* add first byte */
+		if res > MAX_UTF || res < limits[count] {
+			return 0, 0 /* invalid byte sequence */
+		}
+	}
+	if strict {
+		/* check for invalid code points; too large or surrogates */
+		if res > MAX_UNICODE || (0xD800 <= res && res <= 0xDFFF) {
+			return 0, 0
+		}
+	}
+	return rune(res), count + 1
+}
+
+// utf8.len (s [, i [, j [, lax]]])
 // http://www.lua.org/manual/5.3/manual.html#pdf-utf8.len
-// lua-5.3.4/src/lutf8lib.c#utflen()
+// 遇到非法字节序列时返回nil和该序列的位置
+// lua-5.4.6/src/lutf8lib.c#utflen()
 func utfLen(ls LuaState) int {
 	s := ls.CheckString(1)
 	sLen := len(s)
 	i := posRelat(ls.OptInteger(2, 1), sLen)
 	j := posRelat(ls.OptInteger(3, -1), sLen)
+	lax := ls.ToBoolean(4)
 	ls.ArgCheck(1 <= i && i <= sLen+1, 2,
 		"initial position out of string")
 	ls.ArgCheck(j <= sLen, 3,
 		"final position out of string")
 
-	if i > j {
-		ls.PushInteger(0)
-	} else {
-		n := utf8.RuneCountInString(s[i-1 : j])
-		ls.PushInteger(int64(n))
+	n := 0
+	for i--; i < j; n++ {
+		_, size := _utf8Decode(s, i, !lax)
+		if size == 0 { /* conversion error? */
+			ls.PushNil()                 /* return nil ... */
+			ls.PushInteger(int64(i + 1)) /* ... and current position */
+			return 2
+		}
+		i += size
 	}
-
+	ls.PushInteger(int64(n))
 	return 1
 }
 
 // utf8.offset (s, n [, i])
 // http://www.lua.org/manual/5.3/manual.html#pdf-utf8.offset
+// lua-5.3.4/src/lutf8lib.c#byteoffset()
 func utfByteOffset(ls LuaState) int {
 	s := ls.CheckString(1)
 	sLen := len(s)
@@ -66,18 +109,18 @@ func utfByteOffset(ls LuaState) int {
 
 	if n == 0 {
 		/* find beginning of current byte sequence */
-		for i > 0 && _isCont(s[i]) {
+		for i > 0 && _isContAt(s, i) {
 			i--
 		}
 	} else {
-		if i < sLen && _isCont(s[i]) {
+		if _isContAt(s, i) {
 			ls.Error2("initial position is a continuation byte")
 		}
 		if n < 0 {
 			for n < 0 && i > 0 { /* move back */
 				for { /* find beginning of previous character */
 					i--
-					if !(i > 0 && _isCont(s[i])) {
+					if !(i > 0 && _isContAt(s, i)) {
 						break
 					}
 				}
@@ -88,7 +131,7 @@ func utfByteOffset(ls LuaState) int {
 			for n > 0 && i < sLen {
 				for { /* find beginning of next character */
 					i++
-					if i >= sLen || !_isCont(s[i]) {
+					if !_isContAt(s, i) {
 						break /* (cannot pass final '\0') */
 					}
 				}
@@ -104,81 +147,108 @@ func utfByteOffset(ls LuaState) int {
 	return 1
 }
 
-// utf8.codepoint (s [, i [, j]])
+// utf8.codepoint (s [, i [, j [, lax]]])
 // http://www.lua.org/manual/5.3/manual.html#pdf-utf8.codepoint
-// lua-5.3.4/src/lutf8lib.c#codepoint()
+// lua-5.4.6/src/lutf8lib.c#codepoint()
 func utfCodePoint(ls LuaState) int {
 	s := ls.CheckString(1)
 	sLen := len(s)
 	i := posRelat(ls.OptInteger(2, 1), sLen)
 	j := posRelat(ls.OptInteger(3, int64(i)), sLen)
+	lax := ls.ToBoolean(4)
 
 	ls.ArgCheck(i >= 1, 2, "out of range")
-	ls.ArgCheck(int(j) <= sLen, 3, "out of range")
+	ls.ArgCheck(j <= sLen, 3, "out of range")
 	if i > j {
 		return 0 /* empty interval; return no values */
 	}
 	if j-i >= LUA_MAXINTEGER { /* (lua_Integer -> int) overflow? */
 		return ls.Error2("string slice too long")
 	}
-	n := j - i + 1
-	ls.CheckStack2(n, "string slice too long")
+	ls.CheckStack2(j-i+1, "string slice too long")
 
-	n = 0
-	s = s[i-1:]
-	for i <= j {
-		code, size := utf8.DecodeRuneInString(s)
-		if code == utf8.RuneError {
+	n := 0
+	for i--; i < j; n++ {
+		code, size := _utf8Decode(s, i, !lax)
+		if size == 0 {
 			return ls.Error2("invalid UTF-8 code")
 		}
 		ls.PushInteger(int64(code))
-		n++
 		i += size
-		s = s[size:]
 	}
 	return n
 }
 
 // utf8.char (···)
 // http://www.lua.org/manual/5.3/manual.html#pdf-utf8.char
+// 5.4方言和lua-5.4.6一样接受不超过MAX_UTF的编码
 // lua-5.3.4/src/lutf8lib.c#utfchar()
 func utfChar(ls LuaState) int {
 	n := ls.GetTop() /* number of arguments */
-	codePoints := make([]rune, n)
+	buf := make([]byte, 0, n)
+	max := int64(MAX_UNICODE)
+	if ls.Dialect() == LUA_DIALECT_54 {
+		max = MAX_UTF
+	}
 
 	for i := 1; i <= n; i++ {
 		cp := ls.CheckInteger(i)
-		ls.ArgCheck(0 <= cp && cp <= MAX_UNICODE, i, "value out of range")
-		codePoints[i-1] = rune(cp)
+		ls.ArgCheck(0 <= cp && cp <= max, i, "value out of range")
+		buf = _utf8Esc(buf, uint32(cp))
 	}
 
-	ls.PushString(_encodeUtf8(codePoints))
+	ls.PushString(string(buf))
 	return 1
 }
 
-func _encodeUtf8(codePoints []rune) string {
-	buf := make([]byte, 6)
-	str := make([]byte, 0, len(codePoints))
-
-	for _, cp := range codePoints {
-		n := utf8.EncodeRune(buf, cp)
-		str = append(str, buf[0:n]...)
+// 把编码x按UTF-8追加到buf中，与unicode/utf8不同，代理项会按原样编码
+// lua-5.3.4/src/lobject.c#luaO_utf8esc()
+func _utf8Esc(buf []byte, x uint32) []byte {
+	if x < 0x80 { /* ascii? */
+		return append(buf, byte(x))
 	}
-
-	return string(str)
+	var tmp [8]byte
+	n := len(tmp)
+	mfb := uint32(0x3f) /* maximum that fits in first byte */
+	for {               /* add continuation bytes */
+		n--
+		tmp[n] = byte(0x80 | (x & 0x3f))
+		x >>= 6       /* remove added bits */
+		mfb >>= 1     /* now there is one less bit available in first byte */
+		if x <= mfb { /* still needs continuation byte? */
+			break
+		}
+	}
+	n--
+	tmp[n] = byte((^mfb << 1) | x) /* add first byte */
+	return append(buf, tmp[n:]...)
 }
 
-// utf8.codes (s)
+// utf8.codes (s [, lax])
 // http://www.lua.org/manual/5.3/manual.html#pdf-utf8.codes
+// lua-5.3.4/src/lutf8lib.c#iter_codes()
 func utfIterCodes(ls LuaState) int {
 	ls.CheckString(1)
-	ls.PushGoFunction(_iterAux)
+	if ls.ToBoolean(2) {
+		ls.PushGoFunction(_iterAuxLax)
+	} else {
+		ls.PushGoFunction(_iterAuxStrict)
+	}
 	ls.PushValue(1)
 	ls.PushInteger(0)
 	return 3
 }
 
-func _iterAux(ls LuaState) int {
+func _iterAuxStrict(ls LuaState) int {
+	return _iterAux(ls, true)
+}
+
+func _iterAuxLax(ls LuaState) int {
+	return _iterAux(ls, false)
+}
+
+// lua-5.3.4/src/lutf8lib.c#iter_aux()
+func _iterAux(ls LuaState, strict bool) int {
 	s := ls.CheckString(1)
 	sLen := int64(len(s))
 	n := ls.ToInteger(2) - 1
@@ -193,8 +263,8 @@ func _iterAux(ls LuaState) int {
 	if n >= sLen {
 		return 0 /* no more codepoints */
 	} else {
-		code, _ := utf8.DecodeRuneInString(s[n:])
-		if code == utf8.RuneError {
+		code, size := _utf8Decode(s, int(n), strict)
+		if size == 0 || _isContAt(s, int(n)+size) { /* 字符后面不能紧跟着后续字节 */
 			return ls.Error2("invalid UTF-8 code")
 		}
 		ls.PushInteger(n + 1)
@@ -206,3 +276,8 @@ func _iterAux(ls LuaState) int {
 func _isCont(b byte) bool {
 	return b&0xC0 == 0x80
 }
+
+// 越过字符串末尾时相当于C字符串结尾的'\0'，不是后续字节
+func _isContAt(s string, i int) bool {
+	return i < len(s) && _isCont(s[i])
+}
@@ -20,13 +20,14 @@ func call(i Instruction, vm api.LuaVM) {
 	a, b, c := i.ABC()
 	a += 1
 
-	nArgs := _pushFuncAndArgs(a, b, vm) // 把参数和函数压入栈顶
-	vm.Call(nArgs, c-1)                 // 调用函数
-	_popResults(a, c, vm)               // 弹出返回值
+	nArgs := PushFuncAndArgs(a, b, vm) // 把参数和函数压入栈顶
+	vm.Call(nArgs, c-1)                // 调用函数
+	PopResults(a, c, vm)               // 弹出返回值
 }
 
-// 把参数和函数压入栈顶
-func _pushFuncAndArgs(a, b int, vm api.LuaVM) int {
+// 把函数和参数压入栈顶，b为0时参数一直到栈顶(前一个调用的全部返回值)，返回参数个数
+// 解释器和luaaot生成的Go代码共用下面几个函数，保证两者的行为一致
+func PushFuncAndArgs(a, b int, vm api.LuaVM) int {
 	if b >= 1 {
 		// b-1个参数
 		vm.CheckStack(b)
@@ -36,12 +37,13 @@ func _pushFuncAndArgs(a, b int, vm api.LuaVM) int {
 		return b - 1 // 除去函数外的参数个数
 	} else {
 		// 这种情况是要求把所有参数压入栈顶
-		_fixStack(a, vm)                            // 把参数压入栈顶
+		FixStack(a, vm)                             // 把参数压入栈顶
 		return vm.GetTop() - vm.RegisterCount() - 1 // 除去函数外的参数个数
 	}
 }
 
-func _popResults(a, c int, vm api.LuaVM) {
+// 把栈顶的c-1个返回值放到从a开始的寄存器里，c为0时返回值留在栈顶，再压入a作为标记
+func PopResults(a, c int, vm api.LuaVM) {
 	if c == 1 {
 		// 无返回值
 	} else if c > 1 {
@@ -59,7 +61,8 @@ func _popResults(a, c int, vm api.LuaVM) {
 	}
 }
 
-func _fixStack(a int, vm api.LuaVM) {
+// 把从a开始到标记为止的寄存器和栈顶留下的值接在一起，放到栈顶
+func FixStack(a int, vm api.LuaVM) {
 	x := int(vm.ToInteger(-1)) // 取出最后的整数
 	vm.Pop(1)                  // 弹出标记
 
@@ -84,8 +87,9 @@ func _return(i Instruction, vm api.LuaVM) {
 		}
 	} else {
 		// 如果有部分返回值已经在栈中，只需要返回一部分
-		_fixStack(a, vm)
+		FixStack(a, vm)
 	}
+	vm.CloseUpvalues(1) // 返回值已经准备好，关闭全部待关闭变量
 }
 
 // 把传递给当前函数的变长参数加载到连续多个寄存器中
@@ -97,7 +101,7 @@ func vararg(i Instruction, vm api.LuaVM) {
 		// 把变长参数压入栈顶
 		vm.LoadVararg(b - 1)
 		// 把变长参数从栈顶移动到连续多个寄存器中
-		_popResults(a, b, vm)
+		PopResults(a, b, vm)
 	}
 }
 
@@ -107,9 +111,9 @@ func tailCall(i Instruction, vm api.LuaVM) {
 	a += 1
 
 	c := 0
-	nArgs := _pushFuncAndArgs(a, b, vm) // 把参数和函数压入栈顶
-	vm.Call(nArgs, c-1)                 // 调用函数
-	_popResults(a, c, vm)               // 弹出返回值
+	nArgs := PushFuncAndArgs(a, b, vm) // 把参数和函数压入栈顶
+	vm.Call(nArgs, c-1)                // 调用函数
+	PopResults(a, c, vm)               // 弹出返回值
 }
 
 // SELF指令 用来优化语法糖，把对象和方法拷贝到连续的两个寄存器中，这样在调用方法时就不需要再次拷贝了(节约一条指令)
@@ -129,7 +133,7 @@ func tForCall(i Instruction, vm api.LuaVM) {
 	a, _, c := i.ABC()
 	a += 1
 
-	_pushFuncAndArgs(a, 3, vm) // 把函数和参数压入栈顶
-	vm.Call(2, c)              // 调用函数
-	_popResults(a+3, c+1, vm)  // 弹出返回值
+	PushFuncAndArgs(a, 3, vm) // 把函数和参数压入栈顶
+	vm.Call(2, c)             // 调用函数
+	PopResults(a+3, c+1, vm)  // 弹出返回值
 }
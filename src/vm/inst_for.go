@@ -2,11 +2,20 @@ package vm
 
 import (
 	. "lua/src/api"
+	. "lua/src/binchunk"
+	. "lua/src/number"
+	"math"
 )
 
 func forPrep(i Instruction, vm LuaVM) {
 	a, sBx := i.AsBx()
 	a += 1
+	if vm.FuncDialect() == LUA_DIALECT_54 {
+		if !ForPrep54(a, vm) { // 不进入循环时跳过FORLOOP
+			vm.AddPC(sBx + 1)
+		}
+		return
+	}
 	// R(A) -= R(A+2) 预先减去步长
 	vm.PushValue(a)
 	vm.PushValue(a + 2)
@@ -19,6 +28,19 @@ func forPrep(i Instruction, vm LuaVM) {
 func forLoop(i Instruction, vm LuaVM) {
 	a, sBx := i.AsBx()
 	a += 1
+	jump := false
+	if vm.FuncDialect() == LUA_DIALECT_54 {
+		jump = ForLoop54(a, vm)
+	} else {
+		jump = ForLoop(a, vm)
+	}
+	if jump {
+		vm.AddPC(sBx)
+	}
+}
+
+// 5.3的FORLOOP：R(A) += R(A+2)，没有越过上限时把R(A)复制到控制变量，返回true表示继续循环
+func ForLoop(a int, vm LuaVM) bool {
 	vm.PushValue(a + 2) // R(A+2)
 	vm.PushValue(a)     // R(A)
 	vm.Arith(LUA_OPADD) // R(A) += R(A+2)
@@ -27,9 +49,10 @@ func forLoop(i Instruction, vm LuaVM) {
 	isPositiveStep := vm.ToNumber(a+2) >= 0
 	if isPositiveStep && vm.Compare(a, a+1, LUA_OPLE) ||
 		!isPositiveStep && vm.Compare(a+1, a, LUA_OPLE) {
-		vm.AddPC(sBx)
 		vm.Copy(a, a+3)
+		return true
 	}
+	return false
 }
 
 func tForLoop(i Instruction, vm LuaVM) {
@@ -41,3 +64,122 @@ func tForLoop(i Instruction, vm LuaVM) {
 		vm.AddPC(sBx)
 	}
 }
+
+// 5.4的数值for循环：初始值和步长都是整数时，FORPREP预先算出循环次数放进R(A+1)，
+// FORLOOP按次数循环，不会因为整数溢出而死循环；否则全部转换成浮点数。
+// 指令布局和5.3相同(FORPREP跳到FORLOOP)，所以进入循环时FORPREP直接执行循环体，
+// 不进入循环时跳过FORLOOP。返回false表示循环一次也不执行
+// lua-5.4.6/src/lvm.c#forprep()
+func ForPrep54(a int, vm LuaVM) bool {
+	if vm.IsInteger(a) && vm.IsInteger(a+2) { // 整数循环
+		init := vm.ToInteger(a)
+		step := vm.ToInteger(a + 2)
+		if step == 0 {
+			panic("'for' step is zero")
+		}
+		limit, skip := forLimit(vm, a+1, init, step)
+		if skip {
+			return false
+		}
+		// 循环次数(不含第一次)，用无符号数计算避免溢出
+		var count uint64
+		if step > 0 {
+			count = uint64(limit) - uint64(init)
+			if step != 1 {
+				count /= uint64(step)
+			}
+		} else {
+			count = uint64(init) - uint64(limit)
+			count /= uint64(-(step + 1)) + 1 // 避免对最小整数取负
+		}
+		vm.PushInteger(int64(count))
+		vm.Replace(a + 1)
+	} else { // 浮点数循环
+		limit := forNumber(vm, a+1, "limit")
+		step := forNumber(vm, a+2, "step")
+		init := forNumber(vm, a, "initial value")
+		if step == 0 {
+			panic("'for' step is zero")
+		}
+		if step > 0 && limit < init || step < 0 && init < limit {
+			return false
+		}
+		vm.PushNumber(limit)
+		vm.Replace(a + 1)
+		vm.PushNumber(step)
+		vm.Replace(a + 2)
+		vm.PushNumber(init)
+		vm.Replace(a)
+	}
+	vm.Copy(a, a+3) // 控制变量
+	return true
+}
+
+// 返回true表示继续循环
+// lua-5.4.6/src/lvm.c#OP_FORLOOP
+func ForLoop54(a int, vm LuaVM) bool {
+	if vm.IsInteger(a + 2) { // 整数循环
+		count := uint64(vm.ToInteger(a + 1))
+		if count > 0 {
+			vm.PushInteger(int64(count - 1))
+			vm.Replace(a + 1)
+			vm.PushInteger(vm.ToInteger(a) + vm.ToInteger(a+2)) // 允许回绕
+			vm.Replace(a)
+			vm.Copy(a, a+3)
+			return true
+		}
+	} else { // 浮点数循环
+		step := vm.ToNumber(a + 2)
+		limit := vm.ToNumber(a + 1)
+		idx := vm.ToNumber(a) + step
+		if step > 0 && idx <= limit || step <= 0 && limit <= idx {
+			vm.PushNumber(idx)
+			vm.Replace(a)
+			vm.Copy(a, a+3)
+			return true
+		}
+	}
+	return false
+}
+
+// 把循环上限转换成整数，浮点数按步长的方向取整，超出整数范围时截断；
+// 第二个返回值为true表示循环一次也不执行
+// lua-5.4.6/src/lvm.c#forlimit()
+func forLimit(vm LuaVM, idx int, init, step int64) (limit int64, skip bool) {
+	if n, ok := vm.ToIntegerX(idx); ok && vm.IsInteger(idx) {
+		limit = n
+	} else {
+		f := forNumber(vm, idx, "limit")
+		if step < 0 {
+			f = math.Ceil(f)
+		} else {
+			f = math.Floor(f)
+		}
+		if n, ok := FloatToInteger(f); ok {
+			limit = n
+		} else if f > 0 { // 太大
+			if step < 0 {
+				return 0, true
+			}
+			limit = math.MaxInt64
+		} else { // 太小(或者NaN)
+			if step > 0 {
+				return 0, true
+			}
+			limit = math.MinInt64
+		}
+	}
+	if step > 0 {
+		return limit, init > limit
+	}
+	return limit, init < limit
+}
+
+// 把for循环的初始值、上限或步长转换成浮点数
+func forNumber(vm LuaVM, idx int, what string) float64 {
+	n, ok := vm.ToNumberX(idx)
+	if !ok {
+		panic("'for' " + what + " must be a number")
+	}
+	return n
+}
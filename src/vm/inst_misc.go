@@ -13,7 +13,7 @@ func move(i Instruction, vm api.LuaVM) {
 	vm.Copy(b, a)
 }
 
-// jmp指令负责无条件跳转和闭合处于开启状态的Upvalue
+// jmp指令负责无条件跳转和闭合处于开启状态的Upvalue，同时关闭这些寄存器中的待关闭变量
 // pc += sBx; if (A) close all upvalues >= R(A - 1)
 func jmp(i Instruction, vm api.LuaVM) {
 	a, sBx := i.AsBx()
@@ -22,3 +22,10 @@ func jmp(i Instruction, vm api.LuaVM) {
 		vm.CloseUpvalues(a)
 	}
 }
+
+// 把寄存器标记为待关闭变量(5.4)，离开作用域时(JMP或RETURN关闭它，出错时由PCall关闭)调用它的__close元方法
+// mark R(A) as to-be-closed
+func tbc(i Instruction, vm api.LuaVM) {
+	a, _, _ := i.ABC()
+	vm.ToClose(a + 1)
+}
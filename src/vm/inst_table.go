@@ -66,20 +66,22 @@ func setTable(i Instruction, vm api.LuaVM) {
 // 如果还不够，会在SETLIST指令后面添加一个EXTRAARG指令，用其Ax操作数来保存批次数
 func setList(i Instruction, vm api.LuaVM) {
 	a, b, c := i.ABC()
-	a += 1
+	if c == 0 { // C放不下时在下一条EXTRAARG指令里，和C一样从1开始
+		c = Instruction(vm.Fetch()).Ax()
+	}
+	SetList(a+1, b, c, vm)
+}
+
+// 把从a+1开始的b个寄存器依次放到表R(a)里，c是从1开始的批次数，b为0时一直放到栈顶
+func SetList(a, b, c int, vm api.LuaVM) {
 	bIsZero := b == 0
 	if bIsZero { // 如果b为0，表示要收集所有的值
 		b = int(vm.ToInteger(-1)) - a - 1
 		vm.Pop(1)
 	}
-	if c > 0 {
-		c = c - 1
-	} else {
-		c = Instruction(vm.Fetch()).Ax()
-	}
 
 	vm.CheckStack(1)
-	idx := int64(c * LFIELDS_PER_FLUSH)
+	idx := int64((c - 1) * LFIELDS_PER_FLUSH)
 	for j := 1; j <= b; j++ {
 		idx++
 		vm.PushValue(a + j)
@@ -9,6 +9,9 @@ type Instruction uint32
 
 const MAXARG_Bx = 1<<18 - 1       // 262143
 const MAXARG_sBx = MAXARG_Bx >> 1 // 262143 / 2 = 131071
+const MAXARG_C = 1<<9 - 1         // 511
+const MAXARG_Ax = 1<<26 - 1       // 67108863
+
 // 定义从指令中提取操作码的方法
 func (self Instruction) Opcode() int {
 	return int(self & 0x3F)
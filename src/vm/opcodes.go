@@ -61,6 +61,7 @@ const (
 	OP_CLOSURE
 	OP_VARARG
 	OP_EXTRAARG
+	OP_TBC // 5.4方言新增，只出现在5.4方言编译的(扩展格式的)chunk中
 )
 
 // 操作数
@@ -132,4 +133,5 @@ var opcodes = []opcode{
 	opcode{0, 1, OpArgU, OpArgN, IABx /* */, "CLOSURE ", closure},  // R(A) := closure(KPROTO[Bx])
 	opcode{0, 1, OpArgU, OpArgN, IABC /* */, "VARARG  ", vararg},   // R(A), R(A+1), ..., R(A+B-2) = vararg
 	opcode{0, 0, OpArgU, OpArgU, IAx /*  */, "EXTRAARG", nil},      // extra (larger) argument for previous opcode
+	opcode{0, 0, OpArgN, OpArgN, IABC /* */, "TBC     ", tbc},      // mark R(A) as to-be-closed
 }
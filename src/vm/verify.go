@@ -0,0 +1,322 @@
+package vm
+
+import (
+	"fmt"
+	. "lua/src/binchunk"
+)
+
+// 字节码校验器：在加载不可信的二进制chunk时检查操作数范围、跳转目标和指令序列，
+// 避免畸形的字节码在执行时访问越界或让虚拟机崩溃
+// 参考lua-5.1.5/src/ldebug.c#symbexec()
+
+// 校验函数原型及其全部子函数原型，发现问题时返回描述错误的error
+func Verify(proto *Prototype) error {
+	return verify(proto, nil)
+}
+
+func verify(f, parent *Prototype) error {
+	v := &verifier{f: f, parent: parent}
+	if err := v.check(); err != nil {
+		return err
+	}
+	for _, p := range f.Protos {
+		if p == nil {
+			return v.errorf("missing function prototype")
+		}
+		if err := verify(p, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type verifier struct {
+	f      *Prototype
+	parent *Prototype // 外围函数，主函数为nil
+	pc     int        // 正在检查的指令
+}
+
+type verifyError struct {
+	msg string
+}
+
+func (self *verifyError) Error() string {
+	return self.msg
+}
+
+func (self *verifier) errorf(format string, a ...interface{}) error {
+	msg := fmt.Sprintf(format, a...)
+	if self.pc >= 0 && self.pc < len(self.f.Code) {
+		msg = fmt.Sprintf("%s at instruction %d", msg, self.pc+1)
+	}
+	return &verifyError{fmt.Sprintf("%s in function <%d,%d>", msg,
+		self.f.LineDefined, self.f.LastLineDefined)}
+}
+
+// 检查函数头、Upvalue、调试信息和每一条指令
+func (self *verifier) check() error {
+	f := self.f
+	self.pc = -1
+	if int(f.NumParams) > int(f.MaxStackSize) {
+		return self.errorf("too many parameters")
+	}
+	if len(f.Code) == 0 {
+		return self.errorf("empty function")
+	}
+	if Instruction(f.Code[len(f.Code)-1]).Opcode() != OP_RETURN {
+		return self.errorf("function does not end with RETURN")
+	}
+	if self.parent != nil {
+		for i, uv := range f.Upvalues {
+			if uv.Instack > 1 ||
+				uv.Instack == 1 && int(uv.Idx) >= int(self.parent.MaxStackSize) ||
+				uv.Instack == 0 && int(uv.Idx) >= len(self.parent.Upvalues) {
+				return self.errorf("bad upvalue %d", i)
+			}
+		}
+	}
+	if len(f.LineInfo) != 0 && len(f.LineInfo) != len(f.Code) {
+		return self.errorf("bad line info")
+	}
+	for i, lv := range f.LocVars {
+		if lv.StartPC > lv.EndPC || int(lv.EndPC) > len(f.Code) {
+			return self.errorf("bad local variable %d", i)
+		}
+	}
+	for self.pc = 0; self.pc < len(f.Code); self.pc++ {
+		if err := self.checkInstruction(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *verifier) checkInstruction() error {
+	f, pc := self.f, self.pc
+	i := Instruction(f.Code[pc])
+	op := i.Opcode()
+	if op > OP_TBC || op == OP_TBC && f.Dialect != LUA_DIALECT_54 {
+		return self.errorf("bad opcode %d", op)
+	}
+
+	if op == OP_EXTRAARG { // 只能跟在LOADKX或C为0的SETLIST后面
+		if pc == 0 || !needsExtraArg(Instruction(f.Code[pc-1])) {
+			return self.errorf("unexpected EXTRAARG")
+		}
+		return nil
+	}
+	if needsExtraArg(i) &&
+		(pc+1 >= len(f.Code) || Instruction(f.Code[pc+1]).Opcode() != OP_EXTRAARG) {
+		return self.errorf("missing EXTRAARG")
+	}
+	if opcodes[op].testFlag == 1 && op != OP_TFORCALL { // 测试指令后面必须是跳转指令
+		if pc+1 >= len(f.Code) || Instruction(f.Code[pc+1]).Opcode() != OP_JMP {
+			return self.errorf("test not followed by JMP")
+		}
+	}
+
+	// 操作数A
+	switch op {
+	case OP_JMP:
+		if a, _ := i.AsBx(); a > 0 && a-1 >= int(f.MaxStackSize) {
+			return self.errorf("bad register")
+		}
+	case OP_SETTABUP:
+		if a, _, _ := i.ABC(); a >= len(f.Upvalues) {
+			return self.errorf("bad upvalue index")
+		}
+	case OP_EQ, OP_LT, OP_LE: // A是布尔值
+	default:
+		if err := self.checkReg(int(i >> 6 & 0xFF)); err != nil {
+			return err
+		}
+	}
+
+	// 操作数B和C
+	switch i.OpMode() {
+	case IABC:
+		_, b, c := i.ABC()
+		if err := self.checkArg(i.BMode(), b); err != nil {
+			return err
+		}
+		if err := self.checkArg(i.CMode(), c); err != nil {
+			return err
+		}
+	case IABx:
+		_, bx := i.ABx()
+		if i.BMode() == OpArgK && bx >= len(f.Constants) {
+			return self.errorf("bad constant index")
+		}
+	case IAsBx:
+		_, sbx := i.AsBx()
+		target := pc + 1 + sbx
+		if target < 0 || target >= len(f.Code) {
+			return self.errorf("bad jump target")
+		}
+		if t := Instruction(f.Code[target]); t.Opcode() == OP_EXTRAARG || isOpenUse(t) {
+			return self.errorf("bad jump target")
+		}
+	}
+
+	return self.checkOperands(i)
+}
+
+// 需要EXTRAARG提供参数的指令
+func needsExtraArg(i Instruction) bool {
+	switch i.Opcode() {
+	case OP_LOADKX:
+		return true
+	case OP_SETLIST:
+		_, _, c := i.ABC()
+		return c == 0
+	}
+	return false
+}
+
+// 按照操作数的使用类型检查B和C
+func (self *verifier) checkArg(mode byte, arg int) error {
+	switch mode {
+	case OpArgR:
+		return self.checkReg(arg)
+	case OpArgK:
+		if arg > 0xFF {
+			if arg&0xFF >= len(self.f.Constants) {
+				return self.errorf("bad constant index")
+			}
+			return nil
+		}
+		return self.checkReg(arg)
+	}
+	return nil
+}
+
+// 检查寄存器索引是否超出函数的寄存器数量
+func (self *verifier) checkReg(reg int) error {
+	if reg < 0 || reg >= int(self.f.MaxStackSize) {
+		return self.errorf("bad register")
+	}
+	return nil
+}
+
+// 检查寄存器区间[first, first+n)
+func (self *verifier) checkRegs(first, n int) error {
+	if n > 0 {
+		return self.checkReg(first + n - 1)
+	}
+	return nil
+}
+
+// 检查各条指令特有的约束
+func (self *verifier) checkOperands(i Instruction) error {
+	f, pc := self.f, self.pc
+	a, b, c := i.ABC()
+	_, bx := i.ABx()
+	switch i.Opcode() {
+	case OP_LOADKX:
+		if Instruction(f.Code[pc+1]).Ax() >= len(f.Constants) {
+			return self.errorf("bad constant index")
+		}
+	case OP_LOADBOOL:
+		if c != 0 && pc+2 >= len(f.Code) {
+			return self.errorf("bad jump target")
+		}
+	case OP_LOADNIL:
+		return self.checkRegs(a, b+1)
+	case OP_GETUPVAL, OP_SETUPVAL, OP_GETTABUP:
+		if b >= len(f.Upvalues) {
+			return self.errorf("bad upvalue index")
+		}
+	case OP_SELF:
+		return self.checkReg(a + 1)
+	case OP_CONCAT:
+		if b >= c {
+			return self.errorf("bad register range")
+		}
+	case OP_CALL, OP_TAILCALL:
+		if b > 0 {
+			if err := self.checkRegs(a, b); err != nil {
+				return err
+			}
+		} else if err := self.checkOpenUse(); err != nil {
+			return err
+		}
+		if i.Opcode() == OP_TAILCALL || c == 0 {
+			return self.checkOpenResult()
+		}
+		return self.checkRegs(a, c-1)
+	case OP_RETURN:
+		if b > 0 {
+			return self.checkRegs(a, b-1)
+		}
+		return self.checkOpenUse()
+	case OP_FORLOOP, OP_FORPREP:
+		return self.checkRegs(a, 4)
+	case OP_TFORCALL:
+		if err := self.checkRegs(a, 3+c); err != nil {
+			return err
+		}
+		if pc+1 >= len(f.Code) || Instruction(f.Code[pc+1]).Opcode() != OP_TFORLOOP {
+			return self.errorf("TFORCALL not followed by TFORLOOP")
+		}
+	case OP_TFORLOOP:
+		return self.checkRegs(a, 2)
+	case OP_SETLIST:
+		if b > 0 {
+			return self.checkRegs(a, b+1)
+		}
+		return self.checkOpenUse()
+	case OP_CLOSURE:
+		if bx >= len(f.Protos) {
+			return self.errorf("bad function index")
+		}
+	case OP_VARARG:
+		if f.IsVararg == 0 {
+			return self.errorf("VARARG in non-vararg function")
+		}
+		if b > 0 {
+			return self.checkRegs(a, b-1)
+		}
+		return self.checkOpenResult()
+	}
+	return nil
+}
+
+// 返回全部结果的指令后面必须紧跟使用全部结果(B为0)的指令
+func (self *verifier) checkOpenResult() error {
+	pc := self.pc + 1
+	if pc < len(self.f.Code) && isOpenUse(Instruction(self.f.Code[pc])) {
+		return nil
+	}
+	return self.errorf("multiple results not consumed")
+}
+
+// 使用全部结果的指令前面必须紧跟返回全部结果的指令
+func (self *verifier) checkOpenUse() error {
+	pc := self.pc - 1
+	if pc >= 0 && isOpenResult(Instruction(self.f.Code[pc])) {
+		return nil
+	}
+	return self.errorf("multiple results not produced")
+}
+
+func isOpenResult(i Instruction) bool {
+	_, b, c := i.ABC()
+	switch i.Opcode() {
+	case OP_CALL:
+		return c == 0
+	case OP_TAILCALL:
+		return true
+	case OP_VARARG:
+		return b == 0
+	}
+	return false
+}
+
+func isOpenUse(i Instruction) bool {
+	_, b, _ := i.ABC()
+	switch i.Opcode() {
+	case OP_CALL, OP_TAILCALL, OP_RETURN, OP_SETLIST:
+		return b == 0
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+#!/bin/sh
+# 差分测试：test/*.lua分别用lua解释执行和用luaaot翻译成Go程序执行，比较输出和退出状态
+# 用法：sh test/aot_diff.sh [-5.4] [-O]，选项同时传给lua和luaaot
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+tmp=$root/.aot_diff # 生成的包要放在lua模块里才能导入lua/src/...
+trap 'rm -rf "$tmp"' EXIT
+rm -rf "$tmp"
+mkdir -p "$tmp/bin"
+(cd "$root" && go build -o "$tmp/bin/lua" ./src/lua.go && go build -o "$tmp/bin/luaaot" ./src/luaaot) || exit 1
+
+# 去掉程序名、地址和os.date()输出的时间，它们在两次执行中不同
+normalize() {
+	sed "s|$tmp/bin/[A-Za-z0-9_-]*:|lua:|; s/0x[0-9a-f]*//g; s/[0-9][0-9]:[0-9][0-9]:[0-9][0-9]//g"
+}
+
+cd "$root/test" || exit 1
+failed=0
+for f in *.lua; do
+	name=${f%.lua}
+	mkdir -p "$tmp/$name"
+	if ! "$tmp/bin/luaaot" "$@" -o "$tmp/$name/main.go" "$f" ||
+		! (cd "$root" && go build -o "$tmp/bin/$name" "./.aot_diff/$name"); then
+		echo "FAIL $f (translation)"
+		failed=1
+		continue
+	fi
+	want=$("$tmp/bin/lua" "$@" "$f" 2>&1; echo "exit $?")
+	got=$("$tmp/bin/$name" 2>&1; echo "exit $?")
+	if [ "$(echo "$want" | normalize)" = "$(echo "$got" | normalize)" ]; then
+		echo "ok   $f"
+	else
+		echo "FAIL $f"
+		echo "$want" | normalize >"$tmp/want.txt"
+		echo "$got" | normalize >"$tmp/got.txt"
+		diff "$tmp/want.txt" "$tmp/got.txt" | head -20
+		failed=1
+	fi
+done
+exit $failed
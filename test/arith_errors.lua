@@ -0,0 +1,9 @@
+-- 算术和位运算的操作数类型不对时的错误信息，5.3和5.4方言相同
+print(pcall(function() return 1 + nil end))
+print(pcall(function() return {} * 2 end))
+print(pcall(function() return "a" - 1 end))
+print(pcall(function() return "1" + {} end))
+print(pcall(function() return -{} end))
+print(pcall(function() return 1.5 | 1 end))
+print(pcall(function() return "x" | 1 end))
+print(pcall(function() return 2 ^ true end))
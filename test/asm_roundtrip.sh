@@ -0,0 +1,27 @@
+#!/bin/sh
+# 汇编往返测试：test/*.lua编译成二进制chunk，再经过反汇编→汇编→转储，两次得到的chunk必须逐字节相同
+# 用法：sh test/asm_roundtrip.sh [-5.4] [-O] [-s]，选项传给每一次luac
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+(cd "$root" && go build -o "$tmp/luac" ./src/luac) || exit 1
+
+cd "$root/test" || exit 1
+failed=0
+for f in *.lua; do
+	name=${f%.lua}
+	if ! "$tmp/luac" "$@" -o "$tmp/$name.out" "$f" ||
+		! "$tmp/luac" "$@" -S -o "$tmp/$name.s" "$f" ||
+		! "$tmp/luac" -a -o "$tmp/$name.asm.out" "$tmp/$name.s"; then
+		echo "FAIL $f (luac)"
+		failed=1
+	elif cmp -s "$tmp/$name.out" "$tmp/$name.asm.out"; then
+		echo "ok   $f"
+	else
+		echo "FAIL $f"
+		cmp "$tmp/$name.out" "$tmp/$name.asm.out"
+		failed=1
+	fi
+done
+exit $failed
@@ -0,0 +1,40 @@
+#!/bin/sh
+# 语法树JSON往返测试：test/*.lua用luac -ast导出JSON，解码再编码必须得到相同的JSON，
+# 用luac -j从JSON编译出的chunk和源代码执行的输出、退出状态必须相同
+# 用法：sh test/ast_roundtrip.sh [-5.4]，选项同时传给lua和luac
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+(cd "$root" && go build -o "$tmp/lua" ./src/lua.go && go build -o "$tmp/luac" ./src/luac) || exit 1
+
+cd "$root/test" || exit 1
+failed=0
+for f in *.lua; do
+	name=${f%.lua}
+	if ! "$tmp/luac" "$@" -ast -o "$tmp/$name.json" "$f" ||
+		! "$tmp/luac" "$@" -j -ast -o "$tmp/$name.again.json" "$tmp/$name.json" ||
+		! "$tmp/luac" "$@" -j -o "$tmp/$name.out" "$tmp/$name.json"; then
+		echo "FAIL $f (luac)"
+		failed=1
+	elif ! cmp -s "$tmp/$name.json" "$tmp/$name.again.json"; then
+		echo "FAIL $f (json)"
+		diff "$tmp/$name.json" "$tmp/$name.again.json" | head -20
+		failed=1
+	else
+		# 去掉地址和os.date()输出的时间，它们在两次执行中不同
+		want=$("$tmp/lua" "$@" "$f" </dev/null 2>&1; echo "exit $?")
+		got=$("$tmp/lua" "$@" "$tmp/$name.out" </dev/null 2>&1; echo "exit $?")
+		normalize='s/0x[0-9a-f]*//g; s/[0-9][0-9]:[0-9][0-9]:[0-9][0-9]//g'
+		if [ "$(echo "$want" | sed "$normalize")" = "$(echo "$got" | sed "$normalize")" ]; then
+			echo "ok   $f"
+		else
+			echo "FAIL $f"
+			echo "$want" >"$tmp/want"
+			echo "$got" >"$tmp/got"
+			diff "$tmp/want" "$tmp/got" | head -20
+			failed=1
+		fi
+	fi
+done
+exit $failed
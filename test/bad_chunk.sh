@@ -0,0 +1,54 @@
+#!/bin/sh
+# 畸形二进制chunk测试：加载时被拒绝或者执行时报错，都要以Lua错误的形式返回，lua进程不能崩溃
+# 用法：sh test/bad_chunk.sh
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+(cd "$root" && go build -o "$tmp/lua" ./src/lua.go && go build -o "$tmp/luac" ./src/luac) || exit 1
+cd "$tmp" || exit 1
+
+# 加载并调用chunk，输出错误信息或者调用的结果
+run() {
+	./lua -e "local f, err = loadfile('$1')
+		if f then print('$1', 'call', pcall(f)) else print('$1', 'load', err) end" 2>&1
+	echo "exit $?"
+}
+
+# 汇编只有一条NEWTABLE指令的主函数，B、C是表的预估容量，编码之后最大约为1.6e10
+newtable() {
+	printf '.function "=bad" 0 0\n.params 0\n.vararg\n.slots 2\nNEWTABLE 0 %d %d\nRETURN 0 2\n.end\n' $2 $3 >"$1.s"
+	./luac -a -o "$1" "$1.s"
+}
+
+newtable array.out 320 0
+newtable hash.out 0 320
+echo 'return {}' >ok.lua
+./luac -o ok.out ok.lua
+head -c 40 ok.out >truncated.out
+# 把NEWTABLE 0 0 0改成NEWTABLE 200 0 0，寄存器超出了函数的栈大小
+off=$(od -An -v -tx1 ok.out | tr -s ' \n' '\n\n' | grep -v '^$' |
+	awk 'NR > 4 && p[NR-3] == "0b" && p[NR-2] == "00" && p[NR-1] == "00" && $0 == "00" { print NR - 4; exit } { p[NR] = $0 }')
+cp ok.out register.out
+printf '\013\062\000\000' | dd of=register.out bs=1 seek="$off" conv=notrunc 2>/dev/null
+
+for f in array.out hash.out truncated.out register.out; do
+	run $f
+done >got.txt
+cat >want.txt <<'END'
+array.out	call	false	table overflow
+exit 0
+hash.out	call	false	table overflow
+exit 0
+truncated.out	load	truncated.out: truncated precompiled chunk
+exit 0
+register.out	load	register.out: bad binary format (bad register at instruction 2 in function <0,0>)
+exit 0
+END
+if cmp -s want.txt got.txt; then
+	echo "ok   bad chunks"
+else
+	echo "FAIL bad chunks"
+	diff want.txt got.txt | head -20
+	exit 1
+fi
@@ -0,0 +1,40 @@
+#!/bin/sh
+# 性能测试：用当前代码构建的lua执行test/bench/*.lua，每个脚本取3次中最快的时间
+# 用法：sh test/bench.sh [基准lua]，给出基准lua(比如用之前的版本构建)时同时测试它，并检查两者的输出相同
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+(cd "$root" && go build -o "$tmp/lua" ./src/lua.go) || exit 1
+base=$1
+
+# 执行3次，输出写到文件，打印最快的时间(毫秒)
+run() {
+	best=
+	for i in 1 2 3; do
+		start=$(date +%s%N)
+		"$1" "$2" >"$3" 2>&1
+		ms=$((($(date +%s%N) - start) / 1000000))
+		if [ -z "$best" ] || [ "$ms" -lt "$best" ]; then
+			best=$ms
+		fi
+	done
+	echo "$best"
+}
+
+cd "$root/test/bench" || exit 1
+failed=0
+for f in *.lua; do
+	new=$(run "$tmp/lua" "$f" "$tmp/new.txt")
+	if [ -z "$base" ]; then
+		printf "%-12s %6d ms\n" "$f" "$new"
+		continue
+	fi
+	old=$(run "$base" "$f" "$tmp/old.txt")
+	printf "%-12s %6d ms -> %6d ms\n" "$f" "$old" "$new"
+	if ! cmp -s "$tmp/old.txt" "$tmp/new.txt"; then
+		echo "FAIL $f (output differs)"
+		failed=1
+	fi
+done
+exit $failed
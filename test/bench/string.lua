@@ -0,0 +1,26 @@
+-- 字符串拼接、比较和标准库调用
+local parts = {}
+for i = 1, 200000 do
+    parts[#parts + 1] = "item" .. i .. ";"
+end
+local s = table.concat(parts)
+
+local count = 0
+for i = 1, #parts do
+    if parts[i] < "item5" then
+        count = count + 1
+    end
+end
+
+local n = 0
+for i = 1, 50000 do
+    local p = string.find(parts[i], ";", 1, true)
+    n = n + #string.sub(parts[i], 5, p - 1)
+end
+
+local up = 0
+for i = 1, 50000 do
+    up = up + #string.upper(parts[i]) + #string.format("%d:%s", i, parts[i])
+end
+
+print(#s, count, n, up)
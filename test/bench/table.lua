@@ -0,0 +1,25 @@
+-- 数组和哈希表的读写
+local n = 200000
+local t = {}
+for i = 1, n do
+    t[i] = i * 2
+end
+local sum = 0
+for round = 1, 10 do
+    for i = 1, n do
+        sum = sum + t[i]
+    end
+end
+
+local h = {}
+for i = 1, 50000 do
+    h["k" .. i % 1000] = (h["k" .. i % 1000] or 0) + 1
+end
+
+local p = {x = 0, y = 0}
+for i = 1, 300000 do
+    p.x = p.x + 1
+    p.y = p.y + p.x
+end
+
+print(sum, h.k1, p.x, p.y)
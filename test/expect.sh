@@ -0,0 +1,37 @@
+#!/bin/sh
+# 输出测试：test/expected/NAME.txt是lua执行test/NAME.lua的期望输出(标准输出和标准错误，最后一行是退出状态)，
+# NAME.5.4.txt是用-5.4执行时的期望输出
+# 用法：sh test/expect.sh [-u]，-u用这次的输出更新期望输出
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+(cd "$root" && go build -o "$tmp/lua" ./src/lua.go) || exit 1
+
+cd "$root/test" || exit 1
+failed=0
+for want in expected/*.txt; do
+	name=$(basename "$want" .txt)
+	opt=
+	case $name in
+	*.5.4)
+		name=${name%.5.4}
+		opt=-5.4
+		;;
+	esac
+	(
+		cd "$tmp" && ./lua $opt "$root/test/$name.lua" 2>&1
+		echo "exit $?"
+	) | sed "s|$root/test/||g; s|^\./lua:|lua:|" >"$tmp/got"
+	if [ "$1" = "-u" ]; then
+		cp "$tmp/got" "$want"
+		echo "updated $want"
+	elif cmp -s "$want" "$tmp/got"; then
+		echo "ok   ${opt:+$opt }$name.lua"
+	else
+		echo "FAIL ${opt:+$opt }$name.lua"
+		diff "$want" "$tmp/got" | head -20
+		failed=1
+	fi
+done
+exit $failed
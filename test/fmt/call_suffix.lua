@@ -0,0 +1,7 @@
+-- 接在调用后面的字符串和表参数前面都不加空格，只有紧跟在名字后面的字符串参数加一个空格
+c(1)"str"{x}
+c(1) "str" {x}
+require "set"
+local s = Set.new{1, 2}
+obj:m"s"
+f "a" "b"
@@ -0,0 +1,5 @@
+-- 块开头和关键字同一行的注释留在关键字后面，不能移到上一个分支里
+if a then x() else --[[ c ]] y() end
+if a then --[[ t ]] x() elseif b then --[[ e ]] z = --[[ v ]] 1 else --[[ c ]] y() end
+while x do --[[ w ]] f() end
+local function g() --[[ g ]] return 1 end
@@ -0,0 +1,4 @@
+-- 语句前面的行内注释留在语句前面，不能移到后面的表达式里
+a = 1
+--[[ mid ]] b = 2
+--[[ one ]] --[[ two ]] local c = --[[ three ]] 3
@@ -0,0 +1,43 @@
+#!/bin/sh
+# 格式化的幂等性测试：test/*.lua格式化一次之后再格式化，结果必须不变
+# luafmt本身会确认格式化前后编译出的字节码相同，所以两次格式化都必须成功
+# 不带选项时还检查test/fmt/NAME.lua格式化的结果和test/fmt/NAME.out相同，NAME.out再格式化也不变
+# 用法：sh test/fmt_idempotent.sh [luafmt的选项]，比如-5.4、-i 2
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+(cd "$root" && go build -o "$tmp/luafmt" ./src/luafmt) || exit 1
+
+cd "$root/test" || exit 1
+failed=0
+for f in *.lua; do
+	if ! "$tmp/luafmt" "$@" <"$f" >"$tmp/once.lua"; then
+		echo "FAIL $f (first pass)"
+		failed=1
+	elif ! "$tmp/luafmt" "$@" <"$tmp/once.lua" >"$tmp/twice.lua"; then
+		echo "FAIL $f (second pass)"
+		failed=1
+	elif cmp -s "$tmp/once.lua" "$tmp/twice.lua"; then
+		echo "ok   $f"
+	else
+		echo "FAIL $f"
+		diff "$tmp/once.lua" "$tmp/twice.lua" | head -20
+		failed=1
+	fi
+done
+[ $# -gt 0 ] && exit $failed
+for f in fmt/*.lua; do
+	want=${f%.lua}.out
+	if ! "$tmp/luafmt" <"$f" >"$tmp/once.lua" || ! "$tmp/luafmt" <"$want" >"$tmp/twice.lua"; then
+		echo "FAIL $f"
+		failed=1
+	elif cmp -s "$want" "$tmp/once.lua" && cmp -s "$want" "$tmp/twice.lua"; then
+		echo "ok   $f"
+	else
+		echo "FAIL $f"
+		diff "$want" "$tmp/once.lua" | head -20
+		failed=1
+	fi
+done
+exit $failed
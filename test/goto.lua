@@ -0,0 +1,70 @@
+-- goto和标签：continue、向后跳转、跳出嵌套循环，以及跳转时关闭被捕获的局部变量
+-- continue
+local s = ""
+for i = 1, 5 do
+  if i % 2 == 0 then goto continue end
+  s = s .. i .. " "
+  ::continue::
+end
+print(s)
+-- backward loop
+local n = 0
+::top::
+n = n + 1
+if n < 3 then goto top end
+print("n", n)
+-- closures per iteration via goto
+local fs = {}
+do
+  local i = 1
+  ::again::
+  local x = i * 10
+  fs[#fs + 1] = function() return x end
+  i = i + 1
+  if i <= 3 then goto again end
+end
+print(fs[1](), fs[2](), fs[3]())
+-- nested break-out
+for i = 1, 3 do
+  for j = 1, 3 do
+    if i * j == 4 then goto out end
+  end
+end
+::out::
+print("out")
+-- goto out of block with captured local
+local gs = {}
+for i = 1, 3 do
+  local y = i
+  gs[i] = function() return y end
+  if i == 2 then goto done end
+end
+::done::
+print(gs[1](), gs[2](), gs[3])
+-- while with continue + closure
+local k, hs = 0, {}
+while k < 3 do
+  k = k + 1
+  local z = k
+  hs[k] = function() return z end
+  if k == 2 then goto cont end
+  z = z * 100
+  ::cont::
+end
+print(hs[1](), hs[2](), hs[3]())
+-- goto in nested function
+local function f(a)
+  if a then goto yes end
+  do return "no" end
+  ::yes::
+  return "yes"
+end
+print(f(true), f(false))
+-- repeat with goto
+local r = 0
+repeat
+  r = r + 1
+  if r < 5 then goto skip end
+  print("r", r)
+  ::skip::
+until r >= 5
@@ -0,0 +1,101 @@
+#!/bin/sh
+# 词法分析器性能测试：对test/*.lua和生成的大文件反复切分token，每个文件取3次中最快的时间
+# 用法：sh test/lexbench.sh [基准版本]，给出git版本(比如换成手写词法分析器之前的提交)时同时测试它，
+# 并检查两者切分出的token(类型、文本和行号)完全相同
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp" "$root/.lexbench"' EXIT
+base=$1
+
+# 测试程序要放在lua模块里才能导入lua/src/...，只用到两个版本都有的NewLexer()和NextToken()
+harness() {
+	mkdir -p "$1/.lexbench"
+	cat >"$1/.lexbench/main.go" <<'GO'
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"lua/src/compiler/lexer"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func main() {
+	for _, name := range os.Args[1:] {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		chunk := string(data)
+		var best time.Duration
+		for i := 0; i < 3; i++ { // 计时的时候只切分token
+			start := time.Now()
+			l := lexer.NewLexer(chunk, "@"+name)
+			for {
+				if _, kind, _ := l.NextToken(); kind == lexer.TOKEN_EOF {
+					break
+				}
+			}
+			if d := time.Since(start); i == 0 || d < best {
+				best = d
+			}
+		}
+		n, sum := 0, uint32(0) // 再切分一次，计算token的数量和校验和
+		l := lexer.NewLexer(chunk, "@"+name)
+		for {
+			line, kind, token := l.NextToken()
+			n++
+			sum = crc32.Update(sum, crc32.IEEETable, []byte(fmt.Sprint(line, kind, token)))
+			if kind == lexer.TOKEN_EOF {
+				break
+			}
+		}
+		fmt.Printf("%s %d %08x %d\n", filepath.Base(name), n, sum, best.Milliseconds())
+	}
+}
+GO
+	(cd "$1" && go build -o "$2" ./.lexbench) || exit 1
+}
+
+# 生成的大文件：test/*.lua重复多次，再加上各种数字、转义字符串、长字符串和注释
+cat "$root"/test/*.lua >"$tmp/all.lua"
+i=0
+while [ $i -lt 200 ]; do
+	cat "$tmp/all.lua"
+	i=$((i + 1))
+done >"$tmp/big.lua"
+awk 'BEGIN {
+	for (i = 0; i < 100000; i++) {
+		printf "local v%d = {0x%X, %d.5e-3, \"a\\tb\\\\c\\x41\\u{48}\\z\n   d\", [[long\r\nstring]]} -- comment %d\n", i, i, i, i
+		printf "--[==[ block\ncomment ]==] v%d[1] = v%d[1] // 3 ~ 0xff << 2 .. \"\\065\"\n", i, i
+	}
+}' >"$tmp/gen.lua"
+files="$tmp/all.lua $tmp/big.lua $tmp/gen.lua"
+for f in $files; do
+	printf "%-8s %10d bytes\n" "$(basename "$f")" "$(wc -c <"$f")"
+done
+
+harness "$root" "$tmp/new"
+"$tmp/new" $files >"$tmp/new.txt" || exit 1
+if [ -z "$base" ]; then
+	awk '{ printf "%-8s %8d tokens %6d ms\n", $1, $2, $4 }' "$tmp/new.txt"
+	exit 0
+fi
+
+mkdir -p "$tmp/base"
+git -C "$root" archive "$base" | tar -x -C "$tmp/base" || exit 1
+harness "$tmp/base" "$tmp/old"
+"$tmp/old" $files >"$tmp/old.txt" || exit 1
+failed=0
+paste "$tmp/old.txt" "$tmp/new.txt" | while read -r name n1 sum1 ms1 _ n2 sum2 ms2; do
+	printf "%-8s %8d tokens %6d ms -> %6d ms\n" "$name" "$n2" "$ms1" "$ms2"
+	if [ "$n1" != "$n2" ] || [ "$sum1" != "$sum2" ]; then
+		echo "FAIL $name (tokens differ)"
+		exit 1
+	fi
+done || failed=1
+exit $failed
@@ -0,0 +1,31 @@
+#!/bin/sh
+# 语言服务器的会话测试：把test/lsp/session.jsonl里的每条消息(一行一个JSON)加上Content-Length头部发给lualsp，
+# 去掉回复的头部之后每行一条消息，和test/lsp/session.out比较，最后一行是lualsp的退出状态
+# 用法：sh test/lsp_session.sh [-u]，-u用这次的输出更新session.out
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+(cd "$root" && go build -o "$tmp/lualsp" ./src/lualsp) || exit 1
+
+cd "$root/test/lsp" || exit 1
+while IFS= read -r msg; do
+	printf 'Content-Length: %d\r\n\r\n%s' "$(printf '%s' "$msg" | wc -c)" "$msg"
+done <session.jsonl >"$tmp/in"
+"$tmp/lualsp" <"$tmp/in" >"$tmp/raw"
+status=$?
+{
+	sed 's/Content-Length: [0-9]*\r$//' "$tmp/raw" | tr -d '\r' | grep -v '^$'
+	echo "exit $status"
+} >"$tmp/got"
+
+if [ "$1" = "-u" ]; then
+	cp "$tmp/got" session.out
+	echo "updated session.out"
+elif cmp -s session.out "$tmp/got"; then
+	echo "ok   session.jsonl"
+else
+	echo "FAIL session.jsonl"
+	diff session.out "$tmp/got" | head -20
+	exit 1
+fi
@@ -0,0 +1,32 @@
+#!/bin/sh
+# 优化遍的差分测试：test/*.lua不优化执行一次，再分别用-O(全部优化遍)和每个单独的优化遍执行，比较输出和退出状态
+# 用法：sh test/opt_diff.sh [-5.4]，选项传给每次执行的lua
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+(cd "$root" && go build -o "$tmp/lua" ./src/lua.go) || exit 1
+
+# 去掉地址和os.date()输出的时间，它们在两次执行中不同
+normalize() {
+	sed 's/0x[0-9a-f]*//g; s/[0-9][0-9]:[0-9][0-9]:[0-9][0-9]//g'
+}
+
+cd "$root/test" || exit 1
+failed=0
+for f in *.lua; do
+	want=$("$tmp/lua" "$@" "$f" 2>&1; echo "exit $?")
+	for opt in -O -Oconst -Odead -Opeephole; do
+		got=$("$tmp/lua" "$@" $opt "$f" 2>&1; echo "exit $?")
+		if [ "$(echo "$want" | normalize)" = "$(echo "$got" | normalize)" ]; then
+			echo "ok   $opt $f"
+		else
+			echo "FAIL $opt $f"
+			echo "$want" | normalize >"$tmp/want.txt"
+			echo "$got" | normalize >"$tmp/got.txt"
+			diff "$tmp/want.txt" "$tmp/got.txt" | head -20
+			failed=1
+		fi
+	done
+done
+exit $failed
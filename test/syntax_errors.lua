@@ -0,0 +1,17 @@
+-- 语法错误和代码生成阶段的错误：load返回nil和带位置的错误信息，不能让进程崩溃
+local cases = {
+  "function f() return ... end",
+  "local function g(a, ...) return function() return ... end end",
+  "x = = 1",
+  "local t = {1, 2",
+  "for i = 1 do end",
+  "break",
+  "goto nowhere",
+  "x = 'abc",
+  "return 1 +",
+  "local x = 1\n\nlocal function h()\n  return ...\nend",
+  "local x = 1\nreturn " .. string.rep("{", 300) .. string.rep("}", 300),
+}
+for i, src in ipairs(cases) do
+  print(i, load(src, "=case"))
+end
@@ -0,0 +1,30 @@
+-- utf8库：合法和非法的字节序列、lax模式以及错误信息
+local s = "héllo, 世界"
+print(utf8.len(s), #s)
+print(utf8.len("abc\xE4def"))
+print(utf8.len("\xF4\x90\x80\x80"), utf8.len("\xF4\x90\x80\x80", 1, -1, true))
+print(utf8.offset(s, 3), utf8.offset(s, -1), utf8.offset(s, 0, 3))
+print(utf8.codepoint(s, 1, 3))
+print(utf8.char(72, 233, 0x4E16, 0x10FFFF) == "H\u{E9}\u{4E16}\u{10FFFF}")
+for p, c in utf8.codes("aé世") do
+  print(p, c)
+end
+
+-- 字符后面紧跟着多余的后续字节
+print(pcall(function()
+  for p, c in utf8.codes("a\x80b") do
+    print(p, c)
+  end
+end))
+print(pcall(utf8.codepoint, "\xFF"))
+print(pcall(utf8.offset, s, 1, 3))
+
+-- 超出Unicode范围的编码，5.4方言可以达到0x7FFFFFFF
+for _, code in ipairs({0x110000, 0x7FFFFFFF, 0x80000000}) do
+  local ok, c = pcall(utf8.char, code)
+  if ok then
+    print(ok, c:byte(1, -1))
+  else
+    print(ok, c)
+  end
+end